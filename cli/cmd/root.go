@@ -62,6 +62,7 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(cmd.NewVersionCmd())
 	rootCmd.AddCommand(cmd.NewInitCmd())
 	rootCmd.AddCommand(cmd.NewSSHCmd())
+	rootCmd.AddCommand(cmd.NewMasterSecretCmd())
 	rootCmd.AddCommand(cmd.NewMaaPatchCmd())
 
 	return rootCmd
@@ -0,0 +1,286 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/constellation/kubecmd"
+	"github.com/edgelesssys/constellation/v2/internal/crypto"
+	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// NewMasterSecretCmd returns a new cobra.Command for the master-secret command.
+func NewMasterSecretCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "master-secret",
+		Short: "Manage the master secret of your Constellation cluster",
+		Long:  "Manage the master secret of your Constellation cluster.",
+		Args:  cobra.ExactArgs(0),
+	}
+
+	cmd.AddCommand(newMasterSecretRotateCmd())
+	cmd.AddCommand(newMasterSecretFinalizeCmd())
+	return cmd
+}
+
+func newMasterSecretRotateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rotate",
+		Short: "Rotate the master secret of your Constellation cluster",
+		Long: "Rotate the master secret of your Constellation cluster.\n\n" +
+			"A new version of the master secret is generated and added to the master secret file. " +
+			"New state disk keys are derived from the new version. " +
+			"Existing nodes re-key their state disks on their next reboot. " +
+			"Once all nodes have been rebooted, run \"constellation master-secret finalize\" to remove the previous versions from the cluster.\n\n" +
+			"Keys bound to the identity of the cluster, e.g., the cluster ID and the emergency SSH CA, " +
+			"as well as keys requested by other clients of the KeyService, are always derived from the initial master secret.",
+		Args: cobra.ExactArgs(0),
+		RunE: runMasterSecretRotate,
+	}
+}
+
+func newMasterSecretFinalizeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "finalize",
+		Short: "Finish the rotation of the master secret of your Constellation cluster",
+		Long: "Finish the rotation of the master secret of your Constellation cluster.\n\n" +
+			"Checks that all nodes have re-keyed their state disks, and removes the previous versions of the master secret " +
+			"from the cluster and the master secret file. The initial master secret is kept for the keys bound to the identity of the cluster, " +
+			"but the KeyService refuses to derive state disk keys from it from then on.\n\n" +
+			"A node has re-keyed its state disk once it rebooted. Nodes that were removed from the cluster since the rotation " +
+			"must be confirmed with --removed-nodes, since they can't rejoin the cluster once the previous versions are removed.",
+		Args: cobra.ExactArgs(0),
+		RunE: runMasterSecretFinalize,
+	}
+	cmd.Flags().StringSlice("removed-nodes", nil, "names of nodes that were removed from the cluster since the master secret was rotated")
+	return cmd
+}
+
+type masterSecretCmd struct {
+	log         debugLog
+	fileHandler file.Handler
+	flags       rootFlags
+	// removedNodes are the nodes confirmed to be removed from the cluster since the rotation.
+	removedNodes []string
+}
+
+func runMasterSecretRotate(cmd *cobra.Command, _ []string) error {
+	m, kubeClient, err := newMasterSecretCmd(cmd)
+	if err != nil {
+		return err
+	}
+	return m.rotate(cmd, kubeClient)
+}
+
+func runMasterSecretFinalize(cmd *cobra.Command, _ []string) error {
+	m, kubeClient, err := newMasterSecretCmd(cmd)
+	if err != nil {
+		return err
+	}
+	if m.removedNodes, err = cmd.Flags().GetStringSlice("removed-nodes"); err != nil {
+		return fmt.Errorf("getting 'removed-nodes' flag: %w", err)
+	}
+	return m.finalize(cmd, kubeClient)
+}
+
+func newMasterSecretCmd(cmd *cobra.Command) (*masterSecretCmd, masterSecretKubeClient, error) {
+	log, err := newCLILogger(cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating logger: %w", err)
+	}
+	m := &masterSecretCmd{log: log, fileHandler: file.NewHandler(afero.NewOsFs())}
+	if err := m.flags.parse(cmd.Flags()); err != nil {
+		return nil, nil, err
+	}
+
+	kubeConfig, err := m.fileHandler.Read(constants.AdminConfFilename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading kubeconfig: %w", err)
+	}
+	kubeClient, err := kubecmd.New(kubeConfig, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("setting up kubernetes client: %w", err)
+	}
+	return m, kubeClient, nil
+}
+
+// rotate adds a new version of the master secret and makes the cluster use it for new state disk keys.
+// If a previous call failed after updating the master secret file, the rotation is resumed.
+func (m *masterSecretCmd) rotate(cmd *cobra.Command, kubeClient masterSecretKubeClient) error {
+	masterSecret, err := m.readMasterSecret()
+	if err != nil {
+		return err
+	}
+
+	clusterVersions, err := kubeClient.GetMasterSecretVersions(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("getting master secret versions of the cluster: %w", err)
+	}
+	if len(clusterVersions.Previous) > 0 {
+		return fmt.Errorf(
+			"rotation to master secret version %d is still in progress: reboot all nodes and run \"constellation master-secret finalize\" first",
+			clusterVersions.Current,
+		)
+	}
+
+	localVersion, _ := cluster.MasterSecretVersions(masterSecret)
+	switch localVersion {
+	case clusterVersions.Current:
+		key, err := crypto.GenerateRandomBytes(crypto.MasterSecretLengthDefault)
+		if err != nil {
+			return fmt.Errorf("generating master secret: %w", err)
+		}
+		salt, err := crypto.GenerateRandomBytes(crypto.RNGLengthDefault)
+		if err != nil {
+			return fmt.Errorf("generating master secret salt: %w", err)
+		}
+		masterSecret.Rotations = append(masterSecret.Rotations, uri.MasterSecretRotation{
+			Version: clusterVersions.Current + 1,
+			Key:     key,
+			Salt:    salt,
+		})
+		// persist the new version before the cluster uses it, so keys derived from it can always be recovered
+		if err := m.fileHandler.WriteJSON(constants.MasterSecretFilename, masterSecret, file.OptOverwrite); err != nil {
+			return fmt.Errorf("writing master secret: %w", err)
+		}
+		m.log.Debug("Generated master secret version", "version", clusterVersions.Current+1)
+	case clusterVersions.Current + 1:
+		m.log.Debug("Resuming rotation to master secret version", "version", localVersion)
+	default:
+		return fmt.Errorf(
+			"master secret file %q has version %d, but the cluster uses version %d",
+			m.flags.pathPrefixer.PrefixPrintablePath(constants.MasterSecretFilename), localVersion, clusterVersions.Current,
+		)
+	}
+
+	newVersion, previousVersions := cluster.MasterSecretVersions(masterSecret)
+	cmd.Println("Updating the KeyService. This may take a minute.")
+	if err := kubeClient.ApplyMasterSecretRotations(cmd.Context(), masterSecret.Rotations); err != nil {
+		return fmt.Errorf("applying master secret rotations: %w", err)
+	}
+
+	bootIDs, err := kubeClient.NodeBootIDs(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("getting boot IDs of nodes: %w", err)
+	}
+	if err := kubeClient.ApplyMasterSecretVersions(cmd.Context(), cluster.KeyVersions{
+		Current:  newVersion,
+		Previous: previousVersions,
+		BootIDs:  bootIDs,
+	}); err != nil {
+		return fmt.Errorf("applying master secret versions: %w", err)
+	}
+
+	cmd.Printf("Master secret rotated to version %d and written to %q.\n", newVersion, m.flags.pathPrefixer.PrefixPrintablePath(constants.MasterSecretFilename))
+	cmd.Println("Reboot all nodes to re-key their state disks, then run \"constellation master-secret finalize\".")
+	return nil
+}
+
+// finalize removes previous versions of the master secret once all nodes have re-keyed their state disks.
+func (m *masterSecretCmd) finalize(cmd *cobra.Command, kubeClient masterSecretKubeClient) error {
+	masterSecret, err := m.readMasterSecret()
+	if err != nil {
+		return err
+	}
+
+	clusterVersions, err := kubeClient.GetMasterSecretVersions(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("getting master secret versions of the cluster: %w", err)
+	}
+	if len(clusterVersions.Previous) == 0 {
+		return errors.New("no master secret rotation in progress")
+	}
+	currentIdx := slices.IndexFunc(masterSecret.Rotations, func(rotation uri.MasterSecretRotation) bool {
+		return rotation.Version == clusterVersions.Current
+	})
+	if currentIdx < 0 {
+		return fmt.Errorf(
+			"master secret file %q is missing version %d used by the cluster",
+			m.flags.pathPrefixer.PrefixPrintablePath(constants.MasterSecretFilename), clusterVersions.Current,
+		)
+	}
+
+	bootIDs, err := kubeClient.NodeBootIDs(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("getting boot IDs of nodes: %w", err)
+	}
+	// a node is done once its boot ID changed, or once its removal from the cluster was confirmed
+	var pending, missing []string
+	for node, bootID := range clusterVersions.BootIDs {
+		currentBootID, ok := bootIDs[node]
+		switch {
+		case ok && currentBootID != "" && currentBootID != bootID:
+		case !ok && slices.Contains(m.removedNodes, node):
+		case ok:
+			pending = append(pending, node)
+		default:
+			missing = append(missing, node)
+		}
+	}
+	var errs error
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		errs = errors.Join(errs, fmt.Errorf("nodes haven't been rebooted since the master secret was rotated: %s", strings.Join(pending, ", ")))
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		errs = errors.Join(errs, fmt.Errorf(
+			"nodes weren't found in the cluster: %s: if they were removed, confirm with --removed-nodes=%s",
+			strings.Join(missing, ", "), strings.Join(missing, ","),
+		))
+	}
+	if errs != nil {
+		return errs
+	}
+
+	// stop handing out previous keys before removing the versions they are derived from
+	if err := kubeClient.ApplyMasterSecretVersions(cmd.Context(), cluster.KeyVersions{Current: clusterVersions.Current}); err != nil {
+		return fmt.Errorf("applying master secret versions: %w", err)
+	}
+	// the initial master secret is only kept for keys bound to the cluster's identity
+	finalized := masterSecret.Rotations[currentIdx]
+	finalized.Finalized = true
+	masterSecret.Rotations = []uri.MasterSecretRotation{finalized}
+	cmd.Println("Updating the KeyService. This may take a minute.")
+	if err := kubeClient.ApplyMasterSecretRotations(cmd.Context(), masterSecret.Rotations); err != nil {
+		return fmt.Errorf("applying master secret rotations: %w", err)
+	}
+	if err := m.fileHandler.WriteJSON(constants.MasterSecretFilename, masterSecret, file.OptOverwrite); err != nil {
+		return fmt.Errorf("writing master secret: %w", err)
+	}
+
+	cmd.Printf("Master secret rotation to version %d finished.\n", clusterVersions.Current)
+	return nil
+}
+
+func (m *masterSecretCmd) readMasterSecret() (uri.MasterSecret, error) {
+	var masterSecret uri.MasterSecret
+	if err := m.fileHandler.ReadJSON(constants.MasterSecretFilename, &masterSecret); err != nil {
+		return uri.MasterSecret{}, fmt.Errorf(
+			"reading master secret (does %q exist?): %w",
+			m.flags.pathPrefixer.PrefixPrintablePath(constants.MasterSecretFilename), err,
+		)
+	}
+	return masterSecret, nil
+}
+
+type masterSecretKubeClient interface {
+	GetMasterSecretVersions(ctx context.Context) (cluster.KeyVersions, error)
+	ApplyMasterSecretVersions(ctx context.Context, versions cluster.KeyVersions) error
+	ApplyMasterSecretRotations(ctx context.Context, rotations []uri.MasterSecretRotation) error
+	NodeBootIDs(ctx context.Context) (map[string]string, error)
+}
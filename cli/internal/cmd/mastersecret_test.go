@@ -0,0 +1,244 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/crypto"
+	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasterSecretRotate(t *testing.T) {
+	rotation1 := uri.MasterSecretRotation{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1")}
+
+	testCases := map[string]struct {
+		masterSecret  *uri.MasterSecret
+		kubeClient    *stubMasterSecretKubeClient
+		wantVersion   uint32
+		wantPrevious  []uint32
+		wantRotations int
+		wantErr       bool
+	}{
+		"first rotation": {
+			masterSecret:  &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt")},
+			kubeClient:    &stubMasterSecretKubeClient{bootIDs: map[string]string{"node": "boot-id"}},
+			wantVersion:   1,
+			wantPrevious:  []uint32{0},
+			wantRotations: 1,
+		},
+		"second rotation": {
+			masterSecret:  &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt"), Rotations: []uri.MasterSecretRotation{rotation1}},
+			kubeClient:    &stubMasterSecretKubeClient{versions: cluster.KeyVersions{Current: 1}},
+			wantVersion:   2,
+			wantPrevious:  []uint32{0, 1},
+			wantRotations: 2,
+		},
+		"resume rotation": {
+			masterSecret:  &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt"), Rotations: []uri.MasterSecretRotation{rotation1}},
+			kubeClient:    &stubMasterSecretKubeClient{},
+			wantVersion:   1,
+			wantPrevious:  []uint32{0},
+			wantRotations: 1,
+		},
+		"rotation in progress": {
+			masterSecret: &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt"), Rotations: []uri.MasterSecretRotation{rotation1}},
+			kubeClient:   &stubMasterSecretKubeClient{versions: cluster.KeyVersions{Current: 1, Previous: []uint32{0}}},
+			wantErr:      true,
+		},
+		"master secret file outdated": {
+			masterSecret: &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt")},
+			kubeClient:   &stubMasterSecretKubeClient{versions: cluster.KeyVersions{Current: 2}},
+			wantErr:      true,
+		},
+		"no master secret": {
+			kubeClient: &stubMasterSecretKubeClient{},
+			wantErr:    true,
+		},
+		"applying rotations fails": {
+			masterSecret: &uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt")},
+			kubeClient:   &stubMasterSecretKubeClient{applyRotationsErr: errors.New("failed")},
+			wantErr:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fileHandler := file.NewHandler(afero.NewMemMapFs())
+			if tc.masterSecret != nil {
+				require.NoError(fileHandler.WriteJSON(constants.MasterSecretFilename, tc.masterSecret))
+			}
+			cmd := NewMasterSecretCmd()
+			cmd.SetOut(&bytes.Buffer{})
+			m := &masterSecretCmd{log: logger.NewTest(t), fileHandler: fileHandler}
+
+			err := m.rotate(cmd, tc.kubeClient)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			var masterSecret uri.MasterSecret
+			require.NoError(fileHandler.ReadJSON(constants.MasterSecretFilename, &masterSecret))
+			assert.Equal(tc.masterSecret.Key, masterSecret.Key)
+			assert.Equal(tc.masterSecret.Salt, masterSecret.Salt)
+			assert.Len(masterSecret.Rotations, tc.wantRotations)
+			assert.Equal(masterSecret.Rotations, tc.kubeClient.rotations)
+			assert.Equal(tc.wantVersion, tc.kubeClient.versions.Current)
+			assert.Equal(tc.wantPrevious, tc.kubeClient.versions.Previous)
+			assert.Equal(tc.kubeClient.bootIDs, tc.kubeClient.versions.BootIDs)
+		})
+	}
+}
+
+func TestMasterSecretFinalize(t *testing.T) {
+	masterSecret := uri.MasterSecret{
+		Key:  []byte("key"),
+		Salt: []byte("salt"),
+		Rotations: []uri.MasterSecretRotation{
+			{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1")},
+			{Version: 2, Key: []byte("key-2"), Salt: []byte("salt-2")},
+		},
+	}
+
+	testCases := map[string]struct {
+		kubeClient   *stubMasterSecretKubeClient
+		removedNodes []string
+		wantErr      bool
+	}{
+		"all nodes rebooted": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+				bootIDs:  map[string]string{"node": "boot-2", "new-node": "boot-3"},
+			},
+		},
+		"node removal confirmed": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+			},
+			removedNodes: []string{"node"},
+		},
+		"node missing": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+			},
+			wantErr: true,
+		},
+		"other node removal confirmed": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+			},
+			removedNodes: []string{"other-node"},
+			wantErr:      true,
+		},
+		"removal confirmed for node that wasn't rebooted": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+				bootIDs:  map[string]string{"node": "boot-1"},
+			},
+			removedNodes: []string{"node"},
+			wantErr:      true,
+		},
+		"boot ID unknown": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+				bootIDs:  map[string]string{"node": ""},
+			},
+			wantErr: true,
+		},
+		"node not rebooted": {
+			kubeClient: &stubMasterSecretKubeClient{
+				versions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-1"}},
+				bootIDs:  map[string]string{"node": "boot-1"},
+			},
+			wantErr: true,
+		},
+		"no rotation in progress": {
+			kubeClient: &stubMasterSecretKubeClient{versions: cluster.KeyVersions{Current: 2}},
+			wantErr:    true,
+		},
+		"cluster version unknown": {
+			kubeClient: &stubMasterSecretKubeClient{versions: cluster.KeyVersions{Current: 3, Previous: []uint32{0, 2}}},
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fileHandler := file.NewHandler(afero.NewMemMapFs())
+			require.NoError(fileHandler.WriteJSON(constants.MasterSecretFilename, masterSecret))
+			cmd := NewMasterSecretCmd()
+			cmd.SetOut(&bytes.Buffer{})
+			m := &masterSecretCmd{log: logger.NewTest(t), fileHandler: fileHandler, removedNodes: tc.removedNodes}
+
+			err := m.finalize(cmd, tc.kubeClient)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			wantRotations := []uri.MasterSecretRotation{{Version: 2, Key: []byte("key-2"), Salt: []byte("salt-2"), Finalized: true}}
+			var got uri.MasterSecret
+			require.NoError(fileHandler.ReadJSON(constants.MasterSecretFilename, &got))
+			assert.Equal(wantRotations, got.Rotations)
+			assert.Equal(wantRotations, tc.kubeClient.rotations)
+			assert.Equal(cluster.KeyVersions{Current: 2}, tc.kubeClient.versions)
+
+			// state disk keys aren't derived from the initial master secret anymore
+			kms, err := cluster.NewFromMasterSecret(uri.MasterSecret{Key: got.Key, Salt: got.Salt, Rotations: tc.kubeClient.rotations})
+			require.NoError(err)
+			diskKeyID := crypto.DEKPrefix + "8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e"
+			_, err = kms.GetDEK(t.Context(), diskKeyID, crypto.StateDiskKeyLength)
+			assert.ErrorIs(err, cluster.ErrVersionRetired)
+			_, err = kms.GetDEK(t.Context(), cluster.MasterSecretKeyID(diskKeyID, 2), crypto.StateDiskKeyLength)
+			assert.NoError(err)
+		})
+	}
+}
+
+type stubMasterSecretKubeClient struct {
+	versions          cluster.KeyVersions
+	rotations         []uri.MasterSecretRotation
+	applyRotationsErr error
+	bootIDs           map[string]string
+}
+
+func (s *stubMasterSecretKubeClient) GetMasterSecretVersions(_ context.Context) (cluster.KeyVersions, error) {
+	return s.versions, nil
+}
+
+func (s *stubMasterSecretKubeClient) ApplyMasterSecretVersions(_ context.Context, versions cluster.KeyVersions) error {
+	s.versions = versions
+	return nil
+}
+
+func (s *stubMasterSecretKubeClient) ApplyMasterSecretRotations(_ context.Context, rotations []uri.MasterSecretRotation) error {
+	s.rotations = rotations
+	return s.applyRotationsErr
+}
+
+func (s *stubMasterSecretKubeClient) NodeBootIDs(_ context.Context) (map[string]string, error) {
+	return s.bootIDs, nil
+}
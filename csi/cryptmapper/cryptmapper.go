@@ -8,17 +8,23 @@ SPDX-License-Identifier: BUSL-1.1
 package cryptmapper
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/internal/cryptsetup"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/google/uuid"
 )
 
 const (
@@ -30,8 +36,53 @@ const (
 	integrityFSSuffix = "-integrity"
 	keySizeIntegrity  = 96
 	keySizeCrypt      = 64
+	// keyScopeTokenType is the type of the LUKS2 token recording the key scope and key version of a volume.
+	// The token's ID is allocated by libcryptsetup, so it doesn't collide with other tokens of the header.
+	keyScopeTokenType = "constellation-csi-key-scope"
+	// maxTokens is the number of token IDs of a LUKS2 header.
+	maxTokens = 32
+
+	// KeyVersionAnnotation is the PersistentVolumeClaim annotation to request re-keying a volume.
+	// Its value is the requested key version. CSI drivers pass it to RekeyCryptDevice.
+	KeyVersionAnnotation = "csi.constellation.edgeless.systems/key-version"
 )
 
+var (
+	// ErrKeyScopeMismatch is returned when a volume is opened with a different key scope than it was created with.
+	ErrKeyScopeMismatch = errors.New("volume belongs to a different key scope")
+	// ErrUnscopedVolume is returned when a volume without a key scope is shredded, since its key can't be destroyed.
+	ErrUnscopedVolume = errors.New("volume has no key scope, so its key can't be destroyed")
+)
+
+// NamespaceKeyScope returns the key scope for volumes of the given Kubernetes namespace.
+func NamespaceKeyScope(namespace string) string {
+	return constants.CSINamespaceKeyScopePrefix + namespace
+}
+
+// StorageClassKeyScope returns the key scope for volumes of the given StorageClass.
+func StorageClassKeyScope(storageClass string) string {
+	return constants.CSIStorageClassKeyScopePrefix + storageClass
+}
+
+// KeyReferenceScope returns the key scope for volumes referencing the given key explicitly.
+func KeyReferenceScope(keyRef string) string {
+	return constants.CSIKeyReferenceScopePrefix + keyRef
+}
+
+// KeyVersionFromAnnotations returns the key version requested by the KeyVersionAnnotation.
+// Returns 0 if the annotation isn't set.
+func KeyVersionFromAnnotations(annotations map[string]string) (int, error) {
+	value, ok := annotations[KeyVersionAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid value %q of annotation %s: must be a non-negative integer", value, KeyVersionAnnotation)
+	}
+	return version, nil
+}
+
 // CryptMapper manages dm-crypt volumes.
 type CryptMapper struct {
 	mapper        func() deviceMapper
@@ -86,7 +137,23 @@ func (c *CryptMapper) CloseCryptDevice(volumeID string) error {
 
 // OpenCryptDevice maps the volume at source to the crypt device identified by volumeID.
 // The key used to encrypt the volume is fetched using CryptMapper's kms client.
+// The key is derived from the volume's UUID only. Use OpenScopedCryptDevice to separate the keys of different tenants.
 func (c *CryptMapper) OpenCryptDevice(ctx context.Context, source, volumeID string, integrity bool) (string, error) {
+	return c.OpenScopedCryptDevice(ctx, source, volumeID, "", integrity)
+}
+
+// OpenScopedCryptDevice maps the volume at source to the crypt device identified by volumeID.
+// The key used to encrypt the volume is fetched using CryptMapper's kms client,
+// and is derived from scope and the volume's UUID.
+// The scope, e.g., the volume's namespace, is recorded in the LUKS2 header of a new volume,
+// and opening the volume with a different scope fails with ErrKeyScopeMismatch.
+// Volumes created without a scope keep using a key derived from their UUID only.
+// The scope only separates key IDs. It isn't a security boundary between tenants,
+// since any caller the key service authorizes for a scope's key ID prefix receives the keys of that scope.
+//
+// If the volume is a clone or a restored snapshot of another volume, i.e., its LUKS2 header was created for a different volumeID,
+// the clone is given a new UUID for its key, and its volume key is re-wrapped under the passphrase derived from it.
+func (c *CryptMapper) OpenScopedCryptDevice(ctx context.Context, source, volumeID, scope string, integrity bool) (string, error) {
 	// Initialize the block device
 	mapper := c.mapper()
 	free, err := mapper.Init(source)
@@ -100,7 +167,7 @@ func (c *CryptMapper) OpenCryptDevice(ctx context.Context, source, volumeID stri
 	// Try to load LUKS headers
 	// If this fails, the device is either not formatted at all, or already formatted with a different FS
 	if err := mapper.LoadLUKS2(); err != nil {
-		passphrase, err = c.formatNewDevice(ctx, mapper, volumeID, source, integrity)
+		passphrase, err = c.formatNewDevice(ctx, mapper, volumeID, source, scope, integrity)
 		if err != nil {
 			return "", fmt.Errorf("formatting device: %w", err)
 		}
@@ -116,20 +183,30 @@ func (c *CryptMapper) OpenCryptDevice(ctx context.Context, source, volumeID stri
 			return deviceName, nil
 		}
 
-		uuid, err := mapper.GetUUID()
+		token, err := getKeyScopeToken(mapper)
 		if err != nil {
 			return "", err
 		}
-		passphrase, err = c.kms.GetDEK(ctx, uuid, crypto.StateDiskKeyLength)
+		if token.Scope != "" && token.Scope != scope {
+			return "", fmt.Errorf("opening volume with key scope %q: %w", scope, ErrKeyScopeMismatch)
+		}
+		if token.isPending() {
+			if token, err = c.completeKeyChange(ctx, mapper, token); err != nil {
+				return "", fmt.Errorf("completing interrupted key change: %w", err)
+			}
+		}
+		if token.VolumeID != volumeID {
+			if token, err = c.claimVolume(ctx, mapper, token, volumeID); err != nil {
+				return "", err
+			}
+		}
+		passphrase, err = c.getPassphrase(ctx, mapper, token)
 		if err != nil {
 			return "", err
 		}
-		if len(passphrase) != crypto.StateDiskKeyLength {
-			return "", fmt.Errorf("expected key length to be [%d] but got [%d]", crypto.StateDiskKeyLength, len(passphrase))
-		}
 	}
 
-	if err := mapper.ActivateByPassphrase(volumeID, 0, string(passphrase), cryptsetup.ReadWriteQueueBypass); err != nil {
+	if err := mapper.ActivateByPassphrase(volumeID, anyKeyslot, string(passphrase), cryptsetup.ReadWriteQueueBypass); err != nil {
 		return "", fmt.Errorf("trying to activate dm-crypt volume: %w", err)
 	}
 
@@ -149,16 +226,16 @@ func (c *CryptMapper) ResizeCryptDevice(ctx context.Context, volumeID string) (s
 		return "", fmt.Errorf("loading device: %w", err)
 	}
 
-	uuid, err := mapper.GetUUID()
+	token, err := getKeyScopeToken(mapper)
 	if err != nil {
 		return "", err
 	}
-	passphrase, err := c.kms.GetDEK(ctx, uuid, crypto.StateDiskKeyLength)
+	passphrase, err := c.getActivePassphrase(ctx, mapper, token)
 	if err != nil {
 		return "", fmt.Errorf("getting key: %w", err)
 	}
 
-	if err := mapper.ActivateByPassphrase("", 0, string(passphrase), resizeFlags); err != nil {
+	if err := mapper.ActivateByPassphrase("", anyKeyslot, string(passphrase), resizeFlags); err != nil {
 		return "", fmt.Errorf("activating keyring for crypt device %q with passphrase: %w", volumeID, err)
 	}
 
@@ -169,6 +246,110 @@ func (c *CryptMapper) ResizeCryptDevice(ctx context.Context, volumeID string) (s
 	return cryptPrefix + volumeID, nil
 }
 
+// RekeyCryptDevice replaces the key of the crypt device mapped for volumeID with the key of the given version.
+// The volume stays mapped while its keyslot is changed, and is opened with the new key from then on.
+// Key versions only increase: if the volume's key version is already at least version, this is a no-op.
+// Returns the key version of the volume.
+func (c *CryptMapper) RekeyCryptDevice(ctx context.Context, volumeID string, version int) (int, error) {
+	mapper := c.mapper()
+	free, err := mapper.InitByName(volumeID)
+	if err != nil {
+		return 0, fmt.Errorf("initializing device: %w", err)
+	}
+	defer free()
+
+	if err := mapper.LoadLUKS2(); err != nil {
+		return 0, fmt.Errorf("loading device: %w", err)
+	}
+
+	token, err := getKeyScopeToken(mapper)
+	if err != nil {
+		return 0, err
+	}
+	if token.isPending() {
+		if token, err = c.completeKeyChange(ctx, mapper, token); err != nil {
+			return 0, fmt.Errorf("completing interrupted key change: %w", err)
+		}
+	}
+	if token.KeyVersion >= version {
+		return token.KeyVersion, nil
+	}
+
+	token.PendingKeyVersion = version
+	if _, err := c.changeKey(ctx, mapper, token); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// ShredCryptDevice crypto-erases the volume at source, which was mapped for volumeID.
+// The volume's keys are destroyed in the KMS, so that they can't be derived anymore, e.g., to decrypt a leaked snapshot of the volume,
+// and the keyslots of its LUKS2 header are wiped, so that the volume can't be opened anymore.
+// Only the keys of volumes with a key scope can be destroyed. For volumes without a scope, e.g., volumes opened by OpenCryptDevice,
+// the error wraps ErrUnscopedVolume and the volume isn't wiped, since snapshots of it would stay decryptable.
+// The crypt device mapped for volumeID is closed first.
+// Call before the volume is released for deletion. Returns nil if the volume was already shredded or was never formatted.
+// The KMS client must be able to destroy keys, e.g., kms.ConstellationKMS.
+func (c *CryptMapper) ShredCryptDevice(ctx context.Context, source, volumeID string) error {
+	destroyer, ok := c.kms.(keyDestroyer)
+	if !ok {
+		return errors.New("KMS client can't destroy keys")
+	}
+	if err := c.CloseCryptDevice(volumeID); err != nil {
+		return err
+	}
+
+	mapper := c.mapper()
+	free, err := mapper.Init(source)
+	if err != nil {
+		return fmt.Errorf("initializing dm-crypt to shred device %q: %w", source, err)
+	}
+	defer free()
+
+	if err := mapper.LoadLUKS2(); err != nil {
+		format, formatErr := c.getDiskFormat(source)
+		if formatErr != nil {
+			return fmt.Errorf("determining if disk is formatted: %w", formatErr)
+		}
+		if format != "" {
+			return fmt.Errorf("disk %q is not a LUKS2 volume, but formatted as: %s", source, format)
+		}
+		// the header was already wiped, or the volume was never formatted
+		return nil
+	}
+
+	token, err := getKeyScopeToken(mapper)
+	if err != nil {
+		return err
+	}
+	headerUUID, err := mapper.GetUUID()
+	if err != nil {
+		return err
+	}
+
+	// The keys of volumes without a scope can't be destroyed, since their IDs can't be told apart from the keys of state disks.
+	if token.Scope == "" {
+		return fmt.Errorf("shredding device %q: %w", source, ErrUnscopedVolume)
+	}
+
+	// The keys are destroyed first, since their IDs are lost once the header is wiped.
+	// While a key change is pending, the volume may already use the pending key.
+	keyIDs := []string{token.keyID(headerUUID)}
+	if pendingKeyID := token.completePending().keyID(headerUUID); pendingKeyID != keyIDs[0] {
+		keyIDs = append(keyIDs, pendingKeyID)
+	}
+	for _, keyID := range keyIDs {
+		if err := destroyer.DestroyDEK(ctx, keyID); err != nil {
+			return fmt.Errorf("destroying key %q: %w", keyID, err)
+		}
+	}
+
+	if err := mapper.WipeKeyslots(LUKSHeaderSize); err != nil {
+		return fmt.Errorf("wiping keyslots of device %q: %w", source, err)
+	}
+	return nil
+}
+
 // GetDevicePath returns the device path of a mapped crypt device.
 func (c *CryptMapper) GetDevicePath(volumeID string) (string, error) {
 	mapper := c.mapper()
@@ -202,7 +383,7 @@ func (c *CryptMapper) closeCryptDevice(source, volumeID, deviceType string) erro
 	return nil
 }
 
-func (c *CryptMapper) formatNewDevice(ctx context.Context, mapper deviceMapper, volumeID, source string, integrity bool) ([]byte, error) {
+func (c *CryptMapper) formatNewDevice(ctx context.Context, mapper deviceMapper, volumeID, source, scope string, integrity bool) ([]byte, error) {
 	format, err := c.getDiskFormat(source)
 	if err != nil {
 		return nil, fmt.Errorf("determining if disk is formatted: %w", err)
@@ -215,18 +396,15 @@ func (c *CryptMapper) formatNewDevice(ctx context.Context, mapper deviceMapper,
 	if err := mapper.Format(integrity); err != nil {
 		return nil, fmt.Errorf("formatting device %q: %w", source, err)
 	}
-
-	uuid, err := mapper.GetUUID()
-	if err != nil {
+	token := keyScopeToken{Scope: scope, VolumeID: volumeID}
+	if err := setKeyScopeToken(mapper, token); err != nil {
 		return nil, err
 	}
-	passphrase, err := c.kms.GetDEK(ctx, uuid, crypto.StateDiskKeyLength)
+
+	passphrase, err := c.getPassphrase(ctx, mapper, token)
 	if err != nil {
 		return nil, err
 	}
-	if len(passphrase) != crypto.StateDiskKeyLength {
-		return nil, fmt.Errorf("expected key length to be [%d] but got [%d]", crypto.StateDiskKeyLength, len(passphrase))
-	}
 
 	// Add a new keyslot using the internal volume key
 	if err := mapper.KeyslotAddByVolumeKey(0, "", string(passphrase)); err != nil {
@@ -247,6 +425,155 @@ func (c *CryptMapper) formatNewDevice(ctx context.Context, mapper deviceMapper,
 	return passphrase, nil
 }
 
+// claimVolume records volumeID as the owner of the loaded device's LUKS2 header.
+// If the header was created for another volume, the device is a clone or restored snapshot of that volume,
+// and is given a new UUID for its key, so that it no longer shares the key of the original volume.
+func (c *CryptMapper) claimVolume(ctx context.Context, mapper deviceMapper, token keyScopeToken, volumeID string) (keyScopeToken, error) {
+	if token.VolumeID == "" {
+		// volume was created before volume IDs were recorded
+		token.VolumeID = volumeID
+		return token, setKeyScopeToken(mapper, token)
+	}
+
+	token.VolumeID = volumeID
+	token.PendingUUID = uuid.NewString()
+	token, err := c.changeKey(ctx, mapper, token)
+	if err != nil {
+		return keyScopeToken{}, fmt.Errorf("assigning new key to cloned volume: %w", err)
+	}
+	return token, nil
+}
+
+// changeKey changes the key of the loaded device to the pending key of token.
+// The pending change is recorded before changing the keyslot, so an interrupted change can be completed later.
+func (c *CryptMapper) changeKey(ctx context.Context, mapper deviceMapper, token keyScopeToken) (keyScopeToken, error) {
+	currentPassphrase, err := c.getPassphrase(ctx, mapper, token)
+	if err != nil {
+		return keyScopeToken{}, err
+	}
+	newPassphrase, err := c.getPassphrase(ctx, mapper, token.completePending())
+	if err != nil {
+		return keyScopeToken{}, err
+	}
+	if err := setKeyScopeToken(mapper, token); err != nil {
+		return keyScopeToken{}, err
+	}
+	return rewrapVolumeKey(mapper, token, currentPassphrase, newPassphrase)
+}
+
+// completeKeyChange completes an interrupted change of the loaded device's key to the pending key of token.
+func (c *CryptMapper) completeKeyChange(ctx context.Context, mapper deviceMapper, token keyScopeToken) (keyScopeToken, error) {
+	currentPassphrase, err := c.getActivePassphrase(ctx, mapper, token)
+	if err != nil {
+		return keyScopeToken{}, err
+	}
+	newPassphrase, err := c.getPassphrase(ctx, mapper, token.completePending())
+	if err != nil {
+		return keyScopeToken{}, err
+	}
+	return rewrapVolumeKey(mapper, token, currentPassphrase, newPassphrase)
+}
+
+// getActivePassphrase returns the passphrase the loaded device's keyslot is protected with.
+// While a key change is pending, this is either the passphrase of the current or of the pending key.
+func (c *CryptMapper) getActivePassphrase(ctx context.Context, mapper deviceMapper, token keyScopeToken) ([]byte, error) {
+	passphrase, err := c.getPassphrase(ctx, mapper, token)
+	if err != nil {
+		return nil, err
+	}
+	if !token.isPending() {
+		return passphrase, nil
+	}
+	// activating without a device name only checks the passphrase
+	if err := mapper.ActivateByPassphrase("", anyKeyslot, string(passphrase), 0); err == nil {
+		return passphrase, nil
+	}
+	return c.getPassphrase(ctx, mapper, token.completePending())
+}
+
+// getPassphrase fetches the passphrase of the key recorded in token for the loaded device.
+func (c *CryptMapper) getPassphrase(ctx context.Context, mapper deviceMapper, token keyScopeToken) ([]byte, error) {
+	headerUUID, err := mapper.GetUUID()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := c.kms.GetDEK(ctx, token.dekID(headerUUID), crypto.StateDiskKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) != crypto.StateDiskKeyLength {
+		return nil, fmt.Errorf("expected key length to be [%d] but got [%d]", crypto.StateDiskKeyLength, len(passphrase))
+	}
+	return passphrase, nil
+}
+
+// rewrapVolumeKey protects the volume key of the loaded device with newPassphrase instead of currentPassphrase,
+// and records the pending key of token as the device's key.
+func rewrapVolumeKey(mapper deviceMapper, token keyScopeToken, currentPassphrase, newPassphrase []byte) (keyScopeToken, error) {
+	if !bytes.Equal(currentPassphrase, newPassphrase) {
+		// adds a keyslot for the new passphrase and removes the keyslot of the current passphrase
+		if err := mapper.KeyslotChangeByPassphrase(anyKeyslot, anyKeyslot, string(currentPassphrase), string(newPassphrase)); err != nil {
+			return keyScopeToken{}, fmt.Errorf("changing keyslot: %w", err)
+		}
+	}
+	next := token.completePending()
+	if err := setKeyScopeToken(mapper, next); err != nil {
+		return keyScopeToken{}, err
+	}
+	return next, nil
+}
+
+// getKeyScopeToken returns the key scope token of the loaded device.
+func getKeyScopeToken(mapper deviceMapper) (keyScopeToken, error) {
+	_, token, err := findKeyScopeToken(mapper)
+	return token, err
+}
+
+// setKeyScopeToken records the key scope token in the LUKS2 header of the loaded device.
+// An existing key scope token is replaced, otherwise a free token ID is allocated.
+func setKeyScopeToken(mapper deviceMapper, token keyScopeToken) error {
+	tokenID, _, err := findKeyScopeToken(mapper)
+	if err != nil {
+		return err
+	}
+	token.Type = keyScopeTokenType
+	token.Keyslots = []string{}
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshaling key scope token: %w", err)
+	}
+	if _, err := mapper.TokenJSONSet(tokenID, string(tokenJSON)); err != nil {
+		return fmt.Errorf("recording key scope token: %w", err)
+	}
+	return nil
+}
+
+// findKeyScopeToken returns the ID and content of the key scope token of the loaded device.
+// If the device doesn't have a key scope token, e.g., because it was created without a scope, the ID is anyToken.
+func findKeyScopeToken(mapper deviceMapper) (int, keyScopeToken, error) {
+	for tokenID := range maxTokens {
+		tokenJSON, err := mapper.TokenJSONGet(tokenID)
+		if err != nil {
+			// token ID isn't in use
+			continue
+		}
+		var token keyScopeToken
+		if err := json.Unmarshal([]byte(tokenJSON), &struct {
+			Type *string `json:"type"`
+		}{Type: &token.Type}); err != nil {
+			return 0, keyScopeToken{}, fmt.Errorf("unmarshaling type of token %d: %w", tokenID, err)
+		}
+		if token.Type != keyScopeTokenType {
+			continue
+		}
+		if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+			return 0, keyScopeToken{}, fmt.Errorf("unmarshaling key scope token: %w", err)
+		}
+		return tokenID, token, nil
+	}
+	return anyToken, keyScopeToken{}, nil
+}
+
 // IsIntegrityFS checks if the fstype string contains an integrity suffix.
 // If yes, returns the trimmed fstype and true, fstype and false otherwise.
 func IsIntegrityFS(fstype string) (string, bool) {
@@ -269,11 +596,72 @@ type deviceMapper interface {
 	GetUUID() (string, error)
 	LoadLUKS2() error
 	KeyslotAddByVolumeKey(keyslot int, volumeKey string, passphrase string) error
+	KeyslotChangeByPassphrase(currentKeyslot, newKeyslot int, currentPassphrase, newPassphrase string) error
 	Wipe(name string, wipeBlockSize int, flags int, progress func(size, offset uint64), frequency time.Duration) error
+	WipeKeyslots(headerSize uint64) error
 	Resize(name string, newSize uint64) error
+	TokenJSONGet(token int) (string, error)
+	TokenJSONSet(token int, json string) (int, error)
+}
+
+// keyScopeToken is the LUKS2 token recording the key scope and key version of a volume.
+type keyScopeToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	Scope    string   `json:"scope,omitempty"`
+	// KeyVersion is the version of the key in use. Version 0 is the key the volume was created with.
+	KeyVersion int `json:"keyVersion,omitempty"`
+	// UUID replaces the UUID of the LUKS2 header in the key ID of cloned volumes.
+	UUID string `json:"uuid,omitempty"`
+	// VolumeID is the ID of the volume the header belongs to. A different ID on open indicates a cloned volume.
+	VolumeID string `json:"volumeID,omitempty"`
+	// PendingKeyVersion is set while the volume is re-keyed to this version.
+	PendingKeyVersion int `json:"pendingKeyVersion,omitempty"`
+	// PendingUUID is set while a cloned volume is assigned this UUID.
+	PendingUUID string `json:"pendingUUID,omitempty"`
+}
+
+// keyID returns the ID of the volume's keys, i.e., the ID of its data encryption keys without key version.
+func (t keyScopeToken) keyID(headerUUID string) string {
+	keyID := headerUUID
+	if t.UUID != "" {
+		keyID = t.UUID
+	}
+	if t.Scope != "" {
+		keyID = t.Scope + "/" + keyID
+	}
+	return keyID
+}
+
+// dekID returns the ID of the data encryption key recorded in the token.
+func (t keyScopeToken) dekID(headerUUID string) string {
+	return kms.VersionedKeyID(t.keyID(headerUUID), uint32(t.KeyVersion))
+}
+
+// isPending returns true if a key change of the volume was started but not completed.
+func (t keyScopeToken) isPending() bool {
+	return t.PendingKeyVersion != 0 || t.PendingUUID != ""
+}
+
+// completePending returns the token with the pending key change applied.
+func (t keyScopeToken) completePending() keyScopeToken {
+	if t.PendingKeyVersion != 0 {
+		t.KeyVersion = t.PendingKeyVersion
+	}
+	if t.PendingUUID != "" {
+		t.UUID = t.PendingUUID
+	}
+	t.PendingKeyVersion = 0
+	t.PendingUUID = ""
+	return t
 }
 
 // keyCreator is an interface to create data encryption keys.
 type keyCreator interface {
 	GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error)
 }
+
+// keyDestroyer is an interface to destroy data encryption keys, and all keys below their ID.
+type keyDestroyer interface {
+	DestroyDEK(ctx context.Context, dekID string) error
+}
@@ -18,6 +18,8 @@ import (
 )
 
 const (
+	anyKeyslot  = cryptsetup.CRYPT_ANY_SLOT
+	anyToken    = cryptsetup.CRYPT_ANY_TOKEN
 	resizeFlags = cryptsetup.CRYPT_ACTIVATE_KEYRING_KEY | ccryptsetup.ReadWriteQueueBypass
 )
 
@@ -15,6 +15,8 @@ import (
 )
 
 const (
+	anyKeyslot  = -1
+	anyToken    = -1
 	resizeFlags = 0x800 | ccryptsetup.ReadWriteQueueBypass
 )
 
@@ -9,11 +9,14 @@ package cryptmapper
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 )
 
@@ -227,6 +230,180 @@ func TestOpenCryptDevice(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestOpenScopedCryptDevice(t *testing.T) {
+	const uuid = "8d7e5a3c-0f1b-4c2d-9e8f-7a6b5c4d3e2f"
+	const volumeID = "volume0"
+
+	testCases := map[string]struct {
+		scope       string
+		mapper      *stubCryptDevice
+		wantDEKIDs  []string
+		wantToken   keyScopeToken
+		wantTokenID int
+		wantErr     bool
+		wantErrIs   error
+	}{
+		"new volume": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid, loadErr: assert.AnError},
+			wantDEKIDs: []string{"namespace/team-a/" + uuid},
+			wantToken:  keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID},
+		},
+		"new volume without scope": {
+			mapper:     &stubCryptDevice{uuid: uuid, loadErr: assert.AnError},
+			wantDEKIDs: []string{uuid},
+			wantToken:  keyScopeToken{VolumeID: volumeID},
+		},
+		"existing volume": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID})},
+			wantDEKIDs: []string{"namespace/team-a/" + uuid},
+			wantToken:  keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID},
+		},
+		"existing volume without token": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid},
+			wantDEKIDs: []string{uuid},
+			wantToken:  keyScopeToken{VolumeID: volumeID},
+		},
+		"token of other type": {
+			scope:       NamespaceKeyScope("team-a"),
+			mapper:      &stubCryptDevice{uuid: uuid, otherTokens: map[int]string{0: `{"type":"other","keyslots":[]}`}},
+			wantDEKIDs:  []string{uuid},
+			wantToken:   keyScopeToken{VolumeID: volumeID},
+			wantTokenID: 1,
+		},
+		"new volume with token of other type": {
+			scope:       NamespaceKeyScope("team-a"),
+			mapper:      &stubCryptDevice{uuid: uuid, loadErr: assert.AnError, otherTokens: map[int]string{0: `{"type":"other","keyslots":[]}`}},
+			wantDEKIDs:  []string{"namespace/team-a/" + uuid},
+			wantToken:   keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID},
+			wantTokenID: 1,
+		},
+		"key scope token after token of other type": {
+			scope: NamespaceKeyScope("team-a"),
+			mapper: &stubCryptDevice{
+				uuid:        uuid,
+				token:       testToken(keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID}),
+				tokenID:     3,
+				otherTokens: map[int]string{0: `{"type":"other","keyslots":[]}`},
+			},
+			wantDEKIDs:  []string{"namespace/team-a/" + uuid},
+			wantToken:   keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID},
+			wantTokenID: 3,
+		},
+		"re-keyed volume": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", KeyVersion: 2, VolumeID: volumeID})},
+			wantDEKIDs: []string{"namespace/team-a/" + uuid + "/v2"},
+			wantToken:  keyScopeToken{Scope: "namespace/team-a", KeyVersion: 2, VolumeID: volumeID},
+		},
+		"re-keyed volume without scope": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{KeyVersion: 1, VolumeID: volumeID})},
+			wantDEKIDs: []string{uuid + "/v1"},
+			wantToken:  keyScopeToken{KeyVersion: 1, VolumeID: volumeID},
+		},
+		"interrupted re-keying": {
+			scope: NamespaceKeyScope("team-a"),
+			mapper: &stubCryptDevice{
+				uuid:            uuid,
+				token:           testToken(keyScopeToken{Scope: "namespace/team-a", KeyVersion: 1, PendingKeyVersion: 2, VolumeID: volumeID}),
+				validPassphrase: testKey("namespace/team-a/" + uuid + "/v2"),
+			},
+			wantDEKIDs: []string{
+				"namespace/team-a/" + uuid + "/v1",
+				"namespace/team-a/" + uuid + "/v2", // check pending key
+				"namespace/team-a/" + uuid + "/v2", // complete key change
+				"namespace/team-a/" + uuid + "/v2", // open
+			},
+			wantToken: keyScopeToken{Scope: "namespace/team-a", KeyVersion: 2, VolumeID: volumeID},
+		},
+		"cloned volume": {
+			scope:      NamespaceKeyScope("team-a"),
+			mapper:     &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", KeyVersion: 1, VolumeID: "other-volume"})},
+			wantDEKIDs: []string{"namespace/team-a/" + uuid + "/v1"},
+			wantToken:  keyScopeToken{Scope: "namespace/team-a", KeyVersion: 1, VolumeID: volumeID},
+		},
+		"clone of cloned volume": {
+			mapper:     &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{UUID: "2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d", VolumeID: "other-volume"})},
+			wantDEKIDs: []string{"2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d"},
+			wantToken:  keyScopeToken{VolumeID: volumeID},
+		},
+		"assigning new key to clone fails": {
+			mapper:  &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{VolumeID: "other-volume"}), keyslotChangeErr: assert.AnError},
+			wantErr: true,
+		},
+		"scope mismatch": {
+			scope:     NamespaceKeyScope("team-b"),
+			mapper:    &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID})},
+			wantErrIs: ErrKeyScopeMismatch,
+		},
+		"existing volume opened without scope": {
+			mapper:    &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", VolumeID: volumeID})},
+			wantErrIs: ErrKeyScopeMismatch,
+		},
+		"invalid token": {
+			scope:   NamespaceKeyScope("team-a"),
+			mapper:  &stubCryptDevice{uuid: uuid, token: "{"},
+			wantErr: true,
+		},
+		"recording scope fails": {
+			scope:   NamespaceKeyScope("team-a"),
+			mapper:  &stubCryptDevice{uuid: uuid, loadErr: assert.AnError, tokenSetErr: assert.AnError},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			kms := &fakeKMS{deriveKeys: true}
+			mapper := &CryptMapper{
+				mapper:        testMapper(tc.mapper),
+				kms:           kms,
+				getDiskFormat: func(_ string) (string, error) { return "", nil },
+			}
+
+			_, err := mapper.OpenScopedCryptDevice(t.Context(), "/dev/some-device", volumeID, tc.scope, false)
+			switch {
+			case tc.wantErrIs != nil:
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Empty(kms.dekIDs)
+				return
+			case tc.wantErr:
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			token := parseTestToken(t, tc.mapper.token)
+			if tc.mapper.changedFrom == "" {
+				assert.Equal(tc.wantDEKIDs, kms.dekIDs)
+				assert.Equal(tc.wantToken, token)
+				assert.Equal(tc.wantTokenID, tc.mapper.tokenID)
+				for id, other := range tc.mapper.otherTokens {
+					assert.NotEqual(id, tc.mapper.tokenID)
+					assert.Equal(`{"type":"other","keyslots":[]}`, other)
+				}
+				return
+			}
+
+			// the clone's key is derived from a new UUID
+			assert.NotEmpty(token.UUID)
+			assert.NotEqual(uuid, token.UUID)
+			newDEKID := tc.wantToken.completePending()
+			newDEKID.UUID = token.UUID
+			assert.Equal(testKey(tc.wantDEKIDs[0]), tc.mapper.changedFrom)
+			assert.Equal(testKey(newDEKID.dekID(uuid)), tc.mapper.changedTo)
+			tc.wantToken.UUID = token.UUID
+			assert.Equal(tc.wantToken, token)
+		})
+	}
+}
+
 func TestResizeCryptDevice(t *testing.T) {
 	volumeID := "pvc-123"
 	someErr := errors.New("error")
@@ -259,6 +436,11 @@ func TestResizeCryptDevice(t *testing.T) {
 			device:   &stubCryptDevice{activatePassErr: someErr},
 			wantErr:  true,
 		},
+		"invalid key scope token": {
+			volumeID: volumeID,
+			device:   &stubCryptDevice{token: "{"},
+			wantErr:  true,
+		},
 	}
 
 	for name, tc := range testCases {
@@ -281,6 +463,299 @@ func TestResizeCryptDevice(t *testing.T) {
 	}
 }
 
+func TestRekeyCryptDevice(t *testing.T) {
+	const uuid = "8d7e5a3c-0f1b-4c2d-9e8f-7a6b5c4d3e2f"
+	const volumeID = "pvc-123"
+
+	testCases := map[string]struct {
+		version         int
+		device          *stubCryptDevice
+		kms             *fakeKMS
+		wantVersion     int
+		wantChangedFrom string
+		wantChangedTo   string
+		wantToken       keyScopeToken
+		wantErr         bool
+	}{
+		"volume without token": {
+			version:         1,
+			device:          &stubCryptDevice{uuid: uuid},
+			wantVersion:     1,
+			wantChangedFrom: uuid,
+			wantChangedTo:   uuid + "/v1",
+			wantToken:       keyScopeToken{KeyVersion: 1},
+		},
+		"scoped volume": {
+			version:         3,
+			device:          &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{Scope: "namespace/team-a", KeyVersion: 1, VolumeID: volumeID})},
+			wantVersion:     3,
+			wantChangedFrom: "namespace/team-a/" + uuid + "/v1",
+			wantChangedTo:   "namespace/team-a/" + uuid + "/v3",
+			wantToken:       keyScopeToken{Scope: "namespace/team-a", KeyVersion: 3, VolumeID: volumeID},
+		},
+		"cloned volume": {
+			version:         1,
+			device:          &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{UUID: "2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d", VolumeID: volumeID})},
+			wantVersion:     1,
+			wantChangedFrom: "2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d",
+			wantChangedTo:   "2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d/v1",
+			wantToken:       keyScopeToken{UUID: "2b1f9c4e-5d6a-4e7b-8c9d-0e1f2a3b4c5d", KeyVersion: 1, VolumeID: volumeID},
+		},
+		"already at version": {
+			version:     1,
+			device:      &stubCryptDevice{uuid: uuid, token: testToken(keyScopeToken{KeyVersion: 2})},
+			wantVersion: 2,
+			wantToken:   keyScopeToken{KeyVersion: 2},
+		},
+		"interrupted after changing keyslot": {
+			version: 2,
+			device: &stubCryptDevice{
+				uuid:            uuid,
+				token:           testToken(keyScopeToken{KeyVersion: 1, PendingKeyVersion: 2}),
+				validPassphrase: testKey(uuid + "/v2"),
+			},
+			wantVersion: 2,
+			wantToken:   keyScopeToken{KeyVersion: 2},
+		},
+		"interrupted before changing keyslot": {
+			version: 2,
+			device: &stubCryptDevice{
+				uuid:            uuid,
+				token:           testToken(keyScopeToken{KeyVersion: 1, PendingKeyVersion: 2}),
+				validPassphrase: testKey(uuid + "/v1"),
+			},
+			wantVersion:     2,
+			wantChangedFrom: uuid + "/v1",
+			wantChangedTo:   uuid + "/v2",
+			wantToken:       keyScopeToken{KeyVersion: 2},
+		},
+		"InitByName fails": {
+			version: 1,
+			device:  &stubCryptDevice{initByNameErr: assert.AnError},
+			wantErr: true,
+		},
+		"Load fails": {
+			version: 1,
+			device:  &stubCryptDevice{loadErr: assert.AnError},
+			wantErr: true,
+		},
+		"getting key fails": {
+			version: 1,
+			device:  &stubCryptDevice{uuid: uuid},
+			kms:     &fakeKMS{getDEKErr: assert.AnError},
+			wantErr: true,
+		},
+		"changing keyslot fails": {
+			version:   1,
+			device:    &stubCryptDevice{uuid: uuid, keyslotChangeErr: assert.AnError},
+			wantToken: keyScopeToken{PendingKeyVersion: 1},
+			wantErr:   true,
+		},
+		"recording key version fails": {
+			version: 1,
+			device:  &stubCryptDevice{uuid: uuid, tokenSetErr: assert.AnError},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			if tc.kms == nil {
+				tc.kms = &fakeKMS{}
+			}
+			tc.kms.deriveKeys = true
+			mapper := &CryptMapper{
+				kms:    tc.kms,
+				mapper: testMapper(tc.device),
+			}
+
+			version, err := mapper.RekeyCryptDevice(t.Context(), volumeID, tc.version)
+			if tc.device.token != "" {
+				assert.Equal(tc.wantToken, parseTestToken(t, tc.device.token))
+			}
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersion, version)
+			if tc.wantChangedFrom == "" {
+				assert.Empty(tc.device.changedFrom)
+				return
+			}
+			assert.Equal(testKey(tc.wantChangedFrom), tc.device.changedFrom)
+			assert.Equal(testKey(tc.wantChangedTo), tc.device.changedTo)
+		})
+	}
+}
+
+func TestShredCryptDevice(t *testing.T) {
+	const (
+		volumeID   = "pvc-123"
+		headerUUID = "8d7e5a3c-0000-4000-8000-000000000000"
+		cloneUUID  = "5b2f1c9e-0000-4000-8000-000000000000"
+	)
+	scope := NamespaceKeyScope("team-a")
+	someErr := errors.New("error")
+
+	testCases := map[string]struct {
+		device           *stubCryptDevice
+		kms              keyCreator
+		diskFormat       string
+		wantDestroyedIDs []string
+		wantWiped        bool
+		wantErr          bool
+		wantErrIs        error
+	}{
+		"volume without scope can't be shredded": {
+			device:    &stubCryptDevice{uuid: headerUUID},
+			kms:       &fakeKMS{},
+			wantErr:   true,
+			wantErrIs: ErrUnscopedVolume,
+		},
+		"scoped volume": {
+			device:           &stubCryptDevice{uuid: headerUUID, token: testToken(keyScopeToken{Scope: scope, VolumeID: volumeID})},
+			kms:              &fakeKMS{},
+			wantDestroyedIDs: []string{scope + "/" + headerUUID},
+			wantWiped:        true,
+		},
+		"all key versions are destroyed": {
+			device:           &stubCryptDevice{uuid: headerUUID, token: testToken(keyScopeToken{Scope: scope, KeyVersion: 2, VolumeID: volumeID})},
+			kms:              &fakeKMS{},
+			wantDestroyedIDs: []string{scope + "/" + headerUUID},
+			wantWiped:        true,
+		},
+		"cloned volume": {
+			device:           &stubCryptDevice{uuid: headerUUID, token: testToken(keyScopeToken{Scope: scope, UUID: cloneUUID, VolumeID: volumeID})},
+			kms:              &fakeKMS{},
+			wantDestroyedIDs: []string{scope + "/" + cloneUUID},
+			wantWiped:        true,
+		},
+		"clone pending": {
+			device: &stubCryptDevice{
+				uuid:  headerUUID,
+				token: testToken(keyScopeToken{Scope: scope, VolumeID: volumeID, PendingUUID: cloneUUID}),
+			},
+			kms:              &fakeKMS{},
+			wantDestroyedIDs: []string{scope + "/" + headerUUID, scope + "/" + cloneUUID},
+			wantWiped:        true,
+		},
+		"already shredded": {
+			device: &stubCryptDevice{loadErr: someErr},
+			kms:    &fakeKMS{},
+		},
+		"not a LUKS2 volume": {
+			device:     &stubCryptDevice{loadErr: someErr},
+			kms:        &fakeKMS{},
+			diskFormat: "ext4",
+			wantErr:    true,
+		},
+		"KMS can't destroy keys": {
+			device:  &stubCryptDevice{uuid: headerUUID, token: testToken(keyScopeToken{Scope: scope, VolumeID: volumeID})},
+			kms:     &stubKeyCreator{},
+			wantErr: true,
+		},
+		"destroying key fails": {
+			device:  &stubCryptDevice{uuid: headerUUID, token: testToken(keyScopeToken{Scope: scope, VolumeID: volumeID})},
+			kms:     &fakeKMS{destroyDEKErr: someErr},
+			wantErr: true,
+		},
+		"wiping keyslots fails": {
+			device: &stubCryptDevice{
+				uuid:            headerUUID,
+				token:           testToken(keyScopeToken{Scope: scope, VolumeID: volumeID}),
+				wipeKeyslotsErr: someErr,
+			},
+			kms:              &fakeKMS{},
+			wantDestroyedIDs: []string{scope + "/" + headerUUID},
+			wantErr:          true,
+		},
+		"Init fails": {
+			device:  &stubCryptDevice{initErr: someErr},
+			kms:     &fakeKMS{},
+			wantErr: true,
+		},
+		"GetUUID fails": {
+			device:  &stubCryptDevice{uuidErr: someErr},
+			kms:     &fakeKMS{},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			mapper := &CryptMapper{
+				kms:           tc.kms,
+				mapper:        testMapper(tc.device),
+				getDiskFormat: func(_ string) (string, error) { return tc.diskFormat, nil },
+			}
+
+			err := mapper.ShredCryptDevice(t.Context(), "/dev/some-device", volumeID)
+			if tc.wantErr {
+				assert.Error(err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(err, tc.wantErrIs)
+				}
+			} else {
+				assert.NoError(err)
+			}
+			if kms, ok := tc.kms.(*fakeKMS); ok {
+				assert.Equal(tc.wantDestroyedIDs, kms.destroyedIDs)
+			}
+			assert.Equal(tc.wantWiped, tc.device.keyslotsWiped)
+		})
+	}
+}
+
+// stubKeyCreator is a KMS client that can't destroy keys.
+type stubKeyCreator struct{}
+
+func (stubKeyCreator) GetDEK(_ context.Context, _ string, dekSize int) ([]byte, error) {
+	return bytes.Repeat([]byte{0xAA}, dekSize), nil
+}
+
+func TestKeyVersionFromAnnotations(t *testing.T) {
+	testCases := map[string]struct {
+		annotations map[string]string
+		wantVersion int
+		wantErr     bool
+	}{
+		"not set": {
+			annotations: map[string]string{"other": "1"},
+		},
+		"set": {
+			annotations: map[string]string{KeyVersionAnnotation: "2"},
+			wantVersion: 2,
+		},
+		"not a number": {
+			annotations: map[string]string{KeyVersionAnnotation: "latest"},
+			wantErr:     true,
+		},
+		"negative": {
+			annotations: map[string]string{KeyVersionAnnotation: "-1"},
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			version, err := KeyVersionFromAnnotations(tc.annotations)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersion, version)
+		})
+	}
+}
+
 func TestGetDevicePath(t *testing.T) {
 	volumeID := "pvc-123"
 	someErr := errors.New("error")
@@ -370,20 +845,36 @@ func TestIsIntegrityFS(t *testing.T) {
 }
 
 type fakeKMS struct {
-	presetKey []byte
-	getDEKErr error
+	presetKey     []byte
+	deriveKeys    bool
+	getDEKErr     error
+	dekIDs        []string
+	destroyDEKErr error
+	destroyedIDs  []string
 }
 
-func (k *fakeKMS) GetDEK(_ context.Context, _ string, dekSize int) ([]byte, error) {
+func (k *fakeKMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byte, error) {
+	k.dekIDs = append(k.dekIDs, dekID)
 	if k.getDEKErr != nil {
 		return nil, k.getDEKErr
 	}
 	if k.presetKey != nil {
 		return k.presetKey, nil
 	}
+	if k.deriveKeys {
+		return []byte(testKey(dekID)), nil
+	}
 	return bytes.Repeat([]byte{0xAA}, dekSize), nil
 }
 
+func (k *fakeKMS) DestroyDEK(_ context.Context, dekID string) error {
+	if k.destroyDEKErr != nil {
+		return k.destroyDEKErr
+	}
+	k.destroyedIDs = append(k.destroyedIDs, dekID)
+	return nil
+}
+
 type stubCryptDevice struct {
 	deviceName       string
 	uuid             string
@@ -399,6 +890,16 @@ type stubCryptDevice struct {
 	keySlotAddErr    error
 	wipeErr          error
 	resizeErr        error
+	token            string
+	tokenID          int
+	otherTokens      map[int]string
+	tokenSetErr      error
+	validPassphrase  string
+	keyslotChangeErr error
+	changedFrom      string
+	changedTo        string
+	wipeKeyslotsErr  error
+	keyslotsWiped    bool
 }
 
 func (c *stubCryptDevice) Init(_ string) (func(), error) {
@@ -413,7 +914,10 @@ func (c *stubCryptDevice) ActivateByVolumeKey(_, _ string, _, _ int) error {
 	return c.activateErr
 }
 
-func (c *stubCryptDevice) ActivateByPassphrase(_ string, _ int, _ string, _ int) error {
+func (c *stubCryptDevice) ActivateByPassphrase(_ string, _ int, passphrase string, _ int) error {
+	if c.validPassphrase != "" && passphrase != c.validPassphrase {
+		return errors.New("wrong passphrase")
+	}
 	return c.activatePassErr
 }
 
@@ -448,12 +952,82 @@ func (c *stubCryptDevice) Wipe(_ string, _ int, _ int, _ func(size, offset uint6
 	return c.wipeErr
 }
 
+func (c *stubCryptDevice) WipeKeyslots(_ uint64) error {
+	if c.wipeKeyslotsErr != nil {
+		return c.wipeKeyslotsErr
+	}
+	c.keyslotsWiped = true
+	return nil
+}
+
 func (c *stubCryptDevice) Resize(_ string, _ uint64) error {
 	return c.resizeErr
 }
 
+func (c *stubCryptDevice) KeyslotChangeByPassphrase(_, _ int, currentPassphrase, newPassphrase string) error {
+	if c.keyslotChangeErr != nil {
+		return c.keyslotChangeErr
+	}
+	c.changedFrom = currentPassphrase
+	c.changedTo = newPassphrase
+	return nil
+}
+
+func (c *stubCryptDevice) TokenJSONGet(token int) (string, error) {
+	if other, ok := c.otherTokens[token]; ok {
+		return other, nil
+	}
+	if c.token == "" || token != c.tokenID {
+		return "", errors.New("token not found")
+	}
+	return c.token, nil
+}
+
+func (c *stubCryptDevice) TokenJSONSet(token int, json string) (int, error) {
+	if c.tokenSetErr != nil {
+		return -1, c.tokenSetErr
+	}
+	if token == anyToken {
+		// allocate the lowest free token ID, like libcryptsetup
+		token = 0
+		for c.otherTokens[token] != "" {
+			token++
+		}
+	}
+	c.token = json
+	c.tokenID = token
+	return token, nil
+}
+
 func testMapper(stub *stubCryptDevice) func() deviceMapper {
 	return func() deviceMapper {
 		return stub
 	}
 }
+
+// testKey returns the key fakeKMS derives for dekID.
+func testKey(dekID string) string {
+	key := sha256.Sum256([]byte(dekID))
+	return string(key[:])
+}
+
+// testToken returns the JSON of the key scope token t.
+func testToken(t keyScopeToken) string {
+	t.Type = keyScopeTokenType
+	t.Keyslots = []string{}
+	tokenJSON, err := json.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	return string(tokenJSON)
+}
+
+// parseTestToken parses a key scope token, omitting its type and keyslots.
+func parseTestToken(t *testing.T, tokenJSON string) keyScopeToken {
+	t.Helper()
+	var token keyScopeToken
+	require.NoError(t, json.Unmarshal([]byte(tokenJSON), &token))
+	token.Type = ""
+	token.Keyslots = nil
+	return token
+}
@@ -9,51 +9,188 @@ package kms
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/atls"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/choose"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/variant"
+	"github.com/edgelesssys/constellation/v2/internal/config"
+	"github.com/edgelesssys/constellation/v2/internal/grpc/atlscredentials"
+	grpcretry "github.com/edgelesssys/constellation/v2/internal/grpc/retry"
+	"github.com/edgelesssys/constellation/v2/internal/grpc/serviceaccount"
+	"github.com/edgelesssys/constellation/v2/internal/retry"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 // ConstellationKMS is a key service to fetch volume keys.
+// All requests share a single connection to the keyservice.
 type ConstellationKMS struct {
 	endpoint string
-	kms      kmsClient
+	creds    credentials.TransportCredentials
+	// tokens authenticate calls with the driver's service account. They're only sent over aTLS.
+	tokens        credentials.PerRPCCredentials
+	retryInterval time.Duration
+	kms           kmsClient
+
+	mux  sync.Mutex
+	conn *grpc.ClientConn
 }
 
-// NewConstellationKMS initializes a ConstellationKMS.
+// NewConstellationKMS initializes a ConstellationKMS connecting to the keyservice's plain gRPC endpoint,
+// e.g., "key-service.kube-system:9000".
+// Keys are sent unencrypted over the pod network. Use NewAttestedConstellationKMS instead.
+// Calls aren't authenticated, so they're refused by keyservices that authorize callers.
 func NewConstellationKMS(endpoint string) *ConstellationKMS {
+	return newConstellationKMS(endpoint, insecure.NewCredentials(), nil)
+}
+
+// NewAttestedConstellationKMS initializes a ConstellationKMS connecting to the keyservice's aTLS endpoint,
+// e.g., "key-service.kube-system:9001".
+// The keyservice's attestation is verified with validator before any key is requested.
+// Calls are authenticated with the driver's projected service account token for the keyservice.
+func NewAttestedConstellationKMS(endpoint string, validator atls.Validator) *ConstellationKMS {
+	tokens := serviceaccount.NewSecureTokenCredentials(serviceaccount.KeyServiceTokenPath)
+	return newConstellationKMS(endpoint, atlscredentials.New(nil, []atls.Validator{validator}), tokens)
+}
+
+func newConstellationKMS(endpoint string, creds credentials.TransportCredentials, tokens credentials.PerRPCCredentials) *ConstellationKMS {
 	return &ConstellationKMS{
-		endpoint: endpoint, // default: "kms.kube-system:port"
-		kms:      &constellationKMSClient{},
+		endpoint:      endpoint,
+		creds:         creds,
+		tokens:        tokens,
+		retryInterval: time.Second,
+		kms:           &constellationKMSClient{},
+	}
+}
+
+// NewValidator creates a validator for the keyservice's attestation.
+// attestationConfig is the attestation config of the cluster,
+// as stored in the "attestationConfig" key of the join-config ConfigMap in the kube-system namespace.
+func NewValidator(attestationVariant string, attestationConfig []byte, log *slog.Logger) (atls.Validator, error) {
+	attVariant, err := variant.FromString(attestationVariant)
+	if err != nil {
+		return nil, fmt.Errorf("parsing attestation variant: %w", err)
+	}
+	cfg, err := config.UnmarshalAttestationConfig(attestationConfig, attVariant)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling attestation config: %w", err)
 	}
+	return choose.Validator(cfg, log)
 }
 
 // GetDEK request a data encryption key derived from the Constellation's master secret.
+// Requests are retried while the keyservice is unavailable, until ctx is done.
 func (k *ConstellationKMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
-	conn, err := grpc.NewClient(k.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := k.getConn()
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
 
-	res, err := k.kms.GetDataKey(
-		ctx,
-		&keyserviceproto.GetDataKeyRequest{
+	doer := &getDataKeyDoer{
+		kms:  k.kms,
+		conn: conn,
+		req: &keyserviceproto.GetDataKeyRequest{
 			DataKeyId: dekID,
 			Length:    uint32(dekSize),
 		},
-		conn,
-	)
-	if err != nil {
+	}
+	retrier := retry.NewIntervalRetrier(doer, k.retryInterval, grpcretry.ServiceIsUnavailable)
+	if err := retrier.Do(ctx); err != nil {
 		return nil, fmt.Errorf("fetching data encryption key from Constellation KMS: %w", err)
 	}
 
-	return res.DataKey, nil
+	return doer.res.DataKey, nil
+}
+
+// DestroyDEK destroys the data encryption key with the given ID, and all keys below it, e.g., all versions of a volume's key.
+// The keyservice refuses destroyed keys from then on. Destroyed keys can't be restored.
+// Requests are retried while the keyservice is unavailable, until ctx is done.
+func (k *ConstellationKMS) DestroyDEK(ctx context.Context, dekID string) error {
+	conn, err := k.getConn()
+	if err != nil {
+		return err
+	}
+
+	doer := &destroyDataKeyDoer{
+		kms:  k.kms,
+		conn: conn,
+		req:  &keyserviceproto.DestroyDataKeyRequest{DataKeyId: dekID},
+	}
+	retrier := retry.NewIntervalRetrier(doer, k.retryInterval, grpcretry.ServiceIsUnavailable)
+	if err := retrier.Do(ctx); err != nil {
+		return fmt.Errorf("destroying data encryption key in Constellation KMS: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the keyservice.
+func (k *ConstellationKMS) Close() error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.conn == nil {
+		return nil
+	}
+	err := k.conn.Close()
+	k.conn = nil
+	return err
+}
+
+// getConn returns the connection to the keyservice, creating it on first use.
+func (k *ConstellationKMS) getConn() (*grpc.ClientConn, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.conn != nil {
+		return k.conn, nil
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(k.creds)}
+	if k.tokens != nil {
+		// the keyservice authorizes callers by their service account
+		opts = append(opts, grpc.WithPerRPCCredentials(k.tokens))
+	}
+	conn, err := grpc.NewClient(k.endpoint, opts...)
+	if err != nil {
+		return nil, err
+	}
+	k.conn = conn
+	return conn, nil
+}
+
+type getDataKeyDoer struct {
+	kms  kmsClient
+	conn *grpc.ClientConn
+	req  *keyserviceproto.GetDataKeyRequest
+	res  *keyserviceproto.GetDataKeyResponse
+}
+
+func (d *getDataKeyDoer) Do(ctx context.Context) error {
+	res, err := d.kms.GetDataKey(ctx, d.req, d.conn)
+	if err != nil {
+		return err
+	}
+	d.res = res
+	return nil
+}
+
+type destroyDataKeyDoer struct {
+	kms  kmsClient
+	conn *grpc.ClientConn
+	req  *keyserviceproto.DestroyDataKeyRequest
+}
+
+func (d *destroyDataKeyDoer) Do(ctx context.Context) error {
+	_, err := d.kms.DestroyDataKey(ctx, d.req, d.conn)
+	return err
 }
 
 type kmsClient interface {
 	GetDataKey(context.Context, *keyserviceproto.GetDataKeyRequest, *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error)
+	DestroyDataKey(context.Context, *keyserviceproto.DestroyDataKeyRequest, *grpc.ClientConn) (*keyserviceproto.DestroyDataKeyResponse, error)
 }
 
 type constellationKMSClient struct{}
@@ -61,3 +198,7 @@ type constellationKMSClient struct{}
 func (c *constellationKMSClient) GetDataKey(ctx context.Context, req *keyserviceproto.GetDataKeyRequest, conn *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error) {
 	return keyserviceproto.NewAPIClient(conn).GetDataKey(ctx, req)
 }
+
+func (c *constellationKMSClient) DestroyDataKey(ctx context.Context, req *keyserviceproto.DestroyDataKeyRequest, conn *grpc.ClientConn) (*keyserviceproto.DestroyDataKeyResponse, error) {
+	return keyserviceproto.NewAPIClient(conn).DestroyDataKey(ctx, req)
+}
@@ -10,11 +10,17 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -23,26 +29,60 @@ func TestMain(m *testing.M) {
 }
 
 type stubKMSClient struct {
-	getDataKeyErr error
-	dataKey       []byte
+	getDataKeyErrs     []error
+	destroyDataKeyErrs []error
+	dataKey            []byte
+	destroyedKeyID     string
+	conns              []*grpc.ClientConn
 }
 
-func (c *stubKMSClient) GetDataKey(context.Context, *keyserviceproto.GetDataKeyRequest, *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error) {
-	return &keyserviceproto.GetDataKeyResponse{DataKey: c.dataKey}, c.getDataKeyErr
+func (c *stubKMSClient) GetDataKey(_ context.Context, _ *keyserviceproto.GetDataKeyRequest, conn *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error) {
+	c.conns = append(c.conns, conn)
+	if len(c.getDataKeyErrs) > 0 {
+		err := c.getDataKeyErrs[0]
+		c.getDataKeyErrs = c.getDataKeyErrs[1:]
+		return nil, err
+	}
+	return &keyserviceproto.GetDataKeyResponse{DataKey: c.dataKey}, nil
+}
+
+func (c *stubKMSClient) DestroyDataKey(_ context.Context, req *keyserviceproto.DestroyDataKeyRequest, conn *grpc.ClientConn) (*keyserviceproto.DestroyDataKeyResponse, error) {
+	c.conns = append(c.conns, conn)
+	if len(c.destroyDataKeyErrs) > 0 {
+		err := c.destroyDataKeyErrs[0]
+		c.destroyDataKeyErrs = c.destroyDataKeyErrs[1:]
+		return nil, err
+	}
+	c.destroyedKeyID = req.DataKeyId
+	return &keyserviceproto.DestroyDataKeyResponse{}, nil
 }
 
 func TestConstellationKMS(t *testing.T) {
 	testCases := map[string]struct {
-		kms     *stubKMSClient
-		wantErr bool
+		kms       *stubKMSClient
+		wantCalls int
+		wantErr   bool
 	}{
 		"GetDataKey success": {
-			kms:     &stubKMSClient{dataKey: []byte{0x1, 0x2, 0x3}},
-			wantErr: false,
+			kms:       &stubKMSClient{dataKey: []byte{0x1, 0x2, 0x3}},
+			wantCalls: 1,
 		},
 		"GetDataKey error": {
-			kms:     &stubKMSClient{getDataKeyErr: errors.New("error")},
-			wantErr: true,
+			kms:       &stubKMSClient{getDataKeyErrs: []error{errors.New("error")}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		"keyservice temporarily unavailable": {
+			kms: &stubKMSClient{
+				getDataKeyErrs: []error{status.Error(codes.Unavailable, "unavailable"), status.Error(codes.Unavailable, "unavailable")},
+				dataKey:        []byte{0x1, 0x2, 0x3},
+			},
+			wantCalls: 3,
+		},
+		"permission denied isn't retried": {
+			kms:       &stubKMSClient{getDataKeyErrs: []error{status.Error(codes.PermissionDenied, "denied")}},
+			wantCalls: 1,
+			wantErr:   true,
 		},
 	}
 
@@ -53,12 +93,13 @@ func TestConstellationKMS(t *testing.T) {
 			listener := bufconn.Listen(1)
 			defer listener.Close()
 
-			kms := &ConstellationKMS{
-				endpoint: listener.Addr().String(),
-				kms:      tc.kms,
-			}
+			kms := newConstellationKMS(listener.Addr().String(), insecure.NewCredentials(), nil)
+			kms.retryInterval = time.Millisecond
+			kms.kms = tc.kms
+			defer kms.Close()
 			res, err := kms.GetDEK(t.Context(), "data-key", 64)
 
+			assert.Len(tc.kms.conns, tc.wantCalls)
 			if tc.wantErr {
 				assert.Error(err)
 				assert.Nil(res)
@@ -69,3 +110,125 @@ func TestConstellationKMS(t *testing.T) {
 		})
 	}
 }
+
+func TestDestroyDEK(t *testing.T) {
+	testCases := map[string]struct {
+		kms       *stubKMSClient
+		wantCalls int
+		wantErr   bool
+	}{
+		"success": {
+			kms:       &stubKMSClient{},
+			wantCalls: 1,
+		},
+		"keyservice temporarily unavailable": {
+			kms:       &stubKMSClient{destroyDataKeyErrs: []error{status.Error(codes.Unavailable, "unavailable")}},
+			wantCalls: 2,
+		},
+		"destroying not configured": {
+			kms:       &stubKMSClient{destroyDataKeyErrs: []error{status.Error(codes.FailedPrecondition, "not configured")}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			listener := bufconn.Listen(1)
+			defer listener.Close()
+
+			kms := newConstellationKMS(listener.Addr().String(), insecure.NewCredentials(), nil)
+			kms.retryInterval = time.Millisecond
+			kms.kms = tc.kms
+			defer kms.Close()
+			err := kms.DestroyDEK(t.Context(), "namespace/team-a/volume-uuid")
+
+			assert.Len(tc.kms.conns, tc.wantCalls)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal("namespace/team-a/volume-uuid", tc.kms.destroyedKeyID)
+		})
+	}
+}
+
+func TestConstellationKMSReusesConnection(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	listener := bufconn.Listen(1)
+	defer listener.Close()
+
+	stub := &stubKMSClient{dataKey: []byte{0x1, 0x2, 0x3}}
+	kms := newConstellationKMS(listener.Addr().String(), insecure.NewCredentials(), nil)
+	kms.kms = stub
+
+	for range 3 {
+		_, err := kms.GetDEK(t.Context(), "data-key", 64)
+		require.NoError(err)
+	}
+	require.Len(stub.conns, 3)
+	assert.Same(stub.conns[0], stub.conns[1])
+	assert.Same(stub.conns[0], stub.conns[2])
+
+	// a new connection is created after closing
+	assert.NoError(kms.Close())
+	assert.NoError(kms.Close())
+	_, err := kms.GetDEK(t.Context(), "data-key", 64)
+	require.NoError(err)
+	assert.NotSame(stub.conns[0], stub.conns[3])
+	assert.NoError(kms.Close())
+}
+
+func TestConstellationKMSTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	// service account tokens are never sent over plain gRPC
+	assert.Nil(NewConstellationKMS("key-service:9000").tokens)
+
+	kms := NewAttestedConstellationKMS("key-service:9001", nil)
+	if assert.NotNil(kms.tokens) {
+		assert.True(kms.tokens.RequireTransportSecurity())
+	}
+}
+
+func TestNewValidator(t *testing.T) {
+	testCases := map[string]struct {
+		variant string
+		config  []byte
+		wantErr bool
+	}{
+		"valid config": {
+			variant: "qemu-vtpm",
+			config:  []byte(`{"measurements":{"4":{"expected":"0000000000000000000000000000000000000000000000000000000000000000","warnOnly":false}}}`),
+		},
+		"invalid variant": {
+			variant: "invalid",
+			config:  []byte(`{}`),
+			wantErr: true,
+		},
+		"invalid config": {
+			variant: "qemu-vtpm",
+			config:  []byte(`not json`),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			validator, err := NewValidator(tc.variant, tc.config, logger.NewTest(t))
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.NotNil(validator)
+		})
+	}
+}
@@ -216,11 +216,96 @@ func TestDeviceCloning(t *testing.T) {
 	require.NoError(err)
 	defer teardown(defaultBackingImage+"-copy", cpDevice)
 
+	// the copy is detected as clone and is given its own key
 	_, err = mapper.OpenCryptDevice(t.Context(), cpDevice, deviceName+"-copy", false)
 	assert.NoError(err)
 
 	assert.NoError(mapper.CloseCryptDevice(deviceName))
 	assert.NoError(mapper.CloseCryptDevice(deviceName + "-copy"))
+
+	// both volumes can be opened again with their own keys
+	_, err = mapper.OpenCryptDevice(t.Context(), devicePath, deviceName, false)
+	assert.NoError(err)
+	_, err = mapper.OpenCryptDevice(t.Context(), cpDevice, deviceName+"-copy", false)
+	assert.NoError(err)
+	assert.NoError(mapper.CloseCryptDevice(deviceName))
+	assert.NoError(mapper.CloseCryptDevice(deviceName + "-copy"))
+}
+
+func TestKeyScope(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	devicePath := setup(defaultBackingImage)
+	defer teardown(defaultBackingImage, devicePath)
+
+	mapper := cryptmapper.New(&dynamicKMS{})
+	scope := cryptmapper.NamespaceKeyScope("team-a")
+
+	_, err := mapper.OpenScopedCryptDevice(t.Context(), devicePath, deviceName, scope, false)
+	require.NoError(err)
+	require.NoError(mapper.CloseCryptDevice(deviceName))
+
+	_, err = mapper.OpenScopedCryptDevice(t.Context(), devicePath, deviceName, cryptmapper.NamespaceKeyScope("team-b"), false)
+	assert.ErrorIs(err, cryptmapper.ErrKeyScopeMismatch)
+	_, err = mapper.OpenCryptDevice(t.Context(), devicePath, deviceName, false)
+	assert.ErrorIs(err, cryptmapper.ErrKeyScopeMismatch)
+
+	_, err = mapper.OpenScopedCryptDevice(t.Context(), devicePath, deviceName, scope, false)
+	assert.NoError(err)
+	assert.NoError(mapper.CloseCryptDevice(deviceName))
+}
+
+func TestRekey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	devicePath := setup(defaultBackingImage)
+	defer teardown(defaultBackingImage, devicePath)
+
+	mapper := cryptmapper.New(&dynamicKMS{})
+
+	_, err := mapper.OpenCryptDevice(t.Context(), devicePath, deviceName, false)
+	require.NoError(err)
+
+	version, err := mapper.RekeyCryptDevice(t.Context(), deviceName, 1)
+	require.NoError(err)
+	assert.Equal(1, version)
+	require.NoError(mapper.CloseCryptDevice(deviceName))
+
+	_, err = mapper.OpenCryptDevice(t.Context(), devicePath, deviceName, false)
+	assert.NoError(err)
+	assert.NoError(mapper.CloseCryptDevice(deviceName))
+}
+
+func TestShred(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	devicePath := setup(defaultBackingImage)
+	defer teardown(defaultBackingImage, devicePath)
+
+	kms := &shreddingKMS{}
+	mapper := cryptmapper.New(kms)
+
+	_, err := mapper.OpenScopedCryptDevice(t.Context(), devicePath, deviceName, cryptmapper.NamespaceKeyScope("team-a"), false)
+	require.NoError(err)
+
+	// the volume is closed before it's shredded
+	require.NoError(mapper.ShredCryptDevice(t.Context(), devicePath, deviceName))
+	assert.Len(kms.destroyed, 1)
+	_, err = os.Stat("/dev/mapper/" + deviceName)
+	assert.True(os.IsNotExist(err))
+
+	// the LUKS2 header is wiped
+	header := make([]byte, 4096)
+	device, err := os.Open(devicePath)
+	require.NoError(err)
+	defer device.Close()
+	_, err = device.ReadAt(header, 0)
+	require.NoError(err)
+	assert.Equal(make([]byte, 4096), header)
+
+	// shredding a shredded volume is a no-op
+	assert.NoError(mapper.ShredCryptDevice(t.Context(), devicePath, deviceName))
+	assert.Len(kms.destroyed, 1)
 }
 
 func TestConcurrency(t *testing.T) {
@@ -277,3 +362,14 @@ func (k *dynamicKMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byt
 	}
 	return key, nil
 }
+
+// shreddingKMS is a dynamicKMS that can destroy keys.
+type shreddingKMS struct {
+	dynamicKMS
+	destroyed []string
+}
+
+func (k *shreddingKMS) DestroyDEK(_ context.Context, dekID string) error {
+	k.destroyed = append(k.destroyed, dekID)
+	return nil
+}
@@ -84,13 +84,24 @@ func (d *DiskEncryption) FormatDisk(passphrase string) error {
 }
 
 // MapDisk maps a crypt device to /dev/mapper/target using the provided passphrase.
+// The passphrase may be in any keyslot, since re-keying moves it out of keyslot 0.
 func (d *DiskEncryption) MapDisk(target, passphrase string) error {
-	if err := d.device.ActivateByPassphrase(target, 0, passphrase, cryptsetup.ReadWriteQueueBypass); err != nil {
+	if err := d.device.ActivateByPassphrase(target, cryptsetup.AnyKeyslot, passphrase, cryptsetup.ReadWriteQueueBypass); err != nil {
 		return fmt.Errorf("mapping disk as %q: %w", target, err)
 	}
 	return nil
 }
 
+// ChangePassphrase replaces currentPassphrase with newPassphrase.
+// The new passphrase is added to a free keyslot before the keyslot of the current passphrase is destroyed,
+// so that the disk can still be opened with one of them if the change is interrupted.
+func (d *DiskEncryption) ChangePassphrase(currentPassphrase, newPassphrase string) error {
+	if err := d.device.KeyslotChangeByPassphrase(cryptsetup.AnyKeyslot, cryptsetup.AnyKeyslot, currentPassphrase, newPassphrase); err != nil {
+		return fmt.Errorf("changing passphrase: %w", err)
+	}
+	return nil
+}
+
 // UnmapDisk removes the mapping of target.
 func (d *DiskEncryption) UnmapDisk(target string) error {
 	return d.device.Deactivate(target)
@@ -127,6 +138,7 @@ type cryptDevice interface {
 	Init(path string) (func(), error)
 	LoadLUKS2() error
 	KeyslotAddByVolumeKey(keyslot int, volumeKey string, passphrase string) error
+	KeyslotChangeByPassphrase(currentKeyslot int, newKeyslot int, currentPassphrase string, newPassphrase string) error
 	SetConstellationStateDiskToken(diskIsInitialized bool) error
 	ConstellationStateDiskTokenIsInitialized() bool
 	Wipe(name string, wipeBlockSize int, flags int, logCallback func(size, offset uint64), logFrequency time.Duration) error
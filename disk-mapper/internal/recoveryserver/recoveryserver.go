@@ -27,6 +27,8 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/grpc/atlscredentials"
 	"github.com/edgelesssys/constellation/v2/internal/grpc/grpclog"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -39,11 +41,12 @@ type kmsFactory func(ctx context.Context, storageURI string, kmsURI string) (kms
 type RecoveryServer struct {
 	mux sync.Mutex
 
-	diskUUID          string
-	stateDiskKey      []byte
-	measurementSecret []byte
-	grpcServer        server
-	factory           kmsFactory
+	diskUUID              string
+	stateDiskKey          []byte
+	previousStateDiskKeys [][]byte
+	measurementSecret     []byte
+	grpcServer            server
+	factory               kmsFactory
 
 	log *slog.Logger
 
@@ -71,7 +74,8 @@ func New(issuer atls.Issuer, factory kmsFactory, log *slog.Logger) *RecoveryServ
 // It blocks until a recover request call is successful.
 // The server will shut down when the call is successful and the keys are returned.
 // Additionally, the server can be shutdown by canceling the context.
-func (s *RecoveryServer) Serve(ctx context.Context, listener net.Listener, diskUUID string) (diskKey, measurementSecret []byte, err error) {
+// previousDiskKeys are keys of the state disk derived from previous versions of the master secret.
+func (s *RecoveryServer) Serve(ctx context.Context, listener net.Listener, diskUUID string) (diskKey, measurementSecret []byte, previousDiskKeys [][]byte, err error) {
 	s.log.Info("Starting RecoveryServer")
 	s.diskUUID = diskUUID
 	recoveryDone := make(chan struct{}, 1)
@@ -91,12 +95,12 @@ func (s *RecoveryServer) Serve(ctx context.Context, listener net.Listener, diskU
 		case <-ctx.Done():
 			s.log.Info("Context canceled, shutting down server")
 			s.grpcServer.GracefulStop()
-			return nil, nil, ctx.Err()
+			return nil, nil, nil, ctx.Err()
 		case <-recoveryDone:
 			if serveErr != nil {
-				return nil, nil, serveErr
+				return nil, nil, nil, serveErr
 			}
-			return s.stateDiskKey, s.measurementSecret, nil
+			return s.stateDiskKey, s.measurementSecret, s.previousStateDiskKeys, nil
 		}
 	}
 }
@@ -118,11 +122,29 @@ func (s *RecoveryServer) Recover(ctx context.Context, req *recoverproto.RecoverM
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "requesting measurementSecret: %s", err)
 	}
-	stateDiskKey, err := cloudKms.GetDEK(ctx, crypto.DEKPrefix+s.diskUUID, crypto.StateDiskKeyLength)
+
+	// Only the cluster KMS supports rotating the master secret.
+	// For any other KMS, all keys are derived from version 0.
+	var currentVersion uint32
+	var previousVersions []uint32
+	if masterSecret, err := uri.DecodeMasterSecretFromURI(req.KmsUri); err == nil {
+		currentVersion, previousVersions = cluster.MasterSecretVersions(masterSecret)
+	}
+
+	stateDiskKey, err := cloudKms.GetDEK(ctx, cluster.MasterSecretKeyID(crypto.DEKPrefix+s.diskUUID, currentVersion), crypto.StateDiskKeyLength)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "requesting stateDiskKey: %s", err)
 	}
+	var previousStateDiskKeys [][]byte
+	for _, version := range previousVersions {
+		previousKey, err := cloudKms.GetDEK(ctx, cluster.MasterSecretKeyID(crypto.DEKPrefix+s.diskUUID, version), crypto.StateDiskKeyLength)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "requesting previous stateDiskKey: %s", err)
+		}
+		previousStateDiskKeys = append(previousStateDiskKeys, previousKey)
+	}
 	s.stateDiskKey = stateDiskKey
+	s.previousStateDiskKeys = previousStateDiskKeys
 	s.measurementSecret = measurementSecret
 	log.Info("Received state disk key and measurement secret, shutting down server")
 
@@ -142,10 +164,10 @@ func NewStub(log *slog.Logger) *StubServer {
 }
 
 // Serve waits until the context is canceled and returns nil.
-func (s *StubServer) Serve(ctx context.Context, _ net.Listener, _ string) ([]byte, []byte, error) {
+func (s *StubServer) Serve(ctx context.Context, _ net.Listener, _ string) ([]byte, []byte, [][]byte, error) {
 	s.log.Info("Running as worker node, skipping recovery server")
 	<-ctx.Done()
-	return nil, nil, ctx.Err()
+	return nil, nil, nil, ctx.Err()
 }
 
 type server interface {
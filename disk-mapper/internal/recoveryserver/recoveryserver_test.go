@@ -19,6 +19,8 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/grpc/dialer"
 	"github.com/edgelesssys/constellation/v2/internal/grpc/testdialer"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -47,7 +49,7 @@ func TestServe(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_, _, err := server.Serve(ctx, listener, uuid)
+		_, _, _, err := server.Serve(ctx, listener, uuid)
 		assert.ErrorIs(err, context.Canceled)
 	}()
 	time.Sleep(100 * time.Millisecond)
@@ -62,7 +64,7 @@ func TestServe(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_, _, err := server.Serve(t.Context(), listener, uuid)
+		_, _, _, err := server.Serve(t.Context(), listener, uuid)
 		assert.NoError(err)
 	}()
 	time.Sleep(100 * time.Millisecond)
@@ -70,22 +72,39 @@ func TestServe(t *testing.T) {
 	wg.Wait()
 
 	// Serve method returns an error when serving is unsuccessful
-	_, _, err := server.Serve(t.Context(), listener, uuid)
+	_, _, _, err := server.Serve(t.Context(), listener, uuid)
 	assert.Error(err)
 }
 
 func TestRecover(t *testing.T) {
 	testCases := map[string]struct {
-		kmsURI     string
-		storageURI string
-		factory    kmsFactory
-		wantErr    bool
+		kmsURI           string
+		storageURI       string
+		factory          kmsFactory
+		wantDiskKey      []byte
+		wantPreviousKeys [][]byte
+		wantErr          bool
 	}{
 		"success": {
 			// base64 encoded: key=masterkey&salt=somesalt
-			kmsURI:     "kms://cluster-kms?key=bWFzdGVya2V5&salt=c29tZXNhbHQ=",
-			storageURI: "storage://no-store",
-			factory:    newStubKMS(nil, nil),
+			kmsURI:      "kms://cluster-kms?key=bWFzdGVya2V5&salt=c29tZXNhbHQ=",
+			storageURI:  "storage://no-store",
+			factory:     newStubKMS(nil, nil),
+			wantDiskKey: []byte("key-uuid"),
+		},
+		"rotated master secret": {
+			kmsURI: uri.MasterSecret{
+				Key:  []byte("masterkey"),
+				Salt: []byte("somesalt"),
+				Rotations: []uri.MasterSecretRotation{
+					{Version: 1, Key: []byte("masterkey-1"), Salt: []byte("somesalt-1")},
+					{Version: 2, Key: []byte("masterkey-2"), Salt: []byte("somesalt-2")},
+				},
+			}.EncodeToURI(),
+			storageURI:       "storage://no-store",
+			factory:          newStubKMS(nil, nil),
+			wantDiskKey:      []byte(cluster.MasterSecretKeyID("key-uuid", 2)),
+			wantPreviousKeys: [][]byte{[]byte("key-uuid"), []byte(cluster.MasterSecretKeyID("key-uuid", 1))},
 		},
 		"kms init fails": {
 			factory: newStubKMS(errors.New("setup failed"), nil),
@@ -111,6 +130,7 @@ func TestRecover(t *testing.T) {
 			listener := netDialer.GetListener("192.0.2.1:1234")
 
 			var diskKey, measurementSecret []byte
+			var previousDiskKeys [][]byte
 			var serveErr error
 			var wg sync.WaitGroup
 			defer wg.Wait()
@@ -120,7 +140,7 @@ func TestRecover(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				diskKey, measurementSecret, serveErr = server.Serve(serveCtx, listener, serverUUID)
+				diskKey, measurementSecret, previousDiskKeys, serveErr = server.Serve(serveCtx, listener, serverUUID)
 			}()
 
 			conn, err := dialer.New(nil, nil, netDialer).Dial("192.0.2.1:1234")
@@ -141,7 +161,8 @@ func TestRecover(t *testing.T) {
 			require.NoError(serveErr)
 			assert.NoError(err)
 			assert.NotNil(measurementSecret)
-			assert.NotNil(diskKey)
+			assert.Equal(tc.wantDiskKey, diskKey)
+			assert.Equal(tc.wantPreviousKeys, previousDiskKeys)
 		})
 	}
 }
@@ -160,9 +181,10 @@ type stubKMS struct {
 	getDEKErr error
 }
 
-func (s *stubKMS) GetDEK(_ context.Context, _ string, _ int) ([]byte, error) {
+// GetDEK returns the key ID as key, so tests can check which keys were requested.
+func (s *stubKMS) GetDEK(_ context.Context, dekID string, _ int) ([]byte, error) {
 	if s.getDEKErr != nil {
 		return nil, s.getDEKErr
 	}
-	return []byte("someDEK"), nil
+	return []byte(dekID), nil
 }
@@ -68,7 +68,8 @@ func New(dial grpcDialer, nodeInfo metadata.InstanceMetadata,
 // The client will continuously request available control-plane endpoints
 // from the metadata API and send rejoin requests to them.
 // The function returns after a successful rejoin request has been performed.
-func (c *RejoinClient) Start(ctx context.Context, diskUUID string) (diskKey, measurementSecret []byte) {
+// previousDiskKeys are keys of the state disk derived from previous versions of the master secret.
+func (c *RejoinClient) Start(ctx context.Context, diskUUID string) (diskKey, measurementSecret []byte, previousDiskKeys [][]byte) {
 	c.log.Info("Starting RejoinClient")
 	c.diskUUID = diskUUID
 	ticker := c.clock.NewTicker(c.interval)
@@ -82,40 +83,40 @@ func (c *RejoinClient) Start(ctx context.Context, diskUUID string) (diskKey, mea
 			c.log.With(slog.Any("error", err)).Error("Failed to get control-plane endpoints")
 		} else {
 			c.log.With(slog.Any("endpoints", endpoints)).Info("Received list with JoinService endpoints")
-			diskKey, measurementSecret, err = c.tryRejoinWithAvailableServices(ctx, endpoints)
+			diskKey, measurementSecret, previousDiskKeys, err = c.tryRejoinWithAvailableServices(ctx, endpoints)
 			if err == nil {
 				c.log.Info("Successfully retrieved rejoin ticket")
-				return diskKey, measurementSecret
+				return diskKey, measurementSecret, previousDiskKeys
 			}
 		}
 
 		select {
 		case <-ctx.Done():
-			return nil, nil
+			return nil, nil, nil
 		case <-ticker.C():
 		}
 	}
 }
 
 // tryRejoinWithAvailableServices tries sending rejoin requests to the available endpoints.
-func (c *RejoinClient) tryRejoinWithAvailableServices(ctx context.Context, endpoints []string) (diskKey, measurementSecret []byte, err error) {
+func (c *RejoinClient) tryRejoinWithAvailableServices(ctx context.Context, endpoints []string) (diskKey, measurementSecret []byte, previousDiskKeys [][]byte, err error) {
 	for _, endpoint := range endpoints {
 		c.log.With(slog.String("endpoint", endpoint)).Info("Requesting rejoin ticket")
 		rejoinTicket, err := c.requestRejoinTicket(endpoint)
 		if err == nil {
-			return rejoinTicket.StateDiskKey, rejoinTicket.MeasurementSecret, nil
+			return rejoinTicket.StateDiskKey, rejoinTicket.MeasurementSecret, rejoinTicket.PreviousStateDiskKeys, nil
 		}
 		c.log.With(slog.Any("error", err), slog.String("endpoint", endpoint)).Warn("Failed to rejoin on endpoint")
 
 		// stop requesting additional endpoints if the context is done
 		select {
 		case <-ctx.Done():
-			return nil, nil, ctx.Err()
+			return nil, nil, nil, ctx.Err()
 		default:
 		}
 	}
 	c.log.Error("Failed to rejoin on all endpoints")
-	return nil, nil, errors.New("failed to join on all endpoints")
+	return nil, nil, nil, errors.New("failed to join on all endpoints")
 }
 
 // requestRejoinTicket requests a rejoin ticket from the endpoint.
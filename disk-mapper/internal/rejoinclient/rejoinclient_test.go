@@ -255,14 +255,16 @@ func TestStart(t *testing.T) {
 
 			diskKey := []byte("disk-key")
 			measurementSecret := []byte("measurement-secret")
+			previousDiskKeys := [][]byte{[]byte("previous-disk-key")}
 			netDialer := testdialer.NewBufconnDialer()
 			dialer := dialer.New(nil, nil, netDialer)
 			serverCreds := atlscredentials.New(nil, nil)
 			rejoinServer := grpc.NewServer(grpc.Creds(serverCreds))
 			rejoinServiceAPI := &stubRejoinServiceAPI{
 				rejoinTicketResponse: &joinproto.IssueRejoinTicketResponse{
-					StateDiskKey:      diskKey,
-					MeasurementSecret: measurementSecret,
+					StateDiskKey:          diskKey,
+					MeasurementSecret:     measurementSecret,
+					PreviousStateDiskKeys: previousDiskKeys,
 				},
 			}
 			joinproto.RegisterAPIServer(rejoinServer, rejoinServiceAPI)
@@ -294,9 +296,10 @@ func TestStart(t *testing.T) {
 
 			client := New(dialer, tc.nodeInfo, meta, logger.NewTest(t))
 
-			passphrase, secret := client.Start(t.Context(), "uuid")
+			passphrase, secret, previousPassphrases := client.Start(t.Context(), "uuid")
 			assert.Equal(diskKey, passphrase)
 			assert.Equal(measurementSecret, secret)
+			assert.Equal(previousDiskKeys, previousPassphrases)
 		})
 	}
 }
@@ -27,6 +27,7 @@ type DeviceMapper interface {
 	FormatDisk(passphrase string) error
 	MapDisk(target string, passphrase string) error
 	UnmapDisk(target string) error
+	ChangePassphrase(currentPassphrase string, newPassphrase string) error
 }
 
 // ConfigurationGenerator is an interface for generating systemd-cryptsetup@.service unit files.
@@ -42,9 +43,10 @@ type MetadataAPI interface {
 }
 
 // RecoveryDoer is an interface to perform key recovery operations.
-// Calls to Do may be blocking, and if successful return a passphrase and measurementSecret.
+// Calls to Do may be blocking, and if successful return a passphrase and measurementSecret,
+// and the passphrases derived from previous versions of the master secret.
 type RecoveryDoer interface {
-	Do(uuid, endpoint string) (passphrase, measurementSecret []byte, err error)
+	Do(uuid, endpoint string) (passphrase, measurementSecret []byte, previousPassphrases [][]byte, err error)
 }
 
 // DiskMounter uses the syscall package to mount disks.
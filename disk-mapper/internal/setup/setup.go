@@ -84,12 +84,12 @@ func (s *Manager) PrepareExistingDisk(recoverer RecoveryDoer) error {
 	s.log.With(slog.String("uuid", uuid)).Info("Preparing existing state disk")
 	endpoint := net.JoinHostPort("0.0.0.0", strconv.Itoa(constants.RecoveryPort))
 
-	passphrase, measurementSecret, err := recoverer.Do(uuid, endpoint)
+	passphrase, measurementSecret, previousPassphrases, err := recoverer.Do(uuid, endpoint)
 	if err != nil {
 		return fmt.Errorf("failed to perform recovery: %w", err)
 	}
 
-	if err := s.mapper.MapDisk(stateDiskMappedName, string(passphrase)); err != nil {
+	if err := s.mapDisk(passphrase, previousPassphrases); err != nil {
 		return err
 	}
 
@@ -124,6 +124,26 @@ func (s *Manager) PrepareExistingDisk(recoverer RecoveryDoer) error {
 	return s.mounter.Unmount(stateDiskMountPath, 0)
 }
 
+// mapDisk maps the state disk using passphrase.
+// If the state disk is still encrypted with a passphrase derived from a previous version of the master secret,
+// the disk is re-keyed to passphrase before mapping it.
+func (s *Manager) mapDisk(passphrase []byte, previousPassphrases [][]byte) error {
+	mapErr := s.mapper.MapDisk(stateDiskMappedName, string(passphrase))
+	if mapErr == nil || len(previousPassphrases) == 0 {
+		return mapErr
+	}
+
+	s.log.With(slog.Any("error", mapErr)).Info("Failed to map state disk, trying passphrases of previous master secret versions")
+	for _, previousPassphrase := range previousPassphrases {
+		if err := s.mapper.ChangePassphrase(string(previousPassphrase), string(passphrase)); err != nil {
+			continue
+		}
+		s.log.Info("Re-keyed state disk to current master secret version")
+		return s.mapper.MapDisk(stateDiskMappedName, string(passphrase))
+	}
+	return mapErr
+}
+
 // PrepareNewDisk prepares an instances state disk by formatting the disk as a LUKS device using a random passphrase.
 func (s *Manager) PrepareNewDisk() error {
 	uuid, _ := s.mapper.DiskUUID()
@@ -220,12 +240,12 @@ func (s *Manager) LogDevices() error {
 
 // RecoveryServer interface serves a recovery server.
 type RecoveryServer interface {
-	Serve(context.Context, net.Listener, string) (key, secret []byte, err error)
+	Serve(context.Context, net.Listener, string) (key, secret []byte, previousKeys [][]byte, err error)
 }
 
 // RejoinClient interface starts a rejoin client.
 type RejoinClient interface {
-	Start(context.Context, string) (key, secret []byte)
+	Start(context.Context, string) (key, secret []byte, previousKeys [][]byte)
 }
 
 // NodeRecoverer bundles a RecoveryServer and RejoinClient.
@@ -245,13 +265,13 @@ func NewNodeRecoverer(recoveryServer RecoveryServer, rejoinClient RejoinClient)
 // Do performs a recovery procedure on the given state disk.
 // The method starts a gRPC server to allow manual recovery by a user.
 // At the same time it tries to request a decryption key from all available Constellation control-plane nodes.
-func (r *NodeRecoverer) Do(uuid, endpoint string) (passphrase, measurementSecret []byte, err error) {
+func (r *NodeRecoverer) Do(uuid, endpoint string) (passphrase, measurementSecret []byte, previousPassphrases [][]byte, err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	lis, err := net.Listen("tcp", endpoint)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	defer lis.Close()
 
@@ -261,11 +281,12 @@ func (r *NodeRecoverer) Do(uuid, endpoint string) (passphrase, measurementSecret
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		key, secret, serveErr := r.recoveryServer.Serve(ctx, lis, uuid)
+		key, secret, previousKeys, serveErr := r.recoveryServer.Serve(ctx, lis, uuid)
 		once.Do(func() {
 			cancel()
 			passphrase = key
 			measurementSecret = secret
+			previousPassphrases = previousKeys
 		})
 		if serveErr != nil && !errors.Is(serveErr, context.Canceled) {
 			err = serveErr
@@ -275,14 +296,15 @@ func (r *NodeRecoverer) Do(uuid, endpoint string) (passphrase, measurementSecret
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		key, secret := r.rejoinClient.Start(ctx, uuid)
+		key, secret, previousKeys := r.rejoinClient.Start(ctx, uuid)
 		once.Do(func() {
 			cancel()
 			passphrase = key
 			measurementSecret = secret
+			previousPassphrases = previousKeys
 		})
 	}()
 
 	wg.Wait()
-	return passphrase, measurementSecret, err
+	return passphrase, measurementSecret, previousPassphrases, err
 }
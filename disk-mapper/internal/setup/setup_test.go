@@ -39,13 +39,14 @@ func TestPrepareExistingDisk(t *testing.T) {
 	}
 
 	testCases := map[string]struct {
-		recoveryDoer    *stubRecoveryDoer
-		mapper          *stubMapper
-		mounter         *stubMounter
-		configGenerator *stubConfigurationGenerator
-		openDevice      vtpm.TPMOpenFunc
-		missingState    bool
-		wantErr         bool
+		recoveryDoer     *stubRecoveryDoer
+		mapper           *stubMapper
+		mounter          *stubMounter
+		configGenerator  *stubConfigurationGenerator
+		openDevice       vtpm.TPMOpenFunc
+		missingState     bool
+		wantChangeCalled bool
+		wantErr          bool
 	}{
 		"success": {
 			recoveryDoer:    testRecoveryDoer,
@@ -113,6 +114,38 @@ func TestPrepareExistingDisk(t *testing.T) {
 			openDevice:      failOpener,
 			wantErr:         true,
 		},
+		"disk re-keyed from previous master secret version": {
+			recoveryDoer: &stubRecoveryDoer{
+				passphrase:          []byte("passphrase"),
+				secret:              []byte("secret"),
+				previousPassphrases: [][]byte{[]byte("unknown"), []byte("previous")},
+			},
+			mapper: &stubMapper{
+				uuid:                 "test",
+				passphrase:           "previous",
+				changePassphraseErrs: map[string]error{"unknown": someErr},
+			},
+			mounter:          &stubMounter{},
+			configGenerator:  &stubConfigurationGenerator{},
+			openDevice:       vtpm.OpenNOPTPM,
+			wantChangeCalled: true,
+		},
+		"disk not encrypted with any known passphrase": {
+			recoveryDoer: &stubRecoveryDoer{
+				passphrase:          []byte("passphrase"),
+				secret:              []byte("secret"),
+				previousPassphrases: [][]byte{[]byte("previous")},
+			},
+			mapper: &stubMapper{
+				uuid:                 "test",
+				passphrase:           "unknown",
+				changePassphraseErrs: map[string]error{"previous": someErr},
+			},
+			mounter:         &stubMounter{},
+			configGenerator: &stubConfigurationGenerator{},
+			openDevice:      vtpm.OpenNOPTPM,
+			wantErr:         true,
+		},
 		"no state file": {
 			recoveryDoer:    testRecoveryDoer,
 			mapper:          &stubMapper{uuid: "test"},
@@ -155,6 +188,7 @@ func TestPrepareExistingDisk(t *testing.T) {
 				assert.True(tc.mounter.mountCalled)
 				assert.True(tc.mounter.unmountCalled)
 				assert.False(tc.mapper.formatDiskCalled)
+				assert.Equal(tc.wantChangeCalled, tc.mapper.changePassphraseCalled)
 			}
 		})
 	}
@@ -288,32 +322,37 @@ func TestRecoveryDoer(t *testing.T) {
 
 	rejoinClientKey := []byte("rejoinClientKey")
 	rejoinClientSecret := []byte("rejoinClientSecret")
+	rejoinClientPreviousKeys := [][]byte{[]byte("rejoinClientPreviousKey")}
 	recoveryServerKey := []byte("recoveryServerKey")
 	recoveryServerSecret := []byte("recoveryServerSecret")
+	recoveryServerPreviousKeys := [][]byte{[]byte("recoveryServerPreviousKey")}
 
 	recoveryServerErr := errors.New("error")
 	recoveryServer := &stubRecoveryServer{
-		key:      recoveryServerKey,
-		secret:   recoveryServerSecret,
-		sendKeys: make(chan struct{}, 1),
-		err:      recoveryServerErr,
+		key:          recoveryServerKey,
+		secret:       recoveryServerSecret,
+		previousKeys: recoveryServerPreviousKeys,
+		sendKeys:     make(chan struct{}, 1),
+		err:          recoveryServerErr,
 	}
 	rejoinClient := &stubRejoinClient{
-		key:      rejoinClientKey,
-		secret:   rejoinClientSecret,
-		sendKeys: make(chan struct{}, 1),
+		key:          rejoinClientKey,
+		secret:       rejoinClientSecret,
+		previousKeys: rejoinClientPreviousKeys,
+		sendKeys:     make(chan struct{}, 1),
 	}
 	recoverer := NewNodeRecoverer(recoveryServer, rejoinClient)
 
 	var wg sync.WaitGroup
 	var key, secret []byte
+	var previousKeys [][]byte
 	var err error
 
 	// error from recovery server
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		key, secret, err = recoverer.Do("", "")
+		key, secret, previousKeys, err = recoverer.Do("", "")
 	}()
 	recoveryServer.sendKeys <- struct{}{}
 	wg.Wait()
@@ -326,13 +365,14 @@ func TestRecoveryDoer(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		key, secret, err = recoverer.Do("", "")
+		key, secret, previousKeys, err = recoverer.Do("", "")
 	}()
 	recoveryServer.sendKeys <- struct{}{}
 	wg.Wait()
 	assert.NoError(err)
 	assert.Equal(recoveryServerKey, key)
 	assert.Equal(recoveryServerSecret, secret)
+	assert.Equal(recoveryServerPreviousKeys, previousKeys)
 
 	recoveryServer.sendKeys = make(chan struct{}, 1)
 
@@ -340,46 +380,49 @@ func TestRecoveryDoer(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		key, secret, err = recoverer.Do("", "")
+		key, secret, previousKeys, err = recoverer.Do("", "")
 	}()
 	rejoinClient.sendKeys <- struct{}{}
 	wg.Wait()
 	assert.NoError(err)
 	assert.Equal(rejoinClientKey, key)
 	assert.Equal(rejoinClientSecret, secret)
+	assert.Equal(rejoinClientPreviousKeys, previousKeys)
 }
 
 type stubRecoveryServer struct {
-	key      []byte
-	secret   []byte
-	sendKeys chan struct{}
-	err      error
+	key          []byte
+	secret       []byte
+	previousKeys [][]byte
+	sendKeys     chan struct{}
+	err          error
 }
 
-func (s *stubRecoveryServer) Serve(ctx context.Context, _ net.Listener, _ string) ([]byte, []byte, error) {
+func (s *stubRecoveryServer) Serve(ctx context.Context, _ net.Listener, _ string) ([]byte, []byte, [][]byte, error) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, nil, ctx.Err()
+			return nil, nil, nil, ctx.Err()
 		case <-s.sendKeys:
-			return s.key, s.secret, s.err
+			return s.key, s.secret, s.previousKeys, s.err
 		}
 	}
 }
 
 type stubRejoinClient struct {
-	key      []byte
-	secret   []byte
-	sendKeys chan struct{}
+	key          []byte
+	secret       []byte
+	previousKeys [][]byte
+	sendKeys     chan struct{}
 }
 
-func (s *stubRejoinClient) Start(ctx context.Context, _ string) ([]byte, []byte) {
+func (s *stubRejoinClient) Start(ctx context.Context, _ string) ([]byte, []byte, [][]byte) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, nil
+			return nil, nil, nil
 		case <-s.sendKeys:
-			return s.key, s.secret
+			return s.key, s.secret, s.previousKeys
 		}
 	}
 }
@@ -392,6 +435,10 @@ type stubMapper struct {
 	unmapDiskCalled  bool
 	unmapDiskErr     error
 	uuid             string
+	// passphrase is the passphrase of the disk. If set, mapping the disk with a different passphrase fails.
+	passphrase             string
+	changePassphraseCalled bool
+	changePassphraseErrs   map[string]error
 }
 
 func (s *stubMapper) DiskUUID() (string, error) {
@@ -403,11 +450,23 @@ func (s *stubMapper) FormatDisk(string) error {
 	return s.formatDiskErr
 }
 
-func (s *stubMapper) MapDisk(string, string) error {
+func (s *stubMapper) MapDisk(_ string, passphrase string) error {
 	s.mapDiskCalled = true
+	if s.passphrase != "" && s.passphrase != passphrase {
+		return errors.New("wrong passphrase")
+	}
 	return s.mapDiskErr
 }
 
+func (s *stubMapper) ChangePassphrase(currentPassphrase, newPassphrase string) error {
+	s.changePassphraseCalled = true
+	if err := s.changePassphraseErrs[currentPassphrase]; err != nil {
+		return err
+	}
+	s.passphrase = newPassphrase
+	return nil
+}
+
 func (s *stubMapper) UnmapDisk(string) error {
 	s.unmapDiskCalled = true
 	return s.unmapDiskErr
@@ -440,13 +499,14 @@ func (s *stubMounter) MkdirAll(_ string, _ fs.FileMode) error {
 }
 
 type stubRecoveryDoer struct {
-	passphrase  []byte
-	secret      []byte
-	recoveryErr error
+	passphrase          []byte
+	secret              []byte
+	previousPassphrases [][]byte
+	recoveryErr         error
 }
 
-func (s *stubRecoveryDoer) Do(_, _ string) (passphrase, measurementSecret []byte, err error) {
-	return s.passphrase, s.secret, s.recoveryErr
+func (s *stubRecoveryDoer) Do(_, _ string) (passphrase, measurementSecret []byte, previousPassphrases [][]byte, err error) {
+	return s.passphrase, s.secret, s.previousPassphrases, s.recoveryErr
 }
 
 type stubConfigurationGenerator struct {
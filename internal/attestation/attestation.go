@@ -31,6 +31,7 @@ package attestation
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
 )
@@ -43,6 +44,16 @@ const (
 	MeasurementSecretContext = "measurementSecret"
 )
 
+// Errors wrapped by validators, so callers can tell why an attestation document was rejected.
+var (
+	// ErrMeasurementMismatch is returned if the measurements of an attestation document don't match the expected measurements.
+	ErrMeasurementMismatch = errors.New("measurement validation failed")
+	// ErrTCBVersion is returned if a TCB version of an attestation report is below the configured minimum.
+	ErrTCBVersion = errors.New("TCB version too low")
+	// ErrSignature is returned if the signature or certificate chain of an attestation report can't be verified.
+	ErrSignature = errors.New("verifying signature")
+)
+
 // Logger is a logger used to print warnings and infos during attestation validation.
 type Logger interface {
 	Info(msg string, args ...any)
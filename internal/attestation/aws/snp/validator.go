@@ -99,7 +99,7 @@ func sha512sum(key crypto.PublicKey) ([64]byte, error) {
 
 // snpReportValidator validates a given SNP report.
 type snpReportValidator interface {
-	validate(attestation vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, ak [64]byte, config *config.AWSSEVSNP, log attestation.Logger) error
+	validate(attDoc vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, ak [64]byte, config *config.AWSSEVSNP, log attestation.Logger) error
 }
 
 // awsValidator implements the validation for AWS SNP attestation.
@@ -132,9 +132,9 @@ func (r *reportVerifierImpl) SnpAttestation(att *sevsnp.Attestation, opts *verif
 // validate the report by checking if it has a valid VLEK signature.
 // The certificate chain ARK -> ASK -> VLEK is also validated.
 // Checks that the report's userData matches the connection's userData.
-func (a *awsValidator) validate(attestation vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, akDigest [64]byte, config *config.AWSSEVSNP, log attestation.Logger) error {
+func (a *awsValidator) validate(attDoc vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, akDigest [64]byte, config *config.AWSSEVSNP, log attestation.Logger) error {
 	var info snp.InstanceInfo
-	if err := json.Unmarshal(attestation.InstanceInfo, &info); err != nil {
+	if err := json.Unmarshal(attDoc.InstanceInfo, &info); err != nil {
 		return newValidationError(fmt.Errorf("unmarshalling instance info: %w", err))
 	}
 
@@ -151,7 +151,7 @@ func (a *awsValidator) validate(attestation vtpm.AttestationDocument, ask *x509.
 	}
 
 	if err := a.verifier.SnpAttestation(att, verifyOpts); err != nil {
-		return newValidationError(fmt.Errorf("verifying SNP attestation: %w", err))
+		return newValidationError(fmt.Errorf("verifying SNP attestation: %w: %w", attestation.ErrSignature, err))
 	}
 
 	validateOpts := &validate.Options{
@@ -182,7 +182,7 @@ func (a *awsValidator) validate(attestation vtpm.AttestationDocument, ask *x509.
 	// Some constraints are implicitly checked by validate.SnpAttestation:
 	// - the report is not expired
 	if err := a.validator.SnpAttestation(att, validateOpts); err != nil {
-		return newValidationError(fmt.Errorf("validating SNP attestation: %w", err))
+		return newValidationError(fmt.Errorf("validating SNP attestation: %w", snp.MarkTCBError(err, att.Report, validateOpts.MinimumTCB, validateOpts.MinimumLaunchTCB)))
 	}
 
 	return nil
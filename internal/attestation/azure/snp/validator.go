@@ -122,13 +122,10 @@ func (v *Validator) getTrustedKey(ctx context.Context, attDoc vtpm.AttestationDo
 	}
 
 	if err := v.attestationVerifier.SNPAttestation(att, verifyOpts); err != nil {
-		return nil, fmt.Errorf("verifying SNP attestation: %w", err)
+		return nil, fmt.Errorf("verifying SNP attestation: %w: %w", attestation.ErrSignature, err)
 	}
 
-	// Checks if the attestation report matches the given constraints.
-	// Some constraints are implicitly checked by validate.SnpAttestation:
-	// - the report is not expired
-	if err := v.attestationValidator.SNPAttestation(att, &validate.Options{
+	validateOpts := &validate.Options{
 		GuestPolicy: abi.SnpPolicy{
 			Debug: false, // Debug means the VM can be decrypted by the host for debugging purposes and thus is not allowed.
 			SMT:   true,  // Allow Simultaneous Multi-Threading (SMT). Normally, we would want to disable SMT
@@ -158,8 +155,13 @@ func (v *Validator) getTrustedKey(ctx context.Context, attDoc vtpm.AttestationDo
 		// custom check of the MAA-specific values later. Right now, this is a double check, since a custom MAA check
 		// is performed either way.
 		RequireIDBlock: v.config.FirmwareSignerConfig.EnforcementPolicy == idkeydigest.Equal,
-	}); err != nil {
-		return nil, fmt.Errorf("validating SNP attestation: %w", err)
+	}
+
+	// Checks if the attestation report matches the given constraints.
+	// Some constraints are implicitly checked by validate.SnpAttestation:
+	// - the report is not expired
+	if err := v.attestationValidator.SNPAttestation(att, validateOpts); err != nil {
+		return nil, fmt.Errorf("validating SNP attestation: %w", snp.MarkTCBError(err, att.Report, validateOpts.MinimumTCB, validateOpts.MinimumLaunchTCB))
 	}
 	// Custom check of the IDKeyDigests, taking care of the WarnOnly / MAAFallback cases,
 	// but also double-checking the IDKeyDigests if the enforcement policy is set to Equal.
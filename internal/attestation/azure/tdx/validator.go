@@ -98,7 +98,7 @@ func (v *Validator) validateQuote(tdxQuote *tdx.QuoteV4) error {
 		TrustedRoots:     roots,
 		Getter:           v.getter,
 	}); err != nil {
-		return err
+		return fmt.Errorf("%w: %w", attestation.ErrSignature, err)
 	}
 
 	if err := validate.TdxQuote(tdxQuote, &validate.Options{
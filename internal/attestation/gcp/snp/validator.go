@@ -88,7 +88,7 @@ func (v *Validator) getTrustedKey(ctx context.Context, attDoc vtpm.AttestationDo
 
 // snpReportValidator validates a given SNP report.
 type snpReportValidator interface {
-	validate(attestation vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, ak [64]byte, config *config.GCPSEVSNP, log attestation.Logger) error
+	validate(attDoc vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, ak [64]byte, config *config.GCPSEVSNP, log attestation.Logger) error
 }
 
 // gcpValidator implements the validation for GCP SEV-SNP attestation.
@@ -121,9 +121,9 @@ func (r *reportVerifierImpl) SnpAttestation(att *sevsnp.Attestation, opts *verif
 // validate the report by checking if it has a valid VCEK signature.
 // The certificate chain ARK -> ASK -> VCEK is also validated.
 // Checks that the report's userData matches the connection's userData.
-func (a *gcpValidator) validate(attestation vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, reportData [64]byte, config *config.GCPSEVSNP, log attestation.Logger) error {
+func (a *gcpValidator) validate(attDoc vtpm.AttestationDocument, ask *x509.Certificate, ark *x509.Certificate, reportData [64]byte, config *config.GCPSEVSNP, log attestation.Logger) error {
 	var info snp.InstanceInfo
-	if err := json.Unmarshal(attestation.InstanceInfo, &info); err != nil {
+	if err := json.Unmarshal(attDoc.InstanceInfo, &info); err != nil {
 		return fmt.Errorf("unmarshalling instance info: %w", err)
 	}
 
@@ -140,7 +140,7 @@ func (a *gcpValidator) validate(attestation vtpm.AttestationDocument, ask *x509.
 	}
 
 	if err := a.verifier.SnpAttestation(att, verifyOpts); err != nil {
-		return fmt.Errorf("verifying SNP attestation: %w", err)
+		return fmt.Errorf("verifying SNP attestation: %w: %w", attestation.ErrSignature, err)
 	}
 
 	validateOpts := &validate.Options{
@@ -171,7 +171,7 @@ func (a *gcpValidator) validate(attestation vtpm.AttestationDocument, ask *x509.
 	// Some constraints are implicitly checked by validate.SnpAttestation:
 	// - the report is not expired
 	if err := a.validator.SnpAttestation(att, validateOpts); err != nil {
-		return fmt.Errorf("validating SNP attestation: %w", err)
+		return fmt.Errorf("validating SNP attestation: %w", snp.MarkTCBError(err, att.Report, validateOpts.MinimumTCB, validateOpts.MinimumLaunchTCB))
 	}
 
 	return nil
@@ -281,3 +281,25 @@ func (a *InstanceInfo) ParseReportSigner() (*x509.Certificate, error) {
 
 	return reportSigner, nil
 }
+
+// MarkTCBError wraps err, returned by validate.SnpAttestation, with [attestation.ErrTCBVersion]
+// if the CURRENT_TCB or REPORTED_TCB of the report is below minimumTCB, or its LAUNCH_TCB is below minimumLaunchTCB.
+// validate.SnpAttestation checks the TCB versions, but its errors can't be told apart from other validation failures.
+func MarkTCBError(err error, report *spb.Report, minimumTCB, minimumLaunchTCB kds.TCBParts) error {
+	tcbs := []struct {
+		version uint64
+		minimum kds.TCBParts
+	}{
+		{version: report.GetCurrentTcb(), minimum: minimumTCB},
+		{version: report.GetReportedTcb(), minimum: minimumTCB},
+		{version: report.GetLaunchTcb(), minimum: minimumLaunchTCB},
+	}
+	for _, tcb := range tcbs {
+		parts := kds.DecomposeTCBVersion(kds.TCBVersion(tcb.version))
+		if parts.BlSpl < tcb.minimum.BlSpl || parts.TeeSpl < tcb.minimum.TeeSpl ||
+			parts.SnpSpl < tcb.minimum.SnpSpl || parts.UcodeSpl < tcb.minimum.UcodeSpl {
+			return fmt.Errorf("%w: %w", attestation.ErrTCBVersion, err)
+		}
+	}
+	return err
+}
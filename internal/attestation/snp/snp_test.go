@@ -15,10 +15,12 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/edgelesssys/constellation/v2/internal/attestation"
 	"github.com/edgelesssys/constellation/v2/internal/attestation/snp/testdata"
 	"github.com/edgelesssys/constellation/v2/internal/config"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/google/go-sev-guest/kds"
+	spb "github.com/google/go-sev-guest/proto/sevsnp"
 	"github.com/google/go-sev-guest/verify/trust"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -346,3 +348,48 @@ func (m *urlResponseMatcher) match(url string) ([]byte, error) {
 		return nil, fmt.Errorf("unexpected URL: %s", url)
 	}
 }
+
+func TestMarkTCBError(t *testing.T) {
+	validateErr := errors.New("validation failed")
+	tcb := func(parts kds.TCBParts) uint64 {
+		version, err := kds.ComposeTCBParts(parts)
+		require.NoError(t, err)
+		return uint64(version)
+	}
+	current := kds.TCBParts{BlSpl: 3, TeeSpl: 0, SnpSpl: 8, UcodeSpl: 115}
+	old := kds.TCBParts{BlSpl: 3, TeeSpl: 0, SnpSpl: 8, UcodeSpl: 100}
+
+	testCases := map[string]struct {
+		report           *spb.Report
+		minimumTCB       kds.TCBParts
+		minimumLaunchTCB kds.TCBParts
+		wantTCBErr       bool
+	}{
+		"TCB versions at minimum": {
+			report:           &spb.Report{CurrentTcb: tcb(current), ReportedTcb: tcb(current), LaunchTcb: tcb(current)},
+			minimumTCB:       current,
+			minimumLaunchTCB: current,
+		},
+		"reported TCB too low": {
+			report:     &spb.Report{CurrentTcb: tcb(current), ReportedTcb: tcb(old), LaunchTcb: tcb(current)},
+			minimumTCB: current,
+			wantTCBErr: true,
+		},
+		"launch TCB too low": {
+			report:           &spb.Report{CurrentTcb: tcb(current), ReportedTcb: tcb(current), LaunchTcb: tcb(old)},
+			minimumTCB:       old,
+			minimumLaunchTCB: current,
+			wantTCBErr:       true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := MarkTCBError(validateErr, tc.report, tc.minimumTCB, tc.minimumLaunchTCB)
+			assert.ErrorIs(err, validateErr)
+			assert.Equal(tc.wantTCBErr, errors.Is(err, attestation.ErrTCBVersion))
+		})
+	}
+}
@@ -64,7 +64,7 @@ func (v *Validator) Validate(ctx context.Context, attDocRaw []byte, nonce []byte
 	// Verify the quote.
 	quote, err := v.tdx.Verify(ctx, attDoc.RawQuote)
 	if err != nil {
-		return nil, fmt.Errorf("verifying TDX quote: %w", err)
+		return nil, fmt.Errorf("verifying TDX quote: %w: %w", attestation.ErrSignature, err)
 	}
 
 	// Report data
@@ -86,7 +86,7 @@ func (v *Validator) Validate(ctx context.Context, attDocRaw []byte, nonce []byte
 		v.log.Warn(warning)
 	}
 	if len(errs) > 0 {
-		return nil, fmt.Errorf("measurement validation failed:\n%w", errors.Join(errs...))
+		return nil, fmt.Errorf("%w:\n%w", attestation.ErrMeasurementMismatch, errors.Join(errs...))
 	}
 
 	return attDoc.UserData, nil
@@ -225,7 +225,7 @@ func (v *Validator) Validate(ctx context.Context, attDocRaw []byte, nonce []byte
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("verifying attestation document: %w", err)
+		return nil, fmt.Errorf("verifying attestation document: %w: %w", attestation.ErrSignature, err)
 	}
 
 	// Validate confidential computing capabilities of the VM
@@ -243,7 +243,7 @@ func (v *Validator) Validate(ctx context.Context, attDocRaw []byte, nonce []byte
 		v.log.Warn(warning)
 	}
 	if len(errs) > 0 {
-		return nil, fmt.Errorf("measurement validation failed:\n%w", errors.Join(errs...))
+		return nil, fmt.Errorf("%w:\n%w", attestation.ErrMeasurementMismatch, errors.Join(errs...))
 	}
 
 	v.log.Info("Successfully validated attestation document")
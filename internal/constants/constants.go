@@ -32,6 +32,10 @@ const (
 	ConstellationMasterSecretKey = "mastersecret"
 	// ConstellationSaltKey is the name of the key for the salt in the master secret kubernetes secret.
 	ConstellationSaltKey = "salt"
+	// ConstellationMasterSecretRotationsStoreName is the name of the Kubernetes secret holding rotated versions of the master secret.
+	ConstellationMasterSecretRotationsStoreName = "constellation-mastersecret-rotations"
+	// ConstellationMasterSecretRotationsKey is the name of the key for the master secret rotations in the rotations kubernetes secret.
+	ConstellationMasterSecretRotationsKey = "rotations"
 	// ConstellationVerifyServiceUserData is the user data that the verification service includes in the attestation.
 	ConstellationVerifyServiceUserData = "VerifyService"
 	// AttestationVariant is the name of the environment variable that contains the attestation variant.
@@ -44,6 +48,12 @@ const (
 	CLIDebugLogFile = "constellation-debug.log"
 	// SSHCAKeySuffix is the suffix used together with the DEKPrefix to derive an SSH CA key for emergency ssh access.
 	SSHCAKeySuffix = "ca_emergency_ssh"
+	// CSINamespaceKeyScopePrefix is the key ID prefix of CSI volumes with a key scope per namespace.
+	CSINamespaceKeyScopePrefix = "namespace/"
+	// CSIStorageClassKeyScopePrefix is the key ID prefix of CSI volumes with a key scope per StorageClass.
+	CSIStorageClassKeyScopePrefix = "storageclass/"
+	// CSIKeyReferenceScopePrefix is the key ID prefix of CSI volumes with a key scope referenced by a StorageClass parameter.
+	CSIKeyReferenceScopePrefix = "key/"
 	// SSHCAKeyPath is the path to the emergency SSH CA key on the node.
 	SSHCAKeyPath = "/var/run/state/ssh/ssh_ca.pub"
 	// SSHHostKeyPath is the path to the SSH host key of the node.
@@ -59,6 +69,8 @@ const (
 	JoinServicePort = 9090
 	// JoinServiceNodePort is the port for reaching the join service outside of Kubernetes.
 	JoinServiceNodePort = 30090
+	// JoinServiceMetricsPort is the port the join service serves Prometheus metrics on.
+	JoinServiceMetricsPort = 9091
 	// VerifyServicePortHTTP HTTP port for verification service.
 	VerifyServicePortHTTP = 8080
 	// VerifyServicePortGRPC GRPC port for verification service.
@@ -69,6 +81,8 @@ const (
 	VerifyServiceNodePortGRPC = 30081
 	// KeyServicePort is the port the KMS server listens on.
 	KeyServicePort = 9000
+	// KeyServiceATLSPort is the port the KMS server serves aTLS on.
+	KeyServiceATLSPort = 9001
 	// BootstrapperPort port of bootstrapper.
 	BootstrapperPort = 9000
 	// KubernetesPort port for Kubernetes API.
@@ -131,6 +145,10 @@ const (
 	MeasurementSaltFilename = "measurementSalt"
 	// MeasurementSecretFilename is the filename of the secret used in creation of the clusterID.
 	MeasurementSecretFilename = "measurementSecret"
+	// MasterSecretVersionsFilename is the filename of the versions of the master secret used for state disk keys.
+	MasterSecretVersionsFilename = "masterSecretVersions"
+	// JoinPolicyFilename is the filename of the policy restricting which nodes may join the cluster.
+	JoinPolicyFilename = "joinPolicy"
 
 	// K8sVersionFieldName is the name of the of the key holding the wanted Kubernetes version.
 	K8sVersionFieldName = "cluster-version"
@@ -228,6 +246,8 @@ const (
 	ConstellationNamespace = "kube-system"
 	// JoinConfigMap k8s config map with node join config.
 	JoinConfigMap = "join-config"
+	// KeyServiceDaemonSet k8s daemon set running Constellation's KeyService.
+	KeyServiceDaemonSet = "key-service"
 	// InternalConfigMap k8s config map with internal Constellation config.
 	InternalConfigMap = "internal-config"
 	// KubeadmConfigMap k8s config map with kubeadm config
@@ -329,10 +329,14 @@ func (i *chartLoader) loadConstellationServicesValues() map[string]any {
 			"internalCMName":      constants.InternalConfigMap,
 		},
 		"key-service": map[string]any{
-			"image":               i.keyServiceImage,
-			"saltKeyName":         constants.ConstellationSaltKey,
-			"masterSecretKeyName": constants.ConstellationMasterSecretKey,
-			"masterSecretName":    constants.ConstellationMasterSecretStoreName,
+			"image":                        i.keyServiceImage,
+			"saltKeyName":                  constants.ConstellationSaltKey,
+			"masterSecretKeyName":          constants.ConstellationMasterSecretKey,
+			"masterSecretName":             constants.ConstellationMasterSecretStoreName,
+			"masterSecretRotationsName":    constants.ConstellationMasterSecretRotationsStoreName,
+			"masterSecretRotationsKeyName": constants.ConstellationMasterSecretRotationsKey,
+			"atlsPort":                     constants.KeyServiceATLSPort,
+			"attestationVariant":           i.attestationVariant.String(),
 		},
 		"join-service": map[string]any{
 			"csp":   i.csp.String(),
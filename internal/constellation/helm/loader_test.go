@@ -29,6 +29,7 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/cloud/gcpshared"
 	"github.com/edgelesssys/constellation/v2/internal/cloud/openstack"
 	"github.com/edgelesssys/constellation/v2/internal/config"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/constellation/state"
 	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/edgelesssys/constellation/v2/internal/semver"
@@ -191,6 +192,7 @@ func TestConstellationServices(t *testing.T) {
 
 			chartLoader := chartLoader{
 				csp:                      tc.config.GetProvider(),
+				attestationVariant:       tc.config.GetAttestationConfig().GetVariant(),
 				joinServiceImage:         "joinServiceImage",
 				keyServiceImage:          "keyServiceImage",
 				ccmImage:                 tc.ccmImage,
@@ -260,6 +262,25 @@ func TestConstellationServices(t *testing.T) {
 	}
 }
 
+func TestConstellationServicesUpgradeValues(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// extraConstellationServicesValues are only applied on init,
+	// so the values the key service needs to keep serving aTLS after an upgrade must be set by the loader.
+	chartLoader := chartLoader{
+		csp:                cloudprovider.QEMU,
+		attestationVariant: variant.QEMUVTPM{},
+		keyServiceImage:    "keyServiceImage",
+	}
+	values := chartLoader.loadConstellationServicesValues()
+
+	keyServiceValues, ok := values["key-service"].(map[string]any)
+	require.True(ok)
+	assert.Equal(variant.QEMUVTPM{}.String(), keyServiceValues["attestationVariant"])
+	assert.Equal(constants.KeyServiceATLSPort, keyServiceValues["atlsPort"])
+}
+
 func TestExtraCoreDNSValues(t *testing.T) {
 	testCases := map[string]struct {
 		cidr      string
@@ -534,6 +534,7 @@ type kubectlInterface interface {
 	GetCR(ctx context.Context, gvr schema.GroupVersionResource, name string) (*unstructured.Unstructured, error)
 	UpdateCR(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
 	crdLister
+	masterSecretClient
 }
 
 type debugLog interface {
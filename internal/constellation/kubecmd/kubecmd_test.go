@@ -767,6 +767,7 @@ type unstructuredInterface interface {
 
 type stubKubectl struct {
 	unstructuredInterface
+	masterSecretClient
 	configMaps        map[string]*corev1.ConfigMap
 	updatedConfigMaps map[string]*corev1.ConfigMap
 	k8sVersion        string
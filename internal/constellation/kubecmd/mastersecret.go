@@ -0,0 +1,162 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package kubecmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// masterSecretClient manages the Kubernetes resources used to rotate the master secret.
+type masterSecretClient interface {
+	GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+	CreateSecret(ctx context.Context, secret *corev1.Secret) error
+	UpdateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error)
+	GetDaemonSet(ctx context.Context, namespace, name string) (*appsv1.DaemonSet, error)
+	RestartDaemonSet(ctx context.Context, namespace, name string) error
+}
+
+// GetMasterSecretVersions returns the versions of the master secret the cluster uses for state disk keys.
+// If the master secret was never rotated, all keys are derived from version 0.
+func (k *KubeCmd) GetMasterSecretVersions(ctx context.Context) (cluster.KeyVersions, error) {
+	joinConfig, err := k.retryGetJoinConfig(ctx)
+	if err != nil {
+		return cluster.KeyVersions{}, fmt.Errorf("retrieving %s ConfigMap: %w", constants.JoinConfigMap, err)
+	}
+
+	var versions cluster.KeyVersions
+	rawVersions, ok := joinConfig.Data[constants.MasterSecretVersionsFilename]
+	if !ok {
+		return versions, nil
+	}
+	if err := json.Unmarshal([]byte(rawVersions), &versions); err != nil {
+		return cluster.KeyVersions{}, fmt.Errorf("unmarshaling master secret versions: %w", err)
+	}
+	return versions, nil
+}
+
+// ApplyMasterSecretVersions updates the versions of the master secret the JoinService uses for state disk keys.
+func (k *KubeCmd) ApplyMasterSecretVersions(ctx context.Context, versions cluster.KeyVersions) error {
+	rawVersions, err := json.Marshal(versions)
+	if err != nil {
+		return fmt.Errorf("marshaling master secret versions: %w", err)
+	}
+
+	joinConfig, err := k.retryGetJoinConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving %s ConfigMap: %w", constants.JoinConfigMap, err)
+	}
+	if joinConfig.Data == nil {
+		joinConfig.Data = map[string]string{}
+	}
+	joinConfig.Data[constants.MasterSecretVersionsFilename] = string(rawVersions)
+
+	k.log.Debug("Updating master secret versions", "current", versions.Current, "previous", versions.Previous)
+	if err := k.retryAction(ctx, func(ctx context.Context) error {
+		_, err := k.kubectl.UpdateConfigMap(ctx, joinConfig)
+		return err
+	}); err != nil {
+		return fmt.Errorf("setting master secret versions: %w", err)
+	}
+	return nil
+}
+
+// ApplyMasterSecretRotations stores the rotated versions of the master secret in the cluster
+// and restarts the KeyService, so it can derive keys from them.
+// The function returns once all KeyService pods use the new versions.
+func (k *KubeCmd) ApplyMasterSecretRotations(ctx context.Context, rotations []uri.MasterSecretRotation) error {
+	rawRotations, err := json.Marshal(rotations)
+	if err != nil {
+		return fmt.Errorf("marshaling master secret rotations: %w", err)
+	}
+
+	if err := k.retryAction(ctx, func(ctx context.Context) error {
+		secret, err := k.kubectl.GetSecret(ctx, constants.ConstellationNamespace, constants.ConstellationMasterSecretRotationsStoreName)
+		if k8serrors.IsNotFound(err) {
+			k.log.Debug("Secret does not exist, creating it now", "name", constants.ConstellationMasterSecretRotationsStoreName)
+			return k.kubectl.CreateSecret(ctx, masterSecretRotationsSecret(rawRotations))
+		}
+		if err != nil {
+			return err
+		}
+		secret.Data = map[string][]byte{constants.ConstellationMasterSecretRotationsKey: rawRotations}
+		_, err = k.kubectl.UpdateSecret(ctx, secret)
+		return err
+	}); err != nil {
+		return fmt.Errorf("storing master secret rotations: %w", err)
+	}
+
+	k.log.Debug("Restarting KeyService to load master secret rotations")
+	if err := k.retryAction(ctx, func(ctx context.Context) error {
+		return k.kubectl.RestartDaemonSet(ctx, constants.ConstellationNamespace, constants.KeyServiceDaemonSet)
+	}); err != nil {
+		return fmt.Errorf("restarting KeyService: %w", err)
+	}
+
+	if err := k.retryAction(ctx, func(ctx context.Context) error {
+		daemonSet, err := k.kubectl.GetDaemonSet(ctx, constants.ConstellationNamespace, constants.KeyServiceDaemonSet)
+		if err != nil {
+			return err
+		}
+		if !daemonSetRolledOut(daemonSet) {
+			return errors.New("KeyService restart is still in progress")
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("waiting for KeyService restart: %w", err)
+	}
+	return nil
+}
+
+// NodeBootIDs returns a map from node name to the boot ID of the node.
+func (k *KubeCmd) NodeBootIDs(ctx context.Context) (map[string]string, error) {
+	var nodes []corev1.Node
+	if err := k.retryAction(ctx, func(ctx context.Context) error {
+		var err error
+		nodes, err = k.kubectl.GetNodes(ctx)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("getting nodes: %w", err)
+	}
+
+	bootIDs := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		bootIDs[node.Name] = node.Status.NodeInfo.BootID
+	}
+	return bootIDs, nil
+}
+
+// daemonSetRolledOut checks if all pods of the DaemonSet run the latest version of its template.
+func daemonSetRolledOut(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration >= daemonSet.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled
+}
+
+func masterSecretRotationsSecret(rawRotations []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      constants.ConstellationMasterSecretRotationsStoreName,
+			Namespace: constants.ConstellationNamespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			constants.ConstellationMasterSecretRotationsKey: rawRotations,
+		},
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package kubecmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestGetMasterSecretVersions(t *testing.T) {
+	testCases := map[string]struct {
+		data         map[string]string
+		wantVersions cluster.KeyVersions
+		wantErr      bool
+	}{
+		"never rotated": {
+			data: map[string]string{constants.AttestationConfigFilename: "{}"},
+		},
+		"rotation pending": {
+			data: map[string]string{
+				constants.MasterSecretVersionsFilename: `{"current":2,"previous":[0,1],"bootIDs":{"node":"boot-id"}}`,
+			},
+			wantVersions: cluster.KeyVersions{Current: 2, Previous: []uint32{0, 1}, BootIDs: map[string]string{"node": "boot-id"}},
+		},
+		"invalid versions": {
+			data:    map[string]string{constants.MasterSecretVersionsFilename: "invalid"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			kubectl := &stubMasterSecretKubectl{
+				configMaps: map[string]*corev1.ConfigMap{
+					constants.JoinConfigMap: {ObjectMeta: metav1.ObjectMeta{Name: constants.JoinConfigMap}, Data: tc.data},
+				},
+			}
+			cmd := &KubeCmd{kubectl: kubectl, log: logger.NewTest(t), retryInterval: time.Millisecond, maxAttempts: 5}
+
+			versions, err := cmd.GetMasterSecretVersions(t.Context())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersions, versions)
+		})
+	}
+}
+
+func TestApplyMasterSecretVersions(t *testing.T) {
+	require := require.New(t)
+
+	kubectl := &stubMasterSecretKubectl{
+		configMaps: map[string]*corev1.ConfigMap{
+			constants.JoinConfigMap: {
+				ObjectMeta: metav1.ObjectMeta{Name: constants.JoinConfigMap},
+				Data:       map[string]string{constants.AttestationConfigFilename: "{}"},
+			},
+		},
+	}
+	cmd := &KubeCmd{kubectl: kubectl, log: logger.NewTest(t), retryInterval: time.Millisecond, maxAttempts: 5}
+
+	versions := cluster.KeyVersions{Current: 1, Previous: []uint32{0}, BootIDs: map[string]string{"node": "boot-id"}}
+	require.NoError(cmd.ApplyMasterSecretVersions(t.Context(), versions))
+
+	got, err := cmd.GetMasterSecretVersions(t.Context())
+	require.NoError(err)
+	assert.Equal(t, versions, got)
+	assert.Equal(t, "{}", kubectl.configMaps[constants.JoinConfigMap].Data[constants.AttestationConfigFilename])
+}
+
+func TestApplyMasterSecretRotations(t *testing.T) {
+	rotations := []uri.MasterSecretRotation{{Version: 1, Key: []byte("key"), Salt: []byte("salt")}}
+	rolledOut := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Status: appsv1.DaemonSetStatus{
+			ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3,
+		},
+	}
+	rollingOut := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Status: appsv1.DaemonSetStatus{
+			ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 1, NumberAvailable: 3,
+		},
+	}
+
+	testCases := map[string]struct {
+		secret      *corev1.Secret
+		daemonSets  []*appsv1.DaemonSet
+		restartErr  error
+		wantCreated bool
+		wantErr     bool
+	}{
+		"create secret": {
+			daemonSets:  []*appsv1.DaemonSet{rolledOut},
+			wantCreated: true,
+		},
+		"update secret": {
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: constants.ConstellationMasterSecretRotationsStoreName, Namespace: constants.ConstellationNamespace},
+				Data:       map[string][]byte{constants.ConstellationMasterSecretRotationsKey: []byte("[]")},
+			},
+			daemonSets: []*appsv1.DaemonSet{rolledOut},
+		},
+		"wait for rollout": {
+			daemonSets:  []*appsv1.DaemonSet{rollingOut, rollingOut, rolledOut},
+			wantCreated: true,
+		},
+		"rollout doesn't finish": {
+			daemonSets: []*appsv1.DaemonSet{rollingOut},
+			wantErr:    true,
+		},
+		"restart fails": {
+			restartErr: errors.New("failed"),
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			kubectl := &stubMasterSecretKubectl{
+				secret:     tc.secret,
+				daemonSets: tc.daemonSets,
+				restartErr: tc.restartErr,
+			}
+			cmd := &KubeCmd{
+				kubectl:       kubectl,
+				log:           logger.NewTest(t),
+				retryInterval: time.Millisecond,
+				maxAttempts:   5,
+			}
+
+			err := cmd.ApplyMasterSecretRotations(t.Context(), rotations)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			assert.Equal(tc.wantCreated, kubectl.secretCreated)
+			assert.True(kubectl.restarted)
+			var got []uri.MasterSecretRotation
+			require.NoError(json.Unmarshal(kubectl.secret.Data[constants.ConstellationMasterSecretRotationsKey], &got))
+			assert.Equal(rotations, got)
+		})
+	}
+}
+
+func TestNodeBootIDs(t *testing.T) {
+	kubectl := &stubMasterSecretKubectl{
+		nodes: []corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "control-plane"}, Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{BootID: "boot-1"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "worker"}, Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{BootID: "boot-2"}}},
+		},
+	}
+	cmd := &KubeCmd{kubectl: kubectl, log: logger.NewTest(t), retryInterval: time.Millisecond, maxAttempts: 5}
+
+	bootIDs, err := cmd.NodeBootIDs(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"control-plane": "boot-1", "worker": "boot-2"}, bootIDs)
+}
+
+type stubMasterSecretKubectl struct {
+	configMaps    map[string]*corev1.ConfigMap
+	nodes         []corev1.Node
+	secret        *corev1.Secret
+	secretCreated bool
+	restarted     bool
+	restartErr    error
+	// daemonSets are returned by consecutive calls to GetDaemonSet, the last one is repeated.
+	daemonSets []*appsv1.DaemonSet
+	kubectlInterface
+}
+
+func (s *stubMasterSecretKubectl) GetConfigMap(_ context.Context, _, name string) (*corev1.ConfigMap, error) {
+	configMap, ok := s.configMaps[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return configMap, nil
+}
+
+func (s *stubMasterSecretKubectl) UpdateConfigMap(_ context.Context, configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	s.configMaps[configMap.Name] = configMap
+	return configMap, nil
+}
+
+func (s *stubMasterSecretKubectl) GetNodes(_ context.Context) ([]corev1.Node, error) {
+	return s.nodes, nil
+}
+
+func (s *stubMasterSecretKubectl) GetSecret(_ context.Context, _, name string) (*corev1.Secret, error) {
+	if s.secret == nil {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return s.secret, nil
+}
+
+func (s *stubMasterSecretKubectl) CreateSecret(_ context.Context, secret *corev1.Secret) error {
+	s.secret = secret
+	s.secretCreated = true
+	return nil
+}
+
+func (s *stubMasterSecretKubectl) UpdateSecret(_ context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	s.secret = secret
+	return secret, nil
+}
+
+func (s *stubMasterSecretKubectl) RestartDaemonSet(_ context.Context, _, _ string) error {
+	s.restarted = true
+	return s.restartErr
+}
+
+func (s *stubMasterSecretKubectl) GetDaemonSet(_ context.Context, _, _ string) (*appsv1.DaemonSet, error) {
+	daemonSet := s.daemonSets[0]
+	if len(s.daemonSets) > 1 {
+		s.daemonSets = s.daemonSets[1:]
+	}
+	return daemonSet, nil
+}
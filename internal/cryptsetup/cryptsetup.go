@@ -37,6 +37,8 @@ const (
 	FormatNoIntegrity = false
 	tmpDevicePrefix   = "tmp-cryptsetup-"
 	mappedDevicePath  = "/dev/mapper/"
+	// headerWipeBlockSize is the block size used to wipe LUKS2 headers.
+	headerWipeBlockSize = 1024 * 1024
 )
 
 // packageLock is needed to block concurrent use of package functions, since libcryptsetup is not thread safe.
@@ -423,6 +425,30 @@ func (c *CryptSetup) Wipe(
 	return nil
 }
 
+// WipeKeyslots overwrites the LUKS2 header of the device, including all keyslots, with zeros.
+// headerSize is the size of the header, i.e., the offset of the encrypted data on the device.
+// Afterwards, the device can't be activated anymore, not even with the passphrase of one of its former keyslots.
+// The device must not be active.
+func (c *CryptSetup) WipeKeyslots(headerSize uint64) error {
+	packageLock.Lock()
+	defer packageLock.Unlock()
+	if !c.hasAttachedHeaderDevice() {
+		return errDeviceNotOpen
+	}
+
+	device := c.deviceWithAttachedHeader
+	if err := device.Wipe(device.GetDeviceName(), wipePattern, 0, headerSize, headerWipeBlockSize, 0, nil); err != nil {
+		return fmt.Errorf("wiping LUKS2 header of device %q: %w", device.GetDeviceName(), err)
+	}
+	// the detached copy of the header holds the same keyslots
+	if c.hasDetachedHeaderDevice() && c.headerDevice != "" {
+		if err := c.deviceWithDetachedHeader.Wipe(c.headerDevice, wipePattern, 0, 0, headerWipeBlockSize, 0, nil); err != nil {
+			return fmt.Errorf("wiping detached LUKS2 header %q: %w", c.headerDevice, err)
+		}
+	}
+	return nil
+}
+
 func (c *CryptSetup) free() {
 	if c.hasDetachedHeaderDevice() {
 		c.deviceWithDetachedHeader.Free()
@@ -28,6 +28,8 @@ const (
 	ReadWriteQueueBypass = C.CRYPT_ACTIVATE_NO_WRITE_WORKQUEUE | C.CRYPT_ACTIVATE_NO_READ_WORKQUEUE
 	wipeFlags            = cryptsetup.CRYPT_ACTIVATE_PRIVATE | cryptsetup.CRYPT_ACTIVATE_NO_JOURNAL
 	wipePattern          = cryptsetup.CRYPT_WIPE_ZERO
+	// AnyKeyslot selects any keyslot matching the passphrase, or the first free keyslot for new passphrases.
+	AnyKeyslot = cryptsetup.CRYPT_ANY_SLOT
 )
 
 var errInvalidType = errors.New("device is not a *cryptsetup.Device")
@@ -18,6 +18,8 @@ const (
 	cryptActivateNoWriteWorkqueue = 0x2000000
 	wipeFlags                     = 0x10 | 0x1000
 	wipePattern                   = 0
+	// AnyKeyslot selects any keyslot matching the passphrase, or the first free keyslot for new passphrases.
+	AnyKeyslot = -1
 )
 
 var errCGONotSupported = errors.New("using cryptsetup requires building with CGO")
@@ -0,0 +1,84 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package serviceaccount authenticates gRPC calls between cluster services with Kubernetes service account tokens.
+
+Clients attach the token of their service account to each call, and servers read it from the call's metadata
+to verify it with the Kubernetes API.
+
+Clients of the keyservice use a projected token issued for KeyServiceAudience, mounted to KeyServiceTokenPath.
+Such a token is refused by the Kubernetes API and all other services, so a service receiving it can't replay it elsewhere.
+*/
+package serviceaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// KeyServiceAudience is the audience of the service account tokens that clients of the keyservice authenticate with.
+	KeyServiceAudience = "constellation-key-service"
+	// KeyServiceTokenPath is the path the projected service account token for KeyServiceAudience is mounted to.
+	KeyServiceTokenPath = "/var/run/secrets/constellation/key-service/token"
+
+	authorizationKey = "authorization"
+	bearerPrefix     = "Bearer "
+)
+
+// TokenCredentials attaches a service account token to gRPC calls.
+// It implements credentials.PerRPCCredentials.
+type TokenCredentials struct {
+	path                     string
+	requireTransportSecurity bool
+}
+
+// NewTokenCredentials creates TokenCredentials that read the token from the given path.
+// The token is read again for every call, since Kubernetes rotates it.
+// The token is also sent over connections without transport security, which are only used within the cluster.
+func NewTokenCredentials(path string) *TokenCredentials {
+	return &TokenCredentials{path: path}
+}
+
+// NewSecureTokenCredentials creates TokenCredentials like NewTokenCredentials,
+// but gRPC refuses to send the token over connections without transport security, e.g., TLS or aTLS.
+func NewSecureTokenCredentials(path string) *TokenCredentials {
+	return &TokenCredentials{path: path, requireTransportSecurity: true}
+}
+
+// GetRequestMetadata returns the authorization metadata for a call.
+// If the token file doesn't exist, e.g., because the client isn't running in a pod, the call is sent without a token.
+func (c *TokenCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	token, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	return map[string]string{authorizationKey: bearerPrefix + strings.TrimSpace(string(token))}, nil
+}
+
+// RequireTransportSecurity reports whether the token may only be sent over connections with transport security.
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+	return c.requireTransportSecurity
+}
+
+// TokenFromContext returns the service account token of an incoming gRPC call.
+func TokenFromContext(ctx context.Context) (string, bool) {
+	for _, value := range metadata.ValueFromIncomingContext(ctx, authorizationKey) {
+		if token, ok := strings.CutPrefix(value, bearerPrefix); ok && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package serviceaccount
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTokenCredentials(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	creds := NewTokenCredentials(path)
+	assert.False(creds.RequireTransportSecurity())
+
+	// Calls without a token file are sent unauthenticated.
+	md, err := creds.GetRequestMetadata(t.Context())
+	require.NoError(err)
+	assert.Empty(md)
+
+	require.NoError(os.WriteFile(path, []byte("first\n"), 0o600))
+	md, err = creds.GetRequestMetadata(t.Context())
+	require.NoError(err)
+	token, ok := TokenFromContext(metadata.NewIncomingContext(t.Context(), metadata.New(md)))
+	assert.True(ok)
+	assert.Equal("first", token)
+
+	// Rotated tokens are picked up.
+	require.NoError(os.WriteFile(path, []byte("second"), 0o600))
+	md, err = creds.GetRequestMetadata(t.Context())
+	require.NoError(err)
+	token, ok = TokenFromContext(metadata.NewIncomingContext(t.Context(), metadata.New(md)))
+	assert.True(ok)
+	assert.Equal("second", token)
+}
+
+func TestSecureTokenCredentials(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(os.WriteFile(path, []byte("token"), 0o600))
+	creds := NewSecureTokenCredentials(path)
+	assert.True(creds.RequireTransportSecurity())
+
+	// gRPC refuses to send the token over connections without transport security.
+	_, err := grpc.NewClient("localhost:9000", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithPerRPCCredentials(creds))
+	assert.Error(err)
+}
+
+func TestTokenFromContext(t *testing.T) {
+	testCases := map[string]struct {
+		ctx       context.Context
+		wantToken string
+		wantOK    bool
+	}{
+		"bearer token": {
+			ctx:       metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token")),
+			wantToken: "token",
+			wantOK:    true,
+		},
+		"no metadata": {
+			ctx: context.Background(),
+		},
+		"no authorization": {
+			ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("other", "Bearer token")),
+		},
+		"basic auth": {
+			ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Basic dXNlcjpwYXNz")),
+		},
+		"empty token": {
+			ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer ")),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			token, ok := TokenFromContext(tc.ctx)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantToken, token)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package cache implements a kms.CloudKMS that caches the DEKs returned by another kms.CloudKMS.
+
+Cloud KMS backends unwrap DEKs with a remote call, which is rate limited by the cloud provider.
+When many nodes join or many volumes are mounted at once, the same DEKs are requested over and over.
+The cache keeps DEKs in memory for a limited time, deduplicates concurrent requests for the same DEK,
+and retries requests the backend rejected because of throttling with an exponential backoff.
+
+DEKs are only kept in memory. Errors are never cached.
+*/
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/smithy-go"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultTTL is the default time a DEK is cached.
+	DefaultTTL = 5 * time.Minute
+	// DefaultMaxEntries is the default number of DEKs that are cached.
+	DefaultMaxEntries = 1024
+	// DefaultInitialBackoff is the default time to wait before retrying a throttled request.
+	DefaultInitialBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the default maximum time to wait between retries of a throttled request.
+	DefaultMaxBackoff = 10 * time.Second
+	// DefaultMaxAttempts is the default number of attempts for a throttled request.
+	DefaultMaxAttempts = 6
+)
+
+// Options configure the cache. Zero values are replaced by the defaults.
+type Options struct {
+	// TTL is the time a DEK is cached after it was fetched from the backend.
+	TTL time.Duration
+	// MaxEntries is the number of DEKs that are cached. The least recently used DEK is evicted first.
+	MaxEntries int
+	// InitialBackoff is the time to wait before retrying a throttled request. It's doubled for each retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum time to wait between retries of a throttled request.
+	MaxBackoff time.Duration
+	// MaxAttempts is the number of attempts for a throttled request.
+	MaxAttempts int
+	// IsThrottled reports whether the backend rejected a request because of throttling.
+	// Defaults to IsThrottled.
+	IsThrottled func(error) bool
+}
+
+// KMS caches the DEKs of a kms.CloudKMS.
+type KMS struct {
+	backend kms.CloudKMS
+	opts    Options
+	group   singleflight.Group
+	now     func() time.Time
+	sleep   func(context.Context, time.Duration) error
+
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// New wraps backend in a cache.
+func New(backend kms.CloudKMS, opts Options) *KMS {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.IsThrottled == nil {
+		opts.IsThrottled = IsThrottled
+	}
+
+	return &KMS{
+		backend: backend,
+		opts:    opts,
+		now:     time.Now,
+		sleep:   sleep,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// GetDEK returns the DEK for dekID from the cache, or fetches it from the backend.
+// Concurrent requests for the same DEK result in a single request to the backend.
+func (c *KMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	key := fmt.Sprintf("%d/%s", dekSize, dekID)
+	if dek, ok := c.get(key); ok {
+		return dek, nil
+	}
+
+	// The request to the backend is shared by all callers, so it must not be canceled with the context of the first one.
+	// Each caller still stops waiting once its own context is done.
+	resCh := c.group.DoChan(key, func() (any, error) {
+		dek, err := c.fetch(context.WithoutCancel(ctx), dekID, dekSize)
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, dek)
+		return dek, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resCh:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return slices.Clone(res.Val.([]byte)), nil
+	}
+}
+
+// Close clears the cache and closes the backend.
+func (c *KMS) Close() {
+	c.mux.Lock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.mux.Unlock()
+
+	c.backend.Close()
+}
+
+// fetch requests a DEK from the backend, retrying with an exponential backoff while the backend throttles requests.
+func (c *KMS) fetch(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	backoff := c.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		dek, err := c.backend.GetDEK(ctx, dekID, dekSize)
+		if err == nil {
+			return dek, nil
+		}
+		if !c.opts.IsThrottled(err) || attempt >= c.opts.MaxAttempts {
+			return nil, err
+		}
+
+		if err := c.sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff = min(2*backoff, c.opts.MaxBackoff)
+	}
+}
+
+func (c *KMS) get(key string) ([]byte, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return slices.Clone(e.dek), true
+}
+
+func (c *KMS) put(key string, dek []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, dek: slices.Clone(dek), expires: c.now().Add(c.opts.TTL)})
+	for c.lru.Len() > c.opts.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry from the cache and overwrites the DEK in memory.
+// The caller must hold the lock.
+func (c *KMS) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	clear(e.dek)
+}
+
+type entry struct {
+	key     string
+	dek     []byte
+	expires time.Time
+}
+
+// IsThrottled reports whether err signals that a KMS rejected a request because of throttling.
+// It detects throttling errors of AWS, Azure, GCP, gRPC services and HTTP APIs that report their status code.
+func IsThrottled(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded", "SlowDown":
+			return true
+		}
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) && httpErr.HTTPStatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() == codes.ResourceExhausted {
+		return true
+	}
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/smithy-go"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestGetDEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backend := &stubKMS{}
+	c := New(backend, Options{TTL: time.Minute})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	dek, err := c.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal([]byte("volume-01/32"), dek)
+	assert.Equal(1, backend.calls)
+
+	// returned DEKs are copies of the cached ones
+	dek[0] = 'X'
+	dek, err = c.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal([]byte("volume-01/32"), dek)
+	assert.Equal(1, backend.calls)
+
+	// the DEK size is part of the cache key
+	dek, err = c.GetDEK(t.Context(), "volume-01", 64)
+	require.NoError(err)
+	assert.Equal([]byte("volume-01/64"), dek)
+	assert.Equal(2, backend.calls)
+
+	// expired DEKs are fetched again
+	now = now.Add(time.Minute)
+	_, err = c.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal(3, backend.calls)
+}
+
+func TestGetDEKEviction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backend := &stubKMS{}
+	c := New(backend, Options{MaxEntries: 2})
+
+	for _, id := range []string{"a", "b", "a", "c"} {
+		_, err := c.GetDEK(t.Context(), id, 32)
+		require.NoError(err)
+	}
+	assert.Equal(3, backend.calls)
+	assert.Equal(2, c.lru.Len())
+
+	// "b" was the least recently used DEK
+	_, err := c.GetDEK(t.Context(), "a", 32)
+	require.NoError(err)
+	assert.Equal(3, backend.calls)
+	_, err = c.GetDEK(t.Context(), "b", 32)
+	require.NoError(err)
+	assert.Equal(4, backend.calls)
+}
+
+func TestGetDEKErrors(t *testing.T) {
+	throttled := status.Error(codes.ResourceExhausted, "rate limit exceeded")
+
+	testCases := map[string]struct {
+		errs         []error
+		wantCalls    int
+		wantBackoffs []time.Duration
+		wantErr      bool
+	}{
+		"throttled once": {
+			errs:         []error{throttled},
+			wantCalls:    2,
+			wantBackoffs: []time.Duration{time.Second},
+		},
+		"throttled until max attempts": {
+			errs:         []error{throttled, throttled, throttled},
+			wantCalls:    3,
+			wantBackoffs: []time.Duration{time.Second, 2 * time.Second},
+			wantErr:      true,
+		},
+		"other errors aren't retried": {
+			errs:      []error{errors.New("failed")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			backend := &stubKMS{errs: tc.errs}
+			c := New(backend, Options{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 2 * time.Second})
+			var backoffs []time.Duration
+			c.sleep = func(_ context.Context, d time.Duration) error {
+				backoffs = append(backoffs, d)
+				return nil
+			}
+
+			_, err := c.GetDEK(t.Context(), "volume-01", 32)
+			assert.Equal(tc.wantCalls, backend.calls)
+			assert.Equal(tc.wantBackoffs, backoffs)
+			if tc.wantErr {
+				assert.Error(err)
+				// errors aren't cached
+				_, err = c.GetDEK(t.Context(), "volume-01", 32)
+				assert.NoError(err)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestGetDEKSingleflight(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	backend := &stubKMS{block: release}
+	c := New(backend, Options{})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dek, err := c.GetDEK(context.Background(), "volume-01", 32)
+			assert.NoError(err)
+			assert.Equal([]byte("volume-01/32"), dek)
+		}()
+	}
+
+	// canceling one caller doesn't cancel the shared request
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err := c.GetDEK(ctx, "volume-01", 32)
+	assert.ErrorIs(err, context.Canceled)
+
+	assert.Eventually(func() bool { return backend.waiting() }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(1, backend.calls)
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &stubKMS{}
+	c := New(backend, Options{})
+	_, err := c.GetDEK(t.Context(), "volume-01", 32)
+	assert.NoError(err)
+	dek := c.lru.Front().Value.(*entry).dek
+
+	c.Close()
+	assert.True(backend.closed)
+	assert.Zero(c.lru.Len())
+	assert.Equal(make([]byte, len(dek)), dek)
+}
+
+func TestIsThrottled(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		want bool
+	}{
+		"AWS throttling": {
+			err:  fmt.Errorf("decrypting DEK: %w", &smithy.GenericAPIError{Code: "ThrottlingException"}),
+			want: true,
+		},
+		"AWS access denied": {
+			err: &smithy.GenericAPIError{Code: "AccessDeniedException"},
+		},
+		"Azure too many requests": {
+			err:  fmt.Errorf("decrypting DEK: %w", &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}),
+			want: true,
+		},
+		"Azure forbidden": {
+			err: &azcore.ResponseError{StatusCode: http.StatusForbidden},
+		},
+		"Vault too many requests": {
+			err:  &vault.ResponseError{Operation: "decrypt", StatusCode: http.StatusTooManyRequests},
+			want: true,
+		},
+		"gRPC resource exhausted": {
+			err:  fmt.Errorf("decrypting DEK: %w", status.Error(codes.ResourceExhausted, "quota exceeded")),
+			want: true,
+		},
+		"gRPC permission denied": {
+			err: status.Error(codes.PermissionDenied, "denied"),
+		},
+		"other error": {
+			err: errors.New("failed"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, IsThrottled(tc.err))
+		})
+	}
+}
+
+type stubKMS struct {
+	mux     sync.Mutex
+	calls   int
+	errs    []error
+	block   chan struct{}
+	blocked bool
+	closed  bool
+}
+
+func (s *stubKMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byte, error) {
+	s.mux.Lock()
+	s.calls++
+	s.blocked = s.block != nil
+	var err error
+	if len(s.errs) > 0 {
+		err, s.errs = s.errs[0], s.errs[1:]
+	}
+	s.mux.Unlock()
+
+	if s.block != nil {
+		<-s.block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "%s/%d", dekID, dekSize), nil
+}
+
+func (s *stubKMS) Close() {
+	s.closed = true
+}
+
+func (s *stubKMS) waiting() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.blocked
+}
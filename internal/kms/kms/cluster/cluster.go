@@ -12,20 +12,46 @@ Data Encryption Keys (DEK) are derived from master key and salt using HKDF.
 
 This backend does not require a storage backend, as keys are derived on demand and not stored anywhere.
 For that purpose the special NoStoreURI can be used during KMS initialization.
+
+The master secret can be rotated. Each rotation adds a new version of the master secret.
+Key IDs without a version suffix are derived from the initial master secret (version 0),
+so keys bound to the cluster's identity, e.g., the measurement secret, never change.
+Keys derived from a later version are requested using the ID returned by MasterSecretKeyID.
+The version is separated by a NUL byte, which key IDs received from clients must not contain,
+so that clients can't select a version of the master secret through the key ID.
+
+Once a rotation is finalized, keys of state disks are no longer derived from the initial master secret,
+so that the keys of state disks that weren't re-keyed, and of their snapshots, can't be retrieved anymore.
 */
 package cluster
 
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/google/uuid"
 )
 
+// versionSeparator separates a key ID from the version of the master secret it is derived from.
+const versionSeparator = "\x00v"
+
+// ErrVersionRetired is returned when the key of a state disk is requested from a version of the master secret
+// that was replaced by a finalized rotation.
+var ErrVersionRetired = errors.New("master secret version was retired for state disk keys")
+
 // KMS implements the kms.CloudKMS interface for in cluster key management.
 type KMS struct {
 	masterKey []byte
 	salt      []byte
+	rotations map[uint32]uri.MasterSecretRotation
+	// initialRetired is set if a rotation was finalized, so state disk keys aren't derived from version 0 anymore.
+	initialRetired bool
 }
 
 // New creates a new ClusterKMS.
@@ -40,13 +66,122 @@ func New(key []byte, salt []byte) (*KMS, error) {
 	return &KMS{masterKey: key, salt: salt}, nil
 }
 
+// NewFromMasterSecret creates a new ClusterKMS deriving keys from all versions of the master secret.
+func NewFromMasterSecret(secret uri.MasterSecret) (*KMS, error) {
+	kms, err := New(secret.Key, secret.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	kms.rotations = make(map[uint32]uri.MasterSecretRotation, len(secret.Rotations))
+	for _, rotation := range secret.Rotations {
+		if rotation.Version == 0 {
+			return nil, errors.New("master secret rotation must not use version 0")
+		}
+		if len(rotation.Key) == 0 || len(rotation.Salt) == 0 {
+			return nil, fmt.Errorf("missing master key or salt for master secret version %d", rotation.Version)
+		}
+		if _, ok := kms.rotations[rotation.Version]; ok {
+			return nil, fmt.Errorf("duplicate master secret version %d", rotation.Version)
+		}
+		kms.rotations[rotation.Version] = rotation
+		kms.initialRetired = kms.initialRetired || rotation.Finalized
+	}
+	return kms, nil
+}
+
 // GetDEK derives a key from the KMS masterKey.
+// If dekID was created by MasterSecretKeyID, the key is derived from the requested version of the master secret.
+// Once a rotation was finalized, the error wraps ErrVersionRetired for keys of state disks without a version.
 func (c *KMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byte, error) {
 	if len(c.masterKey) == 0 {
 		return nil, errors.New("master key not set for Constellation KMS")
 	}
-	return crypto.DeriveKey(c.masterKey, c.salt, []byte(dekID), uint(dekSize))
+
+	keyID, version := SplitMasterSecretKeyID(dekID)
+	if version == 0 {
+		if c.initialRetired && isStateDiskKeyID(keyID) {
+			return nil, fmt.Errorf("DEK %q: %w", keyID, ErrVersionRetired)
+		}
+		return crypto.DeriveKey(c.masterKey, c.salt, []byte(keyID), uint(dekSize))
+	}
+	rotation, ok := c.rotations[version]
+	if !ok {
+		return nil, fmt.Errorf("master secret version %d is not available", version)
+	}
+	return crypto.DeriveKey(rotation.Key, rotation.Salt, []byte(keyID), uint(dekSize))
 }
 
 // Close is a no-op for cKMS.
 func (c *KMS) Close() {}
+
+// MasterSecretKeyID returns the ID of the key keyID derived from the given version of the master secret.
+// Version 0 is the initial master secret, whose keys use the unmodified key ID.
+func MasterSecretKeyID(keyID string, version uint32) string {
+	if version == 0 {
+		return keyID
+	}
+	return keyID + versionSeparator + strconv.FormatUint(uint64(version), 10)
+}
+
+// MasterSecretVersions returns the current version of the master secret, i.e., the highest version,
+// and all previous versions state disk keys may be derived from, in ascending order.
+// The initial master secret is a previous version until a rotation was finalized.
+func MasterSecretVersions(secret uri.MasterSecret) (current uint32, previous []uint32) {
+	initialRetired := false
+	for _, rotation := range secret.Rotations {
+		current = max(current, rotation.Version)
+		initialRetired = initialRetired || rotation.Finalized
+	}
+	if current == 0 {
+		return 0, nil
+	}
+	if !initialRetired {
+		previous = []uint32{0}
+	}
+	for _, rotation := range secret.Rotations {
+		if rotation.Version != current {
+			previous = append(previous, rotation.Version)
+		}
+	}
+	slices.Sort(previous)
+	return current, previous
+}
+
+// SplitMasterSecretKeyID splits a key ID created by MasterSecretKeyID into the original key ID and the version.
+// IDs without a valid version suffix are returned as is with version 0.
+func SplitMasterSecretKeyID(dekID string) (string, uint32) {
+	idx := strings.LastIndex(dekID, versionSeparator)
+	if idx < 0 {
+		return dekID, 0
+	}
+	suffix := dekID[idx+len(versionSeparator):]
+	version, err := strconv.ParseUint(suffix, 10, 32)
+	// only accept the canonical encoding, so each key has exactly one ID
+	if err != nil || version == 0 || strconv.FormatUint(version, 10) != suffix {
+		return dekID, 0
+	}
+	return dekID[:idx], uint32(version)
+}
+
+// KeyVersions describes which versions of the master secret are used to derive state disk keys.
+// It is stored in the join-config ConfigMap, so the JoinService can hand out keys of the right version.
+type KeyVersions struct {
+	// Current is the version of the master secret used for new keys.
+	Current uint32 `json:"current"`
+	// Previous are the versions that may still be in use by nodes which didn't re-key their state disk yet.
+	Previous []uint32 `json:"previous,omitempty"`
+	// BootIDs maps the names of the nodes at the time of the rotation to their boot IDs.
+	// A node has re-keyed its state disk once it rebooted, i.e., its boot ID changed.
+	BootIDs map[string]string `json:"bootIDs,omitempty"`
+}
+
+// isStateDiskKeyID returns true if keyID is the ID of a state disk's key, i.e., the DEK prefix followed by the disk's UUID.
+func isStateDiskKeyID(keyID string) bool {
+	diskUUID, ok := strings.CutPrefix(keyID, crypto.DEKPrefix)
+	if !ok {
+		return false
+	}
+	_, err := uuid.Parse(diskUUID)
+	return err == nil
+}
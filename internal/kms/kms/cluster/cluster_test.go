@@ -10,7 +10,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/edgelesssys/constellation/v2/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/internal/crypto/testvector"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -110,3 +112,218 @@ func TestVectorsHKDF(t *testing.T) {
 		})
 	}
 }
+
+func TestRotatedMasterSecret(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	initial := testvector.HKDF0xFF
+	rotated := testvector.HKDFZero
+	dekID := initial.InfoPrefix + initial.Info
+
+	kms, err := NewFromMasterSecret(uri.MasterSecret{
+		Key:       initial.Secret,
+		Salt:      initial.Salt,
+		Rotations: []uri.MasterSecretRotation{{Version: 1, Key: rotated.Secret, Salt: rotated.Salt}},
+	})
+	require.NoError(err)
+
+	// plain IDs are derived from the initial master secret
+	key, err := kms.GetDEK(t.Context(), dekID, int(initial.Length))
+	require.NoError(err)
+	assert.Equal(initial.Output, key)
+
+	// versioned IDs are derived from the rotated master secret, using the plain ID as info
+	key, err = kms.GetDEK(t.Context(), MasterSecretKeyID(rotated.InfoPrefix+rotated.Info, 1), int(rotated.Length))
+	require.NoError(err)
+	assert.Equal(rotated.Output, key)
+
+	_, err = kms.GetDEK(t.Context(), MasterSecretKeyID(dekID, 2), int(initial.Length))
+	assert.Error(err)
+}
+
+func TestFinalizedRotation(t *testing.T) {
+	testCases := map[string]struct {
+		finalized   bool
+		dekID       string
+		wantRetired bool
+	}{
+		"state disk key before finalizing": {
+			dekID: crypto.DEKPrefix + "8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e",
+		},
+		"state disk key after finalizing": {
+			finalized:   true,
+			dekID:       crypto.DEKPrefix + "8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e",
+			wantRetired: true,
+		},
+		"current version of state disk key after finalizing": {
+			finalized: true,
+			dekID:     MasterSecretKeyID(crypto.DEKPrefix+"8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e", 1),
+		},
+		"measurement secret after finalizing": {
+			finalized: true,
+			dekID:     crypto.DEKPrefix + crypto.MeasurementSecretKeyID,
+		},
+		"volume key after finalizing": {
+			finalized: true,
+			dekID:     crypto.DEKPrefix + "namespace/team-a/8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			kms, err := NewFromMasterSecret(uri.MasterSecret{
+				Key:       []byte("key"),
+				Salt:      []byte("salt"),
+				Rotations: []uri.MasterSecretRotation{{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1"), Finalized: tc.finalized}},
+			})
+			require.NoError(err)
+
+			_, err = kms.GetDEK(t.Context(), tc.dekID, 32)
+			if tc.wantRetired {
+				assert.ErrorIs(err, ErrVersionRetired)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func TestNewFromMasterSecret(t *testing.T) {
+	testCases := map[string]struct {
+		secret  uri.MasterSecret
+		wantErr bool
+	}{
+		"no rotations": {
+			secret: uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt")},
+		},
+		"rotations": {
+			secret: uri.MasterSecret{
+				Key:  []byte("key"),
+				Salt: []byte("salt"),
+				Rotations: []uri.MasterSecretRotation{
+					{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1")},
+					{Version: 2, Key: []byte("key-2"), Salt: []byte("salt-2")},
+				},
+			},
+		},
+		"missing master key": {
+			secret:  uri.MasterSecret{Salt: []byte("salt")},
+			wantErr: true,
+		},
+		"rotation with version 0": {
+			secret: uri.MasterSecret{
+				Key:       []byte("key"),
+				Salt:      []byte("salt"),
+				Rotations: []uri.MasterSecretRotation{{Version: 0, Key: []byte("key-1"), Salt: []byte("salt-1")}},
+			},
+			wantErr: true,
+		},
+		"rotation without salt": {
+			secret: uri.MasterSecret{
+				Key:       []byte("key"),
+				Salt:      []byte("salt"),
+				Rotations: []uri.MasterSecretRotation{{Version: 1, Key: []byte("key-1")}},
+			},
+			wantErr: true,
+		},
+		"duplicate version": {
+			secret: uri.MasterSecret{
+				Key:  []byte("key"),
+				Salt: []byte("salt"),
+				Rotations: []uri.MasterSecretRotation{
+					{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1")},
+					{Version: 1, Key: []byte("key-2"), Salt: []byte("salt-2")},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewFromMasterSecret(tc.secret)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMasterSecretKeyID(t *testing.T) {
+	testCases := map[string]struct {
+		dekID       string
+		wantKeyID   string
+		wantVersion uint32
+	}{
+		"plain ID":             {dekID: "key-disk", wantKeyID: "key-disk"},
+		"versioned ID":         {dekID: "key-disk\x00v3", wantKeyID: "key-disk", wantVersion: 3},
+		"version 0":            {dekID: "key-disk\x00v0", wantKeyID: "key-disk\x00v0"},
+		"leading zero":         {dekID: "key-disk\x00v03", wantKeyID: "key-disk\x00v03"},
+		"not a number":         {dekID: "key-disk\x00vx", wantKeyID: "key-disk\x00vx"},
+		"empty version":        {dekID: "key-disk\x00v", wantKeyID: "key-disk\x00v"},
+		"version out of range": {dekID: "key-disk\x00v4294967296", wantKeyID: "key-disk\x00v4294967296"},
+		"separator in ID":      {dekID: "key-a\x00vb\x00v2", wantKeyID: "key-a\x00vb", wantVersion: 2},
+		"former separator":     {dekID: "key-disk@v3", wantKeyID: "key-disk@v3"},
+		"key version":          {dekID: "key-disk/v3", wantKeyID: "key-disk/v3"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			keyID, version := SplitMasterSecretKeyID(tc.dekID)
+			assert.Equal(tc.wantKeyID, keyID)
+			assert.Equal(tc.wantVersion, version)
+			if version != 0 {
+				assert.Equal(tc.dekID, MasterSecretKeyID(keyID, version))
+			}
+		})
+	}
+
+	assert.Equal(t, "key-disk", MasterSecretKeyID("key-disk", 0))
+}
+
+func TestMasterSecretVersions(t *testing.T) {
+	testCases := map[string]struct {
+		rotations    []uri.MasterSecretRotation
+		wantCurrent  uint32
+		wantPrevious []uint32
+	}{
+		"never rotated": {},
+		"rotated once": {
+			rotations:    []uri.MasterSecretRotation{{Version: 1}},
+			wantCurrent:  1,
+			wantPrevious: []uint32{0},
+		},
+		"rotated multiple times": {
+			rotations:    []uri.MasterSecretRotation{{Version: 3}, {Version: 1}},
+			wantCurrent:  3,
+			wantPrevious: []uint32{0, 1},
+		},
+		"rotated after finalizing": {
+			rotations:    []uri.MasterSecretRotation{{Version: 1, Finalized: true}, {Version: 2}},
+			wantCurrent:  2,
+			wantPrevious: []uint32{1},
+		},
+		"finalized": {
+			rotations:   []uri.MasterSecretRotation{{Version: 1, Finalized: true}},
+			wantCurrent: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			current, previous := MasterSecretVersions(uri.MasterSecret{Rotations: tc.rotations})
+			assert.Equal(tc.wantCurrent, current)
+			assert.Equal(tc.wantPrevious, previous)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package denylist implements a kms.CloudKMS that refuses the DEKs of destroyed keys.
+
+DEKs are derived from the master secret, or unwrapped with a KEK, so they stay available for as long as the KMS exists.
+Deleting a volume therefore doesn't protect a leaked snapshot of it.
+Destroying the volume's key records its ID on a deny-list in the KMS storage, and GetDEK refuses the key from then on.
+
+Destroying a key ID also destroys all key IDs below it, e.g., destroying "namespace/team-a/<uuid>"
+also destroys "namespace/team-a/<uuid>/v2" and the keys derived from all versions of the master secret.
+Destroyed keys can't be restored.
+
+Each instance caches which keys aren't destroyed for notDestroyedTTL, so a key destroyed through
+another instance is refused by all instances at the latest after that time.
+*/
+package denylist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage"
+)
+
+const (
+	// storagePrefix separates deny-list entries from DEKs in the storage.
+	storagePrefix = "destroyed/"
+	// notDestroyedTTL is the time a key that isn't destroyed is cached, before the deny-list is checked again.
+	notDestroyedTTL = 10 * time.Second
+	// maxNotDestroyed limits the number of cached keys that aren't destroyed.
+	maxNotDestroyed = 4096
+)
+
+// ErrDestroyed is returned when the DEK of a destroyed key is requested.
+var ErrDestroyed = errors.New("key was destroyed")
+
+// KMS refuses the DEKs of destroyed keys, and fetches all other DEKs from another kms.CloudKMS.
+type KMS struct {
+	backend kms.CloudKMS
+	store   kms.Storage
+	now     func() time.Time
+
+	// destroyed caches key IDs known to be destroyed. Since keys can't be restored, entries are never removed.
+	mux       sync.Mutex
+	destroyed map[string]struct{}
+	// notDestroyed caches key IDs that weren't on the deny-list, mapped to the time the entry expires.
+	notDestroyed map[string]time.Time
+}
+
+// New wraps backend with a deny-list persisted in store.
+// The store must be shared by all instances of the KMS, so that a key destroyed through one instance is refused by all of them.
+func New(backend kms.CloudKMS, store kms.Storage) *KMS {
+	return &KMS{
+		backend:      backend,
+		store:        store,
+		now:          time.Now,
+		destroyed:    make(map[string]struct{}),
+		notDestroyed: make(map[string]time.Time),
+	}
+}
+
+// GetDEK returns the DEK for dekID from the backend.
+// If dekID, or an ID it's below of, was destroyed, the error wraps ErrDestroyed.
+func (k *KMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	destroyed, err := k.isDestroyed(ctx, dekID)
+	if err != nil {
+		return nil, fmt.Errorf("checking deny-list: %w", err)
+	}
+	if destroyed {
+		return nil, fmt.Errorf("DEK %q: %w", dekID, ErrDestroyed)
+	}
+	return k.backend.GetDEK(ctx, dekID, dekSize)
+}
+
+// DestroyDEK adds dekID to the deny-list, destroying the key and all keys below it.
+// Destroying a key that was already destroyed is a no-op.
+func (k *KMS) DestroyDEK(ctx context.Context, dekID string) error {
+	dekID, _ = cluster.SplitMasterSecretKeyID(dekID)
+	if dekID == "" {
+		return errors.New("no DEK ID specified")
+	}
+	if err := k.store.Put(ctx, storagePrefix+dekID, []byte(k.now().UTC().Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("adding DEK %q to deny-list: %w", dekID, err)
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.destroyed[dekID] = struct{}{}
+	for id := range k.notDestroyed {
+		if slices.Contains(parentIDs(id), dekID) {
+			delete(k.notDestroyed, id)
+		}
+	}
+	return nil
+}
+
+// Close closes the backend.
+func (k *KMS) Close() {
+	k.backend.Close()
+}
+
+// isDestroyed checks whether dekID, or any ID it's below of, is on the deny-list.
+// Keys derived from a version of the master secret are checked under the ID of the key they're derived for.
+func (k *KMS) isDestroyed(ctx context.Context, dekID string) (bool, error) {
+	dekID, _ = cluster.SplitMasterSecretKeyID(dekID)
+	ids := parentIDs(dekID)
+
+	k.mux.Lock()
+	for _, id := range ids {
+		if _, ok := k.destroyed[id]; ok {
+			k.mux.Unlock()
+			return true, nil
+		}
+	}
+	if expiry, ok := k.notDestroyed[dekID]; ok && k.now().Before(expiry) {
+		k.mux.Unlock()
+		return false, nil
+	}
+	k.mux.Unlock()
+
+	for _, id := range ids {
+		_, err := k.store.Get(ctx, storagePrefix+id)
+		if errors.Is(err, storage.ErrDEKUnset) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		k.mux.Lock()
+		k.destroyed[id] = struct{}{}
+		delete(k.notDestroyed, dekID)
+		k.mux.Unlock()
+		return true, nil
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.cacheNotDestroyed(dekID)
+	return false, nil
+}
+
+// cacheNotDestroyed caches that dekID isn't destroyed until notDestroyedTTL passed.
+// If the cache is full, expired entries are removed first, and dekID isn't cached if none expired.
+// The caller must hold k.mux.
+func (k *KMS) cacheNotDestroyed(dekID string) {
+	now := k.now()
+	if len(k.notDestroyed) >= maxNotDestroyed {
+		for id, expiry := range k.notDestroyed {
+			if !now.Before(expiry) {
+				delete(k.notDestroyed, id)
+			}
+		}
+		if len(k.notDestroyed) >= maxNotDestroyed {
+			return
+		}
+	}
+	k.notDestroyed[dekID] = now.Add(notDestroyedTTL)
+}
+
+// parentIDs returns dekID and all IDs it's below of, e.g., "a", "a/b", and "a/b/c" for "a/b/c".
+func parentIDs(dekID string) []string {
+	var ids []string
+	for i, c := range dekID {
+		if c == '/' && i > 0 {
+			ids = append(ids, dekID[:i])
+		}
+	}
+	return append(ids, dekID)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package denylist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage/memfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestGetDEK(t *testing.T) {
+	testCases := map[string]struct {
+		destroyed     []string
+		storageGetErr error
+		dekID         string
+		wantDestroyed bool
+		wantErr       bool
+	}{
+		"no keys destroyed": {
+			dekID: "key-namespace/team-a/uuid",
+		},
+		"key destroyed": {
+			destroyed:     []string{"key-namespace/team-a/uuid"},
+			dekID:         "key-namespace/team-a/uuid",
+			wantDestroyed: true,
+		},
+		"key version of destroyed key": {
+			destroyed:     []string{"key-namespace/team-a/uuid"},
+			dekID:         "key-namespace/team-a/uuid/v2",
+			wantDestroyed: true,
+		},
+		"key of destroyed scope": {
+			destroyed:     []string{"key-namespace/team-a"},
+			dekID:         "key-namespace/team-a/uuid/v2",
+			wantDestroyed: true,
+		},
+		"master secret version of destroyed key": {
+			destroyed:     []string{"key-namespace/team-a/uuid"},
+			dekID:         "key-namespace/team-a/uuid\x00v2",
+			wantDestroyed: true,
+		},
+		"master secret version of key version of destroyed scope": {
+			destroyed:     []string{"key-namespace/team-a"},
+			dekID:         "key-namespace/team-a/uuid/v2\x00v3",
+			wantDestroyed: true,
+		},
+		"other key destroyed": {
+			destroyed: []string{"key-namespace/team-a/other-uuid"},
+			dekID:     "key-namespace/team-a/uuid",
+		},
+		"only key version destroyed": {
+			destroyed: []string{"key-namespace/team-a/uuid/v1"},
+			dekID:     "key-namespace/team-a/uuid/v2",
+		},
+		"destroyed key is a prefix, but not a parent": {
+			destroyed: []string{"key-namespace/team"},
+			dekID:     "key-namespace/team-a/uuid",
+		},
+		"reading deny-list fails": {
+			storageGetErr: errors.New("failed"),
+			dekID:         "key-namespace/team-a/uuid",
+			wantErr:       true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			store := &stubStorage{Storage: memfs.New(), getErr: tc.storageGetErr}
+			for _, id := range tc.destroyed {
+				require.NoError(New(&stubKMS{}, store).DestroyDEK(t.Context(), id))
+			}
+			backend := &stubKMS{}
+			k := New(backend, store)
+
+			dek, err := k.GetDEK(t.Context(), tc.dekID, 32)
+			switch {
+			case tc.wantErr:
+				assert.Error(err)
+				assert.NotErrorIs(err, ErrDestroyed)
+			case tc.wantDestroyed:
+				assert.ErrorIs(err, ErrDestroyed)
+				assert.Zero(backend.calls)
+			default:
+				require.NoError(err)
+				assert.Equal(fmt.Appendf(nil, "%s/%d", tc.dekID, 32), dek)
+			}
+		})
+	}
+}
+
+func TestDestroyDEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store := &stubStorage{Storage: memfs.New()}
+	k := New(&stubKMS{}, store)
+	_, err := k.GetDEK(t.Context(), "key-uuid", 32)
+	require.NoError(err)
+
+	require.NoError(k.DestroyDEK(t.Context(), "key-uuid"))
+	_, err = k.GetDEK(t.Context(), "key-uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+
+	// destroyed keys are refused by all instances sharing the storage
+	_, err = New(&stubKMS{}, store).GetDEK(t.Context(), "key-uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+
+	// destroyed keys stay destroyed, even if the storage isn't reachable
+	store.getErr = errors.New("failed")
+	_, err = k.GetDEK(t.Context(), "key-uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+
+	// destroying a key twice is a no-op
+	assert.NoError(k.DestroyDEK(t.Context(), "key-uuid"))
+
+	// destroying a master secret version of a key destroys the key
+	require.NoError(k.DestroyDEK(t.Context(), "key-versioned-uuid\x00v2"))
+	store.getErr = nil
+	_, err = New(&stubKMS{}, store).GetDEK(t.Context(), "key-versioned-uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+
+	assert.Error(k.DestroyDEK(t.Context(), ""))
+	store.putErr = errors.New("failed")
+	assert.Error(k.DestroyDEK(t.Context(), "key-other-uuid"))
+}
+
+func TestNotDestroyedCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	now := time.Unix(0, 0)
+	store := &stubStorage{Storage: memfs.New()}
+	k := New(&stubKMS{}, store)
+	k.now = func() time.Time { return now }
+
+	_, err := k.GetDEK(t.Context(), "namespace/team-a/uuid", 32)
+	require.NoError(err)
+	gets := store.gets
+
+	// keys that aren't destroyed are cached, including all master secret versions
+	_, err = k.GetDEK(t.Context(), "namespace/team-a/uuid\x00v2", 32)
+	require.NoError(err)
+	assert.Equal(gets, store.gets)
+
+	// keys destroyed through other instances are refused once the cache expired
+	require.NoError(New(&stubKMS{}, store).DestroyDEK(t.Context(), "namespace/team-a"))
+	_, err = k.GetDEK(t.Context(), "namespace/team-a/uuid", 32)
+	assert.NoError(err)
+	now = now.Add(notDestroyedTTL)
+	_, err = k.GetDEK(t.Context(), "namespace/team-a/uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+	assert.Greater(store.gets, gets)
+
+	// keys destroyed through the same instance are refused immediately
+	_, err = k.GetDEK(t.Context(), "namespace/team-b/uuid", 32)
+	require.NoError(err)
+	require.NoError(k.DestroyDEK(t.Context(), "namespace/team-b"))
+	assert.NotContains(k.notDestroyed, "namespace/team-b/uuid")
+	store.getErr = errors.New("failed")
+	_, err = k.GetDEK(t.Context(), "namespace/team-b/uuid", 32)
+	assert.ErrorIs(err, ErrDestroyed)
+}
+
+func TestCacheNotDestroyed(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(0, 0)
+	k := New(&stubKMS{}, &stubStorage{Storage: memfs.New()})
+	k.now = func() time.Time { return now }
+	for i := range maxNotDestroyed {
+		k.cacheNotDestroyed(fmt.Sprintf("key-%d", i))
+	}
+
+	// the cache doesn't grow beyond its limit
+	k.cacheNotDestroyed("key-new")
+	assert.Len(k.notDestroyed, maxNotDestroyed)
+	assert.NotContains(k.notDestroyed, "key-new")
+
+	// expired entries are removed to make room
+	now = now.Add(notDestroyedTTL)
+	k.cacheNotDestroyed("key-new")
+	assert.Len(k.notDestroyed, 1)
+	assert.Contains(k.notDestroyed, "key-new")
+}
+
+type stubStorage struct {
+	*memfs.Storage
+	getErr error
+	putErr error
+	gets   int
+}
+
+func (s *stubStorage) Get(ctx context.Context, keyID string) ([]byte, error) {
+	s.gets++
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	return s.Storage.Get(ctx, keyID)
+}
+
+func (s *stubStorage) Put(ctx context.Context, keyID string, data []byte) error {
+	if s.putErr != nil {
+		return s.putErr
+	}
+	return s.Storage.Put(ctx, keyID, data)
+}
+
+type stubKMS struct {
+	calls int
+}
+
+func (s *stubKMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byte, error) {
+	s.calls++
+	return fmt.Appendf(nil, "%s/%d", dekID, dekSize), nil
+}
+
+func (s *stubKMS) Close() {}
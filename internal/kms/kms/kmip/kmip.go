@@ -0,0 +1,272 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package kmip implements a KMS backend for key management servers and HSMs speaking KMIP.
+
+DEKs are wrapped by a symmetric AES key on the KMIP server using the Encrypt and Decrypt operations
+in GCM mode (KMIP 1.4), so the key never leaves the server.
+The client authenticates to the server with a TLS client certificate.
+Wrapped DEKs are stored in the configured storage backend.
+
+The package implements the small subset of the TTLV encoding needed for these operations.
+*/
+package kmip
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	kmsInterface "github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/internal"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	wrapping "github.com/hashicorp/go-kms-wrapping/v2"
+)
+
+const (
+	// defaultPort is the IANA registered port of KMIP.
+	defaultPort = "5696"
+	// requestTimeout bounds a single request to the KMIP server if the context has no deadline.
+	requestTimeout = 30 * time.Second
+	// tagSize is the size of the GCM authentication tag appended to the ciphertext.
+	tagSize = 16
+)
+
+// KMSClient implements the CloudKMS interface for KMIP servers.
+type KMSClient struct {
+	kms *internal.KMSClient
+}
+
+// New creates and initializes a new KMSClient for a KMIP server.
+func New(_ context.Context, store kmsInterface.Storage, cfg uri.KMIPConfig) (*KMSClient, error) {
+	if store == nil {
+		return nil, errors.New("no storage backend provided for KMS")
+	}
+
+	wrapper, err := newKMIPWrapper(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("setting KMIP config: %w", err)
+	}
+	return &KMSClient{
+		kms: &internal.KMSClient{
+			Storage: store,
+			Wrapper: wrapper,
+		},
+	}, nil
+}
+
+// GetDEK fetches an encrypted Data Encryption Key from storage and decrypts it using a key stored on the KMIP server.
+func (c *KMSClient) GetDEK(ctx context.Context, keyID string, dekSize int) ([]byte, error) {
+	return c.kms.GetDEK(ctx, keyID, dekSize)
+}
+
+// Close is a no-op for KMIP, since connections are not reused.
+func (c *KMSClient) Close() {}
+
+// kmipWrapper wraps and unwraps data using the Encrypt and Decrypt operations of a KMIP server.
+type kmipWrapper struct {
+	endpoint  string
+	keyID     string
+	tlsConfig *tls.Config
+}
+
+func newKMIPWrapper(cfg uri.KMIPConfig) (*kmipWrapper, error) {
+	if cfg.KeyID == "" {
+		return nil, errors.New("no key ID provided")
+	}
+	endpoint := cfg.Endpoint
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, defaultPort)
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid KMIP endpoint %q", cfg.Endpoint)
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.CACertPath != "" {
+		caCert, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading KMIP CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificate found in %s", cfg.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &kmipWrapper{endpoint: endpoint, keyID: cfg.KeyID, tlsConfig: tlsConfig}, nil
+}
+
+// Encrypt wraps plaintext with the key on the KMIP server.
+// The server generates the IV, the authentication tag is appended to the ciphertext.
+func (w *kmipWrapper) Encrypt(ctx context.Context, plaintext []byte, _ ...wrapping.Option) (*wrapping.BlobInfo, error) {
+	payload, err := w.do(ctx, operationEncrypt,
+		textString(tagUniqueIdentifier, w.keyID),
+		cryptographicParameters(),
+		byteString(tagData, plaintext),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, ok := payload.child(tagData)
+	if !ok || len(ciphertext.value) == 0 {
+		return nil, errors.New("no ciphertext returned by KMIP server")
+	}
+	iv, ok := payload.child(tagIVCounterNonce)
+	if !ok || len(iv.value) == 0 {
+		return nil, errors.New("no IV returned by KMIP server")
+	}
+	tag, ok := payload.child(tagAuthenticatedEncryptionTag)
+	if !ok || len(tag.value) != tagSize {
+		return nil, fmt.Errorf("KMIP server returned no authentication tag of %d bytes", tagSize)
+	}
+
+	return &wrapping.BlobInfo{
+		Ciphertext: append(append([]byte{}, ciphertext.value...), tag.value...),
+		Iv:         iv.value,
+		KeyInfo:    &wrapping.KeyInfo{KeyId: w.keyID},
+	}, nil
+}
+
+// Decrypt unwraps a blob created by Encrypt.
+// The blob is unwrapped with the key it was created with, even if the configured key changed since.
+func (w *kmipWrapper) Decrypt(ctx context.Context, blob *wrapping.BlobInfo, _ ...wrapping.Option) ([]byte, error) {
+	if blob == nil || len(blob.Ciphertext) <= tagSize || len(blob.Iv) == 0 {
+		return nil, errors.New("invalid wrapped blob")
+	}
+	keyID := w.keyID
+	if blob.KeyInfo != nil && blob.KeyInfo.KeyId != "" {
+		keyID = blob.KeyInfo.KeyId
+	}
+	ciphertext, tag := blob.Ciphertext[:len(blob.Ciphertext)-tagSize], blob.Ciphertext[len(blob.Ciphertext)-tagSize:]
+
+	payload, err := w.do(ctx, operationDecrypt,
+		textString(tagUniqueIdentifier, keyID),
+		cryptographicParameters(),
+		byteString(tagData, ciphertext),
+		byteString(tagIVCounterNonce, blob.Iv),
+		byteString(tagAuthenticatedEncryptionTag, tag),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := payload.child(tagData)
+	if !ok {
+		return nil, errors.New("no plaintext returned by KMIP server")
+	}
+	return plaintext.value, nil
+}
+
+// do sends a request with a single batch item to the KMIP server and returns the response payload.
+func (w *kmipWrapper) do(ctx context.Context, operation uint32, payload ...item) (item, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+
+	dialer := &tls.Dialer{Config: w.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", w.endpoint)
+	if err != nil {
+		return item{}, fmt.Errorf("connecting to KMIP server: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return item{}, fmt.Errorf("setting connection deadline: %w", err)
+	}
+
+	request := structure(tagRequestMessage,
+		structure(tagRequestHeader,
+			structure(tagProtocolVersion,
+				integer(tagProtocolVersionMajor, 1),
+				integer(tagProtocolVersionMinor, 4),
+			),
+			integer(tagBatchCount, 1),
+		),
+		structure(tagBatchItem,
+			enumeration(tagOperation, operation),
+			structure(tagRequestPayload, payload...),
+		),
+	)
+	if _, err := conn.Write(request.marshal()); err != nil {
+		return item{}, fmt.Errorf("sending request to KMIP server: %w", err)
+	}
+	response, err := readMessage(conn)
+	if err != nil {
+		return item{}, fmt.Errorf("reading response from KMIP server: %w", err)
+	}
+
+	return parseResponse(response, operation)
+}
+
+// parseResponse checks the result of the single batch item of a response and returns its payload.
+func parseResponse(response item, operation uint32) (item, error) {
+	if response.tag != tagResponseMessage {
+		return item{}, fmt.Errorf("unexpected KMIP message %06X", response.tag)
+	}
+	batchItem, ok := response.child(tagBatchItem)
+	if !ok {
+		return item{}, errors.New("KMIP response contains no batch item")
+	}
+	if op, ok := batchItem.child(tagOperation); ok {
+		if got, err := op.uint32(); err != nil || got != operation {
+			return item{}, fmt.Errorf("KMIP response is for operation %X, expected %X", got, operation)
+		}
+	}
+
+	status, ok := batchItem.child(tagResultStatus)
+	if !ok {
+		return item{}, errors.New("KMIP response contains no result status")
+	}
+	resultStatus, err := status.uint32()
+	if err != nil {
+		return item{}, err
+	}
+	if resultStatus != resultStatusSuccess {
+		var reason uint32
+		if r, ok := batchItem.child(tagResultReason); ok {
+			reason, _ = r.uint32()
+		}
+		var message string
+		if m, ok := batchItem.child(tagResultMessage); ok {
+			message = string(m.value)
+		}
+		return item{}, fmt.Errorf("KMIP operation failed with status %d, reason %d: %s", resultStatus, reason, message)
+	}
+
+	payload, ok := batchItem.child(tagResponsePayload)
+	if !ok {
+		return item{}, errors.New("KMIP response contains no payload")
+	}
+	return payload, nil
+}
+
+// cryptographicParameters selects AES-GCM for the Encrypt and Decrypt operations.
+func cryptographicParameters() item {
+	return structure(tagCryptographicParameters,
+		enumeration(tagBlockCipherMode, blockCipherModeGCM),
+		enumeration(tagCryptographicAlgorithm, cryptographicAlgorithmAES),
+	)
+}
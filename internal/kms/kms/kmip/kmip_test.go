@@ -0,0 +1,440 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package kmip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage/memfs"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	wrapping "github.com/hashicorp/go-kms-wrapping/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestGetDEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pki := newTestPKI(t)
+	server := newFakeKMIPServer(t, pki, "key-1", "key-2")
+
+	store := memfs.New()
+	cfg := pki.config(server.addr, "key-1")
+	client, err := New(t.Context(), store, cfg)
+	require.NoError(err)
+	defer client.Close()
+
+	dek, err := client.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Len(dek, 32)
+
+	again, err := client.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal(dek, again)
+
+	stored, err := store.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	var blob wrapping.BlobInfo
+	require.NoError(json.Unmarshal(stored, &blob))
+	assert.Equal("key-1", blob.KeyInfo.KeyId)
+	assert.Len(blob.Ciphertext, 32+tagSize)
+	assert.NotEqual(dek, blob.Ciphertext[:32])
+
+	// DEKs remain accessible after switching to a new key.
+	cfg.KeyID = "key-2"
+	newClient, err := New(t.Context(), store, cfg)
+	require.NoError(err)
+	defer newClient.Close()
+	afterSwitch, err := newClient.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal(dek, afterSwitch)
+
+	// Tampered ciphertexts are rejected by the server.
+	blob.Ciphertext[0] ^= 0xFF
+	tampered, err := json.Marshal(&blob)
+	require.NoError(err)
+	require.NoError(store.Put(t.Context(), "volume-01", tampered))
+	_, err = client.GetDEK(t.Context(), "volume-01", 32)
+	assert.ErrorContains(err, "authentication tag")
+}
+
+func TestGetDEKErrors(t *testing.T) {
+	testCases := map[string]struct {
+		keyID        string
+		untrustedPKI bool
+	}{
+		"unknown key": {
+			keyID: "unknown",
+		},
+		"client certificate not trusted by server": {
+			keyID:        "key-1",
+			untrustedPKI: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			pki := newTestPKI(t)
+			server := newFakeKMIPServer(t, pki, "key-1")
+
+			cfg := pki.config(server.addr, tc.keyID)
+			if tc.untrustedPKI {
+				other := newTestPKI(t).config(server.addr, tc.keyID)
+				cfg.ClientCertPath, cfg.ClientKeyPath = other.ClientCertPath, other.ClientKeyPath
+			}
+			client, err := New(t.Context(), memfs.New(), cfg)
+			require.NoError(err)
+			defer client.Close()
+
+			_, err = client.GetDEK(t.Context(), "volume-01", 32)
+			assert.Error(err)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	pki := newTestPKI(t)
+
+	testCases := map[string]struct {
+		noStore bool
+		cfg     uri.KMIPConfig
+		wantErr bool
+	}{
+		"valid config": {
+			cfg: pki.config("hsm.example.com:5696", "key-1"),
+		},
+		"default port": {
+			cfg: pki.config("hsm.example.com", "key-1"),
+		},
+		"no storage": {
+			noStore: true,
+			cfg:     pki.config("hsm.example.com:5696", "key-1"),
+			wantErr: true,
+		},
+		"no key ID": {
+			cfg:     pki.config("hsm.example.com:5696", ""),
+			wantErr: true,
+		},
+		"invalid endpoint": {
+			cfg:     pki.config(":5696", "key-1"),
+			wantErr: true,
+		},
+		"missing client certificate": {
+			cfg:     uri.KMIPConfig{Endpoint: "hsm.example.com:5696", KeyID: "key-1", ClientCertPath: "/does/not/exist.pem", ClientKeyPath: "/does/not/exist.pem"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var err error
+			if tc.noStore {
+				_, err = New(t.Context(), nil, tc.cfg)
+			} else {
+				_, err = New(t.Context(), memfs.New(), tc.cfg)
+			}
+			assert.Equal(tc.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	success := structure(tagResponseMessage,
+		structure(tagBatchItem,
+			enumeration(tagOperation, operationEncrypt),
+			enumeration(tagResultStatus, resultStatusSuccess),
+			structure(tagResponsePayload, byteString(tagData, []byte("data"))),
+		),
+	)
+	failure := structure(tagResponseMessage,
+		structure(tagBatchItem,
+			enumeration(tagOperation, operationEncrypt),
+			enumeration(tagResultStatus, 1),
+			enumeration(tagResultReason, 1),
+			textString(tagResultMessage, "item not found"),
+		),
+	)
+
+	testCases := map[string]struct {
+		response  item
+		operation uint32
+		wantErr   bool
+	}{
+		"success": {
+			response:  success,
+			operation: operationEncrypt,
+		},
+		"operation failed": {
+			response:  failure,
+			operation: operationEncrypt,
+			wantErr:   true,
+		},
+		"response for other operation": {
+			response:  success,
+			operation: operationDecrypt,
+			wantErr:   true,
+		},
+		"no batch item": {
+			response:  structure(tagResponseMessage),
+			operation: operationEncrypt,
+			wantErr:   true,
+		},
+		"not a response": {
+			response:  structure(tagRequestMessage),
+			operation: operationEncrypt,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			payload, err := parseResponse(tc.response, tc.operation)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			data, ok := payload.child(tagData)
+			assert.True(ok)
+			assert.Equal([]byte("data"), data.value)
+		})
+	}
+}
+
+// testPKI holds a CA and certificates for the server and client signed by it.
+type testPKI struct {
+	dir        string
+	serverCert tls.Certificate
+	pool       *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	require := require.New(t)
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "KMIP CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(err)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+
+	issue := func(serial int64, template *x509.Certificate) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(err)
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = caTemplate.NotBefore
+		template.NotAfter = caTemplate.NotAfter
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		require.NoError(err)
+		return der, key
+	}
+
+	serverDER, serverKey := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "KMIP server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientDER, clientKey := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "constellation"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", clientDER)
+	clientKeyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	require.NoError(err)
+	writePEM(t, filepath.Join(dir, "client-key.pem"), "PRIVATE KEY", clientKeyDER)
+
+	return &testPKI{
+		dir:        dir,
+		serverCert: tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey},
+		pool:       pool,
+	}
+}
+
+func (p *testPKI) config(endpoint, keyID string) uri.KMIPConfig {
+	return uri.KMIPConfig{
+		Endpoint:       endpoint,
+		KeyID:          keyID,
+		ClientCertPath: filepath.Join(p.dir, "client.pem"),
+		ClientKeyPath:  filepath.Join(p.dir, "client-key.pem"),
+		CACertPath:     filepath.Join(p.dir, "ca.pem"),
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+}
+
+// fakeKMIPServer is a minimal KMIP server supporting the Encrypt and Decrypt operations with AES-GCM keys.
+type fakeKMIPServer struct {
+	addr     string
+	listener net.Listener
+	keys     map[string]cipher.AEAD
+	wg       sync.WaitGroup
+}
+
+func newFakeKMIPServer(t *testing.T, pki *testPKI, keyIDs ...string) *fakeKMIPServer {
+	t.Helper()
+	require := require.New(t)
+
+	keys := make(map[string]cipher.AEAD)
+	for _, id := range keyIDs {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(err)
+		block, err := aes.NewCipher(key)
+		require.NoError(err)
+		keys[id], err = cipher.NewGCM(block)
+		require.NoError(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(err)
+
+	s := &fakeKMIPServer{addr: listener.Addr().String(), listener: listener, keys: keys}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+func (s *fakeKMIPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			request, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(s.handle(request).marshal())
+		}()
+	}
+}
+
+func (s *fakeKMIPServer) handle(request item) item {
+	batchItem, _ := request.child(tagBatchItem)
+	opItem, _ := batchItem.child(tagOperation)
+	operation, _ := opItem.uint32()
+	payload, _ := batchItem.child(tagRequestPayload)
+
+	fail := func(message string) item {
+		return structure(tagResponseMessage,
+			structure(tagBatchItem,
+				enumeration(tagOperation, operation),
+				enumeration(tagResultStatus, 1),
+				enumeration(tagResultReason, 1),
+				textString(tagResultMessage, message),
+			),
+		)
+	}
+	success := func(fields ...item) item {
+		return structure(tagResponseMessage,
+			structure(tagBatchItem,
+				enumeration(tagOperation, operation),
+				enumeration(tagResultStatus, resultStatusSuccess),
+				structure(tagResponsePayload, fields...),
+			),
+		)
+	}
+
+	id, _ := payload.child(tagUniqueIdentifier)
+	aead, ok := s.keys[string(id.value)]
+	if !ok {
+		return fail("item not found")
+	}
+	params, _ := payload.child(tagCryptographicParameters)
+	modeItem, _ := params.child(tagBlockCipherMode)
+	if mode, _ := modeItem.uint32(); mode != blockCipherModeGCM {
+		return fail("unsupported block cipher mode")
+	}
+	data, _ := payload.child(tagData)
+
+	switch operation {
+	case operationEncrypt:
+		nonce := make([]byte, aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		sealed := aead.Seal(nil, nonce, data.value, nil)
+		return success(
+			id,
+			byteString(tagData, sealed[:len(sealed)-aead.Overhead()]),
+			byteString(tagIVCounterNonce, nonce),
+			byteString(tagAuthenticatedEncryptionTag, sealed[len(sealed)-aead.Overhead():]),
+		)
+	case operationDecrypt:
+		nonce, _ := payload.child(tagIVCounterNonce)
+		tag, _ := payload.child(tagAuthenticatedEncryptionTag)
+		if len(nonce.value) != aead.NonceSize() {
+			return fail("invalid IV")
+		}
+		plaintext, err := aead.Open(nil, nonce.value, append(append([]byte{}, data.value...), tag.value...), nil)
+		if err != nil {
+			return fail("authentication tag verification failed")
+		}
+		return success(id, byteString(tagData, plaintext))
+	default:
+		return fail("operation not supported")
+	}
+}
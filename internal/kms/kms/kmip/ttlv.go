@@ -0,0 +1,182 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package kmip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Tags of the KMIP objects used by this package.
+const (
+	tagAuthenticatedEncryptionTag uint32 = 0x4200FF
+	tagBatchCount                 uint32 = 0x42000D
+	tagBatchItem                  uint32 = 0x42000F
+	tagBlockCipherMode            uint32 = 0x420011
+	tagCryptographicAlgorithm     uint32 = 0x420028
+	tagCryptographicParameters    uint32 = 0x42002B
+	tagData                       uint32 = 0x4200C2
+	tagIVCounterNonce             uint32 = 0x42003D
+	tagOperation                  uint32 = 0x42005C
+	tagProtocolVersion            uint32 = 0x420069
+	tagProtocolVersionMajor       uint32 = 0x42006A
+	tagProtocolVersionMinor       uint32 = 0x42006B
+	tagRequestHeader              uint32 = 0x420077
+	tagRequestMessage             uint32 = 0x420078
+	tagRequestPayload             uint32 = 0x420079
+	tagResponseMessage            uint32 = 0x42007B
+	tagResponsePayload            uint32 = 0x42007C
+	tagResultMessage              uint32 = 0x42007D
+	tagResultReason               uint32 = 0x42007E
+	tagResultStatus               uint32 = 0x42007F
+	tagUniqueIdentifier           uint32 = 0x420094
+)
+
+// Item types of TTLV encoding.
+const (
+	typeStructure   byte = 0x01
+	typeInteger     byte = 0x02
+	typeEnumeration byte = 0x05
+	typeTextString  byte = 0x07
+	typeByteString  byte = 0x08
+)
+
+// Enumeration values used by this package.
+const (
+	operationEncrypt uint32 = 0x1F
+	operationDecrypt uint32 = 0x20
+
+	resultStatusSuccess uint32 = 0x00
+
+	cryptographicAlgorithmAES uint32 = 0x03
+	blockCipherModeGCM        uint32 = 0x09
+)
+
+// maxMessageSize bounds the size of messages read from a KMIP server.
+const maxMessageSize = 1 << 20
+
+// item is a single Tag-Type-Length-Value encoded KMIP object.
+// Structures hold their children, all other types hold their raw value.
+type item struct {
+	tag      uint32
+	typ      byte
+	value    []byte
+	children []item
+}
+
+func structure(tag uint32, children ...item) item {
+	return item{tag: tag, typ: typeStructure, children: children}
+}
+
+func integer(tag uint32, value int32) item {
+	return item{tag: tag, typ: typeInteger, value: binary.BigEndian.AppendUint32(nil, uint32(value))}
+}
+
+func enumeration(tag uint32, value uint32) item {
+	return item{tag: tag, typ: typeEnumeration, value: binary.BigEndian.AppendUint32(nil, value)}
+}
+
+func textString(tag uint32, value string) item {
+	return item{tag: tag, typ: typeTextString, value: []byte(value)}
+}
+
+func byteString(tag uint32, value []byte) item {
+	return item{tag: tag, typ: typeByteString, value: value}
+}
+
+// marshal returns the TTLV encoding of the item.
+func (i item) marshal() []byte {
+	value := i.value
+	if i.typ == typeStructure {
+		value = nil
+		for _, child := range i.children {
+			value = append(value, child.marshal()...)
+		}
+	}
+
+	out := make([]byte, 0, 8+len(value)+padding(len(value)))
+	out = append(out, byte(i.tag>>16), byte(i.tag>>8), byte(i.tag))
+	out = append(out, i.typ)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(value)))
+	out = append(out, value...)
+	return append(out, make([]byte, padding(len(value)))...)
+}
+
+// unmarshal decodes a single item from data and returns the remaining bytes.
+func unmarshal(data []byte) (item, []byte, error) {
+	if len(data) < 8 {
+		return item{}, nil, errors.New("TTLV item too short")
+	}
+	i := item{
+		tag: uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]),
+		typ: data[3],
+	}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	data = data[8:]
+	if length > len(data) {
+		return item{}, nil, fmt.Errorf("TTLV item %06X: length %d exceeds remaining %d bytes", i.tag, length, len(data))
+	}
+	value := data[:length]
+	data = data[min(length+padding(length), len(data)):]
+
+	if i.typ != typeStructure {
+		i.value = value
+		return i, data, nil
+	}
+	for len(value) > 0 {
+		child, rest, err := unmarshal(value)
+		if err != nil {
+			return item{}, nil, err
+		}
+		i.children = append(i.children, child)
+		value = rest
+	}
+	return i, data, nil
+}
+
+// readMessage reads a single TTLV encoded message from r.
+func readMessage(r io.Reader) (item, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return item{}, fmt.Errorf("reading message header: %w", err)
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > maxMessageSize {
+		return item{}, fmt.Errorf("message of %d bytes exceeds maximum size", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return item{}, fmt.Errorf("reading message body: %w", err)
+	}
+	msg, _, err := unmarshal(append(header, body...))
+	return msg, err
+}
+
+// child returns the first child with the given tag.
+func (i item) child(tag uint32) (item, bool) {
+	for _, child := range i.children {
+		if child.tag == tag {
+			return child, true
+		}
+	}
+	return item{}, false
+}
+
+// uint32 returns the value of an Integer or Enumeration item.
+func (i item) uint32() (uint32, error) {
+	if (i.typ != typeInteger && i.typ != typeEnumeration) || len(i.value) != 4 {
+		return 0, fmt.Errorf("TTLV item %06X is not an integer or enumeration", i.tag)
+	}
+	return binary.BigEndian.Uint32(i.value), nil
+}
+
+// padding returns the number of bytes needed to align length to 8 bytes.
+func padding(length int) int {
+	return (8 - length%8) % 8
+}
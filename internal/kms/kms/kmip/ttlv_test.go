@@ -0,0 +1,78 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package kmip
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The test vectors are taken from the examples of the KMIP specification.
+func TestMarshal(t *testing.T) {
+	testCases := map[string]struct {
+		item item
+		want string
+	}{
+		"integer": {
+			item: integer(0x420020, 8),
+			want: "42002002 00000004 00000008 00000000",
+		},
+		"enumeration": {
+			item: enumeration(0x420020, 255),
+			want: "42002005 00000004 000000FF 00000000",
+		},
+		"text string": {
+			item: textString(0x420020, "Hello World"),
+			want: "42002007 0000000B 48656C6C 6F20576F 726C6400 00000000",
+		},
+		"byte string": {
+			item: byteString(0x420020, []byte{0x01, 0x02, 0x03}),
+			want: "42002008 00000003 01020300 00000000",
+		},
+		"structure": {
+			item: structure(0x420020, enumeration(0x420004, 254), integer(0x420005, 255)),
+			want: "42002001 00000020 42000405 00000004 000000FE 00000000 42000502 00000004 000000FF 00000000",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			want, err := hex.DecodeString(strings.ReplaceAll(tc.want, " ", ""))
+			require.NoError(err)
+			assert.Equal(want, tc.item.marshal())
+
+			got, err := readMessage(bytes.NewReader(want))
+			require.NoError(err)
+			assert.Equal(tc.item, got)
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	testCases := map[string]string{
+		"too short":                 "420020",
+		"length exceeds data":       "42002008 00000010 01020300 00000000",
+		"child length exceeds data": "42002001 00000010 42000408 00000010 00000000",
+	}
+
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			raw, err := hex.DecodeString(strings.ReplaceAll(data, " ", ""))
+			require.NoError(t, err)
+			_, _, err = unmarshal(raw)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -9,8 +9,19 @@ package kms
 
 import (
 	"context"
+	"strconv"
 )
 
+// VersionedKeyID returns the ID of the given version of the key keyID.
+// Versions are appended as "/v<version>", so the IDs of all versions are below the key's ID,
+// and destroying the key also destroys all of its versions. Version 0 uses the unmodified key ID.
+func VersionedKeyID(keyID string, version uint32) string {
+	if version == 0 {
+		return keyID
+	}
+	return keyID + "/v" + strconv.FormatUint(uint64(version), 10)
+}
+
 // CloudKMS enables using cloud base Key Management Services.
 type CloudKMS interface {
 	// GetDEK returns the DEK for dekID and kekID from the KMS.
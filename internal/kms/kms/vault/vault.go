@@ -0,0 +1,239 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package vault implements a KMS backend for the Transit secrets engine of HashiCorp Vault and OpenBao.
+
+DEKs are wrapped by the Transit key and stored in the configured storage backend.
+Vault keeps all versions of the Transit key, so DEKs wrapped before a key rotation can still be unwrapped.
+*/
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	kmsInterface "github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/internal"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	wrapping "github.com/hashicorp/go-kms-wrapping/v2"
+)
+
+// requestTimeout bounds a single request to Vault.
+const requestTimeout = 30 * time.Second
+
+// KMSClient implements the CloudKMS interface for the Vault Transit secrets engine.
+type KMSClient struct {
+	kms *internal.KMSClient
+}
+
+// New creates and initializes a new KMSClient for Vault.
+func New(_ context.Context, store kmsInterface.Storage, cfg uri.VaultConfig) (*KMSClient, error) {
+	if store == nil {
+		return nil, errors.New("no storage backend provided for KMS")
+	}
+
+	wrapper, err := newTransitWrapper(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("setting Vault Transit config: %w", err)
+	}
+	return &KMSClient{
+		kms: &internal.KMSClient{
+			Storage: store,
+			Wrapper: wrapper,
+		},
+	}, nil
+}
+
+// GetDEK fetches an encrypted Data Encryption Key from storage and decrypts it using a Vault Transit key.
+func (c *KMSClient) GetDEK(ctx context.Context, keyID string, dekSize int) ([]byte, error) {
+	return c.kms.GetDEK(ctx, keyID, dekSize)
+}
+
+// Close releases idle connections to Vault.
+func (c *KMSClient) Close() {
+	if wrapper, ok := c.kms.Wrapper.(*transitWrapper); ok {
+		wrapper.client.CloseIdleConnections()
+	}
+}
+
+// transitWrapper wraps and unwraps data using the encrypt and decrypt endpoints of the Transit secrets engine.
+type transitWrapper struct {
+	client    *http.Client
+	address   string
+	token     string
+	mountPath string
+	keyName   string
+	namespace string
+}
+
+func newTransitWrapper(cfg uri.VaultConfig) (*transitWrapper, error) {
+	address, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Vault address: %w", err)
+	}
+	if address.Scheme != "http" && address.Scheme != "https" {
+		return nil, fmt.Errorf("invalid Vault address %q: scheme must be http or https", cfg.Address)
+	}
+	if cfg.KeyName == "" {
+		return nil, errors.New("no Transit key name provided")
+	}
+	mountPath := strings.Trim(cfg.MountPath, "/")
+	if mountPath == "" {
+		mountPath = "transit"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACertPath != "" {
+		caCert, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading Vault CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificate found in %s", cfg.CACertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &transitWrapper{
+		client:    &http.Client{Transport: transport, Timeout: requestTimeout},
+		address:   strings.TrimSuffix(address.String(), "/"),
+		token:     cfg.Token,
+		mountPath: mountPath,
+		keyName:   cfg.KeyName,
+		namespace: cfg.Namespace,
+	}, nil
+}
+
+// Encrypt wraps plaintext with the Transit key.
+// The returned ciphertext is Vault's versioned ciphertext, e.g., "vault:v1:...".
+func (w *transitWrapper) Encrypt(ctx context.Context, plaintext []byte, _ ...wrapping.Option) (*wrapping.BlobInfo, error) {
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	if err := w.do(ctx, "encrypt", w.keyName, req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Ciphertext == "" {
+		return nil, errors.New("no ciphertext returned by Vault")
+	}
+
+	return &wrapping.BlobInfo{
+		Ciphertext: []byte(resp.Ciphertext),
+		KeyInfo:    &wrapping.KeyInfo{KeyId: w.keyName},
+	}, nil
+}
+
+// Decrypt unwraps a blob created by Encrypt.
+// The blob is unwrapped with the Transit key it was created with, even if the configured key changed since.
+func (w *transitWrapper) Decrypt(ctx context.Context, blob *wrapping.BlobInfo, _ ...wrapping.Option) ([]byte, error) {
+	if blob == nil || len(blob.Ciphertext) == 0 {
+		return nil, errors.New("no ciphertext provided")
+	}
+	keyName := w.keyName
+	if blob.KeyInfo != nil && blob.KeyInfo.KeyId != "" {
+		keyName = blob.KeyInfo.KeyId
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	req := map[string]string{"ciphertext": string(blob.Ciphertext)}
+	if err := w.do(ctx, "decrypt", keyName, req, &resp); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decoding plaintext: %w", err)
+	}
+	return plaintext, nil
+}
+
+// do sends a request to a Transit endpoint and decodes the data of the response into out.
+func (w *transitWrapper) do(ctx context.Context, operation, keyName string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", w.address, w.mountPath, operation, url.PathEscape(keyName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", w.token)
+	req.Header.Set("X-Vault-Request", "true")
+	if w.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", w.namespace)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending %s request to Vault: %w", operation, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("reading %s response from Vault: %w", operation, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respErr := &ResponseError{Operation: operation, StatusCode: resp.StatusCode}
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(respBody, &errResp); err == nil {
+			respErr.Errors = errResp.Errors
+		}
+		return respErr
+	}
+
+	var data struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &data); err != nil {
+		return fmt.Errorf("unmarshaling %s response from Vault: %w", operation, err)
+	}
+	if err := json.Unmarshal(data.Data, out); err != nil {
+		return fmt.Errorf("unmarshaling %s response data from Vault: %w", operation, err)
+	}
+	return nil
+}
+
+// ResponseError is returned if Vault responds to a request with an error status.
+type ResponseError struct {
+	Operation  string
+	StatusCode int
+	Errors     []string
+}
+
+// Error returns the error message.
+func (e *ResponseError) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("%s request to Vault failed with status %d: %s", e.Operation, e.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	return fmt.Sprintf("%s request to Vault failed with status %d", e.Operation, e.StatusCode)
+}
+
+// HTTPStatusCode returns the HTTP status code of the response.
+func (e *ResponseError) HTTPStatusCode() int {
+	return e.StatusCode
+}
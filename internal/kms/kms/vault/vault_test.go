@@ -0,0 +1,306 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage/memfs"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	wrapping "github.com/hashicorp/go-kms-wrapping/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestGetDEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	transit := newFakeTransit(t, "root", "team-a", "disk-key")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+
+	store := memfs.New()
+	client, err := New(t.Context(), store, uri.VaultConfig{
+		Address: server.URL, Token: "root", MountPath: "transit", KeyName: "disk-key", Namespace: "team-a",
+	})
+	require.NoError(err)
+	defer client.Close()
+
+	dek, err := client.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Len(dek, 32)
+
+	// The DEK is only stored wrapped.
+	stored, err := store.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	var blob wrapping.BlobInfo
+	require.NoError(json.Unmarshal(stored, &blob))
+	assert.True(strings.HasPrefix(string(blob.Ciphertext), "vault:v1:"))
+	assert.NotContains(string(stored), base64.StdEncoding.EncodeToString(dek))
+
+	again, err := client.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal(dek, again)
+
+	// DEKs wrapped before a rotation of the Transit key can still be unwrapped.
+	transit.rotate("disk-key")
+	afterRotation, err := client.GetDEK(t.Context(), "volume-01", 32)
+	require.NoError(err)
+	assert.Equal(dek, afterRotation)
+
+	other, err := client.GetDEK(t.Context(), "volume-02", 32)
+	require.NoError(err)
+	assert.NotEqual(dek, other)
+	// New DEKs are wrapped with the latest key version.
+	stored, err = store.Get(t.Context(), "volume-02")
+	require.NoError(err)
+	require.NoError(json.Unmarshal(stored, &blob))
+	assert.True(strings.HasPrefix(string(blob.Ciphertext), "vault:v2:"))
+}
+
+func TestGetDEKErrors(t *testing.T) {
+	testCases := map[string]struct {
+		cfg uri.VaultConfig
+	}{
+		"invalid token": {
+			cfg: uri.VaultConfig{Token: "invalid", MountPath: "transit", KeyName: "disk-key"},
+		},
+		"unknown key": {
+			cfg: uri.VaultConfig{Token: "root", MountPath: "transit", KeyName: "unknown"},
+		},
+		"wrong mount path": {
+			cfg: uri.VaultConfig{Token: "root", MountPath: "kv", KeyName: "disk-key"},
+		},
+		"wrong namespace": {
+			cfg: uri.VaultConfig{Token: "root", MountPath: "transit", KeyName: "disk-key", Namespace: "team-b"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			server := httptest.NewServer(newFakeTransit(t, "root", "", "disk-key"))
+			defer server.Close()
+
+			tc.cfg.Address = server.URL
+			client, err := New(t.Context(), memfs.New(), tc.cfg)
+			require.NoError(err)
+			defer client.Close()
+
+			_, err = client.GetDEK(t.Context(), "volume-01", 32)
+			assert.Error(err)
+		})
+	}
+}
+
+func TestGetDEKCorruptedCiphertext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(newFakeTransit(t, "root", "", "disk-key"))
+	defer server.Close()
+
+	store := memfs.New()
+	blob, err := json.Marshal(&wrapping.BlobInfo{Ciphertext: []byte("vault:v1:AAAA"), KeyInfo: &wrapping.KeyInfo{KeyId: "disk-key"}})
+	require.NoError(err)
+	require.NoError(store.Put(t.Context(), "volume-01", blob))
+
+	client, err := New(t.Context(), store, uri.VaultConfig{Address: server.URL, Token: "root", MountPath: "transit", KeyName: "disk-key"})
+	require.NoError(err)
+	defer client.Close()
+
+	_, err = client.GetDEK(t.Context(), "volume-01", 32)
+	assert.ErrorContains(err, "invalid ciphertext")
+}
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		noStore bool
+		cfg     uri.VaultConfig
+		wantErr bool
+	}{
+		"valid config": {
+			cfg: uri.VaultConfig{Address: "https://vault.example.com:8200", Token: "root", KeyName: "disk-key"},
+		},
+		"no storage": {
+			noStore: true,
+			cfg:     uri.VaultConfig{Address: "https://vault.example.com:8200", Token: "root", KeyName: "disk-key"},
+			wantErr: true,
+		},
+		"invalid address": {
+			cfg:     uri.VaultConfig{Address: "vault.example.com:8200", Token: "root", KeyName: "disk-key"},
+			wantErr: true,
+		},
+		"no key name": {
+			cfg:     uri.VaultConfig{Address: "https://vault.example.com:8200", Token: "root"},
+			wantErr: true,
+		},
+		"missing CA certificate": {
+			cfg:     uri.VaultConfig{Address: "https://vault.example.com:8200", Token: "root", KeyName: "disk-key", CACertPath: "/does/not/exist.pem"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var client *KMSClient
+			var err error
+			if tc.noStore {
+				client, err = New(t.Context(), nil, tc.cfg)
+			} else {
+				client, err = New(t.Context(), memfs.New(), tc.cfg)
+			}
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			client.Close()
+		})
+	}
+}
+
+// fakeTransit is a minimal stand-in for the Transit secrets engine of a Vault dev server mounted at "transit".
+type fakeTransit struct {
+	t         *testing.T
+	token     string
+	namespace string
+
+	mux  sync.Mutex
+	keys map[string][]cipher.AEAD
+}
+
+func newFakeTransit(t *testing.T, token, namespace string, keyNames ...string) *fakeTransit {
+	f := &fakeTransit{t: t, token: token, namespace: namespace, keys: make(map[string][]cipher.AEAD)}
+	for _, name := range keyNames {
+		f.rotate(name)
+	}
+	return f
+}
+
+// rotate adds a new version to the key.
+func (f *fakeTransit) rotate(name string) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(f.t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(f.t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(f.t, err)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.keys[name] = append(f.keys[name], aead)
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != f.token {
+		writeErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	if r.Header.Get("X-Vault-Namespace") != f.namespace {
+		writeErrors(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "v1" || parts[1] != "transit" || r.Method != http.MethodPost {
+		writeErrors(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	operation, keyName := parts[2], parts[3]
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	f.mux.Lock()
+	versions := f.keys[keyName]
+	f.mux.Unlock()
+	if len(versions) == 0 {
+		writeErrors(w, http.StatusBadRequest, "encryption key not found")
+		return
+	}
+
+	switch operation {
+	case "encrypt":
+		plaintext, err := base64.StdEncoding.DecodeString(req["plaintext"])
+		if err != nil {
+			writeErrors(w, http.StatusBadRequest, "invalid plaintext")
+			return
+		}
+		aead := versions[len(versions)-1]
+		nonce := make([]byte, aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+		writeData(w, map[string]string{
+			"ciphertext": fmt.Sprintf("vault:v%d:%s", len(versions), base64.StdEncoding.EncodeToString(ciphertext)),
+		})
+
+	case "decrypt":
+		plaintext, ok := decrypt(versions, req["ciphertext"])
+		if !ok {
+			writeErrors(w, http.StatusBadRequest, "invalid ciphertext: unable to decrypt")
+			return
+		}
+		writeData(w, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+
+	default:
+		writeErrors(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+func decrypt(versions []cipher.AEAD, ciphertext string) ([]byte, bool) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return nil, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil || version < 1 || version > len(versions) {
+		return nil, false
+	}
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	aead := versions[version-1]
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, false
+	}
+	plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	return plaintext, err == nil
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+}
@@ -12,6 +12,9 @@ but only to create them.
 
 Adding support for a new KMS or storage backend requires adding a new URI for that backend,
 and implementing the corresponding get*Config function.
+
+Clients of external KMS backends are wrapped in a cache, since every request to them is a remote call, which is rate limited.
+The cluster KMS derives keys locally and isn't cached.
 */
 package setup
 
@@ -23,11 +26,16 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms/aws"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms/azure"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cache"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms/gcp"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/kmip"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/vault"
 	"github.com/edgelesssys/constellation/v2/internal/kms/storage/awss3"
 	"github.com/edgelesssys/constellation/v2/internal/kms/storage/azureblob"
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage/filestore"
 	"github.com/edgelesssys/constellation/v2/internal/kms/storage/gcs"
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage/s3compat"
 	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 )
 
@@ -48,6 +56,12 @@ func KMS(ctx context.Context, storageURI, kmsURI string) (kms.CloudKMS, error) {
 	return getKMS(ctx, kmsURI, store)
 }
 
+// Storage creates a key store from the given storage URI.
+// Returns nil if the URI is uri.NoStoreURI.
+func Storage(ctx context.Context, storageURI string) (kms.Storage, error) {
+	return getStore(ctx, storageURI)
+}
+
 // getStore creates a key store depending on the given parameters.
 func getStore(ctx context.Context, storageURI string) (kms.Storage, error) {
 	url, err := url.Parse(storageURI)
@@ -80,6 +94,20 @@ func getStore(ctx context.Context, storageURI string) (kms.Storage, error) {
 		}
 		return gcs.New(ctx, cfg)
 
+	case "s3compat":
+		cfg, err := uri.DecodeS3CompatConfigFromURI(storageURI)
+		if err != nil {
+			return nil, err
+		}
+		return s3compat.New(ctx, cfg)
+
+	case "file":
+		cfg, err := uri.DecodeFileStoreConfigFromURI(storageURI)
+		if err != nil {
+			return nil, err
+		}
+		return filestore.New(cfg)
+
 	case "no-store":
 		return nil, nil
 
@@ -104,30 +132,52 @@ func getKMS(ctx context.Context, kmsURI string, store kms.Storage) (kms.CloudKMS
 		if err != nil {
 			return nil, fmt.Errorf("invalid AWS KMS URI: %w", err)
 		}
-		return aws.New(ctx, store, cfg)
+		return cached(aws.New(ctx, store, cfg))
 
 	case "azure":
 		cfg, err := uri.DecodeAzureConfigFromURI(kmsURI)
 		if err != nil {
 			return nil, fmt.Errorf("invalid Azure Key Vault URI: %w", err)
 		}
-		return azure.New(ctx, store, cfg)
+		return cached(azure.New(ctx, store, cfg))
 
 	case "gcp":
 		cfg, err := uri.DecodeGCPConfigFromURI(kmsURI)
 		if err != nil {
 			return nil, fmt.Errorf("invalid GCP KMS URI: %w", err)
 		}
-		return gcp.New(ctx, store, cfg)
+		return cached(gcp.New(ctx, store, cfg))
+
+	case "kmip":
+		cfg, err := uri.DecodeKMIPConfigFromURI(kmsURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KMIP URI: %w", err)
+		}
+		return cached(kmip.New(ctx, store, cfg))
+
+	case "vault":
+		cfg, err := uri.DecodeVaultConfigFromURI(kmsURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Vault KMS URI: %w", err)
+		}
+		return cached(vault.New(ctx, store, cfg))
 
 	case "cluster-kms":
 		cfg, err := uri.DecodeMasterSecretFromURI(kmsURI)
 		if err != nil {
 			return nil, err
 		}
-		return cluster.New(cfg.Key, cfg.Salt)
+		return cluster.NewFromMasterSecret(cfg)
 
 	default:
 		return nil, fmt.Errorf("unknown KMS type: %s", url.Host)
 	}
 }
+
+// cached wraps the client of an external KMS in a cache.
+func cached(client kms.CloudKMS, err error) (kms.CloudKMS, error) {
+	if err != nil {
+		return nil, err
+	}
+	return cache.New(client, cache.Options{}), nil
+}
@@ -9,6 +9,8 @@ package setup
 import (
 	"testing"
 
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cache"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
@@ -32,5 +34,38 @@ func TestSetUpKMS(t *testing.T) {
 	masterSecret := uri.MasterSecret{Key: []byte("key"), Salt: []byte("salt")}
 	kms, err = KMS(t.Context(), "storage://no-store", masterSecret.EncodeToURI())
 	assert.NoError(err)
+	assert.IsType(&cluster.KMS{}, kms)
+
+	fileStore := uri.FileStoreConfig{Path: t.TempDir()}
+	kms, err = KMS(t.Context(), fileStore.EncodeToURI(), masterSecret.EncodeToURI())
+	assert.NoError(err)
 	assert.NotNil(kms)
+
+	// Vault requires a storage backend for the wrapped DEKs.
+	vaultCfg := uri.VaultConfig{Address: "https://vault.example.com:8200", Token: "token", MountPath: "transit", KeyName: "key"}
+	kms, err = KMS(t.Context(), "storage://no-store", vaultCfg.EncodeToURI())
+	assert.Error(err)
+	assert.Nil(kms)
+
+	// clients of external KMS backends are cached
+	kms, err = KMS(t.Context(), fileStore.EncodeToURI(), vaultCfg.EncodeToURI())
+	assert.NoError(err)
+	assert.IsType(&cache.KMS{}, kms)
+}
+
+func TestSetUpStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := Storage(t.Context(), "storage://unknown")
+	assert.Error(err)
+	assert.Nil(store)
+
+	store, err = Storage(t.Context(), uri.NoStoreURI)
+	assert.NoError(err)
+	assert.Nil(store)
+
+	fileStore := uri.FileStoreConfig{Path: t.TempDir()}
+	store, err = Storage(t.Context(), fileStore.EncodeToURI())
+	assert.NoError(err)
+	assert.NotNil(store)
 }
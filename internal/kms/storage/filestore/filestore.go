@@ -0,0 +1,89 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package filestore implements a storage backend for the KMS that stores keys as files in a local directory.
+
+Each DEK is stored in its own file. File names are the base64url encoded key IDs,
+so key IDs can't escape the directory.
+Files are written atomically, so a crash never leaves a partially written DEK behind.
+*/
+package filestore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+)
+
+// Storage is an implementation of the Storage interface, storing keys in a local directory.
+type Storage struct {
+	dir string
+}
+
+// New creates a Storage using the directory of the provided config.
+// The directory is created if it doesn't exist.
+func New(cfg uri.FileStoreConfig) (*Storage, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("no storage directory provided")
+	}
+	if err := os.MkdirAll(cfg.Path, 0o700); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %w", err)
+	}
+	return &Storage{dir: cfg.Path}, nil
+}
+
+// Get returns a DEK from the directory by key ID.
+func (s *Storage) Get(_ context.Context, keyID string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(keyID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, storage.ErrDEKUnset
+		}
+		return nil, fmt.Errorf("reading DEK from storage: %w", err)
+	}
+	return data, nil
+}
+
+// Put saves a DEK to the directory by key ID.
+func (s *Storage) Put(_ context.Context, keyID string, data []byte) (retErr error) {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("writing DEK to storage: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing DEK to storage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(keyID)); err != nil {
+		return fmt.Errorf("moving DEK into place: %w", err)
+	}
+	return nil
+}
+
+// path returns the path of the file holding the DEK with the given key ID.
+func (s *Storage) path(keyID string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(keyID)))
+}
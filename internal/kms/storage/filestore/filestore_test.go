@@ -0,0 +1,97 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestStorage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(t.TempDir(), "deks")
+	store, err := New(uri.FileStoreConfig{Path: dir})
+	require.NoError(err)
+
+	_, err = store.Get(t.Context(), "volume-01")
+	assert.ErrorIs(err, storage.ErrDEKUnset)
+
+	require.NoError(store.Put(t.Context(), "volume-01", []byte("wrapped-dek")))
+	dek, err := store.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	assert.Equal([]byte("wrapped-dek"), dek)
+
+	require.NoError(store.Put(t.Context(), "volume-01", []byte("rewrapped-dek")))
+	dek, err = store.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	assert.Equal([]byte("rewrapped-dek"), dek)
+
+	// Key IDs can't escape the directory.
+	require.NoError(store.Put(t.Context(), "../escaped", []byte("wrapped-dek")))
+	_, err = os.Stat(filepath.Join(dir, "..", "escaped"))
+	assert.ErrorIs(err, os.ErrNotExist)
+	dek, err = store.Get(t.Context(), "../escaped")
+	require.NoError(err)
+	assert.Equal([]byte("wrapped-dek"), dek)
+
+	// No temporary files are left behind, and DEKs are only readable by the owner.
+	entries, err := os.ReadDir(dir)
+	require.NoError(err)
+	assert.Len(entries, 2)
+	info, err := os.Stat(dir)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0o700), info.Mode().Perm())
+	for _, entry := range entries {
+		info, err := entry.Info()
+		require.NoError(err)
+		assert.Equal(os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	// DEKs persist across instances.
+	reopened, err := New(uri.FileStoreConfig{Path: dir})
+	require.NoError(err)
+	dek, err = reopened.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	assert.Equal([]byte("rewrapped-dek"), dek)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New(uri.FileStoreConfig{})
+	assert.Error(err)
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(os.WriteFile(file, nil, 0o600))
+	_, err = New(uri.FileStoreConfig{Path: filepath.Join(file, "deks")})
+	assert.Error(err)
+}
+
+func TestGetError(t *testing.T) {
+	dir := t.TempDir()
+	store, err := New(uri.FileStoreConfig{Path: dir})
+	require.NoError(t, err)
+
+	// Errors other than a missing file aren't reported as unset DEKs.
+	require.NoError(t, os.Mkdir(store.path("volume-01"), 0o700))
+	_, err = store.Get(t.Context(), "volume-01")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, storage.ErrDEKUnset)
+}
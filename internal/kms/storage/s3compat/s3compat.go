@@ -0,0 +1,157 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package s3compat implements a storage backend for the KMS using S3-compatible object storage, e.g., MinIO or Ceph RGW.
+
+Buckets are addressed path-style, so no wildcard DNS entries are required for the endpoint.
+*/
+package s3compat
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+)
+
+type s3ClientAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+}
+
+// Storage is an implementation of the Storage interface, storing keys in buckets of an S3-compatible object storage.
+type Storage struct {
+	bucketID string
+	client   s3ClientAPI
+}
+
+// New creates a Storage client for an S3-compatible object storage using the provided config.
+func New(ctx context.Context, cfg uri.S3CompatConfig) (*Storage, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("no S3 endpoint provided")
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.AccessKey, "")),
+		awsconfig.WithRegion(cfg.Region),
+	}
+	if cfg.CACertPath != "" {
+		httpClient, err := newHTTPClient(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, awsconfig.WithHTTPClient(httpClient))
+	}
+	clientCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading S3 client config: %w", err)
+	}
+
+	client := s3.NewFromConfig(clientCfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(cfg.Endpoint)
+		o.UsePathStyle = true
+	})
+
+	store := &Storage{client: client, bucketID: cfg.Bucket}
+
+	// Try to create new bucket, continue if bucket already exists
+	if err := store.createBucket(ctx, cfg.Bucket, cfg.Region); err != nil {
+		return nil, fmt.Errorf("creating storage bucket: %w", err)
+	}
+	return store, nil
+}
+
+// Get returns a DEK from the S3-compatible storage by key ID.
+func (s *Storage) Get(ctx context.Context, keyID string) ([]byte, error) {
+	getObjectInput := &s3.GetObjectInput{
+		Bucket: &s.bucketID,
+		Key:    &keyID,
+	}
+	output, err := s.client.GetObject(ctx, getObjectInput)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrDEKUnset
+		}
+		return nil, fmt.Errorf("downloading DEK from storage: %w", err)
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+// Put saves a DEK to the S3-compatible storage by key ID.
+func (s *Storage) Put(ctx context.Context, keyID string, data []byte) error {
+	putObjectInput := &s3.PutObjectInput{
+		Bucket: &s.bucketID,
+		Key:    &keyID,
+		Body:   bytes.NewReader(data),
+	}
+	if _, err := s.client.PutObject(ctx, putObjectInput); err != nil {
+		return fmt.Errorf("uploading DEK to storage: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) createBucket(ctx context.Context, bucketID, region string) error {
+	createBucketInput := &s3.CreateBucketInput{
+		Bucket: &bucketID,
+	}
+	// us-east-1 is the default region and must not be set as location constraint.
+	if region != "us-east-1" {
+		createBucketInput.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+
+	if _, err := s.client.CreateBucket(ctx, createBucketInput); err != nil {
+		var bne *types.BucketAlreadyExists
+		var baowby *types.BucketAlreadyOwnedByYou
+		if !(errors.As(err, &bne) || errors.As(err, &baowby)) {
+			return fmt.Errorf("creating storage container: %w", err)
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether err indicates a missing object.
+// Not all S3-compatible implementations return a NoSuchKey error, so a plain 404 response is accepted as well.
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return true
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// newHTTPClient creates an HTTP client trusting the CA certificate at caCertPath.
+func newHTTPClient(caCertPath string) (*http.Client, error) {
+	caCert, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading S3 CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no valid certificate found in %s", caCertPath)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport}, nil
+}
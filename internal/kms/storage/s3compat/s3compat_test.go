@@ -0,0 +1,271 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package s3compat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/constellation/v2/internal/kms/storage"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubS3Client struct {
+	getObjectOutputData []byte
+	getObjectErr        error
+	putObjectErr        error
+	savedObject         []byte
+	createBucketInput   *s3.CreateBucketInput
+	createBucketErr     error
+}
+
+func (s *stubS3Client) GetObject(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(s.getObjectOutputData)),
+	}, s.getObjectErr
+}
+
+func (s *stubS3Client) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	out, err := io.ReadAll(params.Body)
+	if err != nil {
+		panic(err)
+	}
+	s.savedObject = out
+	return &s3.PutObjectOutput{}, s.putObjectErr
+}
+
+func (s *stubS3Client) CreateBucket(_ context.Context, params *s3.CreateBucketInput, _ ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	s.createBucketInput = params
+	return &s3.CreateBucketOutput{}, s.createBucketErr
+}
+
+type stubResponseError struct {
+	statusCode int
+}
+
+func (e *stubResponseError) Error() string       { return http.StatusText(e.statusCode) }
+func (e *stubResponseError) HTTPStatusCode() int { return e.statusCode }
+
+func TestGet(t *testing.T) {
+	testCases := map[string]struct {
+		client     *stubS3Client
+		unsetError bool
+		wantErr    bool
+	}{
+		"Get successful": {
+			client: &stubS3Client{getObjectOutputData: []byte("test-data")},
+		},
+		"GetObject fails": {
+			client:  &stubS3Client{getObjectErr: errors.New("error")},
+			wantErr: true,
+		},
+		"GetObject fails with NoSuchKey": {
+			client:     &stubS3Client{getObjectErr: &types.NoSuchKey{}},
+			wantErr:    true,
+			unsetError: true,
+		},
+		"GetObject fails with status 404": {
+			client:     &stubS3Client{getObjectErr: &stubResponseError{statusCode: http.StatusNotFound}},
+			wantErr:    true,
+			unsetError: true,
+		},
+		"GetObject fails with status 403": {
+			client:  &stubS3Client{getObjectErr: &stubResponseError{statusCode: http.StatusForbidden}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store := &Storage{
+				client: tc.client,
+			}
+
+			out, err := store.Get(t.Context(), "test-key")
+			if tc.wantErr {
+				assert.Error(err)
+				assert.Equal(tc.unsetError, errors.Is(err, storage.ErrDEKUnset))
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.client.getObjectOutputData, out)
+		})
+	}
+}
+
+func TestPut(t *testing.T) {
+	testCases := map[string]struct {
+		client  *stubS3Client
+		wantErr bool
+	}{
+		"Put successful": {
+			client: &stubS3Client{},
+		},
+		"PutObject fails": {
+			client:  &stubS3Client{putObjectErr: errors.New("error")},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store := &Storage{
+				client: tc.client,
+			}
+
+			testData := []byte{0x1, 0x2, 0x3}
+
+			err := store.Put(t.Context(), "test-key", testData)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(testData, tc.client.savedObject)
+		})
+	}
+}
+
+func TestCreateBucket(t *testing.T) {
+	testCases := map[string]struct {
+		client                 *stubS3Client
+		region                 string
+		wantLocationConstraint bool
+		wantErr                bool
+	}{
+		"CreateBucket successful": {
+			client:                 &stubS3Client{},
+			region:                 "eu-central-1",
+			wantLocationConstraint: true,
+		},
+		"default region has no location constraint": {
+			client: &stubS3Client{},
+			region: "us-east-1",
+		},
+		"CreateBucket fails": {
+			client:  &stubS3Client{createBucketErr: errors.New("error")},
+			region:  "us-east-1",
+			wantErr: true,
+		},
+		"CreateBucket fails with BucketAlreadyExists": {
+			client: &stubS3Client{createBucketErr: &types.BucketAlreadyExists{}},
+			region: "us-east-1",
+		},
+		"CreateBucket fails with BucketAlreadyOwnedByYou": {
+			client: &stubS3Client{createBucketErr: &types.BucketAlreadyOwnedByYou{}},
+			region: "us-east-1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store := &Storage{
+				client: tc.client,
+			}
+
+			err := store.createBucket(t.Context(), "test-bucket", tc.region)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantLocationConstraint, tc.client.createBucketInput.CreateBucketConfiguration != nil)
+		})
+	}
+}
+
+func TestStorageAgainstEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backend := &fakeS3{buckets: make(map[string]map[string][]byte)}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	store, err := New(t.Context(), uri.S3CompatConfig{
+		Endpoint:    server.URL,
+		Bucket:      "deks",
+		Region:      "us-east-1",
+		AccessKeyID: "access-key-id",
+		AccessKey:   "access-key",
+	})
+	require.NoError(err)
+
+	_, err = store.Get(t.Context(), "volume-01")
+	assert.ErrorIs(err, storage.ErrDEKUnset)
+
+	require.NoError(store.Put(t.Context(), "volume-01", []byte("wrapped-dek")))
+	dek, err := store.Get(t.Context(), "volume-01")
+	require.NoError(err)
+	assert.Equal([]byte("wrapped-dek"), dek)
+
+	// Buckets are addressed path-style.
+	assert.Contains(backend.buckets, "deks")
+	assert.Equal([]byte("wrapped-dek"), backend.buckets["deks"]["volume-01"])
+
+	// An existing bucket is reused.
+	_, err = New(t.Context(), uri.S3CompatConfig{
+		Endpoint: server.URL, Bucket: "deks", Region: "us-east-1", AccessKeyID: "access-key-id", AccessKey: "access-key",
+	})
+	require.NoError(err)
+}
+
+// fakeS3 is a minimal path-style S3 endpoint.
+// Like some S3-compatible implementations, it answers requests for missing objects with a plain 404.
+type fakeS3 struct {
+	mux     sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPut && key == "":
+		if _, ok := f.buckets[bucket]; ok {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>BucketAlreadyOwnedByYou</Code></Error>`)
+			return
+		}
+		f.buckets[bucket] = make(map[string][]byte)
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.buckets[bucket][key] = body
+	case r.Method == http.MethodGet:
+		body, ok := f.buckets[bucket][key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -21,6 +21,7 @@ package uri
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/url"
 )
@@ -48,9 +49,13 @@ const (
 	azureKMSURI   = "kms://azure?tenantID=%s&clientID=%s&clientSecret=%s&vaultName=%s&vaultType=%s&keyName=%s"
 	gcpKMSURI     = "kms://gcp?projectID=%s&location=%s&keyRing=%s&credentialsPath=%s&keyName=%s"
 	clusterKMSURI = "kms://cluster-kms?key=%s&salt=%s"
+	kmipKMSURI    = "kms://kmip?endpoint=%s&keyID=%s&clientCertPath=%s&clientKeyPath=%s&caCertPath=%s"
+	vaultKMSURI   = "kms://vault?address=%s&token=%s&mountPath=%s&keyName=%s&namespace=%s&caCertPath=%s"
 	awsS3URI      = "storage://aws?bucket=%s&region=%s&accessKeyID=%s&accessKey=%s"
 	azureBlobURI  = "storage://azure?account=%s&container=%s&tenantID=%s&clientID=%s&clientSecret=%s"
 	gcpStorageURI = "storage://gcp?projectID=%s&bucket=%s&credentialsPath=%s"
+	s3CompatURI   = "storage://s3compat?endpoint=%s&bucket=%s&region=%s&accessKeyID=%s&accessKey=%s&caCertPath=%s"
+	fileStoreURI  = "storage://file?path=%s"
 	// NoStoreURI is a URI that indicates that no storage is used.
 	// Should only be used with cluster KMS.
 	NoStoreURI = "storage://no-store"
@@ -62,15 +67,37 @@ type MasterSecret struct {
 	Key []byte `json:"key"`
 	// Salt is the salt used in HKDF to derive keys.
 	Salt []byte `json:"salt"`
+	// Rotations are the master secrets that replaced Key and Salt for deriving data keys, in ascending order of their version.
+	// Key and Salt are version 0. They remain in use for keys bound to the cluster's identity.
+	Rotations []MasterSecretRotation `json:"rotations,omitempty"`
+}
+
+// MasterSecretRotation is a master secret created by rotating the master secret.
+type MasterSecretRotation struct {
+	// Version of the master secret. Versions start at 1.
+	Version uint32 `json:"version"`
+	// Key is the secret value used in HKDF to derive keys.
+	Key []byte `json:"key"`
+	// Salt is the salt used in HKDF to derive keys.
+	Salt []byte `json:"salt"`
+	// Finalized is set once all state disks were re-keyed to this version.
+	// Keys of state disks are no longer derived from the initial master secret from then on.
+	Finalized bool `json:"finalized,omitempty"`
 }
 
 // EncodeToURI returns a URI encoding the master secret.
 func (m MasterSecret) EncodeToURI() string {
-	return fmt.Sprintf(
+	uri := fmt.Sprintf(
 		clusterKMSURI,
 		base64.URLEncoding.EncodeToString(m.Key),
 		base64.URLEncoding.EncodeToString(m.Salt),
 	)
+	if len(m.Rotations) == 0 {
+		return uri
+	}
+	// marshaling a slice of structs with only primitive fields can't fail
+	rotations, _ := json.Marshal(m.Rotations)
+	return uri + "&rotations=" + base64.URLEncoding.EncodeToString(rotations)
 }
 
 // DecodeMasterSecretFromURI decodes a master secret from a URI.
@@ -96,9 +123,20 @@ func DecodeMasterSecretFromURI(uri string) (MasterSecret, error) {
 	if err != nil {
 		return MasterSecret{}, err
 	}
+	var rotations []MasterSecretRotation
+	if q.Get("rotations") != "" {
+		rawRotations, err := getBase64QueryParameter(q, "rotations")
+		if err != nil {
+			return MasterSecret{}, err
+		}
+		if err := json.Unmarshal(rawRotations, &rotations); err != nil {
+			return MasterSecret{}, fmt.Errorf("unmarshaling master secret rotations: %w", err)
+		}
+	}
 	return MasterSecret{
-		Key:  key,
-		Salt: salt,
+		Key:       key,
+		Salt:      salt,
+		Rotations: rotations,
 	}, nil
 }
 
@@ -228,6 +266,113 @@ func (s AWSS3Config) EncodeToURI() string {
 	)
 }
 
+// S3CompatConfig is the configuration to use an S3-compatible object storage, e.g., MinIO or Ceph, as storage.
+type S3CompatConfig struct {
+	// Endpoint is the URL of the S3 API, e.g., https://minio.example.com:9000.
+	Endpoint string
+	// Bucket is the name of the storage bucket to use.
+	Bucket string
+	// Region is the region of the storage bucket. Defaults to "us-east-1".
+	Region string
+	// AccessKeyID is the ID of the access key used for authentication.
+	AccessKeyID string
+	// AccessKey is the secret value used for authentication.
+	AccessKey string
+	// CACertPath is the path to a PEM encoded CA certificate to verify the endpoint with. It is optional.
+	CACertPath string
+}
+
+// DecodeS3CompatConfigFromURI decodes an S3-compatible storage configuration from a URI.
+func DecodeS3CompatConfigFromURI(uri string) (S3CompatConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return S3CompatConfig{}, err
+	}
+
+	if u.Scheme != "storage" {
+		return S3CompatConfig{}, fmt.Errorf("invalid scheme: %q", u.Scheme)
+	}
+	if u.Host != "s3compat" {
+		return S3CompatConfig{}, fmt.Errorf("invalid host: %q", u.Host)
+	}
+
+	q := u.Query()
+	endpoint, err := getQueryParameter(q, "endpoint")
+	if err != nil {
+		return S3CompatConfig{}, err
+	}
+	bucket, err := getQueryParameter(q, "bucket")
+	if err != nil {
+		return S3CompatConfig{}, err
+	}
+	accessKeyID, err := getQueryParameter(q, "accessKeyID")
+	if err != nil {
+		return S3CompatConfig{}, err
+	}
+	accessKey, err := getQueryParameter(q, "accessKey")
+	if err != nil {
+		return S3CompatConfig{}, err
+	}
+	region := q.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return S3CompatConfig{
+		Endpoint:    endpoint,
+		Bucket:      bucket,
+		Region:      region,
+		AccessKeyID: accessKeyID,
+		AccessKey:   accessKey,
+		CACertPath:  q.Get("caCertPath"),
+	}, nil
+}
+
+// EncodeToURI returns a URI encoding the S3-compatible storage configuration.
+func (s S3CompatConfig) EncodeToURI() string {
+	return fmt.Sprintf(
+		s3CompatURI,
+		url.QueryEscape(s.Endpoint),
+		url.QueryEscape(s.Bucket),
+		url.QueryEscape(s.Region),
+		url.QueryEscape(s.AccessKeyID),
+		url.QueryEscape(s.AccessKey),
+		url.QueryEscape(s.CACertPath),
+	)
+}
+
+// FileStoreConfig is the configuration to use a local directory as storage.
+type FileStoreConfig struct {
+	// Path is the directory the DEKs are stored in.
+	Path string
+}
+
+// DecodeFileStoreConfigFromURI decodes a file storage configuration from a URI.
+func DecodeFileStoreConfigFromURI(uri string) (FileStoreConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return FileStoreConfig{}, err
+	}
+
+	if u.Scheme != "storage" {
+		return FileStoreConfig{}, fmt.Errorf("invalid scheme: %q", u.Scheme)
+	}
+	if u.Host != "file" {
+		return FileStoreConfig{}, fmt.Errorf("invalid host: %q", u.Host)
+	}
+
+	path, err := getQueryParameter(u.Query(), "path")
+	if err != nil {
+		return FileStoreConfig{}, err
+	}
+	return FileStoreConfig{Path: path}, nil
+}
+
+// EncodeToURI returns a URI encoding the file storage configuration.
+func (f FileStoreConfig) EncodeToURI() string {
+	return fmt.Sprintf(fileStoreURI, url.QueryEscape(f.Path))
+}
+
 // AzureConfig is the configuration to authenticate with Azure Key Vault.
 type AzureConfig struct {
 	// TenantID of the Azure Active Directory the Key Vault is located in.
@@ -450,6 +595,144 @@ func (g GCPConfig) EncodeToURI() string {
 	)
 }
 
+// VaultConfig is the configuration to use the Transit secrets engine of HashiCorp Vault or OpenBao.
+type VaultConfig struct {
+	// Address is the URL of the Vault server, e.g., https://vault.example.com:8200.
+	Address string
+	// Token is the Vault token used for authentication.
+	Token string
+	// MountPath is the path the Transit secrets engine is mounted at. Defaults to "transit".
+	MountPath string
+	// KeyName is the name of the Transit key used to wrap DEKs.
+	KeyName string
+	// Namespace is the Vault Enterprise namespace of the secrets engine. It is optional.
+	Namespace string
+	// CACertPath is the path to a PEM encoded CA certificate to verify the Vault server with. It is optional.
+	CACertPath string
+}
+
+// DecodeVaultConfigFromURI decodes a Vault configuration from a URI.
+func DecodeVaultConfigFromURI(uri string) (VaultConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return VaultConfig{}, err
+	}
+
+	if u.Scheme != "kms" {
+		return VaultConfig{}, fmt.Errorf("invalid scheme: %q", u.Scheme)
+	}
+	if u.Host != "vault" {
+		return VaultConfig{}, fmt.Errorf("invalid host: %q", u.Host)
+	}
+
+	q := u.Query()
+	address, err := getQueryParameter(q, "address")
+	if err != nil {
+		return VaultConfig{}, err
+	}
+	token, err := getQueryParameter(q, "token")
+	if err != nil {
+		return VaultConfig{}, err
+	}
+	keyName, err := getQueryParameter(q, "keyName")
+	if err != nil {
+		return VaultConfig{}, err
+	}
+	mountPath := q.Get("mountPath")
+	if mountPath == "" {
+		mountPath = "transit"
+	}
+
+	return VaultConfig{
+		Address:    address,
+		Token:      token,
+		MountPath:  mountPath,
+		KeyName:    keyName,
+		Namespace:  q.Get("namespace"),
+		CACertPath: q.Get("caCertPath"),
+	}, nil
+}
+
+// EncodeToURI returns a URI encoding the Vault configuration.
+func (v VaultConfig) EncodeToURI() string {
+	return fmt.Sprintf(
+		vaultKMSURI,
+		url.QueryEscape(v.Address),
+		url.QueryEscape(v.Token),
+		url.QueryEscape(v.MountPath),
+		url.QueryEscape(v.KeyName),
+		url.QueryEscape(v.Namespace),
+		url.QueryEscape(v.CACertPath),
+	)
+}
+
+// KMIPConfig is the configuration to use a KMIP server, e.g., an HSM, as KMS.
+type KMIPConfig struct {
+	// Endpoint is the address of the KMIP server, e.g., hsm.example.com:5696.
+	Endpoint string
+	// KeyID is the unique identifier of the symmetric key used to wrap DEKs.
+	KeyID string
+	// ClientCertPath is the path to the PEM encoded client certificate used to authenticate to the server.
+	ClientCertPath string
+	// ClientKeyPath is the path to the PEM encoded private key of the client certificate.
+	ClientKeyPath string
+	// CACertPath is the path to a PEM encoded CA certificate to verify the server with. It is optional.
+	CACertPath string
+}
+
+// DecodeKMIPConfigFromURI decodes a KMIP configuration from a URI.
+func DecodeKMIPConfigFromURI(uri string) (KMIPConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return KMIPConfig{}, err
+	}
+
+	if u.Scheme != "kms" {
+		return KMIPConfig{}, fmt.Errorf("invalid scheme: %q", u.Scheme)
+	}
+	if u.Host != "kmip" {
+		return KMIPConfig{}, fmt.Errorf("invalid host: %q", u.Host)
+	}
+
+	q := u.Query()
+	endpoint, err := getQueryParameter(q, "endpoint")
+	if err != nil {
+		return KMIPConfig{}, err
+	}
+	keyID, err := getQueryParameter(q, "keyID")
+	if err != nil {
+		return KMIPConfig{}, err
+	}
+	clientCertPath, err := getQueryParameter(q, "clientCertPath")
+	if err != nil {
+		return KMIPConfig{}, err
+	}
+	clientKeyPath, err := getQueryParameter(q, "clientKeyPath")
+	if err != nil {
+		return KMIPConfig{}, err
+	}
+
+	return KMIPConfig{
+		Endpoint:       endpoint,
+		KeyID:          keyID,
+		ClientCertPath: clientCertPath,
+		ClientKeyPath:  clientKeyPath,
+		CACertPath:     q.Get("caCertPath"),
+	}, nil
+}
+
+// EncodeToURI returns a URI encoding the KMIP configuration.
+func (k KMIPConfig) EncodeToURI() string {
+	return fmt.Sprintf(
+		kmipKMSURI,
+		url.QueryEscape(k.Endpoint),
+		url.QueryEscape(k.KeyID),
+		url.QueryEscape(k.ClientCertPath),
+		url.QueryEscape(k.ClientKeyPath),
+		url.QueryEscape(k.CACertPath),
+	)
+}
+
 // GoogleCloudStorageConfig is the configuration to authenticate with Google Cloud Storage.
 type GoogleCloudStorageConfig struct {
 	// CredentialsPath is the path to a credentials file of a service account used to authorize against the GCP API.
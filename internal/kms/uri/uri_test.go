@@ -27,6 +27,19 @@ func TestMasterSecretURI(t *testing.T) {
 	checkURI(t, cfg, DecodeMasterSecretFromURI)
 }
 
+func TestMasterSecretWithRotationsURI(t *testing.T) {
+	cfg := MasterSecret{
+		Key:  []byte("key"),
+		Salt: []byte("salt"),
+		Rotations: []MasterSecretRotation{
+			{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1")},
+			{Version: 2, Key: []byte("key-2"), Salt: []byte("salt-2")},
+		},
+	}
+
+	checkURI(t, cfg, DecodeMasterSecretFromURI)
+}
+
 func TestAWSURI(t *testing.T) {
 	cfg := AWSConfig{
 		KeyName:     "key",
@@ -96,6 +109,62 @@ func TestGoogleCloudStorageURI(t *testing.T) {
 	checkURI(t, cfg, DecodeGoogleCloudStorageConfigFromURI)
 }
 
+func TestVaultURI(t *testing.T) {
+	cfg := VaultConfig{
+		Address:    "https://vault.example.com:8200",
+		Token:      "hvs.token",
+		MountPath:  "constellation/transit",
+		KeyName:    "key",
+		Namespace:  "team-a",
+		CACertPath: "/path/to/ca.pem",
+	}
+
+	checkURI(t, cfg, DecodeVaultConfigFromURI)
+}
+
+func TestDecodeVaultConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cfg, err := DecodeVaultConfigFromURI("kms://vault?address=http%3A%2F%2F127.0.0.1%3A8200&token=root&keyName=key")
+	require.NoError(err)
+	assert.Equal(VaultConfig{Address: "http://127.0.0.1:8200", Token: "root", MountPath: "transit", KeyName: "key"}, cfg)
+
+	_, err = DecodeVaultConfigFromURI("kms://vault?address=http%3A%2F%2F127.0.0.1%3A8200&keyName=key")
+	assert.Error(err)
+	_, err = DecodeVaultConfigFromURI("kms://aws?address=http%3A%2F%2F127.0.0.1%3A8200&token=root&keyName=key")
+	assert.Error(err)
+}
+
+func TestKMIPURI(t *testing.T) {
+	cfg := KMIPConfig{
+		Endpoint:       "hsm.example.com:5696",
+		KeyID:          "6a3f9b1e-2c4d-4e5f-8a9b-0c1d2e3f4a5b",
+		ClientCertPath: "/path/to/client.pem",
+		ClientKeyPath:  "/path/to/client-key.pem",
+		CACertPath:     "/path/to/ca.pem",
+	}
+
+	checkURI(t, cfg, DecodeKMIPConfigFromURI)
+}
+
+func TestS3CompatURI(t *testing.T) {
+	cfg := S3CompatConfig{
+		Endpoint:    "https://minio.example.com:9000",
+		Bucket:      "constellation-deks",
+		Region:      "eu-central-1",
+		AccessKeyID: "access-key-id",
+		AccessKey:   "access-key",
+		CACertPath:  "/path/to/ca.pem",
+	}
+
+	checkURI(t, cfg, DecodeS3CompatConfigFromURI)
+}
+
+func TestFileStoreURI(t *testing.T) {
+	checkURI(t, FileStoreConfig{Path: "/var/lib/constellation/deks"}, DecodeFileStoreConfigFromURI)
+}
+
 type cfgStruct interface {
 	EncodeToURI() string
 }
@@ -14,7 +14,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
@@ -133,6 +135,35 @@ func (k *Kubectl) UpdateConfigMap(ctx context.Context, configMap *corev1.ConfigM
 	return k.CoreV1().ConfigMaps(configMap.ObjectMeta.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
 }
 
+// CreateSecret creates the provided secret.
+func (k *Kubectl) CreateSecret(ctx context.Context, secret *corev1.Secret) error {
+	_, err := k.CoreV1().Secrets(secret.ObjectMeta.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
+
+// GetSecret returns a Secret given it's name and namespace.
+func (k *Kubectl) GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	return k.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// UpdateSecret updates the given Secret.
+func (k *Kubectl) UpdateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	return k.CoreV1().Secrets(secret.ObjectMeta.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+}
+
+// GetDaemonSet returns a DaemonSet given it's name and namespace.
+func (k *Kubectl) GetDaemonSet(ctx context.Context, namespace, name string) (*appsv1.DaemonSet, error) {
+	return k.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// RestartDaemonSet triggers a rolling restart of the DaemonSet, identified by name and namespace.
+// This is the same as "kubectl rollout restart daemonset".
+func (k *Kubectl) RestartDaemonSet(ctx context.Context, namespace, name string) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, time.Now().Format(time.RFC3339))
+	_, err := k.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
 // AnnotateNode adds the provided annotations to the node, identified by name.
 func (k *Kubectl) AnnotateNode(ctx context.Context, nodeName, annotationKey, annotationValue string) error {
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,24 +31,38 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/file"
 	"github.com/edgelesssys/constellation/v2/internal/grpc/atlscredentials"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cache"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/certcache"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/identity"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/kms"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubeadm"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetes"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetesca"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/metrics"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/policy"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/server"
 	"github.com/edgelesssys/constellation/v2/joinservice/internal/watcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/afero"
 )
 
-// vpcIPTimeout is the maximum amount of time to wait for retrieval of the VPC ip.
-const vpcIPTimeout = 30 * time.Second
+const (
+	// vpcIPTimeout is the maximum amount of time to wait for retrieval of the VPC ip.
+	vpcIPTimeout = 30 * time.Second
+	// nodeIdentityGCInterval is the interval in which identities of nodes that left the cluster are deleted.
+	nodeIdentityGCInterval = time.Hour
+)
 
 func main() {
 	provider := flag.String("cloud-provider", "", "cloud service provider this binary is running on")
 	keyServiceEndpoint := flag.String("key-service-endpoint", "", "endpoint of Constellations key management service")
 	attestationVariant := flag.String("attestation-variant", "", "attestation variant to use for aTLS connections")
+	keyCacheTTL := flag.Duration("key-cache-ttl", time.Minute, "time to cache data keys requested from the key service, disabled if 0")
+	recordNodeIdentities := flag.Bool("node-identities", false, "record the identities of joined nodes, and only issue one join ticket per instance")
+	metricsPort := flag.Int("metrics-port", constants.JoinServiceMetricsPort, "port to serve Prometheus metrics on, disabled if 0")
 	verbosity := flag.Int("v", 0, logger.CmdLineVerbosityDescription)
 	flag.Parse()
 
@@ -60,6 +75,13 @@ func main() {
 
 	handler := file.NewHandler(afero.NewOsFs())
 
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := metrics.New(reg)
+	if *metricsPort != 0 {
+		go serveMetrics(*metricsPort, reg, log)
+	}
+
 	kubeClient, err := kubernetes.New()
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to create Kubernetes client")
@@ -86,22 +108,35 @@ func main() {
 		os.Exit(1)
 	}
 
-	creds := atlscredentials.New(nil, []atls.Validator{validator})
+	creds := atlscredentials.New(nil, []atls.Validator{metrics.Validator(validator)})
+
+	metadataClient, closeMetadata, err := newMetadataClient(context.Background(), *provider)
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("Failed to create cloud metadata client")
+		os.Exit(1)
+	}
+	defer closeMetadata()
 
 	vpcCtx, cancel := context.WithTimeout(context.Background(), vpcIPTimeout)
 	defer cancel()
 
-	vpcIP, err := getVPCIP(vpcCtx, *provider)
+	self, err := metadataClient.Self(vpcCtx)
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to get IP in VPC")
 		os.Exit(1)
 	}
+	vpcIP := self.VPCIP
 	apiServerEndpoint := net.JoinHostPort(vpcIP, strconv.Itoa(constants.KubernetesPort))
 	kubeadm, err := kubeadm.New(apiServerEndpoint, log.WithGroup("kubeadm"))
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to create kubeadm")
 	}
 	keyServiceClient := kms.New(log.WithGroup("keyServiceClient"), *keyServiceEndpoint)
+	var dataKeys dataKeyGetter = keyServiceClient
+	if *keyCacheTTL > 0 {
+		// nodes joining at the same time request the same keys, don't hit the key service for each of them
+		dataKeys = kms.NewCached(keyServiceClient, cache.Options{TTL: *keyCacheTTL})
+	}
 
 	measurementSalt, err := handler.Read(filepath.Join(constants.ServiceBasePath, constants.MeasurementSaltFilename))
 	if err != nil {
@@ -109,12 +144,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// only assign the registry if enabled, so the server doesn't see a typed nil
+	var nodeIdentities nodeIdentityRegistry
+	if *recordNodeIdentities {
+		registry := identity.New(log.WithGroup("nodeIdentities"), kubeClient, validator)
+		go registry.CollectGarbage(context.Background(), nodeIdentityGCInterval)
+		nodeIdentities = registry
+	}
+
 	server, err := server.New(
 		measurementSalt,
 		kubernetesca.New(log.WithGroup("certificateAuthority"), handler),
 		kubeadm,
-		keyServiceClient,
+		dataKeys,
 		kubeClient,
+		policy.NewEngine(log.WithGroup("joinPolicy"), handler, kubeClient, metadataClient),
+		nodeIdentities,
+		metrics,
 		log.WithGroup("server"),
 		file.NewHandler(afero.NewOsFs()),
 	)
@@ -144,46 +190,55 @@ func main() {
 	}
 }
 
-func getVPCIP(ctx context.Context, provider string) (string, error) {
-	var metadataClient metadataAPI
-	var err error
+// serveMetrics serves the metrics of reg on /metrics of the given port.
+// Metrics are served without TLS, since they don't contain sensitive data and are scraped from within the cluster.
+func serveMetrics(port int, reg *prometheus.Registry, log *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	server := http.Server{
+		Addr:              net.JoinHostPort("", strconv.Itoa(port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.With(slog.Any("error", err)).Error("Failed to serve metrics")
+	}
+}
 
+func newMetadataClient(ctx context.Context, provider string) (metadataAPI, func(), error) {
 	switch cloudprovider.FromString(provider) {
 	case cloudprovider.AWS:
-		metadataClient, err = awscloud.New(ctx)
-		if err != nil {
-			return "", err
-		}
+		metadataClient, err := awscloud.New(ctx)
+		return metadataClient, func() {}, err
 	case cloudprovider.Azure:
-		metadataClient, err = azurecloud.New(ctx)
-		if err != nil {
-			return "", err
-		}
+		metadataClient, err := azurecloud.New(ctx)
+		return metadataClient, func() {}, err
 	case cloudprovider.GCP:
 		gcpMeta, err := gcpcloud.New(ctx)
 		if err != nil {
-			return "", err
+			return nil, nil, err
 		}
-		defer gcpMeta.Close()
-		metadataClient = gcpMeta
+		return gcpMeta, func() { gcpMeta.Close() }, nil
 	case cloudprovider.OpenStack:
-		metadataClient, err = openstack.New(ctx)
-		if err != nil {
-			return "", err
-		}
+		metadataClient, err := openstack.New(ctx)
+		return metadataClient, func() {}, err
 	case cloudprovider.QEMU:
-		metadataClient = qemucloud.New()
+		return qemucloud.New(), func() {}, nil
 	default:
-		return "", errors.New("unsupported cloud provider")
+		return nil, nil, errors.New("unsupported cloud provider")
 	}
+}
 
-	self, err := metadataClient.Self(ctx)
-	if err != nil {
-		return "", err
-	}
-	return self.VPCIP, nil
+type dataKeyGetter interface {
+	GetDataKey(ctx context.Context, keyID string, length int) ([]byte, error)
+}
+
+type nodeIdentityRegistry interface {
+	Claim(ctx context.Context, diskUUID, nodeName string, isControlPlane bool, csr []byte) (release func(ctx context.Context, issued bool), err error)
+	CheckRejoin(ctx context.Context, diskUUID string) error
 }
 
 type metadataAPI interface {
 	Self(ctx context.Context) (metadata.InstanceMetadata, error)
+	List(ctx context.Context) ([]metadata.InstanceMetadata, error)
 }
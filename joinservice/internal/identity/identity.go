@@ -0,0 +1,278 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package identity records which nodes joined the cluster, so that join tickets can only be issued once per node.
+
+Nodes are identified by the instance they run on. The instance ID is derived from the attestation key of the
+instance's TPM, which the node proves to own during the aTLS handshake, so a node can't choose its identity.
+Attestation variants without a TPM attestation key, e.g., QEMU TDX, don't support node identities.
+
+Each join is recorded as a NodeIdentity resource. A node that already joined is only issued another join ticket
+if an operator sets allowJoin on its NodeIdentity, or if it repeats the request with the same CSR.
+Setting revoked denies the node to join or rejoin the cluster, and denies any instance to join or rejoin with the node's state disk,
+so that a copy of the disk attached to another instance doesn't receive the disk's key.
+The identities of nodes that left the cluster are garbage collected, unless they were revoked.
+*/
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/attestation/variant"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/vtpm"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// gcGracePeriod is the time a node has to register with Kubernetes after it was issued a join ticket,
+// before its identity is garbage collected.
+const gcGracePeriod = 4 * constants.KubernetesJoinTokenTTL
+
+var (
+	// ErrAlreadyJoined is returned if a node that already joined requests another join ticket.
+	ErrAlreadyJoined = errors.New("node already joined the cluster")
+	// ErrRevoked is returned if the identity of a node was revoked.
+	ErrRevoked = errors.New("node identity revoked")
+)
+
+// Registry records the identities of joined nodes.
+type Registry struct {
+	log        *slog.Logger
+	kubeClient kubeClient
+	// attestationVariant selects the attestation document in the peer's aTLS certificate.
+	attestationVariant variant.Getter
+	now                func() time.Time
+}
+
+// New creates a new Registry.
+// attestationVariant must return the OID of the validator used for the aTLS connections of joining nodes.
+func New(log *slog.Logger, kubeClient kubeClient, attestationVariant variant.Getter) *Registry {
+	return &Registry{log: log, kubeClient: kubeClient, attestationVariant: attestationVariant, now: time.Now}
+}
+
+// Claim records the join of the node that sent the request in ctx.
+// The returned error wraps ErrAlreadyJoined or ErrRevoked if the node may not join.
+// If the node may join, release must be called once the join ticket was issued or issuing it failed.
+// If issuing failed, the claim is undone so the node can retry.
+func (r *Registry) Claim(ctx context.Context, diskUUID, nodeName string, isControlPlane bool, csr []byte) (release func(ctx context.Context, issued bool), err error) {
+	instanceID, err := r.instanceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkDiskRevoked(ctx, diskUUID); err != nil {
+		return nil, err
+	}
+	csrHash := sha256.Sum256(csr)
+	log := r.log.With(slog.String("instanceID", instanceID), slog.String("diskUUID", diskUUID), slog.String("nodeName", nodeName))
+	claimed := kubernetes.NodeIdentity{
+		InstanceID:     instanceID,
+		DiskUUID:       diskUUID,
+		NodeName:       nodeName,
+		IsControlPlane: isControlPlane,
+		CSRHash:        hex.EncodeToString(csrHash[:]),
+		JoinTime:       r.now(),
+	}
+
+	identity, found, err := r.kubeClient.GetNodeIdentity(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("getting node identity: %w", err)
+	}
+	if !found {
+		err := r.kubeClient.CreateNodeIdentity(ctx, claimed)
+		if k8serrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("%w: instance %s is joining concurrently", ErrAlreadyJoined, instanceID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating node identity: %w", err)
+		}
+		return func(ctx context.Context, issued bool) {
+			if issued {
+				return
+			}
+			if err := r.kubeClient.DeleteNodeIdentity(ctx, claimed); err != nil {
+				log.With(slog.Any("error", err)).Error("Failed to delete node identity after failed join")
+			}
+		}, nil
+	}
+
+	if identity.Revoked {
+		return nil, fmt.Errorf("%w: instance %s", ErrRevoked, instanceID)
+	}
+	if identity.NodeName == claimed.NodeName && identity.IsControlPlane == claimed.IsControlPlane && identity.CSRHash == claimed.CSRHash {
+		// the node didn't receive the ticket it was issued, and retries with the same request
+		log.Info("Node identity repeats its join request")
+		return func(context.Context, bool) {}, nil
+	}
+	if !identity.AllowJoin {
+		return nil, fmt.Errorf("%w: instance %s joined as node %q, set allowJoin on its NodeIdentity to allow another join", ErrAlreadyJoined, instanceID, identity.NodeName)
+	}
+
+	// the permission to join again is consumed by this join
+	log.Info("Node identity allows another join")
+	claimed.ResourceVersion = identity.ResourceVersion
+	err = r.kubeClient.UpdateNodeIdentity(ctx, claimed)
+	if k8serrors.IsConflict(err) {
+		return nil, fmt.Errorf("%w: instance %s is joining concurrently", ErrAlreadyJoined, instanceID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating node identity: %w", err)
+	}
+	return func(ctx context.Context, issued bool) {
+		if issued {
+			return
+		}
+		if err := r.allowJoin(ctx, instanceID); err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to restore permission to join after failed join")
+		}
+	}, nil
+}
+
+// CheckRejoin returns an error wrapping ErrRevoked if the identity of the node that sent the request in ctx was revoked,
+// or if the disk with diskUUID belongs to a revoked identity.
+// Nodes that joined before identities were recorded don't have a NodeIdentity and may rejoin.
+func (r *Registry) CheckRejoin(ctx context.Context, diskUUID string) error {
+	instanceID, err := r.instanceID(ctx)
+	if err != nil {
+		return err
+	}
+	identity, found, err := r.kubeClient.GetNodeIdentity(ctx, instanceID)
+	if err != nil {
+		return fmt.Errorf("getting node identity: %w", err)
+	}
+	if found && identity.Revoked {
+		return fmt.Errorf("%w: instance %s", ErrRevoked, instanceID)
+	}
+	return r.checkDiskRevoked(ctx, diskUUID)
+}
+
+// CollectGarbage deletes the identities of nodes that left the cluster every interval, until ctx is done.
+func (r *Registry) CollectGarbage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.collectGarbage(ctx); err != nil {
+				r.log.With(slog.Any("error", err)).Error("Failed to garbage collect node identities")
+			}
+		}
+	}
+}
+
+// collectGarbage deletes the identities of nodes that aren't part of the cluster anymore.
+// Revoked identities are kept, and nodes get a grace period to register after they were issued a join ticket.
+func (r *Registry) collectGarbage(ctx context.Context) error {
+	identities, err := r.kubeClient.ListNodeIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("listing node identities: %w", err)
+	}
+	nodeNames, err := r.kubeClient.ListNodeNames(ctx)
+	if err != nil {
+		return fmt.Errorf("listing nodes: %w", err)
+	}
+
+	var errs error
+	for _, identity := range identities {
+		if identity.Revoked || slices.Contains(nodeNames, identity.NodeName) || r.now().Sub(identity.JoinTime) < gcGracePeriod {
+			continue
+		}
+		// the identity is only deleted if it wasn't claimed again since it was listed
+		err := r.kubeClient.DeleteNodeIdentity(ctx, identity)
+		if k8serrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		r.log.With(slog.String("instanceID", identity.InstanceID), slog.String("nodeName", identity.NodeName)).Info("Deleted identity of node that left the cluster")
+	}
+	return errs
+}
+
+// checkDiskRevoked returns an error wrapping ErrRevoked if diskUUID is the disk of a revoked identity.
+func (r *Registry) checkDiskRevoked(ctx context.Context, diskUUID string) error {
+	identities, err := r.kubeClient.ListNodeIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("listing node identities: %w", err)
+	}
+	for _, identity := range identities {
+		if identity.Revoked && identity.DiskUUID != "" && strings.EqualFold(identity.DiskUUID, diskUUID) {
+			return fmt.Errorf("%w: disk %s of instance %s", ErrRevoked, diskUUID, identity.InstanceID)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) allowJoin(ctx context.Context, instanceID string) error {
+	identity, found, err := r.kubeClient.GetNodeIdentity(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	identity.AllowJoin = true
+	return r.kubeClient.UpdateNodeIdentity(ctx, identity)
+}
+
+// instanceID returns the ID of the instance that sent the request in ctx.
+// It's the hash of the TPM attestation key in the attestation document that was validated during the aTLS handshake.
+func (r *Registry) instanceID(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", errors.New("no peer in request context")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return "", errors.New("peer didn't present an aTLS certificate")
+	}
+	return instanceIDFromCertificate(tlsInfo.State.PeerCertificates[0], r.attestationVariant)
+}
+
+// instanceIDFromCertificate returns the instance ID from the attestation document of the given variant embedded in cert.
+func instanceIDFromCertificate(cert *x509.Certificate, attestationVariant variant.Getter) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attestationVariant.OID()) {
+			continue
+		}
+		var attDoc vtpm.AttestationDocument
+		if err := json.Unmarshal(ext.Value, &attDoc); err != nil {
+			return "", fmt.Errorf("unmarshaling attestation document: %w", err)
+		}
+		if attDoc.Attestation == nil || len(attDoc.Attestation.AkPub) == 0 {
+			return "", fmt.Errorf("attestation variant %s doesn't provide a TPM attestation key to identify instances", attestationVariant.OID())
+		}
+		hash := sha256.Sum256(attDoc.Attestation.AkPub)
+		return hex.EncodeToString(hash[:]), nil
+	}
+	return "", fmt.Errorf("peer certificate doesn't contain an attestation document of variant %s", attestationVariant.OID())
+}
+
+type kubeClient interface {
+	GetNodeIdentity(ctx context.Context, instanceID string) (kubernetes.NodeIdentity, bool, error)
+	ListNodeIdentities(ctx context.Context) ([]kubernetes.NodeIdentity, error)
+	CreateNodeIdentity(ctx context.Context, identity kubernetes.NodeIdentity) error
+	UpdateNodeIdentity(ctx context.Context, identity kubernetes.NodeIdentity) error
+	DeleteNodeIdentity(ctx context.Context, identity kubernetes.NodeIdentity) error
+	ListNodeNames(ctx context.Context) ([]string, error)
+}
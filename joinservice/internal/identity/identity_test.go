@@ -0,0 +1,426 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/attestation/variant"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/vtpm"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetes"
+	"github.com/google/go-tpm-tools/proto/attest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestClaim(t *testing.T) {
+	const diskUUID = "0e2a5c1f-3b2d-4c5e-8f9a-1b2c3d4e5f60"
+	csr := []byte("csr")
+	instanceID := testInstanceID([]byte("ak"))
+	csrHash := sha256.Sum256(csr)
+	joinTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resource := schema.GroupResource{Group: "update.edgeless.systems", Resource: "nodeidentities"}
+	joined := kubernetes.NodeIdentity{
+		InstanceID: instanceID, DiskUUID: diskUUID, NodeName: "worker-0",
+		CSRHash: hex.EncodeToString(csrHash[:]), JoinTime: joinTime,
+	}
+	withOtherCSR := func(identity kubernetes.NodeIdentity) *kubernetes.NodeIdentity {
+		identity.CSRHash = "other"
+		return &identity
+	}
+
+	testCases := map[string]struct {
+		kubeClient     *stubKubeClient
+		ak             []byte
+		issued         bool
+		wantErr        error
+		wantOtherErr   bool
+		wantIdentity   *kubernetes.NodeIdentity
+		wantNoIdentity bool
+	}{
+		"first join": {
+			kubeClient:   &stubKubeClient{},
+			issued:       true,
+			wantIdentity: &joined,
+		},
+		"first join fails": {
+			kubeClient:     &stubKubeClient{},
+			wantNoIdentity: true,
+		},
+		"concurrent first join": {
+			kubeClient: &stubKubeClient{createErr: k8serrors.NewAlreadyExists(resource, instanceID)},
+			wantErr:    ErrAlreadyJoined,
+		},
+		"second join": {
+			kubeClient: &stubKubeClient{identity: withOtherCSR(joined)},
+			wantErr:    ErrAlreadyJoined,
+		},
+		"second join with other disk": {
+			kubeClient: &stubKubeClient{identity: &kubernetes.NodeIdentity{InstanceID: instanceID, DiskUUID: "other-disk", NodeName: "worker-0"}},
+			wantErr:    ErrAlreadyJoined,
+		},
+		"repeated join request": {
+			kubeClient:   &stubKubeClient{identity: &joined},
+			wantIdentity: &joined,
+		},
+		"repeated join request for other role": {
+			kubeClient: &stubKubeClient{identity: &kubernetes.NodeIdentity{
+				InstanceID: instanceID, NodeName: "worker-0", IsControlPlane: true, CSRHash: joined.CSRHash,
+			}},
+			wantErr: ErrAlreadyJoined,
+		},
+		"second join allowed": {
+			kubeClient: &stubKubeClient{
+				identity: &kubernetes.NodeIdentity{InstanceID: instanceID, NodeName: "worker-0", AllowJoin: true, ResourceVersion: "1"},
+			},
+			issued: true,
+			wantIdentity: &kubernetes.NodeIdentity{
+				InstanceID: instanceID, DiskUUID: diskUUID, NodeName: "worker-0",
+				CSRHash: joined.CSRHash, JoinTime: joinTime, ResourceVersion: "1",
+			},
+		},
+		"second join allowed fails": {
+			kubeClient: &stubKubeClient{
+				identity: &kubernetes.NodeIdentity{InstanceID: instanceID, NodeName: "worker-0", AllowJoin: true, ResourceVersion: "1"},
+			},
+			wantIdentity: &kubernetes.NodeIdentity{
+				InstanceID: instanceID, DiskUUID: diskUUID, NodeName: "worker-0",
+				CSRHash: joined.CSRHash, JoinTime: joinTime, AllowJoin: true, ResourceVersion: "1",
+			},
+		},
+		"concurrent second join": {
+			kubeClient: &stubKubeClient{
+				identity:  &kubernetes.NodeIdentity{InstanceID: instanceID, NodeName: "worker-0", AllowJoin: true},
+				updateErr: k8serrors.NewConflict(resource, instanceID, errors.New("modified")),
+			},
+			wantErr: ErrAlreadyJoined,
+		},
+		"revoked": {
+			kubeClient: &stubKubeClient{identity: &kubernetes.NodeIdentity{InstanceID: instanceID, CSRHash: joined.CSRHash, AllowJoin: true, Revoked: true}},
+			wantErr:    ErrRevoked,
+		},
+		"disk of revoked identity": {
+			kubeClient: &stubKubeClient{others: []kubernetes.NodeIdentity{{InstanceID: "other-instance", DiskUUID: strings.ToUpper(diskUUID), Revoked: true}}},
+			wantErr:    ErrRevoked,
+		},
+		"disk of other identity": {
+			kubeClient:   &stubKubeClient{others: []kubernetes.NodeIdentity{{InstanceID: "other-instance", DiskUUID: "other-disk", Revoked: true}}},
+			issued:       true,
+			wantIdentity: &joined,
+		},
+		"getting identity fails": {
+			kubeClient:   &stubKubeClient{getErr: errors.New("failed")},
+			wantOtherErr: true,
+		},
+		"listing identities fails": {
+			kubeClient:   &stubKubeClient{listErr: errors.New("failed")},
+			wantOtherErr: true,
+		},
+		"attestation document without attestation key": {
+			kubeClient:   &stubKubeClient{},
+			ak:           []byte{},
+			wantOtherErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ak := []byte("ak")
+			if tc.ak != nil {
+				ak = tc.ak
+			}
+			registry := New(logger.NewTest(t), tc.kubeClient, variant.QEMUVTPM{})
+			registry.now = func() time.Time { return joinTime }
+			release, err := registry.Claim(peerContext(t, ak), diskUUID, "worker-0", false, csr)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			if tc.wantOtherErr {
+				assert.Error(err)
+				assert.NotErrorIs(err, ErrAlreadyJoined)
+				return
+			}
+			require.NoError(err)
+
+			release(t.Context(), tc.issued)
+			if tc.wantNoIdentity {
+				assert.Nil(tc.kubeClient.identity)
+				return
+			}
+			assert.Equal(tc.wantIdentity, tc.kubeClient.identity)
+		})
+	}
+}
+
+func TestCheckRejoin(t *testing.T) {
+	const diskUUID = "0e2a5c1f-3b2d-4c5e-8f9a-1b2c3d4e5f60"
+	instanceID := testInstanceID([]byte("ak"))
+
+	testCases := map[string]struct {
+		kubeClient   *stubKubeClient
+		wantErr      error
+		wantOtherErr bool
+	}{
+		"joined node": {
+			kubeClient: &stubKubeClient{identity: &kubernetes.NodeIdentity{InstanceID: instanceID}},
+		},
+		"node joined before identities were recorded": {
+			kubeClient: &stubKubeClient{},
+		},
+		"revoked": {
+			kubeClient: &stubKubeClient{identity: &kubernetes.NodeIdentity{InstanceID: instanceID, Revoked: true}},
+			wantErr:    ErrRevoked,
+		},
+		"disk of revoked identity attached to other instance": {
+			kubeClient: &stubKubeClient{others: []kubernetes.NodeIdentity{{InstanceID: "decommissioned-instance", DiskUUID: diskUUID, Revoked: true}}},
+			wantErr:    ErrRevoked,
+		},
+		"disk of identity that isn't revoked": {
+			kubeClient: &stubKubeClient{others: []kubernetes.NodeIdentity{{InstanceID: "other-instance", DiskUUID: diskUUID}}},
+		},
+		"getting identity fails": {
+			kubeClient:   &stubKubeClient{getErr: errors.New("failed")},
+			wantOtherErr: true,
+		},
+		"listing identities fails": {
+			kubeClient:   &stubKubeClient{listErr: errors.New("failed")},
+			wantOtherErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := New(logger.NewTest(t), tc.kubeClient, variant.QEMUVTPM{}).CheckRejoin(peerContext(t, []byte("ak")), diskUUID)
+			switch {
+			case tc.wantErr != nil:
+				assert.ErrorIs(err, tc.wantErr)
+			case tc.wantOtherErr:
+				assert.Error(err)
+				assert.NotErrorIs(err, ErrRevoked)
+			default:
+				assert.NoError(err)
+				assert.Equal(instanceID, tc.kubeClient.gotInstanceID)
+			}
+		})
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	longAgo := now.Add(-2 * gcGracePeriod)
+
+	testCases := map[string]struct {
+		identity   kubernetes.NodeIdentity
+		nodeNames  []string
+		deleteErr  error
+		wantDelete bool
+		wantErr    bool
+	}{
+		"node is part of the cluster": {
+			identity:  kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: longAgo},
+			nodeNames: []string{"control-plane-0", "worker-0"},
+		},
+		"node left the cluster": {
+			identity:   kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: longAgo},
+			nodeNames:  []string{"control-plane-0"},
+			wantDelete: true,
+		},
+		"node didn't register yet": {
+			identity:  kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: now.Add(-time.Minute)},
+			nodeNames: []string{"control-plane-0"},
+		},
+		"revoked node left the cluster": {
+			identity:  kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: longAgo, Revoked: true},
+			nodeNames: []string{"control-plane-0"},
+		},
+		"identity was claimed again": {
+			identity:  kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: longAgo},
+			deleteErr: k8serrors.NewConflict(schema.GroupResource{}, "a", errors.New("modified")),
+		},
+		"deleting fails": {
+			identity:  kubernetes.NodeIdentity{InstanceID: "a", NodeName: "worker-0", JoinTime: longAgo},
+			deleteErr: errors.New("failed"),
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			identity := tc.identity
+			kubeClient := &stubKubeClient{identity: &identity, nodeNames: tc.nodeNames, deleteErr: tc.deleteErr}
+			registry := New(logger.NewTest(t), kubeClient, variant.QEMUVTPM{})
+			registry.now = func() time.Time { return now }
+
+			err := registry.collectGarbage(t.Context())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			if tc.wantDelete {
+				assert.Nil(kubeClient.identity)
+			} else {
+				assert.Equal(&tc.identity, kubeClient.identity)
+			}
+		})
+	}
+}
+
+func TestInstanceIDFromCertificate(t *testing.T) {
+	attDoc := func(t *testing.T, doc vtpm.AttestationDocument) []byte {
+		raw, err := json.Marshal(doc)
+		require.NoError(t, err)
+		return raw
+	}
+
+	testCases := map[string]struct {
+		extensions func(t *testing.T) []pkix.Extension
+		wantID     string
+		wantErr    bool
+	}{
+		"attestation key": {
+			extensions: func(t *testing.T) []pkix.Extension {
+				return []pkix.Extension{{Id: variant.QEMUVTPM{}.OID(), Value: attDoc(t, vtpm.AttestationDocument{Attestation: &attest.Attestation{AkPub: []byte("ak")}})}}
+			},
+			wantID: testInstanceID([]byte("ak")),
+		},
+		"attestation document of other variant is ignored": {
+			extensions: func(t *testing.T) []pkix.Extension {
+				return []pkix.Extension{{Id: variant.AzureTrustedLaunch{}.OID(), Value: attDoc(t, vtpm.AttestationDocument{Attestation: &attest.Attestation{AkPub: []byte("ak")}})}}
+			},
+			wantErr: true,
+		},
+		"no attestation key": {
+			extensions: func(t *testing.T) []pkix.Extension {
+				return []pkix.Extension{{Id: variant.QEMUVTPM{}.OID(), Value: attDoc(t, vtpm.AttestationDocument{})}}
+			},
+			wantErr: true,
+		},
+		"invalid attestation document": {
+			extensions: func(*testing.T) []pkix.Extension {
+				return []pkix.Extension{{Id: variant.QEMUVTPM{}.OID(), Value: []byte("invalid")}}
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			id, err := instanceIDFromCertificate(&x509.Certificate{Extensions: tc.extensions(t)}, variant.QEMUVTPM{})
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantID, id)
+		})
+	}
+}
+
+// peerContext returns a context of a request sent by a node with the given attestation key.
+func peerContext(t *testing.T, ak []byte) context.Context {
+	t.Helper()
+	attDoc, err := json.Marshal(vtpm.AttestationDocument{Attestation: &attest.Attestation{AkPub: ak}})
+	require.NoError(t, err)
+	cert := &x509.Certificate{Extensions: []pkix.Extension{{Id: variant.QEMUVTPM{}.OID(), Value: attDoc}}}
+	return peer.NewContext(t.Context(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+}
+
+func testInstanceID(ak []byte) string {
+	hash := sha256.Sum256(ak)
+	return hex.EncodeToString(hash[:])
+}
+
+type stubKubeClient struct {
+	identity      *kubernetes.NodeIdentity
+	others        []kubernetes.NodeIdentity
+	nodeNames     []string
+	gotInstanceID string
+	getErr        error
+	listErr       error
+	createErr     error
+	updateErr     error
+	deleteErr     error
+}
+
+func (s *stubKubeClient) GetNodeIdentity(_ context.Context, instanceID string) (kubernetes.NodeIdentity, bool, error) {
+	s.gotInstanceID = instanceID
+	if s.getErr != nil || s.identity == nil {
+		return kubernetes.NodeIdentity{}, false, s.getErr
+	}
+	return *s.identity, true, nil
+}
+
+func (s *stubKubeClient) ListNodeIdentities(_ context.Context) ([]kubernetes.NodeIdentity, error) {
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	if s.identity == nil {
+		return s.others, nil
+	}
+	return append([]kubernetes.NodeIdentity{*s.identity}, s.others...), nil
+}
+
+func (s *stubKubeClient) CreateNodeIdentity(_ context.Context, identity kubernetes.NodeIdentity) error {
+	if s.createErr != nil {
+		return s.createErr
+	}
+	s.identity = &identity
+	return nil
+}
+
+func (s *stubKubeClient) UpdateNodeIdentity(_ context.Context, identity kubernetes.NodeIdentity) error {
+	if s.updateErr != nil {
+		return s.updateErr
+	}
+	s.identity = &identity
+	return nil
+}
+
+func (s *stubKubeClient) DeleteNodeIdentity(_ context.Context, _ kubernetes.NodeIdentity) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	s.identity = nil
+	return nil
+}
+
+func (s *stubKubeClient) ListNodeNames(_ context.Context) ([]string, error) {
+	return s.nodeNames, nil
+}
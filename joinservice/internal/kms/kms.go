@@ -12,6 +12,9 @@ import (
 	"fmt"
 	"log/slog"
 
+	"github.com/edgelesssys/constellation/v2/internal/grpc/serviceaccount"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cache"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -34,12 +37,18 @@ func New(log *slog.Logger, endpoint string) Client {
 }
 
 // GetDataKey returns a data encryption key for the given UUID.
+// If keyID was created by cluster.MasterSecretKeyID, the key is derived from the requested version of the master secret.
 func (c Client) GetDataKey(ctx context.Context, keyID string, length int) ([]byte, error) {
-	log := c.log.With(slog.String("keyID", keyID), slog.String("endpoint", c.endpoint))
+	keyID, version := cluster.SplitMasterSecretKeyID(keyID)
+	log := c.log.With(slog.String("keyID", keyID), slog.Any("masterSecretVersion", version), slog.String("endpoint", c.endpoint))
 	// the KMS does not use aTLS since traffic is only routed through the Constellation cluster
 	// cluster internal connections are considered trustworthy
 	log.Info(fmt.Sprintf("Connecting to KMS at %s", c.endpoint))
-	conn, err := grpc.NewClient(c.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(c.endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// the keyservice authorizes callers by their service account
+		grpc.WithPerRPCCredentials(serviceaccount.NewTokenCredentials(serviceaccount.KeyServiceTokenPath)),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +58,9 @@ func (c Client) GetDataKey(ctx context.Context, keyID string, length int) ([]byt
 	res, err := c.grpc.GetDataKey(
 		ctx,
 		&keyserviceproto.GetDataKeyRequest{
-			DataKeyId: keyID,
-			Length:    uint32(length),
+			DataKeyId:           keyID,
+			Length:              uint32(length),
+			MasterSecretVersion: version,
 		},
 		conn,
 	)
@@ -62,6 +72,30 @@ func (c Client) GetDataKey(ctx context.Context, keyID string, length int) ([]byt
 	return res.DataKey, nil
 }
 
+// GetDEK returns a data encryption key for the given key ID.
+// Together with Close, it allows wrapping the client in a kms.CloudKMS decorator.
+func (c Client) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	return c.GetDataKey(ctx, dekID, dekSize)
+}
+
+// Close is a no-op, since the client doesn't keep connections open.
+func (c Client) Close() {}
+
+// CachedClient caches the data encryption keys returned by Constellation's keyservice.
+type CachedClient struct {
+	cache *cache.KMS
+}
+
+// NewCached creates a new CachedClient.
+func NewCached(client Client, opts cache.Options) CachedClient {
+	return CachedClient{cache: cache.New(client, opts)}
+}
+
+// GetDataKey returns a data encryption key for the given UUID from the cache, or requests it from the keyservice.
+func (c CachedClient) GetDataKey(ctx context.Context, keyID string, length int) ([]byte, error) {
+	return c.cache.GetDEK(ctx, keyID, length)
+}
+
 type grpcClient interface {
 	GetDataKey(context.Context, *keyserviceproto.GetDataKeyRequest, *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error)
 }
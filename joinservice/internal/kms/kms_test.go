@@ -11,6 +11,8 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cache"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"github.com/stretchr/testify/assert"
@@ -22,9 +24,13 @@ import (
 type stubClient struct {
 	getDataKeyErr error
 	dataKey       []byte
+	calls         int
+	req           *keyserviceproto.GetDataKeyRequest
 }
 
-func (c *stubClient) GetDataKey(context.Context, *keyserviceproto.GetDataKeyRequest, *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error) {
+func (c *stubClient) GetDataKey(_ context.Context, req *keyserviceproto.GetDataKeyRequest, _ *grpc.ClientConn) (*keyserviceproto.GetDataKeyResponse, error) {
+	c.calls++
+	c.req = req
 	return &keyserviceproto.GetDataKeyResponse{DataKey: c.dataKey}, c.getDataKeyErr
 }
 
@@ -34,14 +40,26 @@ func TestMain(m *testing.M) {
 
 func TestGetDataKey(t *testing.T) {
 	testCases := map[string]struct {
-		client  *stubClient
-		wantErr bool
+		client      *stubClient
+		keyID       string
+		wantKeyID   string
+		wantVersion uint32
+		wantErr     bool
 	}{
 		"GetDataKey success": {
-			client: &stubClient{dataKey: []byte{0x1, 0x2, 0x3}},
+			client:    &stubClient{dataKey: []byte{0x1, 0x2, 0x3}},
+			keyID:     "disk-uuid",
+			wantKeyID: "disk-uuid",
+		},
+		"master secret version is sent separately": {
+			client:      &stubClient{dataKey: []byte{0x1, 0x2, 0x3}},
+			keyID:       cluster.MasterSecretKeyID("disk-uuid", 2),
+			wantKeyID:   "disk-uuid",
+			wantVersion: 2,
 		},
 		"GetDataKey error": {
 			client:  &stubClient{getDataKeyErr: errors.New("error")},
+			keyID:   "disk-uuid",
 			wantErr: true,
 		},
 	}
@@ -60,13 +78,34 @@ func TestGetDataKey(t *testing.T) {
 
 			client.grpc = tc.client
 
-			res, err := client.GetDataKey(t.Context(), "disk-uuid", 32)
+			res, err := client.GetDataKey(t.Context(), tc.keyID, 32)
 			if tc.wantErr {
 				assert.Error(err)
 			} else {
 				assert.NoError(err)
 				assert.Equal(tc.client.dataKey, res)
+				assert.Equal(tc.wantKeyID, tc.client.req.DataKeyId)
+				assert.Equal(tc.wantVersion, tc.client.req.MasterSecretVersion)
 			}
 		})
 	}
 }
+
+func TestCachedGetDataKey(t *testing.T) {
+	assert := assert.New(t)
+
+	listener := bufconn.Listen(1)
+	defer listener.Close()
+
+	stub := &stubClient{dataKey: []byte{0x1, 0x2, 0x3}}
+	client := New(logger.NewTest(t), listener.Addr().String())
+	client.grpc = stub
+	cached := NewCached(client, cache.Options{})
+
+	for range 3 {
+		res, err := cached.GetDataKey(t.Context(), "disk-uuid", 32)
+		assert.NoError(err)
+		assert.Equal(stub.dataKey, res)
+	}
+	assert.Equal(1, stub.calls)
+}
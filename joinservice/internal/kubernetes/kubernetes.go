@@ -18,6 +18,7 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/versions/components"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -132,7 +133,6 @@ func (c *Client) AddNodeToJoiningNodes(ctx context.Context, nodeName string, com
 }
 
 func (c *Client) addControlPlaneToJoiningNodes(ctx context.Context, joiningNode *unstructured.Unstructured) error {
-	joiningNodeResource := schema.GroupVersionResource{Group: "update.edgeless.systems", Version: "v1alpha1", Resource: "joiningnodes"}
 	_, err := c.dynClient.Resource(joiningNodeResource).Create(ctx, joiningNode, metav1.CreateOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to create joining control-plane node, maybe another node is already joining: %w", err)
@@ -141,7 +141,6 @@ func (c *Client) addControlPlaneToJoiningNodes(ctx context.Context, joiningNode
 }
 
 func (c *Client) addWorkerToJoiningNodes(ctx context.Context, joiningNode *unstructured.Unstructured) error {
-	joiningNodeResource := schema.GroupVersionResource{Group: "update.edgeless.systems", Version: "v1alpha1", Resource: "joiningnodes"}
 	_, err := c.dynClient.Resource(joiningNodeResource).Apply(ctx, joiningNode.GetName(), joiningNode, metav1.ApplyOptions{FieldManager: "join-service"})
 	if err != nil {
 		return fmt.Errorf("failed to create joining node: %w", err)
@@ -149,6 +148,242 @@ func (c *Client) addWorkerToJoiningNodes(ctx context.Context, joiningNode *unstr
 	return nil
 }
 
+// CountJoiningNodes returns the number of nodes that received a join ticket but haven't joined the cluster yet.
+func (c *Client) CountJoiningNodes(ctx context.Context) (int, error) {
+	joiningNodes, err := c.dynClient.Resource(joiningNodeResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list joining nodes: %w", err)
+	}
+	return len(joiningNodes.Items), nil
+}
+
+// JoinRequest is a request of a node to join the cluster, which is held until it's approved.
+type JoinRequest struct {
+	NodeName       string
+	IsControlPlane bool
+	PeerAddress    string
+	Approved       bool
+}
+
+// GetJoinRequest returns the join request of the given node.
+// found is false if the node didn't request to join yet.
+func (c *Client) GetJoinRequest(ctx context.Context, nodeName string) (req JoinRequest, found bool, err error) {
+	name, err := k8sCompliantHostname(nodeName)
+	if err != nil {
+		return JoinRequest{}, false, fmt.Errorf("failed to get k8s compliant hostname: %w", err)
+	}
+	joinRequest, err := c.dynClient.Resource(joinRequestResource).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return JoinRequest{}, false, nil
+	}
+	if err != nil {
+		return JoinRequest{}, false, fmt.Errorf("failed to get join request: %w", err)
+	}
+
+	req.NodeName, _, _ = unstructured.NestedString(joinRequest.Object, "spec", "nodeName")
+	req.IsControlPlane, _, _ = unstructured.NestedBool(joinRequest.Object, "spec", "isControlPlane")
+	req.PeerAddress, _, _ = unstructured.NestedString(joinRequest.Object, "spec", "peerAddress")
+	req.Approved, _, _ = unstructured.NestedBool(joinRequest.Object, "spec", "approved")
+	return req, true, nil
+}
+
+// CreateJoinRequest creates a join request for the given node, which has to be approved by an operator.
+func (c *Client) CreateJoinRequest(ctx context.Context, req JoinRequest) error {
+	name, err := k8sCompliantHostname(req.NodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get k8s compliant hostname: %w", err)
+	}
+	joinRequest := &unstructured.Unstructured{}
+	joinRequest.SetUnstructuredContent(map[string]any{
+		"apiVersion": "update.edgeless.systems/v1alpha1",
+		"kind":       "JoinRequest",
+		"metadata": map[string]any{
+			"name": name,
+		},
+		"spec": map[string]any{
+			"nodeName":       req.NodeName,
+			"isControlPlane": req.IsControlPlane,
+			"peerAddress":    req.PeerAddress,
+		},
+	})
+	if _, err := c.dynClient.Resource(joinRequestResource).Create(ctx, joinRequest, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create join request: %w", err)
+	}
+	return nil
+}
+
+// DeleteJoinRequest deletes the join request of the given node.
+func (c *Client) DeleteJoinRequest(ctx context.Context, nodeName string) error {
+	name, err := k8sCompliantHostname(nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get k8s compliant hostname: %w", err)
+	}
+	if err := c.dynClient.Resource(joinRequestResource).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete join request: %w", err)
+	}
+	return nil
+}
+
+// NodeIdentity records the join of a node, identified by the instance it runs on.
+type NodeIdentity struct {
+	InstanceID     string
+	DiskUUID       string
+	NodeName       string
+	IsControlPlane bool
+	// CSRHash is the hash of the certificate signing request the node joined with.
+	CSRHash string
+	// JoinTime is the time the node was last issued a join ticket.
+	JoinTime time.Time
+	// AllowJoin allows the node to request another join ticket.
+	AllowJoin bool
+	// Revoked denies the node to join or rejoin the cluster.
+	Revoked bool
+	// ResourceVersion is used for optimistic concurrency control when updating the NodeIdentity.
+	ResourceVersion string
+}
+
+// GetNodeIdentity returns the NodeIdentity of the node with the given instance ID.
+// found is false if the node never joined the cluster.
+func (c *Client) GetNodeIdentity(ctx context.Context, instanceID string) (identity NodeIdentity, found bool, err error) {
+	name, err := k8sCompliantHostname(instanceID)
+	if err != nil {
+		return NodeIdentity{}, false, fmt.Errorf("failed to get k8s compliant name: %w", err)
+	}
+	nodeIdentity, err := c.dynClient.Resource(nodeIdentityResource).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return NodeIdentity{}, false, nil
+	}
+	if err != nil {
+		return NodeIdentity{}, false, fmt.Errorf("failed to get node identity: %w", err)
+	}
+	return nodeIdentityFromObject(nodeIdentity), true, nil
+}
+
+// ListNodeIdentities returns the NodeIdentities of all nodes that joined the cluster.
+func (c *Client) ListNodeIdentities(ctx context.Context) ([]NodeIdentity, error) {
+	nodeIdentities, err := c.dynClient.Resource(nodeIdentityResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node identities: %w", err)
+	}
+	identities := make([]NodeIdentity, 0, len(nodeIdentities.Items))
+	for i := range nodeIdentities.Items {
+		identities = append(identities, nodeIdentityFromObject(&nodeIdentities.Items[i]))
+	}
+	return identities, nil
+}
+
+// CreateNodeIdentity records the join of a node.
+// The returned error wraps a Kubernetes AlreadyExists error if the node already joined.
+func (c *Client) CreateNodeIdentity(ctx context.Context, identity NodeIdentity) error {
+	nodeIdentity, err := nodeIdentityObject(identity)
+	if err != nil {
+		return err
+	}
+	if _, err := c.dynClient.Resource(nodeIdentityResource).Create(ctx, nodeIdentity, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create node identity: %w", err)
+	}
+	return nil
+}
+
+// UpdateNodeIdentity updates the NodeIdentity of a node.
+// The returned error wraps a Kubernetes Conflict error if the NodeIdentity was modified since it was read.
+func (c *Client) UpdateNodeIdentity(ctx context.Context, identity NodeIdentity) error {
+	nodeIdentity, err := nodeIdentityObject(identity)
+	if err != nil {
+		return err
+	}
+	nodeIdentity.SetResourceVersion(identity.ResourceVersion)
+	if _, err := c.dynClient.Resource(nodeIdentityResource).Update(ctx, nodeIdentity, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update node identity: %w", err)
+	}
+	return nil
+}
+
+// DeleteNodeIdentity deletes the NodeIdentity of a node.
+// If the ResourceVersion of identity is set, the returned error wraps a Kubernetes Conflict error
+// if the NodeIdentity was modified since it was read.
+func (c *Client) DeleteNodeIdentity(ctx context.Context, identity NodeIdentity) error {
+	name, err := k8sCompliantHostname(identity.InstanceID)
+	if err != nil {
+		return fmt.Errorf("failed to get k8s compliant name: %w", err)
+	}
+	var opts metav1.DeleteOptions
+	if identity.ResourceVersion != "" {
+		opts.Preconditions = &metav1.Preconditions{ResourceVersion: &identity.ResourceVersion}
+	}
+	if err := c.dynClient.Resource(nodeIdentityResource).Delete(ctx, name, opts); err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete node identity: %w", err)
+	}
+	return nil
+}
+
+// ListNodeNames returns the names of all nodes of the cluster.
+func (c *Client) ListNodeNames(ctx context.Context) ([]string, error) {
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	names := make([]string, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
+func nodeIdentityObject(identity NodeIdentity) (*unstructured.Unstructured, error) {
+	name, err := k8sCompliantHostname(identity.InstanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get k8s compliant name: %w", err)
+	}
+	spec := map[string]any{
+		"instanceID":     identity.InstanceID,
+		"diskUUID":       identity.DiskUUID,
+		"nodeName":       identity.NodeName,
+		"isControlPlane": identity.IsControlPlane,
+		"csrHash":        identity.CSRHash,
+		"allowJoin":      identity.AllowJoin,
+		"revoked":        identity.Revoked,
+	}
+	if !identity.JoinTime.IsZero() {
+		spec["joinTime"] = identity.JoinTime.UTC().Format(time.RFC3339)
+	}
+	nodeIdentity := &unstructured.Unstructured{}
+	nodeIdentity.SetUnstructuredContent(map[string]any{
+		"apiVersion": "update.edgeless.systems/v1alpha1",
+		"kind":       "NodeIdentity",
+		"metadata": map[string]any{
+			"name": name,
+		},
+		"spec": spec,
+	})
+	return nodeIdentity, nil
+}
+
+func nodeIdentityFromObject(nodeIdentity *unstructured.Unstructured) NodeIdentity {
+	var identity NodeIdentity
+	identity.InstanceID, _, _ = unstructured.NestedString(nodeIdentity.Object, "spec", "instanceID")
+	identity.DiskUUID, _, _ = unstructured.NestedString(nodeIdentity.Object, "spec", "diskUUID")
+	identity.NodeName, _, _ = unstructured.NestedString(nodeIdentity.Object, "spec", "nodeName")
+	identity.IsControlPlane, _, _ = unstructured.NestedBool(nodeIdentity.Object, "spec", "isControlPlane")
+	identity.CSRHash, _, _ = unstructured.NestedString(nodeIdentity.Object, "spec", "csrHash")
+	identity.AllowJoin, _, _ = unstructured.NestedBool(nodeIdentity.Object, "spec", "allowJoin")
+	identity.Revoked, _, _ = unstructured.NestedBool(nodeIdentity.Object, "spec", "revoked")
+	joinTime, _, _ := unstructured.NestedString(nodeIdentity.Object, "spec", "joinTime")
+	// identities created without a join time, e.g., by an operator, use their creation time
+	identity.JoinTime = nodeIdentity.GetCreationTimestamp().Time
+	if t, err := time.Parse(time.RFC3339, joinTime); err == nil {
+		identity.JoinTime = t
+	}
+	identity.ResourceVersion = nodeIdentity.GetResourceVersion()
+	return identity
+}
+
+var (
+	joiningNodeResource  = schema.GroupVersionResource{Group: "update.edgeless.systems", Version: "v1alpha1", Resource: "joiningnodes"}
+	joinRequestResource  = schema.GroupVersionResource{Group: "update.edgeless.systems", Version: "v1alpha1", Resource: "joinrequests"}
+	nodeIdentityResource = schema.GroupVersionResource{Group: "update.edgeless.systems", Version: "v1alpha1", Resource: "nodeidentities"}
+)
+
 var validHostnameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
 
 // k8sCompliantHostname transforms a hostname to an RFC 1123 compliant, lowercase subdomain as required by Kubernetes node names.
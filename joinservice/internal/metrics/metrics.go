@@ -0,0 +1,165 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package metrics provides the Prometheus metrics of the join service.
+
+Join and rejoin requests are counted by outcome, attestation failures by reason,
+and the steps of issuing a join ticket are timed, so that failing joins, e.g., after rolling out a bad image, can be alerted on.
+*/
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/atls"
+	"github.com/edgelesssys/constellation/v2/internal/attestation"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "joinservice"
+
+// Outcomes of join and rejoin requests.
+const (
+	// OutcomeSuccess labels requests that were issued a ticket.
+	OutcomeSuccess = "success"
+	// OutcomeDenied labels requests that were denied by the join policy or the node's identity.
+	OutcomeDenied = "denied"
+	// OutcomePostponed labels requests that were held back by the join policy and are retried by the node.
+	OutcomePostponed = "postponed"
+	// OutcomeError labels requests that failed.
+	OutcomeError = "error"
+)
+
+// Reasons of attestation failures.
+const (
+	// ReasonMeasurementMismatch labels attestation documents with unexpected measurements.
+	ReasonMeasurementMismatch = "measurement_mismatch"
+	// ReasonTCBVersion labels attestation reports with a TCB version below the configured minimum.
+	ReasonTCBVersion = "tcb_version"
+	// ReasonSignature labels attestation reports with an invalid signature or certificate chain.
+	ReasonSignature = "signature"
+	// ReasonOther labels all other attestation failures.
+	ReasonOther = "other"
+)
+
+// Metrics holds the Prometheus metrics of the join service.
+// A nil *Metrics is valid and doesn't record anything.
+type Metrics struct {
+	requests            *prometheus.CounterVec
+	attestationFailures *prometheus.CounterVec
+	stepDuration        *prometheus.HistogramVec
+}
+
+// New creates the metrics of the join service and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of join and rejoin requests, by method and outcome.",
+		}, []string{"method", "outcome"}),
+		attestationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "attestation_failures_total",
+			Help:      "Number of attestation documents that failed validation, by reason.",
+		}, []string{"reason"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "join_step_duration_seconds",
+			Help:      "Duration of the steps of issuing a join ticket.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"step"}),
+	}
+	reg.MustRegister(m.requests, m.attestationFailures, m.stepDuration)
+	return m
+}
+
+// ObserveRequest records the outcome of a join or rejoin request that returned err.
+func (m *Metrics) ObserveRequest(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(method, Outcome(err)).Inc()
+}
+
+// Outcome returns the outcome label of a request that returned err.
+func Outcome(err error) string {
+	switch status.Code(err) {
+	case codes.OK:
+		return OutcomeSuccess
+	case codes.PermissionDenied:
+		return OutcomeDenied
+	case codes.ResourceExhausted, codes.FailedPrecondition:
+		return OutcomePostponed
+	default:
+		return OutcomeError
+	}
+}
+
+// Reason returns the reason label of an attestation failure.
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, attestation.ErrMeasurementMismatch):
+		return ReasonMeasurementMismatch
+	case errors.Is(err, attestation.ErrTCBVersion):
+		return ReasonTCBVersion
+	case errors.Is(err, attestation.ErrSignature):
+		return ReasonSignature
+	default:
+		return ReasonOther
+	}
+}
+
+// Validator returns an atls.Validator that counts the attestation failures of v.
+func (m *Metrics) Validator(v atls.Validator) atls.Validator {
+	if m == nil {
+		return v
+	}
+	return &validator{Validator: v, failures: m.attestationFailures}
+}
+
+type validator struct {
+	atls.Validator
+	failures *prometheus.CounterVec
+}
+
+// Validate implements atls.Validator.
+func (v *validator) Validate(ctx context.Context, attDoc []byte, nonce []byte) ([]byte, error) {
+	userData, err := v.Validator.Validate(ctx, attDoc, nonce)
+	if err != nil {
+		v.failures.WithLabelValues(Reason(err)).Inc()
+	}
+	return userData, err
+}
+
+// StepTimer measures the duration of consecutive steps of issuing a join ticket.
+type StepTimer struct {
+	duration *prometheus.HistogramVec
+	last     time.Time
+}
+
+// StepTimer starts timing the first step.
+func (m *Metrics) StepTimer() *StepTimer {
+	if m == nil {
+		return nil
+	}
+	return &StepTimer{duration: m.stepDuration, last: time.Now()}
+}
+
+// Done records the time since the previous step finished, or the timer was started, as the duration of step.
+func (t *StepTimer) Done(step string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.duration.WithLabelValues(step).Observe(now.Sub(t.last).Seconds())
+	t.last = now
+}
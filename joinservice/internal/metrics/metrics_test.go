@@ -0,0 +1,132 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/attestation"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/variant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestObserveRequest(t *testing.T) {
+	testCases := map[string]struct {
+		err         error
+		wantOutcome string
+	}{
+		"success": {
+			wantOutcome: OutcomeSuccess,
+		},
+		"denied": {
+			err:         status.Error(codes.PermissionDenied, "denied"),
+			wantOutcome: OutcomeDenied,
+		},
+		"too many joins": {
+			err:         status.Error(codes.ResourceExhausted, "too many joins"),
+			wantOutcome: OutcomePostponed,
+		},
+		"pending approval": {
+			err:         status.Error(codes.FailedPrecondition, "pending approval"),
+			wantOutcome: OutcomePostponed,
+		},
+		"internal error": {
+			err:         status.Error(codes.Internal, "failed"),
+			wantOutcome: OutcomeError,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			m := New(prometheus.NewRegistry())
+			m.ObserveRequest("IssueJoinTicket", tc.err)
+			assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("IssueJoinTicket", tc.wantOutcome)))
+		})
+	}
+}
+
+func TestValidator(t *testing.T) {
+	testCases := map[string]struct {
+		validateErr error
+		wantReason  string
+	}{
+		"success": {},
+		"measurement mismatch": {
+			validateErr: fmt.Errorf("%w:\n%w", attestation.ErrMeasurementMismatch, errors.New("PCR[4] mismatch")),
+			wantReason:  ReasonMeasurementMismatch,
+		},
+		"TCB version too low": {
+			validateErr: fmt.Errorf("validating SNP attestation: %w: %w", attestation.ErrTCBVersion, errors.New("launch TCB")),
+			wantReason:  ReasonTCBVersion,
+		},
+		"invalid signature": {
+			validateErr: fmt.Errorf("verifying SNP attestation: %w: %w", attestation.ErrSignature, errors.New("bad signature")),
+			wantReason:  ReasonSignature,
+		},
+		"other failure": {
+			validateErr: errors.New("unmarshaling attestation document"),
+			wantReason:  ReasonOther,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			m := New(prometheus.NewRegistry())
+			v := m.Validator(stubValidator{err: tc.validateErr})
+			_, err := v.Validate(t.Context(), nil, nil)
+			assert.ErrorIs(err, tc.validateErr)
+
+			if tc.validateErr == nil {
+				assert.Zero(testutil.CollectAndCount(m.attestationFailures))
+				return
+			}
+			assert.Equal(1, testutil.CollectAndCount(m.attestationFailures))
+			assert.Equal(1.0, testutil.ToFloat64(m.attestationFailures.WithLabelValues(tc.wantReason)))
+		})
+	}
+}
+
+func TestStepTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	m := New(prometheus.NewRegistry())
+	steps := m.StepTimer()
+	steps.Done("join_policy")
+	steps.Done("data_keys")
+	assert.Equal(2, testutil.CollectAndCount(m.stepDuration))
+
+	// a nil *Metrics doesn't record anything
+	var noMetrics *Metrics
+	noMetrics.ObserveRequest("IssueJoinTicket", nil)
+	noMetrics.StepTimer().Done("join_policy")
+	assert.Equal(stubValidator{}, noMetrics.Validator(stubValidator{}))
+}
+
+type stubValidator struct {
+	variant.Dummy
+	err error
+}
+
+func (v stubValidator) Validate(_ context.Context, _ []byte, _ []byte) ([]byte, error) {
+	return nil, v.err
+}
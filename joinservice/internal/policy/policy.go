@@ -0,0 +1,259 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package policy decides whether a node that passed attestation may join the cluster.
+
+The policy is optional. It's read from a VolumeMount backed by the join-config ConfigMap
+for every join request, so changes take effect without restarting the join service.
+All checks of the policy are evaluated before any keys are released to the node.
+*/
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/edgelesssys/constellation/v2/internal/cloud/metadata"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/role"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetes"
+	"github.com/spf13/afero"
+)
+
+var (
+	// ErrDenied is returned if the policy doesn't allow the node to join.
+	ErrDenied = errors.New("join denied by policy")
+	// ErrTooManyJoins is returned if the maximum number of concurrent joins is reached.
+	ErrTooManyJoins = errors.New("too many concurrent joins")
+	// ErrPendingApproval is returned if the join request of the node wasn't approved yet.
+	ErrPendingApproval = errors.New("join request pending approval")
+)
+
+// Policy restricts which nodes may join the cluster.
+// The zero value allows all nodes that pass attestation to join.
+type Policy struct {
+	// MaxConcurrentJoins is the maximum number of nodes that received a join ticket, but haven't joined yet.
+	// Unlimited if 0. The limit is enforced per join service replica: joins that are still being issued
+	// are only counted by the replica issuing them, so concurrent joins through other replicas may exceed it.
+	MaxConcurrentJoins int `json:"maxConcurrentJoins,omitempty"`
+	// NodeNamePatterns are regular expressions, of which the name of a joining node must match at least one.
+	// All names are allowed if empty.
+	NodeNamePatterns []string `json:"nodeNamePatterns,omitempty"`
+	// VerifyCloudMembership requires joining nodes to be listed as instances of the cluster by the cloud metadata API,
+	// with the same role they request to join as, and to connect from the VPC IP of that instance.
+	VerifyCloudMembership bool `json:"verifyCloudMembership,omitempty"`
+	// ManualApproval holds join requests until an operator approves the JoinRequest resource of the node.
+	ManualApproval bool `json:"manualApproval,omitempty"`
+}
+
+// Request is a request of a node to join the cluster.
+type Request struct {
+	NodeName       string
+	IsControlPlane bool
+	PeerAddress    string
+}
+
+// Engine evaluates the join policy.
+type Engine struct {
+	log         *slog.Logger
+	fileHandler file.Handler
+	kubeClient  kubeClient
+	instances   metadata.InstanceLister
+
+	mux      sync.Mutex
+	inFlight int
+}
+
+// NewEngine creates a new Engine.
+// instances may be nil if the cloud metadata API isn't available, in which case cloud membership can't be verified.
+func NewEngine(log *slog.Logger, fileHandler file.Handler, kubeClient kubeClient, instances metadata.InstanceLister) *Engine {
+	return &Engine{
+		log:         log,
+		fileHandler: fileHandler,
+		kubeClient:  kubeClient,
+		instances:   instances,
+	}
+}
+
+// Evaluate checks whether the node may join the cluster.
+// The returned error wraps ErrDenied, ErrTooManyJoins, or ErrPendingApproval if the policy doesn't allow the join.
+// If the join is allowed, done must be called once the join ticket was issued or issuing it failed.
+func (e *Engine) Evaluate(ctx context.Context, req Request) (done func(ctx context.Context, issued bool), err error) {
+	policy, err := e.policy()
+	if err != nil {
+		return nil, fmt.Errorf("reading join policy: %w", err)
+	}
+
+	if err := checkNodeName(policy.NodeNamePatterns, req.NodeName); err != nil {
+		return nil, err
+	}
+	if policy.VerifyCloudMembership {
+		if err := e.checkCloudMembership(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	if policy.ManualApproval {
+		if err := e.checkApproval(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	// concurrent joins are checked last, so that nodes that are denied or pending don't count
+	if err := e.acquire(ctx, policy.MaxConcurrentJoins); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, issued bool) {
+		e.release()
+		if !issued || !policy.ManualApproval {
+			return
+		}
+		// an approval is only valid for a single join
+		if err := e.kubeClient.DeleteJoinRequest(ctx, req.NodeName); err != nil {
+			e.log.With(slog.Any("error", err), slog.String("nodeName", req.NodeName)).Error("Failed to delete approved join request")
+		}
+	}, nil
+}
+
+// policy reads the join policy from a VolumeMount that is backed by the join-config ConfigMap.
+// If no policy is configured, the file doesn't exist and all nodes may join.
+func (e *Engine) policy() (Policy, error) {
+	var policy Policy
+	err := e.fileHandler.ReadJSON(filepath.Join(constants.ServiceBasePath, constants.JoinPolicyFilename), &policy)
+	if err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return Policy{}, err
+	}
+	return policy, nil
+}
+
+func checkNodeName(patterns []string, nodeName string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid node name pattern %q: %w", pattern, err)
+		}
+		if re.MatchString(nodeName) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: node name %q doesn't match any allowed pattern", ErrDenied, nodeName)
+}
+
+func (e *Engine) checkCloudMembership(ctx context.Context, req Request) error {
+	if e.instances == nil {
+		return errors.New("verifying cloud membership: cloud metadata API not available")
+	}
+	instances, err := e.instances.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing instances: %w", err)
+	}
+
+	wantRole := role.Worker
+	if req.IsControlPlane {
+		wantRole = role.ControlPlane
+	}
+	for _, instance := range instances {
+		if instance.Name != req.NodeName {
+			continue
+		}
+		if instance.Role != wantRole {
+			return fmt.Errorf("%w: node %q requested to join as %s, but is a %s instance", ErrDenied, req.NodeName, wantRole.TFString(), instance.Role.TFString())
+		}
+		// the name is chosen by the node, so it must also connect from the instance's address
+		if !sameIP(req.PeerAddress, instance.VPCIP) {
+			return fmt.Errorf("%w: node %q connected from %s, but the instance's IP is %s", ErrDenied, req.NodeName, req.PeerAddress, instance.VPCIP)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: node %q isn't an instance of the cluster", ErrDenied, req.NodeName)
+}
+
+// sameIP checks whether peerAddress, which may include a port, is the IP address ip.
+func sameIP(peerAddress, ip string) bool {
+	host, _, err := net.SplitHostPort(peerAddress)
+	if err != nil {
+		host = peerAddress
+	}
+	peerIP, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	instanceIP, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return peerIP.Unmap() == instanceIP.Unmap()
+}
+
+func (e *Engine) checkApproval(ctx context.Context, req Request) error {
+	joinRequest, found, err := e.kubeClient.GetJoinRequest(ctx, req.NodeName)
+	if err != nil {
+		return fmt.Errorf("getting join request: %w", err)
+	}
+	if !found {
+		e.log.With(slog.String("nodeName", req.NodeName)).Info("Creating join request for manual approval")
+		if err := e.kubeClient.CreateJoinRequest(ctx, kubernetes.JoinRequest{
+			NodeName:       req.NodeName,
+			IsControlPlane: req.IsControlPlane,
+			PeerAddress:    req.PeerAddress,
+		}); err != nil {
+			return fmt.Errorf("creating join request: %w", err)
+		}
+		return fmt.Errorf("%w: approve the JoinRequest of node %q", ErrPendingApproval, req.NodeName)
+	}
+	if !joinRequest.Approved {
+		return fmt.Errorf("%w: approve the JoinRequest of node %q", ErrPendingApproval, req.NodeName)
+	}
+	if joinRequest.IsControlPlane != req.IsControlPlane {
+		return fmt.Errorf("%w: the approved JoinRequest of node %q is for a different role", ErrDenied, req.NodeName)
+	}
+	return nil
+}
+
+// acquire reserves one of the concurrent joins.
+// Nodes count as joining from the moment their join ticket is being issued, until the node operator removes their JoiningNode resource.
+// Tickets that are being issued are counted in this process only, since the join service runs on every control-plane node,
+// and their JoiningNode resources are only created once the ticket was issued.
+func (e *Engine) acquire(ctx context.Context, maxConcurrentJoins int) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if maxConcurrentJoins > 0 {
+		joining, err := e.kubeClient.CountJoiningNodes(ctx)
+		if err != nil {
+			return fmt.Errorf("counting joining nodes: %w", err)
+		}
+		if joining+e.inFlight >= maxConcurrentJoins {
+			return fmt.Errorf("%w: %d nodes are joining, allowed are %d", ErrTooManyJoins, joining+e.inFlight, maxConcurrentJoins)
+		}
+	}
+	e.inFlight++
+	return nil
+}
+
+func (e *Engine) release() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.inFlight--
+}
+
+type kubeClient interface {
+	CountJoiningNodes(ctx context.Context) (int, error)
+	GetJoinRequest(ctx context.Context, nodeName string) (kubernetes.JoinRequest, bool, error)
+	CreateJoinRequest(ctx context.Context, req kubernetes.JoinRequest) error
+	DeleteJoinRequest(ctx context.Context, nodeName string) error
+}
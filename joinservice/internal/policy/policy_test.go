@@ -0,0 +1,289 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package policy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/cloud/metadata"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/internal/role"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/kubernetes"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestEvaluate(t *testing.T) {
+	someErr := errors.New("failed")
+	instances := []metadata.InstanceMetadata{
+		{Name: "control-plane-0", Role: role.ControlPlane, VPCIP: "192.0.2.1"},
+		{Name: "worker-0", Role: role.Worker, VPCIP: "192.0.2.2"},
+	}
+
+	testCases := map[string]struct {
+		policy            string
+		req               Request
+		kubeClient        *stubKubeClient
+		instances         metadata.InstanceLister
+		wantErr           error
+		wantOtherErr      bool
+		wantCreateRequest bool
+		wantDeleteRequest bool
+	}{
+		"no policy": {
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{},
+		},
+		"empty policy": {
+			policy:     "{}",
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{},
+		},
+		"invalid policy": {
+			policy:       "invalid",
+			req:          Request{NodeName: "worker-0"},
+			kubeClient:   &stubKubeClient{},
+			wantOtherErr: true,
+		},
+		"node name matches pattern": {
+			policy:     `{"nodeNamePatterns":["^control-plane-[0-9]+$","^worker-[0-9]+$"]}`,
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{},
+		},
+		"node name doesn't match pattern": {
+			policy:     `{"nodeNamePatterns":["^control-plane-[0-9]+$"]}`,
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{},
+			wantErr:    ErrDenied,
+		},
+		"invalid node name pattern": {
+			policy:       `{"nodeNamePatterns":["("]}`,
+			req:          Request{NodeName: "worker-0"},
+			kubeClient:   &stubKubeClient{},
+			wantOtherErr: true,
+		},
+		"cloud member": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "control-plane-0", IsControlPlane: true, PeerAddress: "192.0.2.1:41234"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+		},
+		"cloud member connecting over IPv4-mapped IPv6": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "worker-0", PeerAddress: "[::ffff:192.0.2.2]:41234"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+		},
+		"not a cloud member": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "worker-1", PeerAddress: "192.0.2.3:41234"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+			wantErr:    ErrDenied,
+		},
+		"cloud member with different role": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "worker-0", IsControlPlane: true, PeerAddress: "192.0.2.2:41234"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+			wantErr:    ErrDenied,
+		},
+		"name of cloud member, but IP of another instance": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "worker-0", PeerAddress: "192.0.2.1:41234"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+			wantErr:    ErrDenied,
+		},
+		"name of cloud member, but unknown peer address": {
+			policy:     `{"verifyCloudMembership":true}`,
+			req:        Request{NodeName: "worker-0", PeerAddress: "unknown"},
+			kubeClient: &stubKubeClient{},
+			instances:  stubInstanceLister{instances: instances},
+			wantErr:    ErrDenied,
+		},
+		"listing instances fails": {
+			policy:       `{"verifyCloudMembership":true}`,
+			req:          Request{NodeName: "worker-0"},
+			kubeClient:   &stubKubeClient{},
+			instances:    stubInstanceLister{err: someErr},
+			wantOtherErr: true,
+		},
+		"no cloud metadata API": {
+			policy:       `{"verifyCloudMembership":true}`,
+			req:          Request{NodeName: "worker-0"},
+			kubeClient:   &stubKubeClient{},
+			wantOtherErr: true,
+		},
+		"below max concurrent joins": {
+			policy:     `{"maxConcurrentJoins":2}`,
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{joiningNodes: 1},
+		},
+		"max concurrent joins reached": {
+			policy:     `{"maxConcurrentJoins":2}`,
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{joiningNodes: 2},
+			wantErr:    ErrTooManyJoins,
+		},
+		"counting joining nodes fails": {
+			policy:       `{"maxConcurrentJoins":2}`,
+			req:          Request{NodeName: "worker-0"},
+			kubeClient:   &stubKubeClient{countErr: someErr},
+			wantOtherErr: true,
+		},
+		"new join request": {
+			policy:            `{"manualApproval":true}`,
+			req:               Request{NodeName: "worker-0"},
+			kubeClient:        &stubKubeClient{},
+			wantErr:           ErrPendingApproval,
+			wantCreateRequest: true,
+		},
+		"join request not approved": {
+			policy: `{"manualApproval":true}`,
+			req:    Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{
+				joinRequests: map[string]kubernetes.JoinRequest{"worker-0": {NodeName: "worker-0"}},
+			},
+			wantErr: ErrPendingApproval,
+		},
+		"join request approved": {
+			policy: `{"manualApproval":true}`,
+			req:    Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{
+				joinRequests: map[string]kubernetes.JoinRequest{"worker-0": {NodeName: "worker-0", Approved: true}},
+			},
+			wantDeleteRequest: true,
+		},
+		"join request approved for different role": {
+			policy: `{"manualApproval":true}`,
+			req:    Request{NodeName: "worker-0", IsControlPlane: true},
+			kubeClient: &stubKubeClient{
+				joinRequests: map[string]kubernetes.JoinRequest{"worker-0": {NodeName: "worker-0", Approved: true}},
+			},
+			wantErr: ErrDenied,
+		},
+		"denied nodes don't create join requests": {
+			policy:     `{"manualApproval":true,"nodeNamePatterns":["^control-plane-[0-9]+$"]}`,
+			req:        Request{NodeName: "worker-0"},
+			kubeClient: &stubKubeClient{},
+			wantErr:    ErrDenied,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fh := file.NewHandler(afero.NewMemMapFs())
+			if tc.policy != "" {
+				require.NoError(fh.Write(filepath.Join(constants.ServiceBasePath, constants.JoinPolicyFilename), []byte(tc.policy), file.OptMkdirAll))
+			}
+			engine := NewEngine(logger.NewTest(t), fh, tc.kubeClient, tc.instances)
+
+			done, err := engine.Evaluate(t.Context(), tc.req)
+			_, created := tc.kubeClient.joinRequests[tc.req.NodeName]
+			assert.Equal(tc.wantCreateRequest, created && tc.kubeClient.created)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			if tc.wantOtherErr {
+				assert.Error(err)
+				for _, policyErr := range []error{ErrDenied, ErrTooManyJoins, ErrPendingApproval} {
+					assert.NotErrorIs(err, policyErr)
+				}
+				return
+			}
+			require.NoError(err)
+			assert.Equal(1, engine.inFlight)
+
+			done(t.Context(), true)
+			assert.Zero(engine.inFlight)
+			assert.Equal(tc.wantDeleteRequest, tc.kubeClient.deleted)
+		})
+	}
+}
+
+func TestEvaluateConcurrentJoins(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fh := file.NewHandler(afero.NewMemMapFs())
+	require.NoError(fh.Write(filepath.Join(constants.ServiceBasePath, constants.JoinPolicyFilename), []byte(`{"maxConcurrentJoins":2}`), file.OptMkdirAll))
+	engine := NewEngine(logger.NewTest(t), fh, &stubKubeClient{}, nil)
+
+	// joins that are being issued count towards the limit
+	done1, err := engine.Evaluate(t.Context(), Request{NodeName: "worker-0"})
+	require.NoError(err)
+	done2, err := engine.Evaluate(t.Context(), Request{NodeName: "worker-1"})
+	require.NoError(err)
+	_, err = engine.Evaluate(t.Context(), Request{NodeName: "worker-2"})
+	assert.ErrorIs(err, ErrTooManyJoins)
+
+	// failed joins free their slot
+	done1(t.Context(), false)
+	done3, err := engine.Evaluate(t.Context(), Request{NodeName: "worker-2"})
+	require.NoError(err)
+
+	done2(t.Context(), true)
+	done3(t.Context(), true)
+	assert.Zero(engine.inFlight)
+}
+
+type stubKubeClient struct {
+	joiningNodes int
+	countErr     error
+	joinRequests map[string]kubernetes.JoinRequest
+	created      bool
+	deleted      bool
+}
+
+func (s *stubKubeClient) CountJoiningNodes(_ context.Context) (int, error) {
+	return s.joiningNodes, s.countErr
+}
+
+func (s *stubKubeClient) GetJoinRequest(_ context.Context, nodeName string) (kubernetes.JoinRequest, bool, error) {
+	req, ok := s.joinRequests[nodeName]
+	return req, ok, nil
+}
+
+func (s *stubKubeClient) CreateJoinRequest(_ context.Context, req kubernetes.JoinRequest) error {
+	if s.joinRequests == nil {
+		s.joinRequests = map[string]kubernetes.JoinRequest{}
+	}
+	s.joinRequests[req.NodeName] = req
+	s.created = true
+	return nil
+}
+
+func (s *stubKubeClient) DeleteJoinRequest(_ context.Context, nodeName string) error {
+	delete(s.joinRequests, nodeName)
+	s.deleted = true
+	return nil
+}
+
+type stubInstanceLister struct {
+	instances []metadata.InstanceMetadata
+	err       error
+}
+
+func (s stubInstanceLister) List(_ context.Context) ([]metadata.InstanceMetadata, error) {
+	return s.instances, s.err
+}
@@ -10,9 +10,11 @@ package server
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"path/filepath"
 	"time"
 
 	"github.com/edgelesssys/constellation/v2/internal/attestation"
@@ -20,9 +22,14 @@ import (
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/internal/file"
 	"github.com/edgelesssys/constellation/v2/internal/grpc/grpclog"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/internal/versions/components"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/identity"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/metrics"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/policy"
 	"github.com/edgelesssys/constellation/v2/joinservice/joinproto"
+	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -42,6 +49,9 @@ type Server struct {
 	dataKeyGetter   dataKeyGetter
 	ca              certificateAuthority
 	kubeClient      kubeClient
+	joinPolicy      joinPolicy
+	nodeIdentities  nodeIdentities
+	metrics         *metrics.Metrics
 	fileHandler     file.Handler
 	joinproto.UnimplementedAPIServer
 }
@@ -49,8 +59,8 @@ type Server struct {
 // New initializes a new Server.
 func New(
 	measurementSalt []byte, ca certificateAuthority,
-	joinTokenGetter joinTokenGetter, dataKeyGetter dataKeyGetter, kubeClient kubeClient, log *slog.Logger,
-	fileHandler file.Handler,
+	joinTokenGetter joinTokenGetter, dataKeyGetter dataKeyGetter, kubeClient kubeClient, joinPolicy joinPolicy,
+	nodeIdentities nodeIdentities, metrics *metrics.Metrics, log *slog.Logger, fileHandler file.Handler,
 ) (*Server, error) {
 	return &Server{
 		measurementSalt: measurementSalt,
@@ -59,6 +69,9 @@ func New(
 		dataKeyGetter:   dataKeyGetter,
 		ca:              ca,
 		kubeClient:      kubeClient,
+		joinPolicy:      joinPolicy,
+		nodeIdentities:  nodeIdentities,
+		metrics:         metrics,
 		fileHandler:     fileHandler,
 	}, nil
 }
@@ -89,9 +102,62 @@ func (s *Server) Run(creds credentials.TransportCredentials, port string) error
 // - measurement salt and secret, to mark the node as initialized.
 // In addition, control plane nodes receive:
 // - a decryption key for CA certificates uploaded to the Kubernetes cluster.
-func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTicketRequest) (*joinproto.IssueJoinTicketResponse, error) {
+//
+// If a join policy is configured, it's evaluated before any keys are released.
+// If node identities are recorded, a join ticket is only issued once per instance,
+// unless another join is allowed on the node's identity.
+func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTicketRequest) (resp *joinproto.IssueJoinTicketResponse, retErr error) {
 	log := s.log.With(slog.String("peerAddress", grpclog.PeerAddrFromContext(ctx)))
 	log.Info("IssueJoinTicket called")
+	defer func() { s.metrics.ObserveRequest("IssueJoinTicket", retErr) }()
+	steps := s.metrics.StepTimer()
+
+	nodeName, err := s.ca.GetNodeNameFromCSR(req.CertificateRequest)
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("Failed getting node name from CSR")
+		return nil, status.Errorf(codes.Internal, "getting node name from CSR: %s", err)
+	}
+	log = log.With(slog.String("nodeName", nodeName))
+
+	if s.joinPolicy != nil {
+		log.Info("Evaluating join policy")
+		done, err := s.joinPolicy.Evaluate(ctx, policy.Request{
+			NodeName:       nodeName,
+			IsControlPlane: req.IsControlPlane,
+			PeerAddress:    grpclog.PeerAddrFromContext(ctx),
+		})
+		switch {
+		case errors.Is(err, policy.ErrDenied):
+			log.With(slog.Any("error", err)).Warn("Join denied by policy")
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		case errors.Is(err, policy.ErrTooManyJoins):
+			log.With(slog.Any("error", err)).Warn("Join postponed by policy")
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case errors.Is(err, policy.ErrPendingApproval):
+			log.With(slog.Any("error", err)).Info("Join pending approval")
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case err != nil:
+			log.With(slog.Any("error", err)).Error("Failed to evaluate join policy")
+			return nil, status.Errorf(codes.Internal, "evaluating join policy: %s", err)
+		}
+		defer func() { done(context.WithoutCancel(ctx), retErr == nil) }()
+		steps.Done("join_policy")
+	}
+
+	if s.nodeIdentities != nil {
+		log.Info("Recording node identity")
+		release, err := s.nodeIdentities.Claim(ctx, req.DiskUuid, nodeName, req.IsControlPlane, req.CertificateRequest)
+		if errors.Is(err, identity.ErrAlreadyJoined) || errors.Is(err, identity.ErrRevoked) {
+			log.With(slog.Any("error", err)).Warn("Join denied for node identity")
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to record node identity")
+			return nil, status.Errorf(codes.Internal, "recording node identity: %s", err)
+		}
+		defer func() { release(context.WithoutCancel(ctx), retErr == nil) }()
+		steps.Done("node_identity")
+	}
 
 	log.Info("Requesting measurement secret")
 	measurementSecret, err := s.dataKeyGetter.GetDataKey(ctx, attestation.MeasurementSecretContext, crypto.DerivedKeyLengthDefault)
@@ -100,8 +166,14 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		return nil, status.Errorf(codes.Internal, "getting measurement secret: %s", err)
 	}
 
-	log.Info("Requesting disk encryption key")
-	stateDiskKey, err := s.dataKeyGetter.GetDataKey(ctx, req.DiskUuid, crypto.StateDiskKeyLength)
+	keyVersions, err := s.keyVersions()
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("Failed to read master secret versions")
+		return nil, status.Errorf(codes.Internal, "reading master secret versions: %s", err)
+	}
+
+	log.Info("Requesting disk encryption key", "masterSecretVersion", keyVersions.Current)
+	stateDiskKey, err := s.dataKeyGetter.GetDataKey(ctx, cluster.MasterSecretKeyID(req.DiskUuid, keyVersions.Current), crypto.StateDiskKeyLength)
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to get key for stateful disk")
 		return nil, status.Errorf(codes.Internal, "getting key for stateful disk: %s", err)
@@ -113,6 +185,8 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		log.With(slog.Any("error", err)).Error("Failed to get seed material to derive SSH CA key")
 		return nil, status.Errorf(codes.Internal, "getting emergency SSH CA seed material: %s", err)
 	}
+	steps.Done("data_keys")
+
 	ca, err := crypto.GenerateEmergencySSHCAKey(sshCAKeySeed)
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to derive ssh CA key from seed material")
@@ -134,6 +208,7 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		log.With(slog.Any("error", err)).Error("Failed to generate and sign SSH host key")
 		return nil, status.Errorf(codes.Internal, "generating and signing SSH host key: %s", err)
 	}
+	steps.Done("ssh_certificate")
 
 	log.Info("Creating Kubernetes join token")
 	kubeArgs, err := s.joinTokenGetter.GetJoinToken(constants.KubernetesJoinTokenTTL)
@@ -141,6 +216,7 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		log.With(slog.Any("error", err)).Error("Failed to generate Kubernetes join arguments")
 		return nil, status.Errorf(codes.Internal, "generating Kubernetes join arguments: %s", err)
 	}
+	steps.Done("join_token")
 
 	log.Info("Querying NodeVersion custom resource for components ConfigMap name")
 	componentsConfigMapName, err := s.getK8sComponentsConfigMapName(ctx)
@@ -155,6 +231,7 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		log.With(slog.Any("error", err)).Error("Failed getting components from ConfigMap")
 		return nil, status.Errorf(codes.Internal, "getting components: %s", err)
 	}
+	steps.Done("components")
 
 	log.Info("Creating signed kubelet certificate")
 	kubeletCert, err := s.ca.GetCertificate(req.CertificateRequest)
@@ -162,6 +239,7 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 		log.With(slog.Any("error", err)).Error("Failed generating kubelet certificate")
 		return nil, status.Errorf(codes.Internal, "Generating kubelet certificate: %s", err)
 	}
+	steps.Done("kubelet_certificate")
 
 	var controlPlaneFiles []*joinproto.ControlPlaneCertOrKey
 	if req.IsControlPlane {
@@ -178,18 +256,14 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 				Data: v,
 			})
 		}
-	}
-
-	nodeName, err := s.ca.GetNodeNameFromCSR(req.CertificateRequest)
-	if err != nil {
-		log.With(slog.Any("error", err)).Error("Failed getting node name from CSR")
-		return nil, status.Errorf(codes.Internal, "getting node name from CSR: %s", err)
+		steps.Done("control_plane_files")
 	}
 
 	if err := s.kubeClient.AddNodeToJoiningNodes(ctx, nodeName, componentsConfigMapName, req.IsControlPlane); err != nil {
 		log.With(slog.Any("error", err)).Error("Failed adding node to joining nodes")
 		return nil, status.Errorf(codes.Internal, "adding node to joining nodes: %s", err)
 	}
+	steps.Done("joining_node")
 
 	log.Info("IssueJoinTicket successful")
 	return &joinproto.IssueJoinTicketResponse{
@@ -208,9 +282,20 @@ func (s *Server) IssueJoinTicket(ctx context.Context, req *joinproto.IssueJoinTi
 }
 
 // IssueRejoinTicket issues a ticket for nodes to rejoin cluster.
-func (s *Server) IssueRejoinTicket(ctx context.Context, req *joinproto.IssueRejoinTicketRequest) (*joinproto.IssueRejoinTicketResponse, error) {
+func (s *Server) IssueRejoinTicket(ctx context.Context, req *joinproto.IssueRejoinTicketRequest) (resp *joinproto.IssueRejoinTicketResponse, retErr error) {
 	log := s.log.With(slog.String("peerAddress", grpclog.PeerAddrFromContext(ctx)))
 	log.Info("IssueRejoinTicket called")
+	defer func() { s.metrics.ObserveRequest("IssueRejoinTicket", retErr) }()
+
+	if s.nodeIdentities != nil {
+		if err := s.nodeIdentities.CheckRejoin(ctx, req.DiskUuid); errors.Is(err, identity.ErrRevoked) {
+			log.With(slog.Any("error", err)).Warn("Rejoin denied for revoked node identity")
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		} else if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to check node identity")
+			return nil, status.Errorf(codes.Internal, "checking node identity: %s", err)
+		}
+	}
 
 	log.Info("Requesting measurement secret")
 	measurementSecret, err := s.dataKeyGetter.GetDataKey(ctx, attestation.MeasurementSecretContext, crypto.DerivedKeyLengthDefault)
@@ -219,20 +304,50 @@ func (s *Server) IssueRejoinTicket(ctx context.Context, req *joinproto.IssueRejo
 		return nil, status.Errorf(codes.Internal, "unable to get measurement secret: %s", err)
 	}
 
-	log.Info("Requesting disk encryption key")
-	stateDiskKey, err := s.dataKeyGetter.GetDataKey(ctx, req.DiskUuid, crypto.StateDiskKeyLength)
+	keyVersions, err := s.keyVersions()
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("Unable to read master secret versions")
+		return nil, status.Errorf(codes.Internal, "unable to read master secret versions: %s", err)
+	}
+
+	log.Info("Requesting disk encryption key", "masterSecretVersion", keyVersions.Current)
+	stateDiskKey, err := s.dataKeyGetter.GetDataKey(ctx, cluster.MasterSecretKeyID(req.DiskUuid, keyVersions.Current), crypto.StateDiskKeyLength)
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Unable to get key for stateful disk")
 		return nil, status.Errorf(codes.Internal, "unable to get key for stateful disk: %s", err)
 	}
 
+	// The node may not have re-keyed its state disk since the master secret was rotated.
+	var previousStateDiskKeys [][]byte
+	for _, version := range keyVersions.Previous {
+		log.Info("Requesting previous disk encryption key", "masterSecretVersion", version)
+		previousKey, err := s.dataKeyGetter.GetDataKey(ctx, cluster.MasterSecretKeyID(req.DiskUuid, version), crypto.StateDiskKeyLength)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Unable to get previous key for stateful disk")
+			return nil, status.Errorf(codes.Internal, "unable to get previous key for stateful disk: %s", err)
+		}
+		previousStateDiskKeys = append(previousStateDiskKeys, previousKey)
+	}
+
 	log.Info("IssueRejoinTicket successful")
 	return &joinproto.IssueRejoinTicketResponse{
-		StateDiskKey:      stateDiskKey,
-		MeasurementSecret: measurementSecret,
+		StateDiskKey:          stateDiskKey,
+		MeasurementSecret:     measurementSecret,
+		PreviousStateDiskKeys: previousStateDiskKeys,
 	}, nil
 }
 
+// keyVersions reads the versions of the master secret used for state disk keys from a VolumeMount that is backed by the join-config ConfigMap.
+// If the master secret was never rotated, the file doesn't exist and all keys are derived from the initial master secret.
+func (s *Server) keyVersions() (cluster.KeyVersions, error) {
+	var keyVersions cluster.KeyVersions
+	err := s.fileHandler.ReadJSON(filepath.Join(constants.ServiceBasePath, constants.MasterSecretVersionsFilename), &keyVersions)
+	if err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return cluster.KeyVersions{}, err
+	}
+	return keyVersions, nil
+}
+
 // getK8sComponentsConfigMapName reads the k8s components config map name from a VolumeMount that is backed by the k8s-version ConfigMap.
 func (s *Server) getK8sComponentsConfigMapName(ctx context.Context) (string, error) {
 	k8sComponentsRef, err := s.kubeClient.GetK8sComponentsRefFromNodeVersionCRD(ctx, constants.NodeVersionResourceName)
@@ -255,6 +370,22 @@ type dataKeyGetter interface {
 	GetDataKey(ctx context.Context, uuid string, length int) ([]byte, error)
 }
 
+// joinPolicy decides whether a node may join the cluster.
+type joinPolicy interface {
+	// Evaluate checks whether the node may join the cluster.
+	// If it may, done must be called once the join ticket was issued or issuing it failed.
+	Evaluate(ctx context.Context, req policy.Request) (done func(ctx context.Context, issued bool), err error)
+}
+
+// nodeIdentities records which nodes joined the cluster.
+type nodeIdentities interface {
+	// Claim records the join of the node that sent the request in ctx.
+	// If the node may join, release must be called once the join ticket was issued or issuing it failed.
+	Claim(ctx context.Context, diskUUID, nodeName string, isControlPlane bool, csr []byte) (release func(ctx context.Context, issued bool), err error)
+	// CheckRejoin checks whether the identity of the node that sent the request in ctx, or of the disk with diskUUID, was revoked.
+	CheckRejoin(ctx context.Context, diskUUID string) error
+}
+
 type certificateAuthority interface {
 	// GetCertificate returns a certificate and private key, signed by the issuer.
 	GetCertificate(certificateRequest []byte) (kubeletCert []byte, err error)
@@ -10,20 +10,28 @@ import (
 	"context"
 	"crypto/ed25519"
 	"errors"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/edgelesssys/constellation/v2/internal/attestation"
 	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/internal/versions/components"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/identity"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/metrics"
+	"github.com/edgelesssys/constellation/v2/joinservice/internal/policy"
 	"github.com/edgelesssys/constellation/v2/joinservice/joinproto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	kubeadmv1 "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1beta3"
 )
 
@@ -65,10 +73,13 @@ func TestIssueJoinTicket(t *testing.T) {
 		kms                             stubKeyGetter
 		ca                              stubCA
 		kubeClient                      stubKubeClient
+		joinPolicy                      *stubJoinPolicy
+		nodeIdentities                  *stubNodeIdentities
 		missingComponentsReferenceFile  bool
 		missingAdditionalPrincipalsFile bool
 		missingSSHHostKey               bool
 		wantErr                         bool
+		wantCode                        codes.Code
 	}{
 		"worker node": {
 			kubeadm: stubTokenGetter{token: testJoinToken},
@@ -80,6 +91,106 @@ func TestIssueJoinTicket(t *testing.T) {
 			ca:         stubCA{cert: testCert, nodeName: "node"},
 			kubeClient: stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
 		},
+		"join policy allows node": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:         stubCA{cert: testCert, nodeName: "node"},
+			kubeClient: stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			joinPolicy: &stubJoinPolicy{},
+		},
+		"join policy denies node": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:         stubCA{cert: testCert, nodeName: "node"},
+			kubeClient: stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			joinPolicy: &stubJoinPolicy{evaluateErr: policy.ErrDenied},
+			wantErr:    true,
+			wantCode:   codes.PermissionDenied,
+		},
+		"join pending approval": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:         stubCA{cert: testCert, nodeName: "node"},
+			kubeClient: stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			joinPolicy: &stubJoinPolicy{evaluateErr: policy.ErrPendingApproval},
+			wantErr:    true,
+			wantCode:   codes.FailedPrecondition,
+		},
+		"join fails after policy allowed node": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:         stubCA{cert: testCert, nodeName: "node"},
+			kubeClient: stubKubeClient{getComponentsErr: someErr},
+			joinPolicy: &stubJoinPolicy{},
+			wantErr:    true,
+			wantCode:   codes.Internal,
+		},
+		"first join of node identity": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:             stubCA{cert: testCert, nodeName: "node"},
+			kubeClient:     stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			nodeIdentities: &stubNodeIdentities{},
+		},
+		"node identity already joined": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:             stubCA{cert: testCert, nodeName: "node"},
+			kubeClient:     stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			nodeIdentities: &stubNodeIdentities{claimErr: identity.ErrAlreadyJoined},
+			wantErr:        true,
+			wantCode:       codes.PermissionDenied,
+		},
+		"node identity revoked": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:             stubCA{cert: testCert, nodeName: "node"},
+			kubeClient:     stubKubeClient{getComponentsVal: clusterComponents, getK8sComponentsRefFromNodeVersionCRDVal: "k8s-components-ref"},
+			nodeIdentities: &stubNodeIdentities{claimErr: identity.ErrRevoked},
+			wantErr:        true,
+			wantCode:       codes.PermissionDenied,
+		},
+		"join fails after node identity was claimed": {
+			kubeadm: stubTokenGetter{token: testJoinToken},
+			kms: stubKeyGetter{dataKeys: map[string][]byte{
+				uuid:                                 testKey,
+				attestation.MeasurementSecretContext: measurementSecret,
+				constants.SSHCAKeySuffix:             testCaKey,
+			}},
+			ca:             stubCA{cert: testCert, nodeName: "node"},
+			kubeClient:     stubKubeClient{getComponentsErr: someErr},
+			nodeIdentities: &stubNodeIdentities{},
+			wantErr:        true,
+			wantCode:       codes.Internal,
+		},
 		"kubeclient fails": {
 			kubeadm: stubTokenGetter{token: testJoinToken},
 			kms: stubKeyGetter{dataKeys: map[string][]byte{
@@ -232,9 +343,16 @@ func TestIssueJoinTicket(t *testing.T) {
 				joinTokenGetter: tc.kubeadm,
 				dataKeyGetter:   tc.kms,
 				kubeClient:      &tc.kubeClient,
+				metrics:         metrics.New(prometheus.NewRegistry()),
 				log:             logger.NewTest(t),
 				fileHandler:     fh,
 			}
+			if tc.joinPolicy != nil {
+				api.joinPolicy = tc.joinPolicy
+			}
+			if tc.nodeIdentities != nil {
+				api.nodeIdentities = tc.nodeIdentities
+			}
 
 			var keyToSend []byte
 			if tc.missingSSHHostKey {
@@ -249,8 +367,19 @@ func TestIssueJoinTicket(t *testing.T) {
 				HostPublicKey:  keyToSend,
 			}
 			resp, err := api.IssueJoinTicket(t.Context(), req)
+			if tc.joinPolicy != nil && tc.joinPolicy.evaluateErr == nil {
+				assert.True(tc.joinPolicy.done)
+				assert.Equal(!tc.wantErr, tc.joinPolicy.issued)
+			}
+			if tc.nodeIdentities != nil && tc.nodeIdentities.claimErr == nil {
+				assert.True(tc.nodeIdentities.released)
+				assert.Equal(!tc.wantErr, tc.nodeIdentities.issued)
+			}
 			if tc.wantErr {
 				assert.Error(err)
+				if tc.wantCode != codes.OK {
+					assert.Equal(tc.wantCode, status.Code(err))
+				}
 				return
 			}
 
@@ -277,8 +406,13 @@ func TestIssueRejoinTicker(t *testing.T) {
 	uuid := "uuid"
 
 	testCases := map[string]struct {
-		keyGetter stubKeyGetter
-		wantErr   bool
+		keyGetter        stubKeyGetter
+		keyVersions      string
+		nodeIdentities   *stubNodeIdentities
+		wantStateDiskKey []byte
+		wantPreviousKeys [][]byte
+		wantErr          bool
+		wantCode         codes.Code
 	}{
 		"success": {
 			keyGetter: stubKeyGetter{
@@ -287,6 +421,62 @@ func TestIssueRejoinTicker(t *testing.T) {
 					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
 				},
 			},
+			wantStateDiskKey: []byte{0x1, 0x2, 0x3},
+		},
+		"rotated master secret": {
+			keyGetter: stubKeyGetter{
+				dataKeys: map[string][]byte{
+					uuid:                                 {0x1, 0x2, 0x3},
+					cluster.MasterSecretKeyID(uuid, 1):   {0x7, 0x8, 0x9},
+					cluster.MasterSecretKeyID(uuid, 2):   {0xA, 0xB, 0xC},
+					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
+				},
+			},
+			keyVersions:      `{"current":2,"previous":[0,1]}`,
+			wantStateDiskKey: []byte{0xA, 0xB, 0xC},
+			wantPreviousKeys: [][]byte{{0x1, 0x2, 0x3}, {0x7, 0x8, 0x9}},
+		},
+		"node identity not revoked": {
+			keyGetter: stubKeyGetter{
+				dataKeys: map[string][]byte{
+					uuid:                                 {0x1, 0x2, 0x3},
+					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
+				},
+			},
+			nodeIdentities:   &stubNodeIdentities{},
+			wantStateDiskKey: []byte{0x1, 0x2, 0x3},
+		},
+		"node identity revoked": {
+			keyGetter: stubKeyGetter{
+				dataKeys: map[string][]byte{
+					uuid:                                 {0x1, 0x2, 0x3},
+					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
+				},
+			},
+			nodeIdentities: &stubNodeIdentities{checkRejoinErr: identity.ErrRevoked},
+			wantErr:        true,
+			wantCode:       codes.PermissionDenied,
+		},
+		"checking node identity fails": {
+			keyGetter: stubKeyGetter{
+				dataKeys: map[string][]byte{
+					uuid:                                 {0x1, 0x2, 0x3},
+					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
+				},
+			},
+			nodeIdentities: &stubNodeIdentities{checkRejoinErr: errors.New("error")},
+			wantErr:        true,
+			wantCode:       codes.Internal,
+		},
+		"invalid master secret versions": {
+			keyGetter: stubKeyGetter{
+				dataKeys: map[string][]byte{
+					uuid:                                 {0x1, 0x2, 0x3},
+					attestation.MeasurementSecretContext: {0x4, 0x5, 0x6},
+				},
+			},
+			keyVersions: "invalid",
+			wantErr:     true,
 		},
 		"failure": {
 			keyGetter: stubKeyGetter{
@@ -302,12 +492,20 @@ func TestIssueRejoinTicker(t *testing.T) {
 			assert := assert.New(t)
 			require := require.New(t)
 
+			fh := file.NewHandler(afero.NewMemMapFs())
+			if tc.keyVersions != "" {
+				require.NoError(fh.Write(filepath.Join(constants.ServiceBasePath, constants.MasterSecretVersionsFilename), []byte(tc.keyVersions), file.OptMkdirAll))
+			}
+
 			api := Server{
 				ca:              stubCA{},
 				joinTokenGetter: stubTokenGetter{},
 				dataKeyGetter:   tc.keyGetter,
 				log:             logger.NewTest(t),
-				fileHandler:     file.NewHandler(afero.NewMemMapFs()),
+				fileHandler:     fh,
+			}
+			if tc.nodeIdentities != nil {
+				api.nodeIdentities = tc.nodeIdentities
 			}
 
 			req := &joinproto.IssueRejoinTicketRequest{
@@ -316,12 +514,16 @@ func TestIssueRejoinTicker(t *testing.T) {
 			resp, err := api.IssueRejoinTicket(t.Context(), req)
 			if tc.wantErr {
 				assert.Error(err)
+				if tc.wantCode != codes.OK {
+					assert.Equal(tc.wantCode, status.Code(err))
+				}
 				return
 			}
 
 			require.NoError(err)
 			assert.Equal(tc.keyGetter.dataKeys[attestation.MeasurementSecretContext], resp.MeasurementSecret)
-			assert.Equal(tc.keyGetter.dataKeys[uuid], resp.StateDiskKey)
+			assert.Equal(tc.wantStateDiskKey, resp.StateDiskKey)
+			assert.Equal(tc.wantPreviousKeys, resp.PreviousStateDiskKeys)
 		})
 	}
 }
@@ -350,6 +552,43 @@ func (f stubKeyGetter) GetDataKey(_ context.Context, name string, _ int) ([]byte
 	return f.dataKeys[name], f.getDataKeyErr
 }
 
+type stubJoinPolicy struct {
+	evaluateErr error
+	done        bool
+	issued      bool
+}
+
+func (s *stubJoinPolicy) Evaluate(_ context.Context, _ policy.Request) (func(context.Context, bool), error) {
+	if s.evaluateErr != nil {
+		return nil, s.evaluateErr
+	}
+	return func(_ context.Context, issued bool) {
+		s.done = true
+		s.issued = issued
+	}, nil
+}
+
+type stubNodeIdentities struct {
+	claimErr       error
+	checkRejoinErr error
+	released       bool
+	issued         bool
+}
+
+func (s *stubNodeIdentities) Claim(_ context.Context, _, _ string, _ bool, _ []byte) (func(context.Context, bool), error) {
+	if s.claimErr != nil {
+		return nil, s.claimErr
+	}
+	return func(_ context.Context, issued bool) {
+		s.released = true
+		s.issued = issued
+	}, nil
+}
+
+func (s *stubNodeIdentities) CheckRejoin(_ context.Context, _ string) error {
+	return s.checkRejoinErr
+}
+
 type stubCA struct {
 	cert       []byte
 	getCertErr error
@@ -331,11 +331,12 @@ func (x *IssueRejoinTicketRequest) GetDiskUuid() string {
 }
 
 type IssueRejoinTicketResponse struct {
-	state             protoimpl.MessageState `protogen:"open.v1"`
-	StateDiskKey      []byte                 `protobuf:"bytes,1,opt,name=state_disk_key,json=stateDiskKey,proto3" json:"state_disk_key,omitempty"`
-	MeasurementSecret []byte                 `protobuf:"bytes,2,opt,name=measurement_secret,json=measurementSecret,proto3" json:"measurement_secret,omitempty"`
-	unknownFields     protoimpl.UnknownFields
-	sizeCache         protoimpl.SizeCache
+	state                 protoimpl.MessageState `protogen:"open.v1"`
+	StateDiskKey          []byte                 `protobuf:"bytes,1,opt,name=state_disk_key,json=stateDiskKey,proto3" json:"state_disk_key,omitempty"`
+	MeasurementSecret     []byte                 `protobuf:"bytes,2,opt,name=measurement_secret,json=measurementSecret,proto3" json:"measurement_secret,omitempty"`
+	PreviousStateDiskKeys [][]byte               `protobuf:"bytes,3,rep,name=previous_state_disk_keys,json=previousStateDiskKeys,proto3" json:"previous_state_disk_keys,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
 }
 
 func (x *IssueRejoinTicketResponse) Reset() {
@@ -382,6 +383,13 @@ func (x *IssueRejoinTicketResponse) GetMeasurementSecret() []byte {
 	return nil
 }
 
+func (x *IssueRejoinTicketResponse) GetPreviousStateDiskKeys() [][]byte {
+	if x != nil {
+		return x.PreviousStateDiskKeys
+	}
+	return nil
+}
+
 var File_joinservice_joinproto_join_proto protoreflect.FileDescriptor
 
 const file_joinservice_joinproto_join_proto_rawDesc = "" +
@@ -411,10 +419,11 @@ const file_joinservice_joinproto_join_proto_rawDesc = "" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
 	"\x04data\x18\x02 \x01(\fR\x04data\"7\n" +
 	"\x18IssueRejoinTicketRequest\x12\x1b\n" +
-	"\tdisk_uuid\x18\x01 \x01(\tR\bdiskUuid\"p\n" +
+	"\tdisk_uuid\x18\x01 \x01(\tR\bdiskUuid\"\xa9\x01\n" +
 	"\x19IssueRejoinTicketResponse\x12$\n" +
 	"\x0estate_disk_key\x18\x01 \x01(\fR\fstateDiskKey\x12-\n" +
-	"\x12measurement_secret\x18\x02 \x01(\fR\x11measurementSecret2\xab\x01\n" +
+	"\x12measurement_secret\x18\x02 \x01(\fR\x11measurementSecret\x127\n" +
+	"\x18previous_state_disk_keys\x18\x03 \x03(\fR\x15previousStateDiskKeys2\xab\x01\n" +
 	"\x03API\x12N\n" +
 	"\x0fIssueJoinTicket\x12\x1c.join.IssueJoinTicketRequest\x1a\x1d.join.IssueJoinTicketResponse\x12T\n" +
 	"\x11IssueRejoinTicket\x12\x1e.join.IssueRejoinTicketRequest\x1a\x1f.join.IssueRejoinTicketResponseB?Z=github.com/edgelesssys/constellation/v2/joinservice/joinprotob\x06proto3"
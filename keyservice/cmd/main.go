@@ -15,22 +15,37 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/atls"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/choose"
+	"github.com/edgelesssys/constellation/v2/internal/attestation/variant"
 	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/grpc/serviceaccount"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/denylist"
 	"github.com/edgelesssys/constellation/v2/internal/kms/setup"
 	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/audit"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/authz"
 	"github.com/edgelesssys/constellation/v2/keyservice/internal/server"
 	"github.com/spf13/afero"
 )
 
 func main() {
 	port := flag.String("port", strconv.Itoa(constants.KeyServicePort), "Port gRPC server listens on")
+	atlsPort := flag.String("atls-port", strconv.Itoa(constants.KeyServiceATLSPort), "Port gRPC server serves aTLS on, requires --attestation-variant")
+	attestationVariant := flag.String("attestation-variant", "", "Attestation variant to use for aTLS connections, aTLS is disabled if empty")
 	masterSecretPath := flag.String("master-secret", filepath.Join(constants.ServiceBasePath, constants.ConstellationMasterSecretKey), "Path to the Constellation master secret")
 	saltPath := flag.String("salt", filepath.Join(constants.ServiceBasePath, constants.ConstellationSaltKey), "Path to the Constellation salt")
+	rotationsPath := flag.String("master-secret-rotations", filepath.Join(constants.ServiceBasePath, constants.ConstellationMasterSecretRotationsKey), "Path to the rotated versions of the Constellation master secret, ignored if the file doesn't exist")
+	authzPolicyPath := flag.String("authorization-policy", "", "Path to a policy mapping caller service accounts to the key IDs they may access, all callers may access all keys if empty")
+	denyListStoragePath := flag.String("deny-list-storage", "", "Path to a file containing the URI of the storage to persist the deny-list of destroyed data keys in, requires --authorization-policy, data keys can't be destroyed if empty")
+	auditLogPath := flag.String("audit-log", "", "Path to append audit records of data key requests to as JSON lines, \"-\" for stdout, disabled if empty")
+	auditEvents := flag.Bool("audit-events", false, "Record data key requests as Kubernetes Events of the keyservice pod, requires the POD_NAMESPACE and POD_NAME environment variables")
 	verbosity := flag.Int("v", 0, logger.CmdLineVerbosityDescription)
 
 	flag.Parse()
@@ -60,6 +75,13 @@ func main() {
 		os.Exit(1)
 	}
 	masterSecret := uri.MasterSecret{Key: masterKey, Salt: salt}
+	if err := file.ReadJSON(*rotationsPath, &masterSecret.Rotations); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		log.With(slog.Any("error", err)).Error("Failed to read master secret rotations")
+		os.Exit(1)
+	}
+	if len(masterSecret.Rotations) > 0 {
+		log.With(slog.Int("rotations", len(masterSecret.Rotations))).Info("Using rotated master secret versions")
+	}
 
 	// set up Key Management Service
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
@@ -69,9 +91,95 @@ func main() {
 		log.With(slog.Any("error", err)).Error("Failed to setup KMS")
 		os.Exit(1)
 	}
+	var destroyer server.KeyDestroyer
+	if *denyListStoragePath != "" {
+		if *authzPolicyPath == "" {
+			// without a policy, every caller could destroy any key
+			log.Error("Deny-list requires an authorization policy")
+			os.Exit(1)
+		}
+		storageURI, err := file.Read(*denyListStoragePath)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to read deny-list storage URI")
+			os.Exit(1)
+		}
+		store, err := setup.Storage(ctx, strings.TrimSpace(string(storageURI)))
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to set up deny-list storage")
+			os.Exit(1)
+		}
+		if store == nil {
+			log.Error("Deny-list requires a storage, but no storage was configured")
+			os.Exit(1)
+		}
+		denyList := denylist.New(conKMS, store)
+		conKMS, destroyer = denyList, denyList
+	}
 	defer conKMS.Close()
 
-	if err := server.New(log.WithGroup("keyService"), conKMS).Run(*port); err != nil {
+	var authorizer server.Authorizer
+	if *authzPolicyPath != "" {
+		var policy authz.Policy
+		if err := file.ReadYAMLStrict(*authzPolicyPath, &policy); err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to read authorization policy")
+			os.Exit(1)
+		}
+		tokenReviewer, err := authz.NewTokenReviewer([]string{serviceaccount.KeyServiceAudience})
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to set up service account authentication")
+			os.Exit(1)
+		}
+		authorizer, err = authz.New(tokenReviewer, policy)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to set up authorization")
+			os.Exit(1)
+		}
+	} else {
+		log.Warn("No authorization policy configured, all callers may access all keys")
+	}
+
+	var sinks []audit.Sink
+	switch *auditLogPath {
+	case "":
+	case "-":
+		sinks = append(sinks, audit.NewJSONLines(os.Stdout))
+	default:
+		auditLog, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to open audit log")
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+		sinks = append(sinks, audit.NewJSONLines(auditLog))
+	}
+	if *auditEvents {
+		events, err := audit.NewEvents(os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME"), log.WithGroup("audit"))
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to set up audit events")
+			os.Exit(1)
+		}
+		sinks = append(sinks, events)
+	}
+	var auditor server.Auditor
+	if len(sinks) > 0 {
+		auditor = audit.Multi(sinks...)
+	}
+
+	var issuer atls.Issuer
+	if *attestationVariant != "" {
+		attVariant, err := variant.FromString(*attestationVariant)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to parse attestation variant")
+			os.Exit(1)
+		}
+		issuer, err = choose.Issuer(attVariant, log.WithGroup("issuer"))
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("Failed to create issuer")
+			os.Exit(1)
+		}
+	}
+
+	if err := server.New(log.WithGroup("keyService"), conKMS, authorizer, auditor, destroyer).Run(*port, *atlsPort, issuer); err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to run key-service server")
 		os.Exit(1)
 	}
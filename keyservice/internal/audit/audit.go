@@ -0,0 +1,89 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package audit records which callers requested or destroyed which data keys of the keyservice.
+
+Records are written to one or more sinks: an append-only stream of JSON lines, e.g., a file or stdout,
+and Kubernetes Events.
+*/
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record describes a single request for, or to destroy, a data key.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Caller is the authenticated identity of the caller. It is empty if callers aren't authenticated.
+	Caller      string `json:"caller,omitempty"`
+	PeerAddress string `json:"peerAddress"`
+	KeyID       string `json:"keyID"`
+	Length      uint32 `json:"length"`
+	// Version is the requested version of the master secret, if it isn't the initial one.
+	Version uint32 `json:"version,omitempty"`
+	// Destroy is set for requests to destroy the data key.
+	Destroy bool `json:"destroy,omitempty"`
+	// Result is the gRPC status code of the response, e.g., "OK" or "PermissionDenied".
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Sink stores audit records.
+type Sink interface {
+	Record(ctx context.Context, record Record) error
+}
+
+// Multi returns a Sink that writes records to all given sinks.
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+// Record writes the record to all sinks, even if some of them fail.
+func (m multiSink) Record(ctx context.Context, record Record) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Record(ctx, record))
+	}
+	return errors.Join(errs...)
+}
+
+// JSONLines writes each record as a line of JSON.
+type JSONLines struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// NewJSONLines creates a JSONLines sink writing to w.
+// w should be opened in append mode, so existing records are never overwritten.
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{w: w}
+}
+
+// Record writes the record as a single line.
+func (j *JSONLines) Record(_ context.Context, record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshaling audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	if _, err := j.w.Write(line); err != nil {
+		return fmt.Errorf("writing audit record: %w", err)
+	}
+	return nil
+}
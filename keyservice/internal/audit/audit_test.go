@@ -0,0 +1,187 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestJSONLines(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	records := []Record{
+		{
+			Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Caller: "system:serviceaccount:kube-system:join-service",
+			PeerAddress: "10.0.0.1:4242", KeyID: "disk-uuid", Length: 32, Result: "OK",
+		},
+		{
+			Time: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC), PeerAddress: "10.0.0.2:4242",
+			KeyID: "disk-uuid", Length: 32, Result: "Unauthenticated", Error: "caller is not authenticated",
+		},
+		{
+			Time: time.Date(2024, 1, 2, 3, 4, 7, 0, time.UTC), Caller: "system:serviceaccount:kube-system:csi-driver",
+			PeerAddress: "10.0.0.3:4242", KeyID: "namespace/team-a/volume-uuid", Destroy: true, Result: "OK",
+		},
+	}
+
+	var out bytes.Buffer
+	sink := NewJSONLines(&out)
+	for _, record := range records {
+		require.NoError(sink.Record(t.Context(), record))
+	}
+
+	scanner := bufio.NewScanner(&out)
+	var got []Record
+	for scanner.Scan() {
+		var record Record
+		require.NoError(json.Unmarshal(scanner.Bytes(), &record))
+		got = append(got, record)
+	}
+	assert.Equal(records, got)
+}
+
+func TestJSONLinesWriteError(t *testing.T) {
+	sink := NewJSONLines(failingWriter{})
+	assert.Error(t, sink.Record(t.Context(), Record{KeyID: "disk-uuid"}))
+}
+
+func TestMulti(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	sink := Multi(NewJSONLines(failingWriter{}), NewJSONLines(&out))
+
+	// Records reach all sinks, even if one fails.
+	assert.Error(sink.Record(t.Context(), Record{KeyID: "disk-uuid"}))
+	assert.Contains(out.String(), `"keyID":"disk-uuid"`)
+}
+
+func TestEvents(t *testing.T) {
+	testCases := map[string]struct {
+		record      Record
+		createErr   error
+		wantReason  string
+		wantType    string
+		wantMessage string
+		wantAction  string
+	}{
+		"granted": {
+			record:      Record{Caller: "system:serviceaccount:kube-system:join-service", PeerAddress: "10.0.0.1:4242", KeyID: "disk-uuid", Length: 32, Result: "OK"},
+			wantReason:  "DataKeyGranted",
+			wantType:    corev1.EventTypeNormal,
+			wantMessage: `system:serviceaccount:kube-system:join-service at 10.0.0.1:4242 requested data key "disk-uuid" with length 32: OK`,
+			wantAction:  "GetDataKey",
+		},
+		"destroyed": {
+			record:      Record{Caller: "system:serviceaccount:kube-system:csi-driver", PeerAddress: "10.0.0.3:4242", KeyID: "volume-uuid", Destroy: true, Result: "OK"},
+			wantReason:  "DataKeyDestroyed",
+			wantType:    corev1.EventTypeNormal,
+			wantMessage: `system:serviceaccount:kube-system:csi-driver at 10.0.0.3:4242 destroyed data key "volume-uuid": OK`,
+			wantAction:  "DestroyDataKey",
+		},
+		"destroying denied": {
+			record: Record{
+				Caller: "system:serviceaccount:default:app", PeerAddress: "10.0.0.2:4242", KeyID: "volume-uuid", Destroy: true,
+				Result: "PermissionDenied", Error: `caller may not access data key "volume-uuid"`,
+			},
+			wantReason:  "DataKeyDenied",
+			wantType:    corev1.EventTypeWarning,
+			wantMessage: `system:serviceaccount:default:app at 10.0.0.2:4242 destroyed data key "volume-uuid": PermissionDenied: caller may not access data key "volume-uuid"`,
+			wantAction:  "DestroyDataKey",
+		},
+		"denied": {
+			record: Record{
+				Caller: "system:serviceaccount:default:app", PeerAddress: "10.0.0.2:4242", KeyID: "disk-uuid", Length: 32,
+				Result: "PermissionDenied", Error: `caller may not access data key "disk-uuid"`,
+			},
+			wantReason:  "DataKeyDenied",
+			wantType:    corev1.EventTypeWarning,
+			wantMessage: `system:serviceaccount:default:app at 10.0.0.2:4242 requested data key "disk-uuid" with length 32: PermissionDenied: caller may not access data key "disk-uuid"`,
+			wantAction:  "GetDataKey",
+		},
+		"unauthenticated": {
+			record:      Record{PeerAddress: "10.0.0.2:4242", KeyID: "disk-uuid", Length: 32, Result: "Unauthenticated"},
+			wantReason:  "DataKeyDenied",
+			wantType:    corev1.EventTypeWarning,
+			wantMessage: `unauthenticated caller at 10.0.0.2:4242 requested data key "disk-uuid" with length 32: Unauthenticated`,
+			wantAction:  "GetDataKey",
+		},
+		"failed": {
+			record:      Record{PeerAddress: "10.0.0.1:4242", KeyID: "disk-uuid", Length: 32, Result: "Internal", Error: "kms unavailable"},
+			wantReason:  "DataKeyRequestFailed",
+			wantType:    corev1.EventTypeWarning,
+			wantMessage: `unauthenticated caller at 10.0.0.1:4242 requested data key "disk-uuid" with length 32: Internal: kms unavailable`,
+			wantAction:  "GetDataKey",
+		},
+		"creating event fails": {
+			record:      Record{KeyID: "disk-uuid", Length: 32, Result: "OK"},
+			createErr:   errors.New("api unavailable"),
+			wantReason:  "DataKeyGranted",
+			wantType:    corev1.EventTypeNormal,
+			wantMessage: `unauthenticated caller at  requested data key "disk-uuid" with length 32: OK`,
+			wantAction:  "GetDataKey",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := &stubEventClient{err: tc.createErr}
+			events := &Events{client: client, namespace: "kube-system", pod: "key-service-abcde", log: logger.NewTest(t)}
+			tc.record.Time = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			// Failing to create events doesn't fail the request.
+			require.NoError(events.Record(t.Context(), tc.record))
+
+			require.Len(client.events, 1)
+			event := client.events[0]
+			assert.Equal(tc.wantReason, event.Reason)
+			assert.Equal(tc.wantType, event.Type)
+			assert.Equal(tc.wantMessage, event.Message)
+			assert.Equal(tc.wantAction, event.Action)
+			assert.Equal("kube-system", event.Namespace)
+			assert.Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "kube-system", Name: "key-service-abcde"}, event.InvolvedObject)
+			assert.Equal(metav1.NewTime(tc.record.Time), event.FirstTimestamp)
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+type stubEventClient struct {
+	events []*corev1.Event
+	err    error
+}
+
+func (c *stubEventClient) Create(_ context.Context, event *corev1.Event, _ metav1.CreateOptions) (*corev1.Event, error) {
+	c.events = append(c.events, event)
+	return event, c.err
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// eventTimeout bounds how long recording an event may delay a data key request.
+	eventTimeout = 5 * time.Second
+	component    = "keyservice"
+)
+
+// Events records data key requests as Kubernetes Events of the keyservice pod.
+//
+// Events are recorded on a best-effort basis: failures are logged, but don't fail the request,
+// so the keyservice keeps working while the Kubernetes API is unavailable.
+// Kubernetes deletes Events after a while, so Events should be exported if they must be kept.
+type Events struct {
+	client    eventClient
+	namespace string
+	pod       string
+	log       *slog.Logger
+}
+
+// NewEvents creates an Events sink using the in-cluster Kubernetes configuration.
+// The events are attached to the pod with the given namespace and name.
+func NewEvents(namespace, pod string, log *slog.Logger) (*Events, error) {
+	if namespace == "" || pod == "" {
+		return nil, fmt.Errorf("pod namespace and name are required, got %q and %q", namespace, pod)
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("creating in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating clientset: %w", err)
+	}
+	return &Events{client: clientset.CoreV1().Events(namespace), namespace: namespace, pod: pod, log: log}, nil
+}
+
+// Record creates an Event for the record.
+func (e *Events) Record(ctx context.Context, record Record) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventTimeout)
+	defer cancel()
+
+	if _, err := e.client.Create(ctx, e.event(record), metav1.CreateOptions{}); err != nil {
+		e.log.With(slog.Any("error", err), slog.String("dataKeyID", record.KeyID)).Error("Failed to record data key request as event")
+	}
+	return nil
+}
+
+// event converts a record to an Event.
+func (e *Events) event(record Record) *corev1.Event {
+	reason, eventType := "DataKeyGranted", corev1.EventTypeNormal
+	action := "GetDataKey"
+	if record.Destroy {
+		reason, action = "DataKeyDestroyed", "DestroyDataKey"
+	}
+	switch record.Result {
+	case "OK":
+	case "PermissionDenied", "Unauthenticated":
+		reason, eventType = "DataKeyDenied", corev1.EventTypeWarning
+	default:
+		reason, eventType = "DataKeyRequestFailed", corev1.EventTypeWarning
+	}
+
+	caller := record.Caller
+	if caller == "" {
+		caller = "unauthenticated caller"
+	}
+	message := fmt.Sprintf("%s at %s requested data key %q with length %d: %s", caller, record.PeerAddress, record.KeyID, record.Length, record.Result)
+	if record.Destroy {
+		message = fmt.Sprintf("%s at %s destroyed data key %q: %s", caller, record.PeerAddress, record.KeyID, record.Result)
+	}
+	if record.Error != "" {
+		message += ": " + record.Error
+	}
+
+	timestamp := metav1.NewTime(record.Time)
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: e.pod + ".",
+			Namespace:    e.namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  e.namespace,
+			Name:       e.pod,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: component},
+		FirstTimestamp:      timestamp,
+		LastTimestamp:       timestamp,
+		Count:               1,
+		Action:              action,
+		ReportingController: component,
+		ReportingInstance:   e.pod,
+	}
+}
+
+type eventClient interface {
+	Create(ctx context.Context, event *corev1.Event, opts metav1.CreateOptions) (*corev1.Event, error)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+/*
+Package authz authorizes callers of the keyservice.
+
+Callers authenticate with the token of their Kubernetes service account, which is verified with a TokenReview.
+A policy maps the resulting identities to the key ID prefixes they may derive keys for,
+so that, e.g., a compromised pod can't request the disk keys of the joinservice.
+Destroying keys requires a separate permission, since it can't be undone.
+*/
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrUnauthenticated is returned if the caller couldn't be authenticated.
+	ErrUnauthenticated = errors.New("caller is not authenticated")
+	// ErrPermissionDenied is returned if the policy doesn't allow the caller to access a key.
+	ErrPermissionDenied = errors.New("caller is not allowed to access key")
+)
+
+// Policy maps caller identities to the key IDs they may access.
+// Callers that match no rule are denied.
+type Policy struct {
+	Callers []Caller `yaml:"callers"`
+}
+
+// Caller grants an identity access to keys.
+type Caller struct {
+	// Identity is a pattern for caller identities, using the syntax of path.Match.
+	// Identities of service accounts have the form "system:serviceaccount:<namespace>:<name>".
+	Identity string `yaml:"identity"`
+	// KeyIDPrefixes are the prefixes of the key IDs the caller may access.
+	// The empty prefix allows access to all keys.
+	KeyIDPrefixes []string `yaml:"keyIDPrefixes"`
+	// DestroyKeyIDPrefixes are the prefixes of the key IDs the caller may destroy.
+	// If empty, the caller may not destroy any keys.
+	DestroyKeyIDPrefixes []string `yaml:"destroyKeyIDPrefixes"`
+}
+
+// Validate checks the policy for errors.
+func (p Policy) Validate() error {
+	var errs []error
+	for i, caller := range p.Callers {
+		if caller.Identity == "" {
+			errs = append(errs, fmt.Errorf("caller %d: identity is required", i))
+		} else if _, err := path.Match(caller.Identity, ""); err != nil {
+			errs = append(errs, fmt.Errorf("caller %d: invalid identity pattern %q: %w", i, caller.Identity, err))
+		}
+		if len(caller.KeyIDPrefixes) == 0 {
+			errs = append(errs, fmt.Errorf("caller %d: keyIDPrefixes is required", i))
+		}
+		if slices.Contains(caller.DestroyKeyIDPrefixes, "") {
+			errs = append(errs, fmt.Errorf("caller %d: destroyKeyIDPrefixes must not contain the empty prefix", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// allows returns true if any rule grants the identity access to the key.
+func (p Policy) allows(identity, keyID string) bool {
+	return p.matches(identity, keyID, func(caller Caller) []string { return caller.KeyIDPrefixes })
+}
+
+// allowsDestroy returns true if any rule allows the identity to destroy the key.
+func (p Policy) allowsDestroy(identity, keyID string) bool {
+	return p.matches(identity, keyID, func(caller Caller) []string { return caller.DestroyKeyIDPrefixes })
+}
+
+// matches returns true if a rule for the identity has a prefix of keyID.
+func (p Policy) matches(identity, keyID string, prefixes func(Caller) []string) bool {
+	for _, caller := range p.Callers {
+		if matched, _ := path.Match(caller.Identity, identity); !matched {
+			continue
+		}
+		for _, prefix := range prefixes(caller) {
+			if strings.HasPrefix(keyID, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorizer authenticates callers and enforces a policy.
+type Authorizer struct {
+	authenticator authenticator
+	policy        Policy
+}
+
+// New creates an Authorizer that authenticates callers with the given authenticator.
+func New(authenticator authenticator, policy Policy) (*Authorizer, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return &Authorizer{authenticator: authenticator, policy: policy}, nil
+}
+
+// Authorize authenticates the caller of a gRPC call and checks whether it may access the key with the given ID.
+// It returns the identity of the caller. The error wraps ErrUnauthenticated or ErrPermissionDenied.
+func (a *Authorizer) Authorize(ctx context.Context, keyID string) (string, error) {
+	identity, err := a.authenticator.Authenticate(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if !a.policy.allows(identity, keyID) {
+		return identity, fmt.Errorf("%w: %s may not access %q", ErrPermissionDenied, identity, keyID)
+	}
+	return identity, nil
+}
+
+// AuthorizeDestroy authenticates the caller of a gRPC call and checks whether it may destroy the key with the given ID.
+// It returns the identity of the caller. The error wraps ErrUnauthenticated or ErrPermissionDenied.
+func (a *Authorizer) AuthorizeDestroy(ctx context.Context, keyID string) (string, error) {
+	identity, err := a.authenticator.Authenticate(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if !a.policy.allowsDestroy(identity, keyID) {
+		return identity, fmt.Errorf("%w: %s may not destroy %q", ErrPermissionDenied, identity, keyID)
+	}
+	return identity, nil
+}
+
+type authenticator interface {
+	// Authenticate returns the identity of the caller of a gRPC call.
+	Authenticate(ctx context.Context) (string, error)
+}
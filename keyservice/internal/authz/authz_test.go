@@ -0,0 +1,204 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package authz
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"))
+}
+
+func TestPolicyValidate(t *testing.T) {
+	testCases := map[string]struct {
+		policy  Policy
+		wantErr bool
+	}{
+		"valid": {
+			policy: Policy{Callers: []Caller{
+				{Identity: "system:serviceaccount:kube-system:join-service", KeyIDPrefixes: []string{""}},
+				{Identity: "system:serviceaccount:s3proxy:*", KeyIDPrefixes: []string{"s3proxy-"}},
+			}},
+		},
+		"empty": {},
+		"missing identity": {
+			policy:  Policy{Callers: []Caller{{KeyIDPrefixes: []string{""}}}},
+			wantErr: true,
+		},
+		"invalid identity pattern": {
+			policy:  Policy{Callers: []Caller{{Identity: "[", KeyIDPrefixes: []string{""}}}},
+			wantErr: true,
+		},
+		"missing key ID prefixes": {
+			policy:  Policy{Callers: []Caller{{Identity: "system:serviceaccount:default:app"}}},
+			wantErr: true,
+		},
+		"destroy key ID prefixes": {
+			policy: Policy{Callers: []Caller{
+				{Identity: "system:serviceaccount:kube-system:csi-driver", KeyIDPrefixes: []string{"namespace/"}, DestroyKeyIDPrefixes: []string{"namespace/"}},
+			}},
+		},
+		"destroying all keys": {
+			policy: Policy{Callers: []Caller{
+				{Identity: "system:serviceaccount:kube-system:csi-driver", KeyIDPrefixes: []string{""}, DestroyKeyIDPrefixes: []string{""}},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy := Policy{Callers: []Caller{
+		{Identity: "system:serviceaccount:kube-system:join-service", KeyIDPrefixes: []string{""}},
+		{Identity: "system:serviceaccount:s3proxy-*:s3proxy", KeyIDPrefixes: []string{"s3proxy-", "team-a"}},
+	}}
+
+	testCases := map[string]struct {
+		authenticator stubAuthenticator
+		keyID         string
+		wantIdentity  string
+		wantErr       error
+	}{
+		"joinservice accesses disk key": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:kube-system:join-service"},
+			keyID:         "8f2d6a0e-disk-uuid",
+			wantIdentity:  "system:serviceaccount:kube-system:join-service",
+		},
+		"s3proxy accesses its key": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:s3proxy-prod:s3proxy"},
+			keyID:         "s3proxy-kek-v2",
+			wantIdentity:  "system:serviceaccount:s3proxy-prod:s3proxy",
+		},
+		"s3proxy accesses second prefix": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:s3proxy-prod:s3proxy"},
+			keyID:         "team-a-names",
+			wantIdentity:  "system:serviceaccount:s3proxy-prod:s3proxy",
+		},
+		"s3proxy accesses disk key": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:s3proxy-prod:s3proxy"},
+			keyID:         "8f2d6a0e-disk-uuid",
+			wantIdentity:  "system:serviceaccount:s3proxy-prod:s3proxy",
+			wantErr:       ErrPermissionDenied,
+		},
+		"unknown caller": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:default:app"},
+			keyID:         "s3proxy-kek",
+			wantIdentity:  "system:serviceaccount:default:app",
+			wantErr:       ErrPermissionDenied,
+		},
+		"authentication fails": {
+			authenticator: stubAuthenticator{err: errors.New("invalid token")},
+			keyID:         "s3proxy-kek",
+			wantErr:       ErrUnauthenticated,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			authorizer, err := New(tc.authenticator, policy)
+			require.NoError(err)
+
+			identity, err := authorizer.Authorize(t.Context(), tc.keyID)
+			assert.Equal(tc.wantIdentity, identity)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestAuthorizeDestroy(t *testing.T) {
+	policy := Policy{Callers: []Caller{
+		{Identity: "system:serviceaccount:kube-system:join-service", KeyIDPrefixes: []string{""}},
+		{Identity: "system:serviceaccount:kube-system:csi-driver", KeyIDPrefixes: []string{"namespace/"}, DestroyKeyIDPrefixes: []string{"namespace/team-a/"}},
+	}}
+
+	testCases := map[string]struct {
+		authenticator stubAuthenticator
+		keyID         string
+		wantIdentity  string
+		wantErr       error
+	}{
+		"csi driver destroys volume key": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:kube-system:csi-driver"},
+			keyID:         "namespace/team-a/volume-uuid",
+			wantIdentity:  "system:serviceaccount:kube-system:csi-driver",
+		},
+		"csi driver destroys key it may only access": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:kube-system:csi-driver"},
+			keyID:         "namespace/team-b/volume-uuid",
+			wantIdentity:  "system:serviceaccount:kube-system:csi-driver",
+			wantErr:       ErrPermissionDenied,
+		},
+		"access to all keys doesn't allow destroying them": {
+			authenticator: stubAuthenticator{identity: "system:serviceaccount:kube-system:join-service"},
+			keyID:         "namespace/team-a/volume-uuid",
+			wantIdentity:  "system:serviceaccount:kube-system:join-service",
+			wantErr:       ErrPermissionDenied,
+		},
+		"authentication fails": {
+			authenticator: stubAuthenticator{err: errors.New("invalid token")},
+			keyID:         "namespace/team-a/volume-uuid",
+			wantErr:       ErrUnauthenticated,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			authorizer, err := New(tc.authenticator, policy)
+			require.NoError(err)
+
+			identity, err := authorizer.AuthorizeDestroy(t.Context(), tc.keyID)
+			assert.Equal(tc.wantIdentity, identity)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestNewInvalidPolicy(t *testing.T) {
+	_, err := New(stubAuthenticator{}, Policy{Callers: []Caller{{Identity: "system:serviceaccount:default:app"}}})
+	assert.Error(t, err)
+}
+
+type stubAuthenticator struct {
+	identity string
+	err      error
+}
+
+func (a stubAuthenticator) Authenticate(context.Context) (string, error) {
+	return a.identity, a.err
+}
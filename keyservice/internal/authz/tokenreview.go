@@ -0,0 +1,114 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package authz
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/grpc/serviceaccount"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// reviewCacheDuration is how long the result of a TokenReview is reused for the same token.
+// Callers like the joinservice request several keys in quick succession.
+const reviewCacheDuration = time.Minute
+
+// TokenReviewer authenticates callers by verifying their service account token with the Kubernetes TokenReview API.
+type TokenReviewer struct {
+	client    tokenReviewClient
+	audiences []string
+	now       func() time.Time
+
+	mux   sync.Mutex
+	cache map[[sha256.Size]byte]review
+}
+
+type review struct {
+	identity string
+	expires  time.Time
+}
+
+// NewTokenReviewer creates a TokenReviewer using the in-cluster Kubernetes configuration.
+// If audiences are given, tokens must be issued for one of them.
+func NewTokenReviewer(audiences []string) (*TokenReviewer, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("creating in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating clientset: %w", err)
+	}
+	return newTokenReviewer(clientset.AuthenticationV1().TokenReviews(), audiences), nil
+}
+
+func newTokenReviewer(client tokenReviewClient, audiences []string) *TokenReviewer {
+	return &TokenReviewer{
+		client:    client,
+		audiences: audiences,
+		now:       time.Now,
+		cache:     map[[sha256.Size]byte]review{},
+	}
+}
+
+// Authenticate returns the Kubernetes username of the service account that issued the call.
+func (r *TokenReviewer) Authenticate(ctx context.Context) (string, error) {
+	token, ok := serviceaccount.TokenFromContext(ctx)
+	if !ok {
+		return "", errors.New("no service account token")
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	if identity, ok := r.cached(hash); ok {
+		return identity, nil
+	}
+
+	result, err := r.client.Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: r.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("reviewing token: %w", err)
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return "", fmt.Errorf("invalid token: %s", result.Status.Error)
+		}
+		return "", errors.New("invalid token")
+	}
+
+	identity := result.Status.User.Username
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cache[hash] = review{identity: identity, expires: r.now().Add(reviewCacheDuration)}
+	return identity, nil
+}
+
+// cached returns the identity of a recently reviewed token and removes expired reviews.
+func (r *TokenReviewer) cached(hash [sha256.Size]byte) (string, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.now()
+	for key, review := range r.cache {
+		if now.After(review.expires) {
+			delete(r.cache, key)
+		}
+	}
+	review, ok := r.cache[hash]
+	return review.identity, ok
+}
+
+type tokenReviewClient interface {
+	Create(ctx context.Context, review *authenticationv1.TokenReview, opts metav1.CreateOptions) (*authenticationv1.TokenReview, error)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package authz
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTokenReviewerAuthenticate(t *testing.T) {
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	testCases := map[string]struct {
+		ctx          context.Context
+		client       *stubTokenReviewClient
+		wantIdentity string
+		wantErr      bool
+	}{
+		"valid token": {
+			ctx: withToken("token"),
+			client: &stubTokenReviewClient{status: authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:join-service"},
+			}},
+			wantIdentity: "system:serviceaccount:kube-system:join-service",
+		},
+		"invalid token": {
+			ctx:     withToken("token"),
+			client:  &stubTokenReviewClient{status: authenticationv1.TokenReviewStatus{Error: "token expired"}},
+			wantErr: true,
+		},
+		"review fails": {
+			ctx:     withToken("token"),
+			client:  &stubTokenReviewClient{err: errors.New("failed")},
+			wantErr: true,
+		},
+		"no token": {
+			ctx:     context.Background(),
+			client:  &stubTokenReviewClient{},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reviewer := newTokenReviewer(tc.client, []string{"keyservice"})
+			identity, err := reviewer.Authenticate(tc.ctx)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantIdentity, identity)
+			assert.Equal("token", tc.client.reviewed.Spec.Token)
+			assert.Equal([]string{"keyservice"}, tc.client.reviewed.Spec.Audiences)
+		})
+	}
+}
+
+func TestTokenReviewerCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	client := &stubTokenReviewClient{status: authenticationv1.TokenReviewStatus{
+		Authenticated: true,
+		User:          authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:join-service"},
+	}}
+	now := time.Now()
+	reviewer := newTokenReviewer(client, nil)
+	reviewer.now = func() time.Time { return now }
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token"))
+
+	_, err := reviewer.Authenticate(ctx)
+	require.NoError(err)
+	_, err = reviewer.Authenticate(ctx)
+	require.NoError(err)
+	assert.Equal(1, client.reviews)
+
+	// Other tokens are reviewed on their own.
+	_, err = reviewer.Authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer other")))
+	require.NoError(err)
+	assert.Equal(2, client.reviews)
+
+	// Reviews expire, so revoked tokens are rejected eventually.
+	now = now.Add(reviewCacheDuration + time.Second)
+	client.status = authenticationv1.TokenReviewStatus{}
+	_, err = reviewer.Authenticate(ctx)
+	assert.Error(err)
+	assert.Equal(3, client.reviews)
+	assert.Empty(reviewer.cache)
+}
+
+type stubTokenReviewClient struct {
+	status   authenticationv1.TokenReviewStatus
+	err      error
+	reviewed *authenticationv1.TokenReview
+	reviews  int
+}
+
+func (c *stubTokenReviewClient) Create(_ context.Context, review *authenticationv1.TokenReview, _ metav1.CreateOptions) (*authenticationv1.TokenReview, error) {
+	c.reviews++
+	c.reviewed = review
+	if c.err != nil {
+		return nil, c.err
+	}
+	result := review.DeepCopy()
+	result.Status = c.status
+	return result, nil
+}
@@ -9,17 +9,32 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/atls"
+	"github.com/edgelesssys/constellation/v2/internal/attestation"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
 	"github.com/edgelesssys/constellation/v2/internal/crypto"
+	"github.com/edgelesssys/constellation/v2/internal/grpc/atlscredentials"
 	"github.com/edgelesssys/constellation/v2/internal/grpc/grpclog"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/denylist"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/audit"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/authz"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -29,39 +44,134 @@ import (
 type Server struct {
 	log    *slog.Logger
 	conKMS kms.CloudKMS
+	// authorizer decides which callers may access which keys. If nil, all callers may access all keys.
+	authorizer Authorizer
+	// auditor records all data key requests. If nil, requests aren't recorded.
+	auditor Auditor
+	// destroyer destroys data keys. If nil, or if authorizer is nil, data keys can't be destroyed.
+	destroyer KeyDestroyer
 	keyserviceproto.UnimplementedAPIServer
 }
 
+// Authorizer authorizes access to keys.
+type Authorizer interface {
+	// Authorize returns the identity of the caller if it may access the key with the given ID.
+	// The error wraps authz.ErrUnauthenticated if the caller couldn't be authenticated.
+	Authorize(ctx context.Context, keyID string) (string, error)
+	// AuthorizeDestroy returns the identity of the caller if it may destroy the key with the given ID.
+	// The error wraps authz.ErrUnauthenticated if the caller couldn't be authenticated.
+	AuthorizeDestroy(ctx context.Context, keyID string) (string, error)
+}
+
+// Auditor records data key requests.
+type Auditor interface {
+	// Record stores an audit record. If it fails, the requested key isn't handed out.
+	Record(ctx context.Context, record audit.Record) error
+}
+
+// KeyDestroyer destroys data keys.
+type KeyDestroyer interface {
+	// DestroyDEK destroys the DEK with the given ID and all DEKs below it,
+	// so that conKMS refuses them from then on.
+	DestroyDEK(ctx context.Context, dekID string) error
+}
+
 // New creates a new Server.
-func New(log *slog.Logger, conKMS kms.CloudKMS) *Server {
+// If authorizer is nil, all callers may access all keys. If auditor is nil, requests aren't recorded.
+// If destroyer or authorizer is nil, data keys can't be destroyed.
+func New(log *slog.Logger, conKMS kms.CloudKMS, authorizer Authorizer, auditor Auditor, destroyer KeyDestroyer) *Server {
 	return &Server{
-		log:    log,
-		conKMS: conKMS,
+		log:        log,
+		conKMS:     conKMS,
+		authorizer: authorizer,
+		auditor:    auditor,
+		destroyer:  destroyer,
 	}
 }
 
-// Run starts the gRPC server.
-func (s *Server) Run(port string) error {
-	// set up listener
+// Run starts the gRPC server on port.
+// If issuer isn't nil, the server additionally serves aTLS on atlsPort, attesting itself with issuer,
+// so that clients outside the control plane can verify the server before requesting keys.
+func (s *Server) Run(port, atlsPort string, issuer atls.Issuer) error {
+	// set up listeners
 	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
 	if err != nil {
 		return fmt.Errorf("failed to listen on port %s: %v", port, err)
 	}
+	var atlsListener net.Listener
+	if issuer != nil {
+		atlsListener, err = net.Listen("tcp", net.JoinHostPort("", atlsPort))
+		if err != nil {
+			return fmt.Errorf("failed to listen on port %s: %v", atlsPort, err)
+		}
+	}
 
 	grpcLog := logger.GRPCLogger(s.log)
 	logger.ReplaceGRPCLogger(grpcLog)
 
 	server := grpc.NewServer(logger.GetServerUnaryInterceptor(grpcLog))
 	keyserviceproto.RegisterAPIServer(server, s)
+	if atlsListener == nil {
+		// start the server
+		s.log.Info(fmt.Sprintf("Starting Constellation key management service on %s", listener.Addr().String()))
+		return server.Serve(listener)
+	}
 
-	// start the server
-	s.log.Info(fmt.Sprintf("Starting Constellation key management service on %s", listener.Addr().String()))
-	return server.Serve(listener)
+	atlsServer := grpc.NewServer(
+		grpc.Creds(atlscredentials.New(issuer, nil)),
+		logger.GetServerUnaryInterceptor(grpcLog),
+	)
+	keyserviceproto.RegisterAPIServer(atlsServer, s)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer atlsServer.GracefulStop()
+
+		s.log.Info(fmt.Sprintf("Starting Constellation key management service on %s", listener.Addr().String()))
+		if serveErr := server.Serve(listener); serveErr != nil {
+			once.Do(func() { err = serveErr })
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer server.GracefulStop()
+
+		s.log.Info(fmt.Sprintf("Starting Constellation key management service with aTLS on %s", atlsListener.Addr().String()))
+		if serveErr := atlsServer.Serve(atlsListener); serveErr != nil {
+			once.Do(func() { err = serveErr })
+		}
+	}()
+
+	wg.Wait()
+	return err
 }
 
 // GetDataKey returns a data key.
-func (s *Server) GetDataKey(ctx context.Context, in *keyserviceproto.GetDataKeyRequest) (*keyserviceproto.GetDataKeyResponse, error) {
-	log := s.log.With("peerAddress", grpclog.PeerAddrFromContext(ctx))
+// Every request is recorded by the auditor, and the key is only returned if recording succeeds.
+func (s *Server) GetDataKey(ctx context.Context, in *keyserviceproto.GetDataKeyRequest) (res *keyserviceproto.GetDataKeyResponse, retErr error) {
+	peerAddress := grpclog.PeerAddrFromContext(ctx)
+	log := s.log.With("peerAddress", peerAddress)
+
+	var identity string
+	if s.auditor != nil {
+		defer func() {
+			record := audit.Record{
+				Caller:      identity,
+				PeerAddress: peerAddress,
+				KeyID:       in.DataKeyId,
+				Length:      in.Length,
+				Version:     in.MasterSecretVersion,
+			}
+			if retErr = s.record(ctx, log, record, retErr); retErr != nil {
+				res = nil
+			}
+		}()
+	}
 
 	// Error on 0 key length
 	if in.Length == 0 {
@@ -74,11 +184,164 @@ func (s *Server) GetDataKey(ctx context.Context, in *keyserviceproto.GetDataKeyR
 		log.Error("No data key ID specified")
 		return nil, status.Error(codes.InvalidArgument, "no data key ID specified")
 	}
+	// the version of the master secret is requested explicitly, and must not be smuggled in through the ID
+	if strings.ContainsRune(in.DataKeyId, 0) {
+		log.Error("Data key ID contains a NUL byte")
+		return nil, status.Error(codes.InvalidArgument, "data key ID must not contain NUL bytes")
+	}
+
+	var err error
+	if identity, log, err = s.authorize(ctx, log, in.DataKeyId, false); err != nil {
+		return nil, err
+	}
 
-	key, err := s.conKMS.GetDEK(ctx, crypto.DEKPrefix+in.DataKeyId, int(in.Length))
+	dekID := cluster.MasterSecretKeyID(crypto.DEKPrefix+in.DataKeyId, in.MasterSecretVersion)
+	key, err := s.conKMS.GetDEK(ctx, dekID, int(in.Length))
+	if errors.Is(err, denylist.ErrDestroyed) {
+		log.With(slog.Any("error", err)).Warn("Rejecting request for destroyed data key")
+		return nil, status.Errorf(codes.FailedPrecondition, "data key %q was destroyed", in.DataKeyId)
+	}
+	if errors.Is(err, cluster.ErrVersionRetired) {
+		log.With(slog.Any("error", err)).Warn("Rejecting request for state disk key of retired master secret version")
+		return nil, status.Errorf(codes.FailedPrecondition, "master secret version %d was retired for state disk keys", in.MasterSecretVersion)
+	}
 	if err != nil {
 		log.With(slog.Any("error", err)).Error("Failed to get data key")
 		return nil, status.Errorf(codes.Internal, "%v", err)
 	}
 	return &keyserviceproto.GetDataKeyResponse{DataKey: key}, nil
 }
+
+// DestroyDataKey destroys a data key and all data keys below its ID, e.g., all versions of a volume's key.
+// GetDataKey refuses destroyed keys from then on. Destroyed keys can't be restored.
+// Only the keys of CSI volumes with a key scope can be destroyed, by callers the authorizer allows to destroy them,
+// and only over aTLS. Every request is recorded by the auditor.
+func (s *Server) DestroyDataKey(ctx context.Context, in *keyserviceproto.DestroyDataKeyRequest) (res *keyserviceproto.DestroyDataKeyResponse, retErr error) {
+	peerAddress := grpclog.PeerAddrFromContext(ctx)
+	log := s.log.With("peerAddress", peerAddress)
+
+	var identity string
+	if s.auditor != nil {
+		defer func() {
+			record := audit.Record{
+				Caller:      identity,
+				PeerAddress: peerAddress,
+				KeyID:       in.DataKeyId,
+				Destroy:     true,
+			}
+			if retErr = s.record(ctx, log, record, retErr); retErr != nil {
+				res = nil
+			}
+		}()
+	}
+
+	if in.DataKeyId == "" {
+		log.Error("No data key ID specified")
+		return nil, status.Error(codes.InvalidArgument, "no data key ID specified")
+	}
+	if strings.ContainsRune(in.DataKeyId, 0) {
+		log.Error("Data key ID contains a NUL byte")
+		return nil, status.Error(codes.InvalidArgument, "data key ID must not contain NUL bytes")
+	}
+	if err := checkDestroyable(in.DataKeyId); err != nil {
+		log.With(slog.Any("error", err), slog.String("dataKeyID", in.DataKeyId)).Warn("Rejecting request to destroy data key")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.destroyer == nil {
+		log.Error("Destroying data keys is not configured")
+		return nil, status.Error(codes.FailedPrecondition, "destroying data keys is not configured")
+	}
+	if s.authorizer == nil {
+		log.Error("Destroying data keys requires an authorization policy")
+		return nil, status.Error(codes.FailedPrecondition, "destroying data keys requires an authorization policy")
+	}
+	// the plain endpoint is reachable by every pod, so keys are only destroyed by callers that verified the key service
+	if !isATLS(ctx) {
+		log.Warn("Rejecting request to destroy data key over plain gRPC")
+		return nil, status.Error(codes.PermissionDenied, "data keys can only be destroyed over aTLS")
+	}
+
+	var err error
+	if identity, log, err = s.authorize(ctx, log, in.DataKeyId, true); err != nil {
+		return nil, err
+	}
+
+	if err := s.destroyer.DestroyDEK(ctx, crypto.DEKPrefix+in.DataKeyId); err != nil {
+		log.With(slog.Any("error", err)).Error("Failed to destroy data key")
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	log.Info("Destroyed data key")
+	return &keyserviceproto.DestroyDataKeyResponse{}, nil
+}
+
+// authorize checks if the caller may access, or if destroy is set, destroy the key with the given ID.
+// It returns the caller's identity and a logger annotated with it.
+func (s *Server) authorize(ctx context.Context, log *slog.Logger, keyID string, destroy bool) (string, *slog.Logger, error) {
+	if s.authorizer == nil {
+		return "", log, nil
+	}
+
+	authorize := s.authorizer.Authorize
+	if destroy {
+		authorize = s.authorizer.AuthorizeDestroy
+	}
+	identity, err := authorize(ctx, keyID)
+	log = log.With(slog.String("caller", identity), slog.String("dataKeyID", keyID))
+	switch {
+	case errors.Is(err, authz.ErrUnauthenticated):
+		log.With(slog.Any("error", err)).Warn("Rejecting unauthenticated data key request")
+		return identity, log, status.Error(codes.Unauthenticated, "caller is not authenticated")
+	case err != nil:
+		log.With(slog.Any("error", err)).Warn("Rejecting unauthorized data key request")
+		return identity, log, status.Errorf(codes.PermissionDenied, "caller may not access data key %q", keyID)
+	}
+	return identity, log, nil
+}
+
+// checkDestroyable checks that keyID is the key of a CSI volume with a key scope, i.e., "<scope type>/<scope name>/<volume>".
+// Keys the cluster depends on, like the measurement secret, the SSH CA seed, and the keys of state disks, can't be destroyed,
+// whatever the authorization policy allows.
+func checkDestroyable(keyID string) error {
+	if keyID == attestation.MeasurementSecretContext || keyID == constants.SSHCAKeySuffix {
+		return fmt.Errorf("data key %q is required by the cluster and can't be destroyed", keyID)
+	}
+	if _, err := uuid.Parse(keyID); err == nil {
+		return fmt.Errorf("data key %q of a state disk can't be destroyed", keyID)
+	}
+	for _, prefix := range []string{
+		constants.CSINamespaceKeyScopePrefix,
+		constants.CSIStorageClassKeyScopePrefix,
+		constants.CSIKeyReferenceScopePrefix,
+	} {
+		scope, volume, ok := strings.Cut(strings.TrimPrefix(keyID, prefix), "/")
+		if strings.HasPrefix(keyID, prefix) && ok && scope != "" && volume != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("data key %q isn't the key of a CSI volume with a key scope, and can't be destroyed", keyID)
+}
+
+// isATLS returns true if the request in ctx was received over aTLS.
+func isATLS(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.AuthInfo.(credentials.TLSInfo)
+	return ok
+}
+
+// record records a request that returned reqErr with the auditor.
+// If recording fails, the request fails.
+func (s *Server) record(ctx context.Context, log *slog.Logger, record audit.Record, reqErr error) error {
+	record.Time = time.Now().UTC()
+	record.Result = status.Code(reqErr).String()
+	if reqErr != nil {
+		record.Error = status.Convert(reqErr).Message()
+	}
+	if err := s.auditor.Record(ctx, record); err != nil {
+		log.With(slog.Any("error", err)).Error("Failed to record data key request")
+		return status.Error(codes.Internal, "failed to record data key request")
+	}
+	return reqErr
+}
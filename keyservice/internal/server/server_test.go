@@ -9,14 +9,29 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/attestation"
+	"github.com/edgelesssys/constellation/v2/internal/constants"
+	"github.com/edgelesssys/constellation/v2/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/cluster"
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms/denylist"
+	"github.com/edgelesssys/constellation/v2/internal/kms/uri"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/audit"
+	"github.com/edgelesssys/constellation/v2/keyservice/internal/authz"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 func TestMain(m *testing.M) {
@@ -30,11 +45,23 @@ func TestGetDataKey(t *testing.T) {
 	log := logger.NewTest(t)
 
 	kms := &stubKMS{derivedKey: []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5}}
-	api := New(log, kms)
+	api := New(log, kms, nil, nil, nil)
 
 	res, err := api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: "1", Length: 32})
 	require.NoError(err)
 	assert.Equal(kms.derivedKey, res.DataKey)
+	assert.Equal(crypto.DEKPrefix+"1", kms.dekID)
+
+	// Test key derived from a rotated master secret
+	res, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: "1", Length: 32, MasterSecretVersion: 2})
+	require.NoError(err)
+	assert.Equal(kms.derivedKey, res.DataKey)
+	assert.Equal(cluster.MasterSecretKeyID(crypto.DEKPrefix+"1", 2), kms.dekID)
+
+	// Test master secret version in the data key id
+	res, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: cluster.MasterSecretKeyID("1", 2), Length: 32})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.Nil(res)
 
 	// Test no data key id
 	res, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{Length: 32})
@@ -47,17 +74,379 @@ func TestGetDataKey(t *testing.T) {
 	assert.Nil(res)
 
 	// Test derive key error
-	api = New(log, &stubKMS{deriveKeyErr: errors.New("error")})
+	api = New(log, &stubKMS{deriveKeyErr: errors.New("error")}, nil, nil, nil)
+	res, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: "1", Length: 32})
+	assert.Equal(codes.Internal, status.Code(err))
+	assert.Nil(res)
+
+	// Test destroyed key
+	api = New(log, &stubKMS{deriveKeyErr: fmt.Errorf("DEK %q: %w", "key-1", denylist.ErrDestroyed)}, nil, nil, nil)
 	res, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: "1", Length: 32})
-	assert.Error(err)
+	assert.Equal(codes.FailedPrecondition, status.Code(err))
 	assert.Nil(res)
 }
 
+func TestGetDataKeyFinalizedRotation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conKMS, err := cluster.NewFromMasterSecret(uri.MasterSecret{
+		Key:       []byte("key"),
+		Salt:      []byte("salt"),
+		Rotations: []uri.MasterSecretRotation{{Version: 1, Key: []byte("key-1"), Salt: []byte("salt-1"), Finalized: true}},
+	})
+	require.NoError(err)
+	api := New(logger.NewTest(t), conKMS, nil, nil, nil)
+	diskUUID := "8d7e5a3c-4f2b-4c1a-9e0d-2b6f1a3c5d7e"
+
+	// state disk keys are only derived from the current version
+	_, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: diskUUID, Length: 32, MasterSecretVersion: 1})
+	assert.NoError(err)
+	_, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: diskUUID, Length: 32})
+	assert.Equal(codes.FailedPrecondition, status.Code(err))
+
+	// keys bound to the cluster's identity are still derived from the initial master secret
+	_, err = api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: constants.SSHCAKeySuffix, Length: 32})
+	assert.NoError(err)
+}
+
+func TestGetDataKeyAuthorization(t *testing.T) {
+	someErr := errors.New("failed")
+
+	testCases := map[string]struct {
+		authorizer *stubAuthorizer
+		wantCode   codes.Code
+	}{
+		"authorized": {
+			authorizer: &stubAuthorizer{identity: "system:serviceaccount:kube-system:join-service"},
+			wantCode:   codes.OK,
+		},
+		"unauthenticated": {
+			authorizer: &stubAuthorizer{err: fmt.Errorf("%w: %w", authz.ErrUnauthenticated, someErr)},
+			wantCode:   codes.Unauthenticated,
+		},
+		"permission denied": {
+			authorizer: &stubAuthorizer{identity: "system:serviceaccount:default:app", err: authz.ErrPermissionDenied},
+			wantCode:   codes.PermissionDenied,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			kms := &stubKMS{derivedKey: []byte{0x0, 0x1, 0x2, 0x3}}
+			api := New(logger.NewTest(t), kms, tc.authorizer, nil, nil)
+
+			res, err := api.GetDataKey(t.Context(), &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32})
+			assert.Equal(tc.wantCode, status.Code(err))
+			assert.Equal("disk-uuid", tc.authorizer.keyID)
+			if tc.wantCode != codes.OK {
+				assert.Nil(res)
+				return
+			}
+			assert.Equal(kms.derivedKey, res.DataKey)
+		})
+	}
+}
+
+func TestGetDataKeyAudit(t *testing.T) {
+	const identity = "system:serviceaccount:kube-system:join-service"
+
+	testCases := map[string]struct {
+		kms        *stubKMS
+		authorizer Authorizer
+		auditErr   error
+		req        *keyserviceproto.GetDataKeyRequest
+		wantCode   codes.Code
+		wantRecord audit.Record
+	}{
+		"granted": {
+			kms:        &stubKMS{derivedKey: []byte{0x1}},
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32},
+			wantCode:   codes.OK,
+			wantRecord: audit.Record{Caller: identity, KeyID: "disk-uuid", Length: 32, Result: "OK"},
+		},
+		"granted without authorization": {
+			kms:        &stubKMS{derivedKey: []byte{0x1}},
+			req:        &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32},
+			wantCode:   codes.OK,
+			wantRecord: audit.Record{KeyID: "disk-uuid", Length: 32, Result: "OK"},
+		},
+		"denied": {
+			kms:        &stubKMS{derivedKey: []byte{0x1}},
+			authorizer: &stubAuthorizer{identity: "system:serviceaccount:default:app", err: authz.ErrPermissionDenied},
+			req:        &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32},
+			wantCode:   codes.PermissionDenied,
+			wantRecord: audit.Record{
+				Caller: "system:serviceaccount:default:app", KeyID: "disk-uuid", Length: 32,
+				Result: "PermissionDenied", Error: `caller may not access data key "disk-uuid"`,
+			},
+		},
+		"invalid request": {
+			kms:        &stubKMS{derivedKey: []byte{0x1}},
+			req:        &keyserviceproto.GetDataKeyRequest{Length: 32},
+			wantCode:   codes.InvalidArgument,
+			wantRecord: audit.Record{Length: 32, Result: "InvalidArgument", Error: "no data key ID specified"},
+		},
+		"key derivation fails": {
+			kms:        &stubKMS{deriveKeyErr: errors.New("failed")},
+			req:        &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32},
+			wantCode:   codes.Internal,
+			wantRecord: audit.Record{KeyID: "disk-uuid", Length: 32, Result: "Internal", Error: "failed"},
+		},
+		"recording fails": {
+			kms:        &stubKMS{derivedKey: []byte{0x1}},
+			auditErr:   errors.New("disk full"),
+			req:        &keyserviceproto.GetDataKeyRequest{DataKeyId: "disk-uuid", Length: 32},
+			wantCode:   codes.Internal,
+			wantRecord: audit.Record{KeyID: "disk-uuid", Length: 32, Result: "OK"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			auditor := &stubAuditor{err: tc.auditErr}
+			api := New(logger.NewTest(t), tc.kms, tc.authorizer, auditor, nil)
+
+			res, err := api.GetDataKey(t.Context(), tc.req)
+			assert.Equal(tc.wantCode, status.Code(err))
+			if tc.wantCode != codes.OK {
+				assert.Nil(res)
+			}
+
+			require.Len(auditor.records, 1)
+			record := auditor.records[0]
+			assert.False(record.Time.IsZero())
+			assert.Equal("unknown", record.PeerAddress)
+			record.Time, record.PeerAddress = time.Time{}, ""
+			assert.Equal(tc.wantRecord, record)
+		})
+	}
+}
+
+func TestDestroyDataKey(t *testing.T) {
+	const (
+		identity = "system:serviceaccount:kube-system:csi-driver"
+		keyID    = "namespace/team-a/8d7e5a3c-0000-4000-8000-000000000000"
+	)
+
+	testCases := map[string]struct {
+		destroyer  *stubDestroyer
+		authorizer Authorizer
+		plainGRPC  bool
+		req        *keyserviceproto.DestroyDataKeyRequest
+		wantCode   codes.Code
+		wantRecord audit.Record
+	}{
+		"destroyed": {
+			destroyer:  &stubDestroyer{},
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.OK,
+			wantRecord: audit.Record{Caller: identity, KeyID: keyID, Destroy: true, Result: "OK"},
+		},
+		"key of storage class scope": {
+			destroyer:  &stubDestroyer{},
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: "storageclass/encrypted-rwo/volume-uuid"},
+			wantCode:   codes.OK,
+			wantRecord: audit.Record{Caller: identity, KeyID: "storageclass/encrypted-rwo/volume-uuid", Destroy: true, Result: "OK"},
+		},
+		"permission denied": {
+			destroyer:  &stubDestroyer{},
+			authorizer: &stubAuthorizer{identity: "system:serviceaccount:default:app", err: authz.ErrPermissionDenied},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.PermissionDenied,
+			wantRecord: audit.Record{
+				Caller: "system:serviceaccount:default:app", KeyID: keyID, Destroy: true,
+				Result: "PermissionDenied", Error: fmt.Sprintf("caller may not access data key %q", keyID),
+			},
+		},
+		"plain gRPC": {
+			destroyer:  &stubDestroyer{},
+			authorizer: &stubAuthorizer{identity: identity},
+			plainGRPC:  true,
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.PermissionDenied,
+			wantRecord: audit.Record{KeyID: keyID, Destroy: true, Result: "PermissionDenied", Error: "data keys can only be destroyed over aTLS"},
+		},
+		"no authorizer": {
+			destroyer:  &stubDestroyer{},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.FailedPrecondition,
+			wantRecord: audit.Record{KeyID: keyID, Destroy: true, Result: "FailedPrecondition", Error: "destroying data keys requires an authorization policy"},
+		},
+		"no data key ID": {
+			destroyer:  &stubDestroyer{},
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.DestroyDataKeyRequest{},
+			wantCode:   codes.InvalidArgument,
+			wantRecord: audit.Record{Destroy: true, Result: "InvalidArgument", Error: "no data key ID specified"},
+		},
+		"destroying not configured": {
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.FailedPrecondition,
+			wantRecord: audit.Record{KeyID: keyID, Destroy: true, Result: "FailedPrecondition", Error: "destroying data keys is not configured"},
+		},
+		"destroying fails": {
+			destroyer:  &stubDestroyer{err: errors.New("failed")},
+			authorizer: &stubAuthorizer{identity: identity},
+			req:        &keyserviceproto.DestroyDataKeyRequest{DataKeyId: keyID},
+			wantCode:   codes.Internal,
+			wantRecord: audit.Record{Caller: identity, KeyID: keyID, Destroy: true, Result: "Internal", Error: "failed"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			auditor := &stubAuditor{}
+			var destroyer KeyDestroyer
+			if tc.destroyer != nil {
+				destroyer = tc.destroyer
+			}
+			api := New(logger.NewTest(t), &stubKMS{}, tc.authorizer, auditor, destroyer)
+
+			ctx := atlsContext(t.Context())
+			if tc.plainGRPC {
+				ctx = t.Context()
+			}
+			res, err := api.DestroyDataKey(ctx, tc.req)
+			assert.Equal(tc.wantCode, status.Code(err))
+			if tc.wantCode != codes.OK {
+				assert.Nil(res)
+				if tc.destroyer != nil && tc.destroyer.err == nil {
+					assert.Empty(tc.destroyer.dekID)
+				}
+			} else {
+				assert.Equal(crypto.DEKPrefix+tc.req.DataKeyId, tc.destroyer.dekID)
+				assert.True(tc.authorizer.(*stubAuthorizer).destroy)
+			}
+
+			require.Len(auditor.records, 1)
+			record := auditor.records[0]
+			record.Time, record.PeerAddress = time.Time{}, ""
+			assert.Equal(tc.wantRecord, record)
+		})
+	}
+}
+
+func TestCheckDestroyable(t *testing.T) {
+	testCases := map[string]struct {
+		keyID   string
+		wantErr bool
+	}{
+		"key of namespace scope": {
+			keyID: "namespace/team-a/8d7e5a3c-0000-4000-8000-000000000000",
+		},
+		"key of storage class scope": {
+			keyID: "storageclass/encrypted-rwo/8d7e5a3c-0000-4000-8000-000000000000",
+		},
+		"key of key reference scope": {
+			keyID: "key/team-a-key/8d7e5a3c-0000-4000-8000-000000000000",
+		},
+		"measurement secret": {
+			keyID:   attestation.MeasurementSecretContext,
+			wantErr: true,
+		},
+		"SSH CA seed": {
+			keyID:   constants.SSHCAKeySuffix,
+			wantErr: true,
+		},
+		"state disk key": {
+			keyID:   "8d7e5a3c-0000-4000-8000-000000000000",
+			wantErr: true,
+		},
+		"key of other service": {
+			keyID:   "s3proxy-kek",
+			wantErr: true,
+		},
+		"whole scope": {
+			keyID:   "namespace/team-a",
+			wantErr: true,
+		},
+		"all scopes of a type": {
+			keyID:   "namespace/",
+			wantErr: true,
+		},
+		"empty scope name": {
+			keyID:   "namespace//8d7e5a3c-0000-4000-8000-000000000000",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := checkDestroyable(tc.keyID)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// atlsContext returns a context of a request received over aTLS.
+func atlsContext(ctx context.Context) context.Context {
+	return peer.NewContext(ctx, &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		AuthInfo: credentials.TLSInfo{},
+	})
+}
+
+type stubDestroyer struct {
+	dekID string
+	err   error
+}
+
+func (d *stubDestroyer) DestroyDEK(_ context.Context, dekID string) error {
+	d.dekID = dekID
+	return d.err
+}
+
+type stubAuditor struct {
+	records []audit.Record
+	err     error
+}
+
+func (a *stubAuditor) Record(_ context.Context, record audit.Record) error {
+	a.records = append(a.records, record)
+	return a.err
+}
+
+type stubAuthorizer struct {
+	identity string
+	err      error
+	keyID    string
+	destroy  bool
+}
+
+func (a *stubAuthorizer) Authorize(_ context.Context, keyID string) (string, error) {
+	a.keyID = keyID
+	return a.identity, a.err
+}
+
+func (a *stubAuthorizer) AuthorizeDestroy(_ context.Context, keyID string) (string, error) {
+	a.keyID = keyID
+	a.destroy = true
+	return a.identity, a.err
+}
+
 type stubKMS struct {
 	kms.CloudKMS
 	masterKey    []byte
 	derivedKey   []byte
 	deriveKeyErr error
+	dekID        string
 }
 
 func (c *stubKMS) CreateKEK(_ context.Context, _ string, kek []byte) error {
@@ -65,7 +454,8 @@ func (c *stubKMS) CreateKEK(_ context.Context, _ string, kek []byte) error {
 	return nil
 }
 
-func (c *stubKMS) GetDEK(_ context.Context, _ string, _ int) ([]byte, error) {
+func (c *stubKMS) GetDEK(_ context.Context, dekID string, _ int) ([]byte, error) {
+	c.dekID = dekID
 	if c.deriveKeyErr != nil {
 		return nil, c.deriveKeyErr
 	}
@@ -26,11 +26,12 @@ const (
 )
 
 type GetDataKeyRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	DataKeyId     string                 `protobuf:"bytes,1,opt,name=data_key_id,json=dataKeyId,proto3" json:"data_key_id,omitempty"`
-	Length        uint32                 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	DataKeyId           string                 `protobuf:"bytes,1,opt,name=data_key_id,json=dataKeyId,proto3" json:"data_key_id,omitempty"`
+	Length              uint32                 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+	MasterSecretVersion uint32                 `protobuf:"varint,3,opt,name=master_secret_version,json=masterSecretVersion,proto3" json:"master_secret_version,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
 }
 
 func (x *GetDataKeyRequest) Reset() {
@@ -77,6 +78,13 @@ func (x *GetDataKeyRequest) GetLength() uint32 {
 	return 0
 }
 
+func (x *GetDataKeyRequest) GetMasterSecretVersion() uint32 {
+	if x != nil {
+		return x.MasterSecretVersion
+	}
+	return 0
+}
+
 type GetDataKeyResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	DataKey       []byte                 `protobuf:"bytes,1,opt,name=data_key,json=dataKey,proto3" json:"data_key,omitempty"`
@@ -121,19 +129,104 @@ func (x *GetDataKeyResponse) GetDataKey() []byte {
 	return nil
 }
 
+type DestroyDataKeyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DataKeyId     string                 `protobuf:"bytes,1,opt,name=data_key_id,json=dataKeyId,proto3" json:"data_key_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DestroyDataKeyRequest) Reset() {
+	*x = DestroyDataKeyRequest{}
+	mi := &file_keyservice_keyserviceproto_keyservice_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DestroyDataKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DestroyDataKeyRequest) ProtoMessage() {}
+
+func (x *DestroyDataKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keyservice_keyserviceproto_keyservice_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DestroyDataKeyRequest.ProtoReflect.Descriptor instead.
+func (*DestroyDataKeyRequest) Descriptor() ([]byte, []int) {
+	return file_keyservice_keyserviceproto_keyservice_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DestroyDataKeyRequest) GetDataKeyId() string {
+	if x != nil {
+		return x.DataKeyId
+	}
+	return ""
+}
+
+type DestroyDataKeyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DestroyDataKeyResponse) Reset() {
+	*x = DestroyDataKeyResponse{}
+	mi := &file_keyservice_keyserviceproto_keyservice_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DestroyDataKeyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DestroyDataKeyResponse) ProtoMessage() {}
+
+func (x *DestroyDataKeyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_keyservice_keyserviceproto_keyservice_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DestroyDataKeyResponse.ProtoReflect.Descriptor instead.
+func (*DestroyDataKeyResponse) Descriptor() ([]byte, []int) {
+	return file_keyservice_keyserviceproto_keyservice_proto_rawDescGZIP(), []int{3}
+}
+
 var File_keyservice_keyserviceproto_keyservice_proto protoreflect.FileDescriptor
 
 const file_keyservice_keyserviceproto_keyservice_proto_rawDesc = "" +
 	"\n" +
-	"+keyservice/keyserviceproto/keyservice.proto\x12\x03kms\"K\n" +
+	"+keyservice/keyserviceproto/keyservice.proto\x12\x03kms\"\x7f\n" +
 	"\x11GetDataKeyRequest\x12\x1e\n" +
 	"\vdata_key_id\x18\x01 \x01(\tR\tdataKeyId\x12\x16\n" +
-	"\x06length\x18\x02 \x01(\rR\x06length\"/\n" +
+	"\x06length\x18\x02 \x01(\rR\x06length\x122\n" +
+	"\x15master_secret_version\x18\x03 \x01(\rR\x13masterSecretVersion\"/\n" +
 	"\x12GetDataKeyResponse\x12\x19\n" +
-	"\bdata_key\x18\x01 \x01(\fR\adataKey2D\n" +
+	"\bdata_key\x18\x01 \x01(\fR\adataKey\"7\n" +
+	"\x15DestroyDataKeyRequest\x12\x1e\n" +
+	"\vdata_key_id\x18\x01 \x01(\tR\tdataKeyId\"\x18\n" +
+	"\x16DestroyDataKeyResponse2\x8f\x01\n" +
 	"\x03API\x12=\n" +
 	"\n" +
-	"GetDataKey\x12\x16.kms.GetDataKeyRequest\x1a\x17.kms.GetDataKeyResponseBDZBgithub.com/edgelesssys/constellation/v2/keyservice/keyserviceprotob\x06proto3"
+	"GetDataKey\x12\x16.kms.GetDataKeyRequest\x1a\x17.kms.GetDataKeyResponse\x12I\n" +
+	"\x0eDestroyDataKey\x12\x1a.kms.DestroyDataKeyRequest\x1a\x1b.kms.DestroyDataKeyResponseBDZBgithub.com/edgelesssys/constellation/v2/keyservice/keyserviceprotob\x06proto3"
 
 var (
 	file_keyservice_keyserviceproto_keyservice_proto_rawDescOnce sync.Once
@@ -147,16 +240,20 @@ func file_keyservice_keyserviceproto_keyservice_proto_rawDescGZIP() []byte {
 	return file_keyservice_keyserviceproto_keyservice_proto_rawDescData
 }
 
-var file_keyservice_keyserviceproto_keyservice_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_keyservice_keyserviceproto_keyservice_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_keyservice_keyserviceproto_keyservice_proto_goTypes = []any{
-	(*GetDataKeyRequest)(nil),  // 0: kms.GetDataKeyRequest
-	(*GetDataKeyResponse)(nil), // 1: kms.GetDataKeyResponse
+	(*GetDataKeyRequest)(nil),      // 0: kms.GetDataKeyRequest
+	(*GetDataKeyResponse)(nil),     // 1: kms.GetDataKeyResponse
+	(*DestroyDataKeyRequest)(nil),  // 2: kms.DestroyDataKeyRequest
+	(*DestroyDataKeyResponse)(nil), // 3: kms.DestroyDataKeyResponse
 }
 var file_keyservice_keyserviceproto_keyservice_proto_depIdxs = []int32{
 	0, // 0: kms.API.GetDataKey:input_type -> kms.GetDataKeyRequest
-	1, // 1: kms.API.GetDataKey:output_type -> kms.GetDataKeyResponse
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
+	2, // 1: kms.API.DestroyDataKey:input_type -> kms.DestroyDataKeyRequest
+	1, // 2: kms.API.GetDataKey:output_type -> kms.GetDataKeyResponse
+	3, // 3: kms.API.DestroyDataKey:output_type -> kms.DestroyDataKeyResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -173,7 +270,7 @@ func file_keyservice_keyserviceproto_keyservice_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_keyservice_keyserviceproto_keyservice_proto_rawDesc), len(file_keyservice_keyserviceproto_keyservice_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -199,6 +296,7 @@ const _ = grpc.SupportPackageIsVersion6
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type APIClient interface {
 	GetDataKey(ctx context.Context, in *GetDataKeyRequest, opts ...grpc.CallOption) (*GetDataKeyResponse, error)
+	DestroyDataKey(ctx context.Context, in *DestroyDataKeyRequest, opts ...grpc.CallOption) (*DestroyDataKeyResponse, error)
 }
 
 type aPIClient struct {
@@ -218,9 +316,19 @@ func (c *aPIClient) GetDataKey(ctx context.Context, in *GetDataKeyRequest, opts
 	return out, nil
 }
 
+func (c *aPIClient) DestroyDataKey(ctx context.Context, in *DestroyDataKeyRequest, opts ...grpc.CallOption) (*DestroyDataKeyResponse, error) {
+	out := new(DestroyDataKeyResponse)
+	err := c.cc.Invoke(ctx, "/kms.API/DestroyDataKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // APIServer is the server API for API service.
 type APIServer interface {
 	GetDataKey(context.Context, *GetDataKeyRequest) (*GetDataKeyResponse, error)
+	DestroyDataKey(context.Context, *DestroyDataKeyRequest) (*DestroyDataKeyResponse, error)
 }
 
 // UnimplementedAPIServer can be embedded to have forward compatible implementations.
@@ -230,6 +338,9 @@ type UnimplementedAPIServer struct {
 func (*UnimplementedAPIServer) GetDataKey(context.Context, *GetDataKeyRequest) (*GetDataKeyResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetDataKey not implemented")
 }
+func (*UnimplementedAPIServer) DestroyDataKey(context.Context, *DestroyDataKeyRequest) (*DestroyDataKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DestroyDataKey not implemented")
+}
 
 func RegisterAPIServer(s *grpc.Server, srv APIServer) {
 	s.RegisterService(&_API_serviceDesc, srv)
@@ -253,6 +364,24 @@ func _API_GetDataKey_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _API_DestroyDataKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DestroyDataKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).DestroyDataKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kms.API/DestroyDataKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).DestroyDataKey(ctx, req.(*DestroyDataKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _API_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "kms.API",
 	HandlerType: (*APIServer)(nil),
@@ -261,6 +390,10 @@ var _API_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetDataKey",
 			Handler:    _API_GetDataKey_Handler,
 		},
+		{
+			MethodName: "DestroyDataKey",
+			Handler:    _API_DestroyDataKey_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "keyservice/keyserviceproto/keyservice.proto",
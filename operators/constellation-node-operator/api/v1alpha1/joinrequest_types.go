@@ -0,0 +1,58 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// JoinRequestSpec defines a request of a node to join the cluster.
+// The join service holds the request until it's approved, if the join policy requires manual approval.
+type JoinRequestSpec struct {
+	// NodeName is the name of the node requesting to join.
+	NodeName string `json:"nodeName,omitempty"`
+	// IsControlPlane is true if the node requests to join as a control plane node.
+	IsControlPlane bool `json:"isControlPlane,omitempty"`
+	// PeerAddress is the address the node sent the join request from.
+	PeerAddress string `json:"peerAddress,omitempty"`
+	// Approved allows the node to join the cluster.
+	// +optional
+	Approved bool `json:"approved,omitempty"`
+}
+
+// JoinRequestStatus defines the observed state of JoinRequest.
+type JoinRequestStatus struct{}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.spec.nodeName`
+//+kubebuilder:printcolumn:name="Control Plane",type=boolean,JSONPath=`.spec.isControlPlane`
+//+kubebuilder:printcolumn:name="Approved",type=boolean,JSONPath=`.spec.approved`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// JoinRequest is the Schema for the joinrequests API.
+type JoinRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   JoinRequestSpec   `json:"spec,omitempty"`
+	Status JoinRequestStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// JoinRequestList contains a list of JoinRequests.
+type JoinRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []JoinRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&JoinRequest{}, &JoinRequestList{})
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeIdentitySpec defines the identity of a node that joined the cluster.
+// The join service records an identity for every join and issues only one join ticket per identity.
+type NodeIdentitySpec struct {
+	// InstanceID identifies the instance the node runs on. It's derived from the attestation key of the instance's TPM.
+	InstanceID string `json:"instanceID,omitempty"`
+	// DiskUUID is the UUID of the node's state disk.
+	DiskUUID string `json:"diskUUID,omitempty"`
+	// NodeName is the name of the node that joined with this identity.
+	NodeName string `json:"nodeName,omitempty"`
+	// IsControlPlane is true if the node joined as a control plane node.
+	IsControlPlane bool `json:"isControlPlane,omitempty"`
+	// CSRHash is the SHA-256 hash of the certificate signing request the node joined with.
+	// A repeated request with the same CSR is answered again, so that the node can retry if the response got lost.
+	CSRHash string `json:"csrHash,omitempty"`
+	// JoinTime is the time the node was last issued a join ticket.
+	// +optional
+	JoinTime metav1.Time `json:"joinTime,omitempty"`
+	// AllowJoin allows the node to join the cluster once more.
+	// +optional
+	AllowJoin bool `json:"allowJoin,omitempty"`
+	// Revoked denies the node to join or rejoin the cluster.
+	// +optional
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// NodeIdentityStatus defines the observed state of NodeIdentity.
+type NodeIdentityStatus struct{}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.spec.nodeName`
+//+kubebuilder:printcolumn:name="Control Plane",type=boolean,JSONPath=`.spec.isControlPlane`
+//+kubebuilder:printcolumn:name="Allow Join",type=boolean,JSONPath=`.spec.allowJoin`
+//+kubebuilder:printcolumn:name="Revoked",type=boolean,JSONPath=`.spec.revoked`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NodeIdentity is the Schema for the nodeidentities API.
+type NodeIdentity struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodeIdentitySpec   `json:"spec,omitempty"`
+	Status NodeIdentityStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NodeIdentityList contains a list of NodeIdentities.
+type NodeIdentityList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NodeIdentity `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NodeIdentity{}, &NodeIdentityList{})
+}
@@ -6,19 +6,35 @@ SPDX-License-Identifier: BUSL-1.1
 
 /*
 Package main parses command line flags and starts the s3proxy server.
+
+The rewrap subcommand re-wraps the DEKs of existing objects with a new KEK version:
+
+	s3proxy rewrap -bucket <bucket> [-prefix <prefix>] -kek-version <version>
 */
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/edgelesssys/constellation/v2/internal/file"
 	"github.com/edgelesssys/constellation/v2/internal/logger"
 	"github.com/edgelesssys/constellation/v2/s3proxy/internal/router"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/afero"
 )
 
 const (
@@ -32,9 +48,23 @@ const (
 	defaultCertLocation = "/etc/s3proxy/certs"
 	// defaultLogLevel is the default log level.
 	defaultLogLevel = 0
+	// defaultMetricsPort is the default port to serve Prometheus metrics on.
+	defaultMetricsPort = 9090
+	// defaultKMSEndpoint is the default endpoint of Constellation's keyservice.
+	defaultKMSEndpoint = "key-service.kube-system:9000"
+	// rewrapCommand is the name of the subcommand that re-wraps DEKs of existing objects.
+	rewrapCommand = "rewrap"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == rewrapCommand {
+		if err := runRewrap(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flags, err := parseFlags()
 	if err != nil {
 		panic(err)
@@ -42,8 +72,8 @@ func main() {
 
 	logger := logger.NewJSONLogger(logger.VerbosityFromInt(flags.logLevel))
 
-	if flags.forwardMultipartReqs {
-		logger.Warn("configured to forward multipart uploads, this may leak data to AWS")
+	if flags.allowMultipart {
+		logger.Warn("The allow-multipart flag is deprecated and ignored, multipart uploads are always encrypted")
 	}
 
 	if err := runServer(flags, logger); err != nil {
@@ -54,11 +84,45 @@ func main() {
 func runServer(flags cmdFlags, log *slog.Logger) error {
 	log.With(slog.String("ip", flags.ip), slog.Int("port", defaultPort), slog.String("region", flags.region)).Info("listening")
 
-	router, err := router.New(flags.region, flags.kmsEndpoint, flags.forwardMultipartReqs, log)
+	policy, err := loadPolicy(flags.policyPath)
+	if err != nil {
+		return err
+	}
+	// Requests for objects with encrypted names are rewritten, which invalidates the client's signature.
+	if policy.EncryptsNames() && flags.credentialsPath == "" {
+		return errors.New("policy encrypts object names, which requires client credentials")
+	}
+
+	backend, err := loadBackend(flags.region, flags.endpoint, flags.pathStyle, flags.caCertPath)
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAuditLog(flags.auditLogPath)
+	if err != nil {
+		return err
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	var credentials *router.CredentialFile
+	if flags.credentialsPath != "" {
+		credentials, err = router.NewCredentialFile(file.NewHandler(afero.NewOsFs()), flags.credentialsPath, log)
+		if err != nil {
+			return err
+		}
+	}
+
+	router, err := router.New(backend, flags.kmsEndpoint, flags.kekVersion, policy, credentials, reg, audit, log)
 	if err != nil {
 		return fmt.Errorf("creating router: %w", err)
 	}
 
+	if flags.metricsPort != 0 {
+		go serveMetrics(flags.ip, flags.metricsPort, reg, log)
+	}
+
 	server := http.Server{
 		Addr:    fmt.Sprintf("%s:%d", flags.ip, defaultPort),
 		Handler: http.HandlerFunc(router.Serve),
@@ -91,10 +155,18 @@ func parseFlags() (cmdFlags, error) {
 	noTLS := flag.Bool("no-tls", false, "disable TLS and listen on port 80, otherwise listen on 443")
 	ip := flag.String("ip", defaultIP, "ip to listen on")
 	region := flag.String("region", defaultRegion, "AWS region in which target bucket is located")
+	endpoint := flag.String("endpoint", "", "URL of an S3-compatible API to send requests to, AWS S3 is used if empty")
+	pathStyle := flag.Bool("path-style", false, "address buckets as part of the URL path instead of the host name")
+	caCertPath := flag.String("ca-cert", "", "path to PEM encoded CA certificates to trust in addition to the system roots when connecting to S3")
 	certLocation := flag.String("cert", defaultCertLocation, "location of TLS certificate")
-	kmsEndpoint := flag.String("kms", "key-service.kube-system:9000", "endpoint of the KMS service to get key encryption keys from")
-	forwardMultipartReqs := flag.Bool("allow-multipart", false, "forward multipart requests to the target bucket; beware: this may store unencrypted data on AWS. See the documentation for more information")
+	kmsEndpoint := flag.String("kms", defaultKMSEndpoint, "endpoint of the KMS service to get key encryption keys from")
+	kekVersion := flag.Uint("kek-version", 1, "version of the key encryption key used for new objects")
+	policyPath := flag.String("policy", "", "path to a policy file mapping buckets and prefixes to actions, all objects are encrypted if empty")
+	credentialsPath := flag.String("credentials", "", "path to a file with the access keys clients sign requests with, requests are re-signed with s3proxy's credentials if set")
+	allowMultipart := flag.Bool("allow-multipart", false, "deprecated: multipart uploads are always encrypted, the flag is ignored")
 	level := flag.Int("level", defaultLogLevel, "log level")
+	metricsPort := flag.Int("metrics-port", defaultMetricsPort, "port to serve Prometheus metrics on, disabled if 0")
+	auditLogPath := flag.String("audit-log", "", "path of a file to append a JSON line per object access to, \"-\" for stdout, disabled if empty")
 
 	flag.Parse()
 
@@ -102,24 +174,170 @@ func parseFlags() (cmdFlags, error) {
 	if netIP == nil {
 		return cmdFlags{}, fmt.Errorf("not a valid IPv4 address: %s", *ip)
 	}
+	version, err := parseKEKVersion(*kekVersion)
+	if err != nil {
+		return cmdFlags{}, err
+	}
 
 	return cmdFlags{
-		noTLS:                *noTLS,
-		ip:                   netIP.String(),
-		region:               *region,
-		certLocation:         *certLocation,
-		kmsEndpoint:          *kmsEndpoint,
-		forwardMultipartReqs: *forwardMultipartReqs,
-		logLevel:             *level,
+		noTLS:           *noTLS,
+		ip:              netIP.String(),
+		region:          *region,
+		endpoint:        *endpoint,
+		pathStyle:       *pathStyle,
+		caCertPath:      *caCertPath,
+		certLocation:    *certLocation,
+		kmsEndpoint:     *kmsEndpoint,
+		kekVersion:      version,
+		policyPath:      *policyPath,
+		credentialsPath: *credentialsPath,
+		allowMultipart:  *allowMultipart,
+		logLevel:        *level,
+		metricsPort:     *metricsPort,
+		auditLogPath:    *auditLogPath,
 	}, nil
 }
 
 type cmdFlags struct {
-	noTLS                bool
-	ip                   string
-	region               string
-	certLocation         string
-	kmsEndpoint          string
-	forwardMultipartReqs bool
-	logLevel             int
+	noTLS           bool
+	ip              string
+	region          string
+	endpoint        string
+	pathStyle       bool
+	caCertPath      string
+	certLocation    string
+	kmsEndpoint     string
+	kekVersion      uint32
+	policyPath      string
+	credentialsPath string
+	allowMultipart  bool
+	logLevel        int
+	metricsPort     int
+	auditLogPath    string
+}
+
+// runRewrap re-wraps the DEKs of existing objects with the given KEK version.
+func runRewrap(args []string) error {
+	flags := flag.NewFlagSet(rewrapCommand, flag.ExitOnError)
+	bucket := flags.String("bucket", "", "bucket whose objects are re-wrapped")
+	prefix := flags.String("prefix", "", "only re-wrap objects whose key starts with this prefix")
+	region := flags.String("region", defaultRegion, "AWS region in which target bucket is located")
+	endpoint := flags.String("endpoint", "", "URL of an S3-compatible API to send requests to, AWS S3 is used if empty")
+	pathStyle := flags.Bool("path-style", false, "address buckets as part of the URL path instead of the host name")
+	caCertPath := flags.String("ca-cert", "", "path to PEM encoded CA certificates to trust in addition to the system roots when connecting to S3")
+	kmsEndpoint := flags.String("kms", defaultKMSEndpoint, "endpoint of the KMS service to get key encryption keys from")
+	kekVersion := flags.Uint("kek-version", 1, "version of the key encryption key to re-wrap DEKs with")
+	policyPath := flags.String("policy", "", "path to the policy file that assigns KEKs to objects")
+	level := flags.Int("level", defaultLogLevel, "log level")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bucket == "" {
+		return errors.New("flag -bucket is required")
+	}
+	version, err := parseKEKVersion(*kekVersion)
+	if err != nil {
+		return err
+	}
+
+	policy, err := loadPolicy(*policyPath)
+	if err != nil {
+		return err
+	}
+
+	backend, err := loadBackend(*region, *endpoint, *pathStyle, *caCertPath)
+	if err != nil {
+		return err
+	}
+
+	log := logger.NewJSONLogger(logger.VerbosityFromInt(*level))
+	router, err := router.New(backend, *kmsEndpoint, version, policy, nil, nil, nil, log)
+	if err != nil {
+		return fmt.Errorf("creating router: %w", err)
+	}
+
+	result, err := router.Rewrap(context.Background(), *bucket, *prefix)
+	log.With(slog.Int("rewrapped", result.Rewrapped), slog.Int("skipped", result.Skipped), slog.Int("failed", result.Failed)).Info("Rewrap finished")
+	if err != nil {
+		return fmt.Errorf("rewrapping objects: %w", err)
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d objects could not be re-wrapped", result.Failed)
+	}
+	return nil
+}
+
+// parseKEKVersion checks the value of a -kek-version flag. KEK versions are positive and at most 32 bits long.
+func parseKEKVersion(version uint) (uint32, error) {
+	if version < 1 || version > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid KEK version %d: must be between 1 and %d", version, uint32(math.MaxUint32))
+	}
+	return uint32(version), nil
+}
+
+// serveMetrics serves the metrics of reg on /metrics of the given port.
+// Metrics are served without TLS, since they don't contain sensitive data and are scraped from within the cluster.
+func serveMetrics(ip string, port int, reg *prometheus.Registry, log *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	server := http.Server{
+		Addr:              net.JoinHostPort(ip, fmt.Sprint(port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.With(slog.Any("error", err)).Error("Serving metrics")
+	}
+}
+
+// openAuditLog opens the audit log at the given path. The file is created if it doesn't exist and appended to otherwise.
+// If path is "-", the audit log is written to stdout. If path is empty, audit logging is disabled and nil is returned.
+func openAuditLog(path string) (*slog.Logger, error) {
+	var out io.Writer
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		out = os.Stdout
+	default:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+		out = file
+	}
+	return slog.New(slog.NewJSONHandler(out, nil)), nil
+}
+
+// loadBackend creates the configuration of the S3 API requests are sent to.
+// If a CA certificate path is given, the certificates are trusted in addition to the system roots.
+func loadBackend(region, endpoint string, pathStyle bool, caCertPath string) (s3.Config, error) {
+	backend := s3.Config{Region: region, Endpoint: endpoint, UsePathStyle: pathStyle}
+	if caCertPath == "" {
+		return backend, nil
+	}
+
+	caCerts, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return s3.Config{}, fmt.Errorf("reading CA certificates: %w", err)
+	}
+	backend.HTTPClient, err = s3.NewHTTPClient(caCerts)
+	if err != nil {
+		return s3.Config{}, fmt.Errorf("creating HTTP client: %w", err)
+	}
+	return backend, nil
+}
+
+// loadPolicy reads the policy file at the given path. If no path is given, the default policy is used.
+func loadPolicy(path string) (router.Policy, error) {
+	if path == "" {
+		return router.DefaultPolicy(), nil
+	}
+
+	var policy router.Policy
+	fileHandler := file.NewHandler(afero.NewOsFs())
+	if err := fileHandler.ReadYAMLStrict(path, &policy); err != nil {
+		return router.Policy{}, fmt.Errorf("reading policy: %w", err)
+	}
+	return policy, nil
 }
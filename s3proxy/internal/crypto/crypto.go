@@ -11,6 +11,7 @@ It uses AES-256-GCM to encrypt and decrypt data.
 package crypto
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	aeadsubtle "github.com/tink-crypto/tink-go/v2/aead/subtle"
@@ -18,11 +19,20 @@ import (
 	"github.com/tink-crypto/tink-go/v2/subtle/random"
 )
 
+const (
+	// dekSizeBytes is the size of a data encryption key. 32 bytes are used for AES-256.
+	dekSizeBytes = 32
+	// PartHeaderSize is the size of the header in front of each encrypted part of a multipart upload
+	// completed by previous versions of s3proxy.
+	// It holds a 4 byte part number and an 8 byte ciphertext length.
+	PartHeaderSize = 12
+)
+
 // Encrypt generates a random key to encrypt a plaintext using AES-256-GCM.
 // The generated key is encrypted using the supplied key encryption key (KEK).
 // The ciphertext and encrypted data encryption key (DEK) are returned.
 func Encrypt(plaintext []byte, kek [32]byte) (ciphertext []byte, encryptedDEK []byte, err error) {
-	dek := random.GetRandomBytes(32)
+	dek := GenerateDEK()
 	aesgcm, err := aeadsubtle.NewAESGCMSIV(dek)
 	if err != nil {
 		return nil, nil, fmt.Errorf("getting aesgcm: %w", err)
@@ -33,14 +43,9 @@ func Encrypt(plaintext []byte, kek [32]byte) (ciphertext []byte, encryptedDEK []
 		return nil, nil, fmt.Errorf("encrypting plaintext: %w", err)
 	}
 
-	keywrapper, err := kwpsubtle.NewKWP(kek[:])
-	if err != nil {
-		return nil, nil, fmt.Errorf("getting kwp: %w", err)
-	}
-
-	encryptedDEK, err = keywrapper.Wrap(dek)
+	encryptedDEK, err = WrapDEK(dek, kek)
 	if err != nil {
-		return nil, nil, fmt.Errorf("wrapping dek: %w", err)
+		return nil, nil, err
 	}
 
 	return ciphertext, encryptedDEK, nil
@@ -49,6 +54,45 @@ func Encrypt(plaintext []byte, kek [32]byte) (ciphertext []byte, encryptedDEK []
 // Decrypt decrypts a ciphertext using AES-256-GCM.
 // The encrypted DEK is decrypted using the supplied KEK.
 func Decrypt(ciphertext, encryptedDEK []byte, kek [32]byte) ([]byte, error) {
+	dek, err := UnwrapDEK(encryptedDEK, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := aeadsubtle.NewAESGCMSIV(dek)
+	if err != nil {
+		return nil, fmt.Errorf("getting aesgcm: %w", err)
+	}
+
+	plaintext, err := aesgcm.Decrypt(ciphertext, []byte(""))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting ciphertext: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// GenerateDEK returns a new random 256 bit data encryption key.
+func GenerateDEK() []byte {
+	return random.GetRandomBytes(dekSizeBytes)
+}
+
+// WrapDEK encrypts a data encryption key using the supplied KEK.
+func WrapDEK(dek []byte, kek [32]byte) ([]byte, error) {
+	keywrapper, err := kwpsubtle.NewKWP(kek[:])
+	if err != nil {
+		return nil, fmt.Errorf("getting kwp: %w", err)
+	}
+
+	encryptedDEK, err := keywrapper.Wrap(dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping dek: %w", err)
+	}
+	return encryptedDEK, nil
+}
+
+// UnwrapDEK decrypts an encrypted data encryption key using the supplied KEK.
+func UnwrapDEK(encryptedDEK []byte, kek [32]byte) ([]byte, error) {
 	keywrapper, err := kwpsubtle.NewKWP(kek[:])
 	if err != nil {
 		return nil, fmt.Errorf("getting kwp: %w", err)
@@ -58,16 +102,57 @@ func Decrypt(ciphertext, encryptedDEK []byte, kek [32]byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unwrapping dek: %w", err)
 	}
+	return dek, nil
+}
 
+// DecryptParts decrypts the body of a multipart upload completed by previous versions of s3proxy.
+// The body is the concatenation of parts, each prefixed with its part number and length and encrypted on its own.
+// New uploads use the segmented format instead.
+// Part numbers have to be strictly increasing, as S3 assembles the parts in ascending order.
+// Since gaps between part numbers are allowed, the part numbers are checked against partsTag to detect dropped parts.
+func DecryptParts(ciphertext, dek, partsTag []byte) ([]byte, error) {
 	aesgcm, err := aeadsubtle.NewAESGCMSIV(dek)
 	if err != nil {
 		return nil, fmt.Errorf("getting aesgcm: %w", err)
 	}
 
-	plaintext, err := aesgcm.Decrypt(ciphertext, []byte(""))
-	if err != nil {
-		return nil, fmt.Errorf("decrypting ciphertext: %w", err)
+	var plaintext []byte
+	var partNumbers []uint32
+	var lastPartNumber uint32
+	for len(ciphertext) > 0 {
+		partNumber, length, err := ParsePartHeader(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		if partNumber <= lastPartNumber {
+			return nil, fmt.Errorf("part %d follows part %d", partNumber, lastPartNumber)
+		}
+		if length > uint64(len(ciphertext)-PartHeaderSize) {
+			return nil, fmt.Errorf("part %d truncated", partNumber)
+		}
+
+		part, err := aesgcm.Decrypt(ciphertext[PartHeaderSize:PartHeaderSize+length], ciphertext[:4])
+		if err != nil {
+			return nil, fmt.Errorf("decrypting part %d: %w", partNumber, err)
+		}
+		plaintext = append(plaintext, part...)
+
+		partNumbers = append(partNumbers, partNumber)
+		lastPartNumber = partNumber
+		ciphertext = ciphertext[PartHeaderSize+length:]
 	}
 
+	if err := VerifyPartsTag(dek, partNumbers, partsTag); err != nil {
+		return nil, err
+	}
 	return plaintext, nil
 }
+
+// ParsePartHeader parses the header in front of a part encrypted by previous versions of s3proxy.
+// It returns the part number and the length of the part's ciphertext following the header.
+func ParsePartHeader(header []byte) (partNumber uint32, ciphertextLength uint64, err error) {
+	if len(header) < PartHeaderSize {
+		return 0, 0, fmt.Errorf("part header truncated: %d bytes left", len(header))
+	}
+	return binary.BigEndian.Uint32(header[:4]), binary.BigEndian.Uint64(header[4:PartHeaderSize]), nil
+}
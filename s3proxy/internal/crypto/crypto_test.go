@@ -7,11 +7,13 @@ package crypto
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	aeadsubtle "github.com/tink-crypto/tink-go/v2/aead/subtle"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -46,3 +48,155 @@ func TestEncryptDecrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptDecryptParts(t *testing.T) {
+	tests := map[string]struct {
+		parts       map[int32][]byte
+		partNumbers []int32
+		// taggedParts are the part numbers the parts tag is computed for, partNumbers if nil.
+		taggedParts []int32
+		noPartsTag  bool
+		tamper      func([]byte) []byte
+		wantErr     bool
+	}{
+		"single part": {
+			parts:       map[int32][]byte{1: []byte("hello, world")},
+			partNumbers: []int32{1},
+		},
+		"multiple parts": {
+			parts:       map[int32][]byte{1: []byte("hello, "), 2: []byte("world"), 5: []byte("!")},
+			partNumbers: []int32{1, 2, 5},
+		},
+		"empty part": {
+			parts:       map[int32][]byte{1: []byte("hello"), 2: {}},
+			partNumbers: []int32{1, 2},
+		},
+		"reordered parts": {
+			parts:       map[int32][]byte{1: []byte("hello, "), 2: []byte("world")},
+			partNumbers: []int32{2, 1},
+			wantErr:     true,
+		},
+		"dropped middle part": {
+			parts:       map[int32][]byte{1: []byte("hello"), 2: []byte(", "), 3: []byte("world")},
+			partNumbers: []int32{1, 3},
+			taggedParts: []int32{1, 2, 3},
+			wantErr:     true,
+		},
+		"dropped last part": {
+			parts:       map[int32][]byte{1: []byte("hello, "), 2: []byte("world")},
+			partNumbers: []int32{1},
+			taggedParts: []int32{1, 2},
+			wantErr:     true,
+		},
+		"missing parts tag": {
+			parts:       map[int32][]byte{1: []byte("hello, world")},
+			partNumbers: []int32{1},
+			noPartsTag:  true,
+			wantErr:     true,
+		},
+		"truncated part": {
+			parts:       map[int32][]byte{1: []byte("hello, "), 2: []byte("world")},
+			partNumbers: []int32{1, 2},
+			tamper:      func(b []byte) []byte { return b[:len(b)-1] },
+			wantErr:     true,
+		},
+		"modified ciphertext": {
+			parts:       map[int32][]byte{1: []byte("hello, world")},
+			partNumbers: []int32{1},
+			tamper: func(b []byte) []byte {
+				b[len(b)-1] ^= 0x1
+				return b
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			dek := GenerateDEK()
+
+			var ciphertext, plaintext []byte
+			for _, partNumber := range tt.partNumbers {
+				part, err := encryptPart(tt.parts[partNumber], dek, partNumber)
+				require.NoError(err)
+				ciphertext = append(ciphertext, part...)
+				plaintext = append(plaintext, tt.parts[partNumber]...)
+			}
+			if tt.tamper != nil {
+				ciphertext = tt.tamper(ciphertext)
+			}
+			var partsTag []byte
+			if !tt.noPartsTag {
+				taggedParts := tt.taggedParts
+				if taggedParts == nil {
+					taggedParts = tt.partNumbers
+				}
+				var indices []uint32
+				for _, partNumber := range taggedParts {
+					indices = append(indices, uint32(partNumber))
+				}
+				var err error
+				partsTag, err = PartsTag(dek, indices)
+				require.NoError(err)
+			}
+
+			decrypted, err := DecryptParts(ciphertext, dek, partsTag)
+			if tt.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(string(plaintext), string(decrypted))
+		})
+	}
+}
+
+func TestWrapUnwrapDEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	kek := [32]byte{}
+	_, err := rand.Read(kek[:])
+	require.NoError(err)
+
+	dek := GenerateDEK()
+	encryptedDEK, err := WrapDEK(dek, kek)
+	require.NoError(err)
+	assert.NotEqual(dek, encryptedDEK)
+
+	unwrapped, err := UnwrapDEK(encryptedDEK, kek)
+	require.NoError(err)
+	assert.Equal(dek, unwrapped)
+
+	_, err = UnwrapDEK(encryptedDEK, [32]byte{})
+	assert.Error(err)
+}
+
+// encryptPart encrypts a single part of a multipart upload using AES-256-GCM.
+// All parts of an upload share the same DEK. The part number is bound to the ciphertext as additional data.
+// The returned ciphertext is prefixed with the part number and its length,
+// as previous versions of s3proxy did.
+func encryptPart(plaintext, dek []byte, partNumber int32) ([]byte, error) {
+	if partNumber < 1 {
+		return nil, fmt.Errorf("invalid part number: %d", partNumber)
+	}
+
+	aesgcm, err := aeadsubtle.NewAESGCMSIV(dek)
+	if err != nil {
+		return nil, fmt.Errorf("getting aesgcm: %w", err)
+	}
+
+	header := make([]byte, PartHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(partNumber))
+
+	ciphertext, err := aesgcm.Encrypt(plaintext, header[:4])
+	if err != nil {
+		return nil, fmt.Errorf("encrypting part: %w", err)
+	}
+	binary.BigEndian.PutUint64(header[4:], uint64(len(ciphertext)))
+
+	return append(header, ciphertext...), nil
+}
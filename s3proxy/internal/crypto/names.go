@@ -0,0 +1,134 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	aeadsubtle "github.com/tink-crypto/tink-go/v2/aead/subtle"
+	daeadsubtle "github.com/tink-crypto/tink-go/v2/daead/subtle"
+	"github.com/tink-crypto/tink-go/v2/tink"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// NameKeySize is the size of the key a NameCipher is created from.
+	NameKeySize = 32
+	// objectKeyInfo and metadataInfo separate the keys derived for object keys and metadata values.
+	objectKeyInfo = "s3proxy object key"
+	metadataInfo  = "s3proxy metadata"
+)
+
+// errNotEncrypted is returned when decrypting a name or value that wasn't encrypted by a NameCipher with the same key.
+var errNotEncrypted = errors.New("not encrypted with this key")
+
+// NameCipher encrypts object keys and user metadata values.
+//
+// Object keys are encrypted deterministically with AES-SIV, so objects can still be addressed by their name.
+// Each segment of a key, separated by "/", is encrypted on its own, so listings by prefix and delimiter keep working.
+// The encrypted segments are encoded with unpadded base64url, which only uses characters that are safe in object keys.
+//
+// Metadata values are encrypted with AES-GCM-SIV and a random nonce. The metadata name is used as associated data,
+// so values can't be moved between metadata entries.
+type NameCipher struct {
+	keys     tink.DeterministicAEAD
+	metadata tink.AEAD
+}
+
+// NewNameCipher creates a NameCipher from a key of NameKeySize bytes.
+func NewNameCipher(key []byte) (*NameCipher, error) {
+	if len(key) != NameKeySize {
+		return nil, fmt.Errorf("invalid name key size %d, expected %d", len(key), NameKeySize)
+	}
+
+	keysKey := make([]byte, daeadsubtle.AESSIVKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(objectKeyInfo)), keysKey); err != nil {
+		return nil, fmt.Errorf("deriving object key key: %w", err)
+	}
+	keys, err := daeadsubtle.NewAESSIV(keysKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting aessiv: %w", err)
+	}
+
+	metadataKey := make([]byte, dekSizeBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(metadataInfo)), metadataKey); err != nil {
+		return nil, fmt.Errorf("deriving metadata key: %w", err)
+	}
+	metadata, err := aeadsubtle.NewAESGCMSIV(metadataKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting aesgcmsiv: %w", err)
+	}
+
+	return &NameCipher{keys: keys, metadata: metadata}, nil
+}
+
+// EncryptKey encrypts an object key segment by segment. Empty segments stay empty.
+func (c *NameCipher) EncryptKey(key string) (string, error) {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		encrypted, err := c.EncryptSegment(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = encrypted
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// EncryptSegment encrypts a single segment of an object key.
+func (c *NameCipher) EncryptSegment(segment string) (string, error) {
+	ciphertext, err := c.keys.EncryptDeterministically([]byte(segment), nil)
+	if err != nil {
+		return "", fmt.Errorf("encrypting key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptSegment decrypts a single segment of an object key.
+// It returns an error if the segment wasn't encrypted with this key.
+func (c *NameCipher) DecryptSegment(segment string) (string, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return "", errNotEncrypted
+	}
+	plaintext, err := c.keys.DecryptDeterministically(ciphertext, nil)
+	if err != nil {
+		return "", errNotEncrypted
+	}
+	return string(plaintext), nil
+}
+
+// EncryptMetadata encrypts the value of the user metadata entry with the given name.
+func (c *NameCipher) EncryptMetadata(name, value string) (string, error) {
+	ciphertext, err := c.metadata.Encrypt([]byte(value), []byte(strings.ToLower(name)))
+	if err != nil {
+		return "", fmt.Errorf("encrypting metadata: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptMetadata decrypts the value of the user metadata entry with the given name.
+// It returns an error if the value wasn't encrypted with this key.
+func (c *NameCipher) DecryptMetadata(name, value string) (string, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", errNotEncrypted
+	}
+	plaintext, err := c.metadata.Decrypt(ciphertext, []byte(strings.ToLower(name)))
+	if err != nil {
+		return "", errNotEncrypted
+	}
+	return string(plaintext), nil
+}
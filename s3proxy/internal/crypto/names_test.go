@@ -0,0 +1,95 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameCipherKeys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cipher, err := NewNameCipher(bytes.Repeat([]byte{0x1}, NameKeySize))
+	require.NoError(err)
+	other, err := NewNameCipher(bytes.Repeat([]byte{0x2}, NameKeySize))
+	require.NoError(err)
+
+	const key = "patients/2024/john-doe.pdf"
+	encrypted, err := cipher.EncryptKey(key)
+	require.NoError(err)
+	assert.NotContains(encrypted, "patients")
+	assert.NotContains(encrypted, "john-doe")
+
+	// Encryption is deterministic, so objects can be addressed by their name.
+	again, err := cipher.EncryptKey(key)
+	require.NoError(err)
+	assert.Equal(encrypted, again)
+
+	// Segments are encrypted on their own, so prefixes are preserved.
+	prefix, err := cipher.EncryptKey("patients/2024/")
+	require.NoError(err)
+	assert.True(strings.HasPrefix(encrypted, prefix))
+	assert.Len(strings.Split(encrypted, "/"), 3)
+
+	segments := strings.Split(encrypted, "/")
+	for i, want := range strings.Split(key, "/") {
+		assert.NotContains(segments[i], "+")
+		plaintext, err := cipher.DecryptSegment(segments[i])
+		require.NoError(err)
+		assert.Equal(want, plaintext)
+
+		_, err = other.DecryptSegment(segments[i])
+		assert.Error(err)
+	}
+
+	_, err = cipher.DecryptSegment("john-doe.pdf")
+	assert.Error(err)
+
+	empty, err := cipher.EncryptKey("a//b/")
+	require.NoError(err)
+	assert.Equal(4, len(strings.Split(empty, "/")))
+	assert.True(strings.HasSuffix(empty, "/"))
+	assert.Contains(empty, "//")
+}
+
+func TestNameCipherMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cipher, err := NewNameCipher(bytes.Repeat([]byte{0x1}, NameKeySize))
+	require.NoError(err)
+
+	encrypted, err := cipher.EncryptMetadata("Patient", "John Doe")
+	require.NoError(err)
+	assert.NotContains(encrypted, "John")
+
+	// Metadata values are encrypted with a random nonce.
+	again, err := cipher.EncryptMetadata("patient", "John Doe")
+	require.NoError(err)
+	assert.NotEqual(encrypted, again)
+
+	plaintext, err := cipher.DecryptMetadata("patient", encrypted)
+	require.NoError(err)
+	assert.Equal("John Doe", plaintext)
+
+	// Values can't be moved to other metadata entries.
+	_, err = cipher.DecryptMetadata("doctor", encrypted)
+	assert.Error(err)
+
+	_, err = cipher.DecryptMetadata("patient", "John Doe")
+	assert.Error(err)
+}
+
+func TestNewNameCipherKeySize(t *testing.T) {
+	_, err := NewNameCipher(make([]byte, 16))
+	assert.Error(t, err)
+}
@@ -0,0 +1,519 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/tink-crypto/tink-go/v2/subtle/random"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+The segmented format splits a plaintext into fixed-size segments that are encrypted one by one,
+so objects can be encrypted and decrypted as streams with bounded memory.
+
+A stream starts with a header:
+
+	version (1 byte) | segment size (4 bytes) | stream index (4 bytes) | plaintext length (8 bytes) | salt (16 bytes)
+
+The header is followed by the encrypted segments. Each segment holds segment size bytes of plaintext,
+except for the final segment, which holds the remainder and may be empty.
+Every stream holds at least one segment.
+
+Each stream uses its own key, derived from the DEK and the random salt using HKDF-SHA256.
+Segments are encrypted using AES-256-GCM. The nonce of a segment is its index followed by a flag marking the final segment.
+The header is passed as additional data to every segment, binding segments to their stream and
+making truncation and reordering of segments detectable.
+Since all segments but the final one hold the same amount of plaintext, the segments holding a plaintext range
+can be located using the header alone and decrypted without reading the rest of the stream.
+
+The stream index is 0 for objects written by PutObject and the part number for parts of a multipart upload.
+An object written by PutObject consists of exactly one stream.
+A completed multipart upload is the concatenation of the streams of its parts.
+Since parts are encrypted before it is known which parts the upload will consist of,
+the parts of a completed upload are authenticated by a separate parts tag: an HMAC-SHA256 over the stream indices
+in the order they are stored in, keyed with a key derived from the DEK. The tag is stored with the object,
+and decryption fails if parts were dropped, or if the object was truncated at the end of a part.
+*/
+
+const (
+	// SegmentSize is the plaintext size of a single segment.
+	SegmentSize = 64 * 1024
+	// HeaderSize is the size of the header in front of each stream.
+	HeaderSize = 1 + 4 + 4 + 8 + saltSize
+
+	streamVersion = 1
+	// maxSegmentSize limits the segment size accepted from stream headers, so a modified header can not trigger huge allocations.
+	maxSegmentSize = 16 * 1024 * 1024
+	saltSize       = 16
+	tagSize        = 16
+	nonceSize      = 12
+	streamKeyInfo  = "constellation-s3proxy-stream"
+	partsKeyInfo   = "constellation-s3proxy-parts"
+)
+
+// ErrNoPartsTag is returned when decrypting a completed multipart upload without a parts tag.
+var ErrNoPartsTag = errors.New("object consists of multiple parts, but has no parts tag to authenticate them")
+
+// EncryptedSize returns the size of the ciphertext produced by NewEncryptingReader for a plaintext of the given size.
+func EncryptedSize(plaintextSize int64) int64 {
+	return HeaderSize + segmentCount(plaintextSize, SegmentSize)*tagSize + plaintextSize
+}
+
+// NewEncryptingReader returns a reader that reads a plaintext of exactly plaintextSize bytes from r
+// and returns the encrypted stream in the segmented format.
+// All segments but the current one are never held in memory.
+// The reader fails if r returns more or less than plaintextSize bytes.
+func NewEncryptingReader(r io.Reader, dek []byte, streamIndex uint32, plaintextSize int64) (io.Reader, error) {
+	if plaintextSize < 0 || segmentCount(plaintextSize, SegmentSize) > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid plaintext size: %d", plaintextSize)
+	}
+
+	h := streamHeader{
+		segmentSize:   SegmentSize,
+		streamIndex:   streamIndex,
+		plaintextSize: plaintextSize,
+	}
+	copy(h.salt[:], random.GetRandomBytes(saltSize))
+
+	stream, err := newStreamCipher(dek, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingReader{
+		source:    r,
+		stream:    stream,
+		plaintext: make([]byte, SegmentSize+1),
+		buf:       stream.header,
+	}, nil
+}
+
+// StreamInfo describes a stream in the segmented format.
+type StreamInfo struct {
+	// Index is 0 for objects written by PutObject and the part number for parts of a multipart upload.
+	Index uint32
+	// PlaintextSize is the size of the stream's plaintext.
+	PlaintextSize int64
+
+	header streamHeader
+}
+
+// CiphertextSize returns the size of the stream, including its header.
+func (i StreamInfo) CiphertextSize() int64 {
+	return HeaderSize + segmentCount(i.PlaintextSize, int64(i.header.segmentSize))*tagSize + i.PlaintextSize
+}
+
+// SegmentRange describes the segments of a stream that hold a range of its plaintext.
+type SegmentRange struct {
+	// FirstSegment is the index of the first segment of the range.
+	FirstSegment int64
+	// Start and End are the offsets of the segments' ciphertext relative to the start of the stream. End is exclusive.
+	Start, End int64
+	// Skip is the number of plaintext bytes of the first segment in front of the requested range.
+	Skip int64
+}
+
+// SegmentRange returns the segments holding the plaintext range [offset, offset+length) of the stream.
+// The range has to lie within the stream's plaintext.
+func (i StreamInfo) SegmentRange(offset, length int64) (SegmentRange, error) {
+	if offset < 0 || length < 0 || offset+length > i.PlaintextSize {
+		return SegmentRange{}, fmt.Errorf("range [%d, %d) is out of bounds for a stream of %d bytes", offset, offset+length, i.PlaintextSize)
+	}
+
+	segmentSize := int64(i.header.segmentSize)
+	first := offset / segmentSize
+	last := first
+	if length > 0 {
+		last = (offset + length - 1) / segmentSize
+	}
+	segments := segmentCount(i.PlaintextSize, segmentSize)
+	lastLength := segmentSize
+	if last == segments-1 {
+		lastLength = i.PlaintextSize - last*segmentSize
+	}
+
+	return SegmentRange{
+		FirstSegment: first,
+		Start:        HeaderSize + first*(segmentSize+tagSize),
+		End:          HeaderSize + last*(segmentSize+tagSize) + lastLength + tagSize,
+		Skip:         offset - first*segmentSize,
+	}, nil
+}
+
+// ParseStreamHeader parses the first HeaderSize bytes of a stream in the segmented format.
+func ParseStreamHeader(header []byte) (StreamInfo, error) {
+	h, err := parseStreamHeader(header)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	return StreamInfo{Index: h.streamIndex, PlaintextSize: h.plaintextSize, header: h}, nil
+}
+
+// NewDecryptingReader returns a reader that decrypts one or more concatenated streams in the segmented format read from r.
+// The stream indices of concatenated streams have to be strictly increasing.
+// If r holds a completed multipart upload, reading fails at the end of r unless partsTag matches the streams read.
+func NewDecryptingReader(r io.Reader, dek []byte, partsTag []byte) io.Reader {
+	return &decryptingReader{
+		source:   r,
+		dek:      dek,
+		partsTag: partsTag,
+	}
+}
+
+// PartsTag returns the parts tag of a completed multipart upload whose streams have the given indices.
+func PartsTag(dek []byte, streamIndices []uint32) ([]byte, error) {
+	mac, err := newPartsMAC(dek)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range streamIndices {
+		writePartsMAC(mac, index)
+	}
+	return mac.Sum(nil), nil
+}
+
+// VerifyPartsTag checks that the streams of a completed multipart upload have the given indices.
+func VerifyPartsTag(dek []byte, streamIndices []uint32, partsTag []byte) error {
+	tag, err := PartsTag(dek, streamIndices)
+	if err != nil {
+		return err
+	}
+	return checkPartsTag(tag, partsTag)
+}
+
+// NewSegmentDecryptingReader returns a reader that decrypts consecutive segments of a single stream read from r,
+// starting with the segment firstSegment. The stream's header is not part of r.
+// Reading ends at the end of the stream, or at the end of r if it ends on a segment boundary.
+func NewSegmentDecryptingReader(r io.Reader, dek []byte, stream StreamInfo, firstSegment int64) (io.Reader, error) {
+	c, err := newStreamCipher(dek, stream.header)
+	if err != nil {
+		return nil, err
+	}
+	if firstSegment < 0 || firstSegment >= c.segments {
+		return nil, fmt.Errorf("segment %d is out of bounds for a stream of %d segments", firstSegment, c.segments)
+	}
+
+	return &decryptingReader{
+		source:     r,
+		dek:        dek,
+		stream:     c,
+		segment:    firstSegment,
+		ciphertext: make([]byte, c.segmentSize+tagSize),
+		partial:    true,
+	}, nil
+}
+
+type encryptingReader struct {
+	source    io.Reader
+	stream    *streamCipher
+	plaintext []byte
+	segment   int64
+	buf       []byte
+	done      bool
+	err       error
+}
+
+// Read implements io.Reader.
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.buf, e.err = e.nextSegment()
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// nextSegment reads and encrypts the next segment from the source.
+func (e *encryptingReader) nextSegment() ([]byte, error) {
+	length := e.stream.segmentLength(e.segment)
+	last := e.segment == e.stream.segments-1
+
+	// Try to read one byte more than expected for the final segment to detect oversized plaintexts.
+	want := length
+	if last {
+		want++
+	}
+	n, err := io.ReadFull(e.source, e.plaintext[:want])
+	switch {
+	case err == nil && last:
+		return nil, errors.New("plaintext is longer than announced")
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		if int64(n) != length {
+			return nil, fmt.Errorf("plaintext is shorter than announced: %w", io.ErrUnexpectedEOF)
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	ciphertext := e.stream.seal(e.plaintext[:length], e.segment)
+	e.segment++
+	e.done = last
+	return ciphertext, nil
+}
+
+type decryptingReader struct {
+	source          io.Reader
+	dek             []byte
+	stream          *streamCipher
+	lastStreamIndex int64
+	segment         int64
+	ciphertext      []byte
+	buf             []byte
+	err             error
+	// partial is set if only some segments of a single stream are read.
+	partial bool
+	// partsTag is the expected parts tag of a completed multipart upload.
+	partsTag []byte
+	// parts computes the parts tag of the streams read so far. It is nil unless a completed multipart upload is read.
+	parts hash.Hash
+}
+
+// Read implements io.Reader.
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.buf, d.err = d.nextSegment()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// nextSegment reads and decrypts the next segment from the source.
+// It returns io.EOF once all streams have been read completely.
+func (d *decryptingReader) nextSegment() ([]byte, error) {
+	if d.partial && d.segment == d.stream.segments {
+		return nil, io.EOF
+	}
+	if d.stream == nil || d.segment == d.stream.segments {
+		header := make([]byte, HeaderSize)
+		n, err := io.ReadFull(d.source, header)
+		switch {
+		case errors.Is(err, io.EOF) && d.stream != nil:
+			return nil, d.checkParts()
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return nil, fmt.Errorf("reading stream header: got %d bytes: %w", n, io.ErrUnexpectedEOF)
+		case err != nil:
+			return nil, fmt.Errorf("reading stream header: %w", err)
+		}
+
+		h, err := parseStreamHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if d.stream != nil && d.lastStreamIndex == 0 {
+			return nil, fmt.Errorf("stream %d follows a single stream object", h.streamIndex)
+		}
+		if d.stream != nil && int64(h.streamIndex) <= d.lastStreamIndex {
+			return nil, fmt.Errorf("stream %d follows stream %d", h.streamIndex, d.lastStreamIndex)
+		}
+		if d.stream == nil && h.streamIndex > 0 {
+			if d.parts, err = newPartsMAC(d.dek); err != nil {
+				return nil, err
+			}
+		}
+		if d.parts != nil {
+			writePartsMAC(d.parts, h.streamIndex)
+		}
+		if d.stream, err = newStreamCipher(d.dek, h); err != nil {
+			return nil, err
+		}
+		d.lastStreamIndex = int64(h.streamIndex)
+		d.segment = 0
+		if cap(d.ciphertext) < int(h.segmentSize)+tagSize {
+			d.ciphertext = make([]byte, int(h.segmentSize)+tagSize)
+		}
+	}
+
+	ciphertext := d.ciphertext[:d.stream.segmentLength(d.segment)+tagSize]
+	if _, err := io.ReadFull(d.source, ciphertext); err != nil {
+		if errors.Is(err, io.EOF) && d.partial {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("reading segment %d: %w", d.segment, err)
+	}
+
+	plaintext, err := d.stream.open(ciphertext, d.segment)
+	if err != nil {
+		return nil, err
+	}
+	d.segment++
+	return plaintext, nil
+}
+
+// checkParts is called at the end of the source. It returns io.EOF if all streams were read,
+// or an error if the streams of a completed multipart upload don't match the parts tag.
+func (d *decryptingReader) checkParts() error {
+	if d.parts == nil {
+		return io.EOF
+	}
+	if err := checkPartsTag(d.parts.Sum(nil), d.partsTag); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// newPartsMAC returns the HMAC computing the parts tag of a completed multipart upload encrypted with dek.
+func newPartsMAC(dek []byte) (hash.Hash, error) {
+	key := make([]byte, dekSizeBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dek, nil, []byte(partsKeyInfo)), key); err != nil {
+		return nil, fmt.Errorf("deriving parts key: %w", err)
+	}
+	return hmac.New(sha256.New, key), nil
+}
+
+func writePartsMAC(mac hash.Hash, streamIndex uint32) {
+	_, _ = mac.Write(binary.BigEndian.AppendUint32(nil, streamIndex))
+}
+
+// checkPartsTag compares the parts tag computed from the streams of an object with the expected one.
+func checkPartsTag(tag, expected []byte) error {
+	if len(expected) == 0 {
+		return ErrNoPartsTag
+	}
+	if !hmac.Equal(tag, expected) {
+		return errors.New("streams don't match the parts tag: parts of the object are missing or were reordered")
+	}
+	return nil
+}
+
+// streamHeader is the header in front of each stream.
+type streamHeader struct {
+	segmentSize   uint32
+	streamIndex   uint32
+	plaintextSize int64
+	salt          [saltSize]byte
+}
+
+func (h streamHeader) marshal() []byte {
+	header := make([]byte, HeaderSize)
+	header[0] = streamVersion
+	binary.BigEndian.PutUint32(header[1:5], h.segmentSize)
+	binary.BigEndian.PutUint32(header[5:9], h.streamIndex)
+	binary.BigEndian.PutUint64(header[9:17], uint64(h.plaintextSize))
+	copy(header[17:], h.salt[:])
+	return header
+}
+
+func parseStreamHeader(header []byte) (streamHeader, error) {
+	if len(header) != HeaderSize {
+		return streamHeader{}, fmt.Errorf("invalid stream header size: %d", len(header))
+	}
+	if header[0] != streamVersion {
+		return streamHeader{}, fmt.Errorf("unsupported stream version: %d", header[0])
+	}
+
+	h := streamHeader{
+		segmentSize:   binary.BigEndian.Uint32(header[1:5]),
+		streamIndex:   binary.BigEndian.Uint32(header[5:9]),
+		plaintextSize: int64(binary.BigEndian.Uint64(header[9:17])),
+	}
+	copy(h.salt[:], header[17:])
+
+	if h.segmentSize == 0 || h.segmentSize > maxSegmentSize {
+		return streamHeader{}, fmt.Errorf("invalid segment size: %d", h.segmentSize)
+	}
+	if h.plaintextSize < 0 || segmentCount(h.plaintextSize, int64(h.segmentSize)) > math.MaxUint32 {
+		return streamHeader{}, fmt.Errorf("invalid plaintext size: %d", h.plaintextSize)
+	}
+	return h, nil
+}
+
+// streamCipher encrypts and decrypts the segments of a single stream.
+type streamCipher struct {
+	aead        cipher.AEAD
+	header      []byte
+	segmentSize int64
+	size        int64
+	segments    int64
+}
+
+func newStreamCipher(dek []byte, h streamHeader) (*streamCipher, error) {
+	key := make([]byte, dekSizeBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dek, h.salt[:], []byte(streamKeyInfo)), key); err != nil {
+		return nil, fmt.Errorf("deriving stream key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("getting aes: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("getting aesgcm: %w", err)
+	}
+
+	return &streamCipher{
+		aead:        aead,
+		header:      h.marshal(),
+		segmentSize: int64(h.segmentSize),
+		size:        h.plaintextSize,
+		segments:    segmentCount(h.plaintextSize, int64(h.segmentSize)),
+	}, nil
+}
+
+// segmentLength returns the plaintext length of the segment with the given index.
+func (s *streamCipher) segmentLength(segment int64) int64 {
+	if segment == s.segments-1 {
+		return s.size - segment*s.segmentSize
+	}
+	return s.segmentSize
+}
+
+func (s *streamCipher) seal(plaintext []byte, segment int64) []byte {
+	return s.aead.Seal(nil, s.nonce(segment), plaintext, s.header)
+}
+
+func (s *streamCipher) open(ciphertext []byte, segment int64) ([]byte, error) {
+	plaintext, err := s.aead.Open(nil, s.nonce(segment), ciphertext, s.header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting segment %d: %w", segment, err)
+	}
+	return plaintext, nil
+}
+
+// nonce returns the nonce of a segment: 7 zero bytes, the 4 byte segment index and a flag marking the final segment.
+func (s *streamCipher) nonce(segment int64) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(segment))
+	if segment == s.segments-1 {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// segmentCount returns the number of segments of a stream. Every stream holds at least one segment.
+func segmentCount(plaintextSize, segmentSize int64) int64 {
+	if plaintextSize == 0 {
+		return 1
+	}
+	return (plaintextSize + segmentSize - 1) / segmentSize
+}
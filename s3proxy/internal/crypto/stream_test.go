@@ -0,0 +1,305 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	tests := map[string]struct {
+		size int
+	}{
+		"empty":                      {size: 0},
+		"short":                      {size: 12},
+		"one byte below segment":     {size: SegmentSize - 1},
+		"exactly one segment":        {size: SegmentSize},
+		"one byte above segment":     {size: SegmentSize + 1},
+		"multiple segments":          {size: 3*SegmentSize + 5},
+		"multiple complete segments": {size: 4 * SegmentSize},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			plaintext := make([]byte, tt.size)
+			_, err := rand.Read(plaintext)
+			require.NoError(err)
+			dek := GenerateDEK()
+
+			encrypter, err := NewEncryptingReader(bytes.NewReader(plaintext), dek, 0, int64(len(plaintext)))
+			require.NoError(err)
+			ciphertext, err := io.ReadAll(encrypter)
+			require.NoError(err)
+			assert.EqualValues(EncryptedSize(int64(len(plaintext))), len(ciphertext))
+
+			decrypted, err := io.ReadAll(NewDecryptingReader(bytes.NewReader(ciphertext), dek, nil))
+			require.NoError(err)
+			assert.True(bytes.Equal(plaintext, decrypted))
+		})
+	}
+}
+
+func TestStreamConcatenated(t *testing.T) {
+	dek := GenerateDEK()
+	parts := [][]byte{
+		bytes.Repeat([]byte("a"), SegmentSize+3),
+		{},
+		[]byte("hello, world"),
+	}
+	encrypt := func(t *testing.T, streamIndex uint32, plaintext []byte) []byte {
+		t.Helper()
+		encrypter, err := NewEncryptingReader(bytes.NewReader(plaintext), dek, streamIndex, int64(len(plaintext)))
+		require.NoError(t, err)
+		ciphertext, err := io.ReadAll(encrypter)
+		require.NoError(t, err)
+		return ciphertext
+	}
+
+	var streams [][]byte
+	var plaintext []byte
+	var indices []uint32
+	for i, part := range parts {
+		indices = append(indices, uint32(2*i+1))
+		streams = append(streams, encrypt(t, indices[i], part))
+		plaintext = append(plaintext, part...)
+	}
+	partsTag, err := PartsTag(dek, indices)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		streams     [][]byte
+		partsTag    []byte
+		wantSuccess bool
+		wantErr     error
+	}{
+		"ascending stream indices": {
+			streams:     streams,
+			partsTag:    partsTag,
+			wantSuccess: true,
+		},
+		"missing parts tag": {
+			streams: streams,
+			wantErr: ErrNoPartsTag,
+		},
+		"parts tag of another object": {
+			streams: streams,
+			partsTag: func() []byte {
+				tag, err := PartsTag(GenerateDEK(), indices)
+				require.NoError(t, err)
+				return tag
+			}(),
+		},
+		"truncated after a part": {
+			streams:  streams[:2],
+			partsTag: partsTag,
+		},
+		"first part dropped": {
+			streams:  streams[1:],
+			partsTag: partsTag,
+		},
+		"part in the middle dropped": {
+			streams:  [][]byte{streams[0], streams[2]},
+			partsTag: partsTag,
+		},
+		"reordered streams": {
+			streams:  [][]byte{streams[1], streams[0], streams[2]},
+			partsTag: partsTag,
+		},
+		"single stream object followed by another stream": {
+			streams: [][]byte{encrypt(t, 0, parts[2]), streams[0]},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			decrypted, err := io.ReadAll(NewDecryptingReader(bytes.NewReader(bytes.Join(tc.streams, nil)), dek, tc.partsTag))
+			switch {
+			case tc.wantSuccess:
+				assert.NoError(err)
+				assert.Equal(plaintext, decrypted)
+			case tc.wantErr != nil:
+				assert.ErrorIs(err, tc.wantErr)
+			default:
+				assert.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifyPartsTag(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dek := GenerateDEK()
+	partsTag, err := PartsTag(dek, []uint32{1, 2, 3})
+	require.NoError(err)
+
+	assert.NoError(VerifyPartsTag(dek, []uint32{1, 2, 3}, partsTag))
+	assert.Error(VerifyPartsTag(dek, []uint32{1, 2}, partsTag))
+	assert.Error(VerifyPartsTag(dek, []uint32{1, 3}, partsTag))
+	assert.Error(VerifyPartsTag(GenerateDEK(), []uint32{1, 2, 3}, partsTag))
+	assert.ErrorIs(VerifyPartsTag(dek, []uint32{1, 2, 3}, nil), ErrNoPartsTag)
+}
+
+func TestStreamTampering(t *testing.T) {
+	dek := GenerateDEK()
+	plaintext := bytes.Repeat([]byte("a"), 2*SegmentSize+10)
+	encrypter, err := NewEncryptingReader(bytes.NewReader(plaintext), dek, 0, int64(len(plaintext)))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypter)
+	require.NoError(t, err)
+	segment := SegmentSize + tagSize
+
+	tests := map[string]struct {
+		tamper func([]byte) []byte
+		dek    []byte
+	}{
+		"wrong key": {
+			tamper: func(b []byte) []byte { return b },
+			dek:    GenerateDEK(),
+		},
+		"modified header": {
+			tamper: func(b []byte) []byte {
+				b[10] ^= 0x1
+				return b
+			},
+		},
+		"modified segment": {
+			tamper: func(b []byte) []byte {
+				b[HeaderSize+segment+5] ^= 0x1
+				return b
+			},
+		},
+		"truncated at segment boundary": {
+			tamper: func(b []byte) []byte { return b[:HeaderSize+2*segment] },
+		},
+		"truncated within segment": {
+			tamper: func(b []byte) []byte { return b[:len(b)-1] },
+		},
+		"swapped segments": {
+			tamper: func(b []byte) []byte {
+				first := bytes.Clone(b[HeaderSize : HeaderSize+segment])
+				copy(b[HeaderSize:], b[HeaderSize+segment:HeaderSize+2*segment])
+				copy(b[HeaderSize+segment:], first)
+				return b
+			},
+		},
+		"appended data": {
+			tamper: func(b []byte) []byte { return append(b, 0x1) },
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dek := dek
+			if tt.dek != nil {
+				dek = tt.dek
+			}
+
+			_, err := io.ReadAll(NewDecryptingReader(bytes.NewReader(tt.tamper(bytes.Clone(ciphertext))), dek, nil))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStreamPlaintextSizeMismatch(t *testing.T) {
+	dek := GenerateDEK()
+	plaintext := bytes.Repeat([]byte("a"), SegmentSize+10)
+
+	encrypter, err := NewEncryptingReader(bytes.NewReader(plaintext), dek, 0, int64(len(plaintext))-1)
+	require.NoError(t, err)
+	_, err = io.ReadAll(encrypter)
+	assert.Error(t, err)
+
+	encrypter, err = NewEncryptingReader(bytes.NewReader(plaintext), dek, 0, int64(len(plaintext))+1)
+	require.NoError(t, err)
+	_, err = io.ReadAll(encrypter)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStreamSegmentRange(t *testing.T) {
+	size := 3*SegmentSize + 5
+	plaintext := make([]byte, size)
+	_, err := rand.Read(plaintext)
+	require.NoError(t, err)
+	dek := GenerateDEK()
+
+	encrypter, err := NewEncryptingReader(bytes.NewReader(plaintext), dek, 0, int64(size))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypter)
+	require.NoError(t, err)
+
+	stream, err := ParseStreamHeader(ciphertext[:HeaderSize])
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(ciphertext)), stream.CiphertextSize())
+
+	tests := map[string]struct {
+		offset, length int64
+		wantErr        bool
+	}{
+		"first byte":              {offset: 0, length: 1},
+		"within segment":          {offset: 10, length: 100},
+		"across segments":         {offset: SegmentSize - 10, length: 20},
+		"whole segment":           {offset: SegmentSize, length: SegmentSize},
+		"final segment":           {offset: 3 * SegmentSize, length: 5},
+		"last byte":               {offset: int64(size) - 1, length: 1},
+		"whole stream":            {offset: 0, length: int64(size)},
+		"empty range":             {offset: 12, length: 0},
+		"past the end":            {offset: int64(size) - 1, length: 2, wantErr: true},
+		"negative offset":         {offset: -1, length: 2, wantErr: true},
+		"offset beyond plaintext": {offset: int64(size) + 1, length: 0, wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			segments, err := stream.SegmentRange(tt.offset, tt.length)
+			if tt.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			decrypter, err := NewSegmentDecryptingReader(bytes.NewReader(ciphertext[segments.Start:segments.End]), dek, stream, segments.FirstSegment)
+			require.NoError(err)
+			decrypted, err := io.ReadAll(decrypter)
+			require.NoError(err)
+			require.GreaterOrEqual(int64(len(decrypted)), segments.Skip+tt.length)
+			assert.Equal(plaintext[tt.offset:tt.offset+tt.length], decrypted[segments.Skip:segments.Skip+tt.length])
+		})
+	}
+
+	t.Run("segments are bound to their position", func(t *testing.T) {
+		segments, err := stream.SegmentRange(SegmentSize, 1)
+		require.NoError(t, err)
+		decrypter, err := NewSegmentDecryptingReader(bytes.NewReader(ciphertext[segments.Start:segments.End]), dek, stream, segments.FirstSegment+1)
+		require.NoError(t, err)
+		_, err = io.ReadAll(decrypter)
+		assert.Error(t, err)
+	})
+
+	t.Run("truncated segment", func(t *testing.T) {
+		segments, err := stream.SegmentRange(0, 1)
+		require.NoError(t, err)
+		decrypter, err := NewSegmentDecryptingReader(bytes.NewReader(ciphertext[segments.Start:segments.End-1]), dek, stream, segments.FirstSegment)
+		require.NoError(t, err)
+		_, err = io.ReadAll(decrypter)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
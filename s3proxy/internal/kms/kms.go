@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"log/slog"
 
+	"github.com/edgelesssys/constellation/v2/internal/grpc/serviceaccount"
 	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -42,7 +43,11 @@ func (c Client) GetDataKey(ctx context.Context, keyID string, length int) ([]byt
 	// the KMS does not use aTLS since traffic is only routed through the Constellation cluster
 	// cluster internal connections are considered trustworthy
 	log.Info("Connecting to KMS")
-	conn, err := grpc.NewClient(c.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(c.endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// the keyservice authorizes callers by their service account
+		grpc.WithPerRPCCredentials(serviceaccount.NewTokenCredentials(serviceaccount.KeyServiceTokenPath)),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,389 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+)
+
+// copySourceRangePattern matches the only form of x-amz-copy-source-range accepted by S3.
+var copySourceRangePattern = regexp.MustCompile(`^bytes=\d+-\d+$`)
+
+// encryptionTags are the metadata keys that describe how an object is encrypted.
+var encryptionTags = []string{dekTag, formatTag, kekIDTag, kekVersionTag, partsTag}
+
+// copySource is the object a CopyObject or UploadPartCopy request copies from.
+type copySource struct {
+	bucket    string
+	key       string
+	versionID string
+}
+
+// parseCopySource parses the value of the x-amz-copy-source header, e.g., "/bucket/key?versionId=1".
+// Access point ARNs are not supported.
+func parseCopySource(raw string) (copySource, error) {
+	rawPath, rawQuery, _ := strings.Cut(raw, "?")
+	sourcePath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return copySource{}, fmt.Errorf("decoding copy source %q: %w", raw, err)
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(sourcePath, "/"), "/")
+	if !ok || bucket == "" || key == "" || strings.HasPrefix(bucket, "arn:") {
+		return copySource{}, fmt.Errorf("invalid copy source %q", raw)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return copySource{}, fmt.Errorf("parsing copy source %q: %w", raw, err)
+	}
+	return copySource{bucket: bucket, key: key, versionID: query.Get("versionId")}, nil
+}
+
+// objectCopy bundles data to implement CopyObject and UploadPartCopy for destinations encrypted by s3proxy.
+type objectCopy struct {
+	// source is the object to copy from. It holds the KEKs the policy assigns to the source location.
+	source object
+	// sourceEncrypted is true if the policy encrypts the source location.
+	sourceEncrypted bool
+	// keks are the KEKs the policy assigns to the destination.
+	keks                 keyEncryptionKeys
+	client               s3Client
+	key                  string
+	bucket               string
+	uploadID             string
+	partNumber           int32
+	sourceRange          string
+	replaceMetadata      bool
+	metadata             map[string]string
+	contentType          string
+	cacheControl         string
+	contentDisposition   string
+	contentEncoding      string
+	contentLanguage      string
+	tags                 string
+	storageClass         string
+	sseCustomerAlgorithm string
+	sseCustomerKey       string
+	sseCustomerKeyMD5    string
+	log                  *slog.Logger
+}
+
+// copyObject is a http.HandlerFunc that implements CopyObject.
+// Encrypted objects are copied by S3. Only their DEK is re-wrapped with the KEK of the destination,
+// since the ciphertext does not depend on the object's location.
+// Unencrypted objects are fetched and encrypted by s3proxy.
+func (c objectCopy) copyObject(w http.ResponseWriter, r *http.Request) {
+	c.log.With(slog.String("key", c.key), slog.String("bucket", c.bucket), slog.String("sourceKey", c.source.key), slog.String("sourceBucket", c.source.bucket)).Debug("copyObject")
+
+	head, ok := c.headSource(w, r)
+	if !ok {
+		return
+	}
+	if _, encrypted := head.Metadata[dekTag]; !encrypted {
+		c.encryptCopy(w, r, head)
+		return
+	}
+	if !c.sourceEncrypted {
+		writeCopyNotImplemented(w, c.log)
+		return
+	}
+
+	metadata, err := rewrapDEK(c.source.keks, c.keks, c.destinationMetadata(head))
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("CopyObject re-wrapping DEK")
+		writeDecryptError(w, r, err)
+		return
+	}
+
+	source := c.source.withVersion(head)
+	output, err := c.client.CopyObject(r.Context(), source.bucket, source.key, source.versionID(), c.bucket, c.key, c.tags, c.destinationHead(head), metadata)
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("CopyObject sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+
+	if output.VersionId != nil {
+		w.Header().Set("x-amz-version-id", *output.VersionId)
+	}
+	if output.CopySourceVersionId != nil {
+		w.Header().Set("x-amz-copy-source-version-id", *output.CopySourceVersionId)
+	}
+	result := copyObjectResult{LastModified: time.Now().UTC()}
+	if output.CopyObjectResult != nil {
+		if output.CopyObjectResult.ETag != nil {
+			result.ETag = *output.CopyObjectResult.ETag
+		}
+		if output.CopyObjectResult.LastModified != nil {
+			result.LastModified = *output.CopyObjectResult.LastModified
+		}
+	}
+	writeXML(w, result, c.log)
+}
+
+// encryptCopy copies an object that is not encrypted by s3proxy by fetching it and uploading it encrypted.
+// Tags of the source object are not copied.
+func (c objectCopy) encryptCopy(w http.ResponseWriter, r *http.Request, head *s3.HeadObjectOutput) {
+	body, size, err := c.source.withVersion(head).openPlaintext(r.Context(), "")
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("CopyObject fetching source object")
+		writeS3Error(w, err)
+		return
+	}
+	defer body.Close()
+
+	metadata := maps.Clone(c.metadata)
+	contentType := c.contentType
+	if !c.replaceMetadata {
+		metadata = maps.Clone(head.Metadata)
+		contentType = ""
+		if head.ContentType != nil {
+			contentType = *head.ContentType
+		}
+	}
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	for _, tag := range encryptionTags {
+		delete(metadata, tag)
+	}
+
+	destination := object{
+		keks:                 c.keks,
+		client:               c.client,
+		key:                  c.key,
+		bucket:               c.bucket,
+		body:                 body,
+		contentLength:        size,
+		tags:                 c.tags,
+		contentType:          contentType,
+		metadata:             metadata,
+		sseCustomerAlgorithm: c.sseCustomerAlgorithm,
+		sseCustomerKey:       c.sseCustomerKey,
+		sseCustomerKeyMD5:    c.sseCustomerKeyMD5,
+		log:                  c.log,
+	}
+	output, err := destination.upload(r.Context())
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("CopyObject uploading encrypted copy")
+		writeS3Error(w, err)
+		return
+	}
+
+	if output.VersionId != nil {
+		w.Header().Set("x-amz-version-id", *output.VersionId)
+	}
+	result := copyObjectResult{LastModified: time.Now().UTC()}
+	if output.ETag != nil {
+		result.ETag = *output.ETag
+	}
+	writeXML(w, result, c.log)
+}
+
+// uploadPartCopy is a http.HandlerFunc that implements UploadPartCopy.
+// The part can not be copied by S3, since it has to be encrypted with the DEK of the upload.
+// Instead, s3proxy decrypts the requested range of the source object and uploads it as a new part.
+func (c objectCopy) uploadPartCopy(w http.ResponseWriter, r *http.Request) {
+	c.log.With(slog.String("key", c.key), slog.String("bucket", c.bucket), slog.Int("partNumber", int(c.partNumber))).Debug("uploadPartCopy")
+
+	if c.partNumber < 1 {
+		c.log.With(slog.Int("partNumber", int(c.partNumber))).Error("UploadPartCopy invalid part number")
+		http.Error(w, fmt.Sprintf("invalid part number: %d", c.partNumber), http.StatusBadRequest)
+		return
+	}
+	if c.sourceRange != "" && !copySourceRangePattern.MatchString(c.sourceRange) {
+		c.log.With(slog.String("range", c.sourceRange)).Error("UploadPartCopy invalid copy source range")
+		http.Error(w, fmt.Sprintf("invalid x-amz-copy-source-range: %s", c.sourceRange), http.StatusBadRequest)
+		return
+	}
+
+	head, ok := c.headSource(w, r)
+	if !ok {
+		return
+	}
+	if _, encrypted := head.Metadata[dekTag]; encrypted && !c.sourceEncrypted {
+		writeCopyNotImplemented(w, c.log)
+		return
+	}
+
+	upload := multipartUpload{keks: c.keks, client: c.client, key: c.key, bucket: c.bucket, uploadID: c.uploadID, log: c.log}
+	dek, err := upload.dek(r)
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("UploadPartCopy fetching upload DEK")
+		writeS3Error(w, err)
+		return
+	}
+
+	plaintext, length, err := c.source.withVersion(head).openPlaintext(r.Context(), c.sourceRange)
+	switch {
+	case errors.Is(err, errInvalidRange):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errRangeNotSatisfiable):
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case errors.Is(err, errKEKNotAllowed):
+		writeDecryptError(w, r, err)
+		return
+	case err != nil:
+		c.log.With(slog.Any("error", err)).Error("UploadPartCopy fetching source object")
+		writeS3Error(w, err)
+		return
+	}
+	defer plaintext.Close()
+
+	ciphertext, err := crypto.NewEncryptingReader(plaintext, dek, uint32(c.partNumber), length)
+	if err != nil {
+		recordCryptoFailure(r.Context(), cryptoEncrypt)
+		c.log.With(slog.Any("error", err)).Error("UploadPartCopy")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	output, err := c.client.UploadPart(r.Context(), c.bucket, c.key, c.uploadID, c.partNumber, c.sseCustomerAlgorithm, c.sseCustomerKey, c.sseCustomerKeyMD5, ciphertext, crypto.EncryptedSize(length))
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("UploadPartCopy sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+
+	result := copyPartResult{LastModified: time.Now().UTC()}
+	if output.ETag != nil {
+		result.ETag = *output.ETag
+	}
+	writeXML(w, result, c.log)
+}
+
+// headSource fetches the metadata of the source object and checks the client's copy conditions.
+// If this fails, an error is written to the response and false is returned.
+func (c objectCopy) headSource(w http.ResponseWriter, r *http.Request) (*s3.HeadObjectOutput, bool) {
+	head, err := c.client.HeadObject(r.Context(), c.source.bucket, c.source.key, c.source.versionID(), c.source.sseCustomerAlgorithm, c.source.sseCustomerKey, c.source.sseCustomerKeyMD5)
+	if err != nil {
+		c.log.With(slog.Any("error", err)).Error("fetching copy source metadata")
+		writeS3Error(w, err)
+		return nil, false
+	}
+	if err := checkCopyConditions(r.Header, head); err != nil {
+		c.log.With(slog.Any("error", err)).Debug("copy precondition failed")
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return nil, false
+	}
+	return head, true
+}
+
+// destinationMetadata returns the user metadata of a copy of an encrypted object.
+// The encryption metadata of the source object is always kept, since the copy shares its ciphertext.
+func (c objectCopy) destinationMetadata(head *s3.HeadObjectOutput) map[string]string {
+	if !c.replaceMetadata {
+		return head.Metadata
+	}
+
+	metadata := make(map[string]string, len(c.metadata)+len(encryptionTags))
+	for key, value := range c.metadata {
+		metadata[key] = value
+	}
+	for _, tag := range encryptionTags {
+		delete(metadata, tag)
+		if value, ok := head.Metadata[tag]; ok {
+			metadata[tag] = value
+		}
+	}
+	return metadata
+}
+
+// destinationHead returns the content headers and storage class of the copy, based on those of the source object.
+func (c objectCopy) destinationHead(head *s3.HeadObjectOutput) *s3.HeadObjectOutput {
+	target := *head
+	if c.replaceMetadata {
+		target.ContentType = optionalString(c.contentType)
+		target.CacheControl = optionalString(c.cacheControl)
+		target.ContentDisposition = optionalString(c.contentDisposition)
+		target.ContentEncoding = optionalString(c.contentEncoding)
+		target.ContentLanguage = optionalString(c.contentLanguage)
+	}
+	if c.storageClass != "" {
+		target.StorageClass = types.StorageClass(c.storageClass)
+	}
+	return &target
+}
+
+// withVersion returns the object pinned to the version described by head,
+// so that the data copied is the data whose metadata was checked.
+func (o object) withVersion(head *s3.HeadObjectOutput) object {
+	if head.VersionId != nil && o.versionID() == "" {
+		o.query = cloneQuery(o.query)
+		o.query.Set("versionId", *head.VersionId)
+	}
+	return o
+}
+
+// checkCopyConditions evaluates the x-amz-copy-source-if-* headers against the source object, like S3 does.
+func checkCopyConditions(header http.Header, head *s3.HeadObjectOutput) error {
+	var etag string
+	if head.ETag != nil {
+		etag = strings.Trim(*head.ETag, `"`)
+	}
+	var lastModified time.Time
+	if head.LastModified != nil {
+		lastModified = *head.LastModified
+	}
+
+	if ifMatch := header.Get("x-amz-copy-source-if-match"); ifMatch != "" {
+		if strings.Trim(ifMatch, `"`) != etag {
+			return errors.New("x-amz-copy-source-if-match does not match the source object")
+		}
+	} else if since, err := http.ParseTime(header.Get("x-amz-copy-source-if-unmodified-since")); err == nil && lastModified.After(since) {
+		return errors.New("source object was modified since x-amz-copy-source-if-unmodified-since")
+	}
+
+	if ifNoneMatch := header.Get("x-amz-copy-source-if-none-match"); ifNoneMatch != "" {
+		if strings.Trim(ifNoneMatch, `"`) == etag {
+			return errors.New("x-amz-copy-source-if-none-match matches the source object")
+		}
+	} else if since, err := http.ParseTime(header.Get("x-amz-copy-source-if-modified-since")); err == nil && !lastModified.After(since) {
+		return errors.New("source object was not modified since x-amz-copy-source-if-modified-since")
+	}
+	return nil
+}
+
+// writeCopyNotImplemented rejects copies of objects that s3proxy would have to decrypt for an unencrypted destination.
+func writeCopyNotImplemented(w http.ResponseWriter, log *slog.Logger) {
+	log.Error("copying objects encrypted by s3proxy to or from unencrypted locations is not supported")
+	http.Error(w, "copying objects encrypted by s3proxy to or from unencrypted locations is not supported, download and upload the object instead", http.StatusNotImplemented)
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// copyObjectResult is the response body of CopyObject.
+type copyObjectResult struct {
+	XMLName      xml.Name  `xml:"CopyObjectResult"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// copyPartResult is the response body of UploadPartCopy.
+type copyPartResult struct {
+	XMLName      xml.Name  `xml:"CopyPartResult"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
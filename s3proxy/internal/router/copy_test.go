@@ -0,0 +1,320 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCopySource(t *testing.T) {
+	testCases := map[string]struct {
+		raw     string
+		want    copySource
+		wantErr bool
+	}{
+		"bucket and key": {
+			raw:  "bucket/key",
+			want: copySource{bucket: "bucket", key: "key"},
+		},
+		"leading slash": {
+			raw:  "/bucket/dir/key",
+			want: copySource{bucket: "bucket", key: "dir/key"},
+		},
+		"escaped key": {
+			raw:  "/bucket/dir/my%20key%3F",
+			want: copySource{bucket: "bucket", key: "dir/my key?"},
+		},
+		"version": {
+			raw:  "/bucket/key?versionId=abc",
+			want: copySource{bucket: "bucket", key: "key", versionID: "abc"},
+		},
+		"missing key":       {raw: "/bucket", wantErr: true},
+		"empty key":         {raw: "/bucket/", wantErr: true},
+		"access point":      {raw: "arn:aws:s3:us-west-2:123456789012:accesspoint/ap/object/key", wantErr: true},
+		"invalid escaping":  {raw: "/bucket/%zz", wantErr: true},
+		"empty copy source": {raw: "", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			source, err := parseCopySource(tc.raw)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, source)
+		})
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	keksA := newTestKEKs([32]byte{0x1})
+	keksB := keyEncryptionKeys{id: "team-b", current: 1, versions: map[uint32][32]byte{1: {0x2}}}
+	data := "hello, world"
+
+	putEncrypted := func(t *testing.T, client *stubS3Client) {
+		obj := object{keks: keksA, client: client, key: "src", bucket: "a", body: strings.NewReader(data), contentLength: int64(len(data)), metadata: map[string]string{"foo": "bar"}, log: logger.NewTest(t)}
+		resp := httptest.NewRecorder()
+		obj.put(resp, httptest.NewRequest(http.MethodPut, "/a/src", nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+	}
+	putUnencrypted := func(_ *testing.T, client *stubS3Client) {
+		client.objects["src"] = stubObject{body: []byte(data), metadata: map[string]string{"foo": "bar"}}
+	}
+
+	testCases := map[string]struct {
+		createSource    func(t *testing.T, client *stubS3Client)
+		sourceKEKs      keyEncryptionKeys
+		sourceEncrypted bool
+		keks            keyEncryptionKeys
+		replaceMetadata bool
+		wantStatus      int
+		wantMetadata    map[string]string
+	}{
+		"same KEK": {
+			createSource:    putEncrypted,
+			sourceKEKs:      keksA,
+			sourceEncrypted: true,
+			keks:            keksA,
+			wantStatus:      http.StatusOK,
+			wantMetadata:    map[string]string{"foo": "bar"},
+		},
+		"different KEK": {
+			createSource:    putEncrypted,
+			sourceKEKs:      keksA,
+			sourceEncrypted: true,
+			keks:            keksB,
+			wantStatus:      http.StatusOK,
+			wantMetadata:    map[string]string{"foo": "bar"},
+		},
+		"replace metadata": {
+			createSource:    putEncrypted,
+			sourceKEKs:      keksA,
+			sourceEncrypted: true,
+			keks:            keksB,
+			replaceMetadata: true,
+			wantStatus:      http.StatusOK,
+			wantMetadata:    map[string]string{"new": "value"},
+		},
+		"unencrypted source is encrypted": {
+			createSource: putUnencrypted,
+			keks:         keksA,
+			wantStatus:   http.StatusOK,
+			wantMetadata: map[string]string{"foo": "bar"},
+		},
+		"source encrypted with KEK not allowed by policy": {
+			createSource:    putEncrypted,
+			sourceKEKs:      keksB,
+			sourceEncrypted: true,
+			keks:            keksB,
+			wantStatus:      http.StatusForbidden,
+		},
+		"encrypted source in unencrypted location": {
+			createSource: putEncrypted,
+			keks:         keksA,
+			wantStatus:   http.StatusNotImplemented,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := newStubS3Client()
+			tc.createSource(t, client)
+
+			objectCopy := objectCopy{
+				source:          object{keks: tc.sourceKEKs, client: client, key: "src", bucket: "a", query: url.Values{}, log: logger.NewTest(t)},
+				sourceEncrypted: tc.sourceEncrypted,
+				keks:            tc.keks,
+				client:          client,
+				key:             "dst",
+				bucket:          "b",
+				replaceMetadata: tc.replaceMetadata,
+				metadata:        map[string]string{"new": "value", dekTag: "invalid"},
+				log:             logger.NewTest(t),
+			}
+			resp := httptest.NewRecorder()
+			objectCopy.copyObject(resp, httptest.NewRequest(http.MethodPut, "/b/dst", nil))
+			require.Equal(tc.wantStatus, resp.Code, resp.Body.String())
+			if tc.wantStatus != http.StatusOK {
+				assert.NotContains(client.objects, "dst")
+				return
+			}
+			assert.Contains(resp.Body.String(), "<CopyObjectResult>")
+
+			copied := client.objects["dst"]
+			assert.NotContains(string(copied.body), data)
+			assert.Equal(tc.keks.id, copied.metadata[kekIDTag])
+			for key, value := range tc.wantMetadata {
+				assert.Equal(value, copied.metadata[key])
+			}
+
+			obj := object{keks: tc.keks, client: client, key: "dst", bucket: "b", log: logger.NewTest(t)}
+			resp = httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/b/dst", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Equal(data, resp.Body.String())
+		})
+	}
+}
+
+func TestUploadPartCopy(t *testing.T) {
+	kek := newTestKEKs([32]byte{0x1})
+	plaintext := make([]byte, 3*crypto.SegmentSize+100)
+	_, err := rand.Read(plaintext)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		sourceRanges []string
+		wantStatus   int
+		want         []byte
+	}{
+		"whole object": {
+			sourceRanges: []string{""},
+			wantStatus:   http.StatusOK,
+			want:         plaintext,
+		},
+		"ranges across segments": {
+			sourceRanges: []string{
+				fmt.Sprintf("bytes=0-%d", crypto.SegmentSize+9),
+				fmt.Sprintf("bytes=%d-%d", crypto.SegmentSize+10, len(plaintext)-1),
+			},
+			wantStatus: http.StatusOK,
+			want:       plaintext,
+		},
+		"single byte": {
+			sourceRanges: []string{"bytes=5-5"},
+			wantStatus:   http.StatusOK,
+			want:         plaintext[5:6],
+		},
+		"open range": {
+			sourceRanges: []string{"bytes=5-"},
+			wantStatus:   http.StatusBadRequest,
+		},
+		"unsatisfiable range": {
+			sourceRanges: []string{fmt.Sprintf("bytes=%d-%d", len(plaintext), len(plaintext)+10)},
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := newStubS3Client()
+			log := logger.NewTest(t)
+			source := object{keks: kek, client: client, key: "src", bucket: "bucket", body: bytes.NewReader(plaintext), contentLength: int64(len(plaintext)), metadata: map[string]string{}, log: log}
+			resp := httptest.NewRecorder()
+			source.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/src", nil))
+			require.Equal(http.StatusOK, resp.Code)
+
+			upload := multipartUpload{keks: kek, client: client, key: "dst", bucket: "bucket", metadata: map[string]string{}, log: log}
+			resp = httptest.NewRecorder()
+			upload.create(resp, httptest.NewRequest(http.MethodPost, "/bucket/dst?uploads", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			for id := range client.uploads {
+				upload.uploadID = id
+			}
+
+			var completeBody strings.Builder
+			completeBody.WriteString("<CompleteMultipartUpload>")
+			for i, sourceRange := range tc.sourceRanges {
+				partNumber := int32(i + 1)
+				objectCopy := objectCopy{
+					source:          object{keks: kek, client: client, key: "src", bucket: "bucket", query: url.Values{}, log: log},
+					sourceEncrypted: true,
+					keks:            kek,
+					client:          client,
+					key:             "dst",
+					bucket:          "bucket",
+					uploadID:        upload.uploadID,
+					partNumber:      partNumber,
+					sourceRange:     sourceRange,
+					log:             log,
+				}
+				resp := httptest.NewRecorder()
+				objectCopy.uploadPartCopy(resp, httptest.NewRequest(http.MethodPut, "/bucket/dst", nil))
+				require.Equal(tc.wantStatus, resp.Code, resp.Body.String())
+				if tc.wantStatus != http.StatusOK {
+					return
+				}
+				assert.Contains(resp.Body.String(), "<CopyPartResult>")
+				fmt.Fprintf(&completeBody, "<Part><ETag>etag</ETag><PartNumber>%d</PartNumber></Part>", partNumber)
+			}
+			completeBody.WriteString("</CompleteMultipartUpload>")
+
+			resp = httptest.NewRecorder()
+			upload.complete(resp, httptest.NewRequest(http.MethodPost, "/bucket/dst", strings.NewReader(completeBody.String())))
+			require.Equal(http.StatusOK, resp.Code)
+
+			obj := object{keks: kek, client: client, key: "dst", bucket: "bucket", log: log}
+			resp = httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/dst", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.True(bytes.Equal(tc.want, resp.Body.Bytes()))
+		})
+	}
+}
+
+func TestCheckCopyConditions(t *testing.T) {
+	etag := `"abc"`
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	head := &s3.HeadObjectOutput{ETag: &etag, LastModified: &lastModified}
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).Format(http.TimeFormat)
+
+	testCases := map[string]struct {
+		header  map[string]string
+		wantErr bool
+	}{
+		"no conditions":                 {},
+		"if-match":                      {header: map[string]string{"x-amz-copy-source-if-match": `"abc"`}},
+		"if-match mismatch":             {header: map[string]string{"x-amz-copy-source-if-match": "def"}, wantErr: true},
+		"if-none-match":                 {header: map[string]string{"x-amz-copy-source-if-none-match": "def"}},
+		"if-none-match matches":         {header: map[string]string{"x-amz-copy-source-if-none-match": "abc"}, wantErr: true},
+		"if-unmodified-since":           {header: map[string]string{"x-amz-copy-source-if-unmodified-since": after}},
+		"if-unmodified-since modified":  {header: map[string]string{"x-amz-copy-source-if-unmodified-since": before}, wantErr: true},
+		"if-modified-since":             {header: map[string]string{"x-amz-copy-source-if-modified-since": before}},
+		"if-modified-since unmodified":  {header: map[string]string{"x-amz-copy-source-if-modified-since": after}, wantErr: true},
+		"if-match overrides unmodified": {header: map[string]string{"x-amz-copy-source-if-match": "abc", "x-amz-copy-source-if-unmodified-since": before}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range tc.header {
+				header.Set(key, value)
+			}
+
+			err := checkCopyConditions(header, head)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/file"
+)
+
+// Credentials are the access keys s3proxy issues to clients.
+// If configured, s3proxy verifies the SigV4 signature of each request against these keys
+// and signs the requests it sends to S3 with its own credentials, so clients never hold the credentials of the S3 API.
+type Credentials struct {
+	Keys []AccessKey `yaml:"keys"`
+}
+
+// AccessKey is an access key s3proxy issues to a client.
+type AccessKey struct {
+	// Name identifies the client the key is issued to.
+	Name string `yaml:"name"`
+	// AccessKeyID is the ID clients use in the credential scope of their signatures.
+	AccessKeyID string `yaml:"accessKeyID"`
+	// SecretAccessKey is the secret clients sign requests with.
+	SecretAccessKey string `yaml:"secretAccessKey"`
+}
+
+// Validate checks the credentials for errors.
+func (c Credentials) Validate() error {
+	var errs []error
+	ids := make(map[string]struct{}, len(c.Keys))
+	for i, key := range c.Keys {
+		switch {
+		case key.AccessKeyID == "":
+			errs = append(errs, fmt.Errorf("key %d: accessKeyID is required", i))
+		case strings.Contains(key.AccessKeyID, "/"):
+			errs = append(errs, fmt.Errorf("key %d: accessKeyID must not contain %q", i, "/"))
+		}
+		if key.SecretAccessKey == "" {
+			errs = append(errs, fmt.Errorf("key %d: secretAccessKey is required", i))
+		}
+		if _, ok := ids[key.AccessKeyID]; ok {
+			errs = append(errs, fmt.Errorf("key %d: duplicate accessKeyID %q", i, key.AccessKeyID))
+		}
+		ids[key.AccessKeyID] = struct{}{}
+	}
+	return errors.Join(errs...)
+}
+
+// lookup returns the access key with the given ID. It returns false if there is none.
+func (c Credentials) lookup(accessKeyID string) (AccessKey, bool) {
+	for _, key := range c.Keys {
+		if key.AccessKeyID == accessKeyID {
+			return key, true
+		}
+	}
+	return AccessKey{}, false
+}
+
+// credentialStore looks up the access keys clients sign requests with.
+type credentialStore interface {
+	lookup(accessKeyID string) (AccessKey, bool)
+}
+
+// CredentialFile holds the credentials read from a YAML file.
+// The file is read again when it is modified, so keys can be issued and revoked without restarting s3proxy.
+type CredentialFile struct {
+	fileHandler file.Handler
+	path        string
+	log         *slog.Logger
+
+	mux         sync.Mutex
+	modTime     time.Time
+	credentials Credentials
+	// err is set if the file could not be read the last time it was modified.
+	err error
+}
+
+// NewCredentialFile reads the credentials from the file at the given path.
+func NewCredentialFile(fileHandler file.Handler, path string, log *slog.Logger) (*CredentialFile, error) {
+	f := &CredentialFile{fileHandler: fileHandler, path: path, log: log}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// lookup returns the access key with the given ID, reading the file again if it was modified.
+// If the modified file can't be read, no key is returned until the file is fixed, so revoked keys can't be used.
+func (f *CredentialFile) lookup(accessKeyID string) (AccessKey, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.reload(); err != nil {
+		f.log.With(slog.Any("error", err)).Error("Reading credentials")
+		return AccessKey{}, false
+	}
+	return f.credentials.lookup(accessKeyID)
+}
+
+// reload reads the file if it was modified since it was last read.
+func (f *CredentialFile) reload() error {
+	info, err := f.fileHandler.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("reading credentials: %w", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.err
+	}
+
+	f.modTime = info.ModTime()
+	f.err = nil
+	var credentials Credentials
+	if err := f.fileHandler.ReadYAMLStrict(f.path, &credentials); err != nil {
+		f.err = fmt.Errorf("reading credentials: %w", err)
+		return f.err
+	}
+	if err := credentials.Validate(); err != nil {
+		f.err = fmt.Errorf("invalid credentials: %w", err)
+		return f.err
+	}
+	f.credentials = credentials
+	return nil
+}
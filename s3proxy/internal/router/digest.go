@@ -0,0 +1,142 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// digestReader checks the body of an intercepted request against the digests sent by the client while the body is streamed.
+//
+// There may be a client that wants to test that incorrect content digests result in API errors.
+// For encrypting the body we have to recalculate the content digest.
+// If the client intentionally sends a mismatching content digest, we would take the client request, rewrap it,
+// calculate the correct digest for the new body and NOT get an error.
+// Thus we have to check incoming requests for matching content digests.
+// Since the body is streamed to S3, a mismatch is only detected at the end of the body.
+// The reader then returns an error instead of io.EOF, which makes the upload to S3 fail.
+type digestReader struct {
+	r            io.Reader
+	clientSHA256 string
+	clientMD5    []byte
+	sha256       hash.Hash
+	md5          hash.Hash
+	// err is set if the body does not match the digests sent by the client.
+	err error
+}
+
+// newDigestReader wraps the body of a request.
+// It returns an error if the digest headers of the request are malformed.
+func newDigestReader(body io.Reader, header http.Header) (*digestReader, error) {
+	clientMD5, err := parseContentMD5(header.Get("content-md5"))
+	if err != nil {
+		return nil, fmt.Errorf("validating content md5: %w", err)
+	}
+
+	// UNSIGNED-PAYLOAD can be used to disabled payload signing. In that case we don't check the content digest.
+	clientSHA256 := header.Get("x-amz-content-sha256")
+	if clientSHA256 == "UNSIGNED-PAYLOAD" {
+		clientSHA256 = ""
+	}
+
+	return &digestReader{
+		r:            body,
+		clientSHA256: clientSHA256,
+		clientMD5:    clientMD5,
+		sha256:       sha256.New(),
+		md5:          md5.New(),
+	}, nil
+}
+
+// Read implements io.Reader.
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.sha256.Write(p[:n])
+	d.md5.Write(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		if d.err = d.verify(); d.err != nil {
+			return n, d.err
+		}
+	}
+	return n, err
+}
+
+// verify compares the digests of the body read so far against the digests sent by the client.
+func (d *digestReader) verify() error {
+	serverSHA256 := fmt.Sprintf("%x", d.sha256.Sum(nil))
+	if d.clientSHA256 != "" && d.clientSHA256 != serverSHA256 {
+		return &contentSHA256MismatchError{clientDigest: d.clientSHA256, serverDigest: serverSHA256}
+	}
+
+	if actual := d.md5.Sum(nil); d.clientMD5 != nil && !bytes.Equal(actual, d.clientMD5) {
+		return fmt.Errorf("validating content md5: content-md5 mismatch, header is %x, body is %x", d.clientMD5, actual)
+	}
+	return nil
+}
+
+type contentSHA256MismatchError struct {
+	clientDigest string
+	serverDigest string
+}
+
+func (e *contentSHA256MismatchError) Error() string {
+	return fmt.Sprintf("x-amz-content-sha256 mismatch: client computed %s, s3proxy computed %s", e.clientDigest, e.serverDigest)
+}
+
+// writeUploadError writes the error of a failed upload to the response.
+// If the upload failed because the body did not match the client's digests, the client is at fault.
+func writeUploadError(w http.ResponseWriter, err error, body io.Reader, log *slog.Logger) {
+	digests, ok := body.(*digestReader)
+	if !ok || digests.err == nil {
+		writeS3Error(w, err)
+		return
+	}
+
+	var mismatchErr *contentSHA256MismatchError
+	if !errors.As(digests.err, &mismatchErr) {
+		http.Error(w, digests.err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The S3 API responds with an XML formatted error message.
+	marshalled, err := xml.Marshal(NewContentSHA256MismatchError(mismatchErr.clientDigest, mismatchErr.serverDigest))
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("marshalling error")
+		http.Error(w, fmt.Sprintf("marshalling error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, string(marshalled), http.StatusBadRequest)
+}
+
+// parseContentMD5 decodes the value of a content-md5 header.
+// An empty header results in a nil digest.
+func parseContentMD5(contentMD5 string) ([]byte, error) {
+	if contentMD5 == "" {
+		return nil, nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil {
+		return nil, fmt.Errorf("decoding base64: %w", err)
+	}
+
+	if len(expected) != md5.Size {
+		return nil, fmt.Errorf("content-md5 must be 16 bytes long, got %d bytes", len(expected))
+	}
+	return expected, nil
+}
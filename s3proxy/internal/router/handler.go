@@ -8,24 +8,26 @@ package router
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
 )
 
-func handleGetObject(client *s3.Client, key string, bucket string, log *slog.Logger) http.HandlerFunc {
+func handleGetObject(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting")
-		if req.Header.Get("Range") != "" {
-			log.Error("GetObject Range header unsupported")
-			http.Error(w, "s3proxy currently does not support Range headers", http.StatusNotImplemented)
-			return
-		}
 
 		obj := object{
+			keks:                 keks,
 			client:               client,
 			key:                  key,
 			bucket:               bucket,
@@ -39,37 +41,19 @@ func handleGetObject(client *s3.Client, key string, bucket string, log *slog.Log
 	}
 }
 
-func handlePutObject(client *s3.Client, key string, bucket string, log *slog.Logger) http.HandlerFunc {
+func handlePutObject(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting")
-		body, err := io.ReadAll(req.Body)
-		if err != nil {
-			log.With(slog.Any("error", err)).Error("PutObject")
-			http.Error(w, fmt.Sprintf("reading body: %s", err.Error()), http.StatusInternalServerError)
+		if req.ContentLength < 0 {
+			log.Error("PutObject request without Content-Length")
+			http.Error(w, "Content-Length is required", http.StatusLengthRequired)
 			return
 		}
 
-		clientDigest := req.Header.Get("x-amz-content-sha256")
-		serverDigest := sha256sum(body)
-
-		// There may be a client that wants to test that incorrect content digests result in API errors.
-		// For encrypting the body we have to recalculate the content digest.
-		// If the client intentionally sends a mismatching content digest, we would take the client request, rewrap it,
-		// calculate the correct digest for the new body and NOT get an error.
-		// Thus we have to check incoming requets for matching content digests.
-		// UNSIGNED-PAYLOAD can be used to disabled payload signing. In that case we don't check the content digest.
-		if clientDigest != "" && clientDigest != "UNSIGNED-PAYLOAD" && clientDigest != serverDigest {
-			log.Debug("PutObject", "error", "x-amz-content-sha256 mismatch")
-			// The S3 API responds with an XML formatted error message.
-			mismatchErr := NewContentSHA256MismatchError(clientDigest, serverDigest)
-			marshalled, err := xml.Marshal(mismatchErr)
-			if err != nil {
-				log.With(slog.Any("error", err)).Error("PutObject")
-				http.Error(w, fmt.Sprintf("marshalling error: %s", err.Error()), http.StatusInternalServerError)
-				return
-			}
-
-			http.Error(w, string(marshalled), http.StatusBadRequest)
+		body, err := newDigestReader(req.Body, req.Header)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("PutObject")
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -83,18 +67,13 @@ func handlePutObject(client *s3.Client, key string, bucket string, log *slog.Log
 			return
 		}
 
-		err = validateContentMD5(req.Header.Get("content-md5"), body)
-		if err != nil {
-			log.With(slog.Any("error", err)).Error("validating content md5")
-			http.Error(w, fmt.Sprintf("validating content md5: %s", err.Error()), http.StatusBadRequest)
-			return
-		}
-
 		obj := object{
+			keks:                      keks,
 			client:                    client,
 			key:                       key,
 			bucket:                    bucket,
-			data:                      body,
+			body:                      body,
+			contentLength:             req.ContentLength,
 			query:                     req.URL.Query(),
 			tags:                      req.Header.Get("x-amz-tagging"),
 			contentType:               req.Header.Get("Content-Type"),
@@ -112,13 +91,31 @@ func handlePutObject(client *s3.Client, key string, bucket string, log *slog.Log
 	}
 }
 
-func handleForwards(log *slog.Logger) http.HandlerFunc {
+// handleForwards forwards requests to the S3 API unmodified.
+// If an endpoint is given, requests are sent to it instead of the host the client addressed.
+// If a signer is given, the client's signature is replaced with a signature by s3proxy's own credentials.
+// If httpClient is nil, http.DefaultClient is used.
+func handleForwards(httpClient *http.Client, endpoint *url.URL, signer *s3.Signer, log *slog.Logger) http.HandlerFunc {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("forwarding")
 
-		newReq := repackage(req)
+		newReq := repackage(req, endpoint)
+		if signer != nil {
+			if err := resign(&newReq, signer); err != nil {
+				log.With(slog.Any("error", err)).Error("re-signing request")
+				var authErr *authError
+				if errors.As(err, &authErr) {
+					writeAuthError(w, req, authErr, log)
+					return
+				}
+				http.Error(w, fmt.Sprintf("re-signing request: %s", err.Error()), http.StatusInternalServerError)
+				return
+			}
+		}
 
-		httpClient := http.DefaultClient
 		resp, err := httpClient.Do(&newReq)
 		if err != nil {
 			log.With(slog.Any("error", err)).Error("do request")
@@ -149,42 +146,264 @@ func handleForwards(log *slog.Logger) http.HandlerFunc {
 	}
 }
 
-// handleCreateMultipartUpload logs the request and blocks with an error message.
-func handleCreateMultipartUpload(log *slog.Logger) http.HandlerFunc {
+// handleDeny rejects requests denied by the policy.
+func handleDeny(bucket, key string, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Info("denying request")
+
+		marshalled, err := xml.Marshal(NewAccessDeniedError(path.Join("/", bucket, key)))
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("marshalling error")
+			http.Error(w, fmt.Sprintf("marshalling error: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		if _, err := w.Write(marshalled); err != nil {
+			log.With(slog.Any("error", err)).Error("Write")
+		}
+	}
+}
+
+// handleCopy handles CopyObject and UploadPartCopy requests.
+// Copies between locations the policy doesn't encrypt are forwarded. Copies to encrypted locations are intercepted.
+// The destination's rule is given, the source's rule is looked up in the policy.
+func handleCopy(
+	client *s3.Client, key string, bucket string, rule PolicyRule, policy Policy, keys keyring, names map[string]*crypto.NameCipher, forward http.Handler, log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting copy")
+
+		source, err := parseCopySource(req.Header.Get("x-amz-copy-source"))
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("parsing copy source")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sourceRule, ok := policy.match(source.bucket, source.key)
+		switch {
+		case !ok || sourceRule.Action == ActionDeny:
+			handleDeny(source.bucket, source.key, log)(w, req)
+			return
+		case rule.Action == ActionPassthrough && sourceRule.Action == ActionPassthrough:
+			forward.ServeHTTP(w, req)
+			return
+		case rule.Action == ActionPassthrough:
+			writeCopyNotImplemented(w, log)
+			return
+		}
+
+		// Copied metadata values stay encrypted with the name key of the source.
+		sourceNames, destinationNames := ruleNames(sourceRule, names), ruleNames(rule, names)
+		replaceMetadata := strings.EqualFold(req.Header.Get("x-amz-metadata-directive"), "REPLACE")
+		if sourceNames != destinationNames && !replaceMetadata && !isUploadPart(req.Method, req.URL.Query()) {
+			log.Error("copying metadata between locations with different name keys is not supported")
+			http.Error(w, "copying metadata between locations with different name keys is not supported, set x-amz-metadata-directive to REPLACE", http.StatusNotImplemented)
+			return
+		}
+		if sourceNames != nil {
+			if source.key, err = sourceNames.EncryptKey(source.key); err != nil {
+				log.With(slog.Any("error", err)).Error("encrypting copy source key")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		sourceObject := object{
+			client:               client,
+			key:                  source.key,
+			bucket:               source.bucket,
+			query:                url.Values{},
+			sseCustomerAlgorithm: req.Header.Get("x-amz-copy-source-server-side-encryption-customer-algorithm"),
+			sseCustomerKey:       req.Header.Get("x-amz-copy-source-server-side-encryption-customer-key"),
+			sseCustomerKeyMD5:    req.Header.Get("x-amz-copy-source-server-side-encryption-customer-key-MD5"),
+			log:                  log,
+		}
+		if source.versionID != "" {
+			sourceObject.query.Set("versionId", source.versionID)
+		}
+		if sourceRule.Action == ActionEncrypt {
+			sourceObject.keks = keys[sourceRule.keyID()]
+		}
+
+		objectCopy := objectCopy{
+			source:               sourceObject,
+			sourceEncrypted:      sourceRule.Action == ActionEncrypt,
+			keks:                 keys[rule.keyID()],
+			client:               client,
+			key:                  key,
+			bucket:               bucket,
+			uploadID:             req.URL.Query().Get("uploadId"),
+			sourceRange:          req.Header.Get("x-amz-copy-source-range"),
+			replaceMetadata:      replaceMetadata,
+			metadata:             getMetadataHeaders(req.Header),
+			contentType:          req.Header.Get("Content-Type"),
+			cacheControl:         req.Header.Get("Cache-Control"),
+			contentDisposition:   req.Header.Get("Content-Disposition"),
+			contentEncoding:      req.Header.Get("Content-Encoding"),
+			contentLanguage:      req.Header.Get("Content-Language"),
+			storageClass:         req.Header.Get("x-amz-storage-class"),
+			sseCustomerAlgorithm: req.Header.Get("x-amz-server-side-encryption-customer-algorithm"),
+			sseCustomerKey:       req.Header.Get("x-amz-server-side-encryption-customer-key"),
+			sseCustomerKeyMD5:    req.Header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+			log:                  log,
+		}
+		if strings.EqualFold(req.Header.Get("x-amz-tagging-directive"), "REPLACE") {
+			objectCopy.tags = req.Header.Get("x-amz-tagging")
+		}
+
+		if !isUploadPart(req.Method, req.URL.Query()) {
+			put(objectCopy.copyObject)(w, req)
+			return
+		}
+		partNumber, err := strconv.ParseInt(req.URL.Query().Get("partNumber"), 10, 32)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("UploadPartCopy parsing part number")
+			http.Error(w, fmt.Sprintf("parsing partNumber: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		objectCopy.partNumber = int32(partNumber)
+		put(objectCopy.uploadPartCopy)(w, req)
+	}
+}
+
+func handleCreateMultipartUpload(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting CreateMultipartUpload")
 
-		log.Error("Blocking CreateMultipartUpload request")
-		http.Error(w, "s3proxy is configured to block CreateMultipartUpload requests", http.StatusNotImplemented)
+		raw := req.Header.Get("x-amz-object-lock-retain-until-date")
+		retentionTime, err := parseRetentionTime(raw)
+		if err != nil {
+			log.With(slog.String("data", raw), slog.Any("error", err)).Error("parsing lock retention time")
+			http.Error(w, fmt.Sprintf("parsing x-amz-object-lock-retain-until-date: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		upload := multipartUpload{
+			keks:                      keks,
+			client:                    client,
+			key:                       key,
+			bucket:                    bucket,
+			tags:                      req.Header.Get("x-amz-tagging"),
+			contentType:               req.Header.Get("Content-Type"),
+			metadata:                  getMetadataHeaders(req.Header),
+			objectLockLegalHoldStatus: req.Header.Get("x-amz-object-lock-legal-hold"),
+			objectLockMode:            req.Header.Get("x-amz-object-lock-mode"),
+			objectLockRetainUntilDate: retentionTime,
+			sseCustomerAlgorithm:      req.Header.Get("x-amz-server-side-encryption-customer-algorithm"),
+			sseCustomerKey:            req.Header.Get("x-amz-server-side-encryption-customer-key"),
+			sseCustomerKeyMD5:         req.Header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+			log:                       log,
+		}
+		post(upload.create)(w, req)
 	}
 }
 
-// handleUploadPart logs the request and blocks with an error message.
-func handleUploadPart(log *slog.Logger) http.HandlerFunc {
+func handleUploadPart(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting UploadPart")
 
-		log.Error("Blocking UploadPart request")
-		http.Error(w, "s3proxy is configured to block UploadPart requests", http.StatusNotImplemented)
+		partNumber, err := strconv.ParseInt(req.URL.Query().Get("partNumber"), 10, 32)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("UploadPart parsing part number")
+			http.Error(w, fmt.Sprintf("parsing partNumber: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if req.ContentLength < 0 {
+			log.Error("UploadPart request without Content-Length")
+			http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+			return
+		}
+
+		body, err := newDigestReader(req.Body, req.Header)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error("UploadPart")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		upload := multipartUpload{
+			keks:                 keks,
+			client:               client,
+			key:                  key,
+			bucket:               bucket,
+			uploadID:             req.URL.Query().Get("uploadId"),
+			partNumber:           int32(partNumber),
+			body:                 body,
+			contentLength:        req.ContentLength,
+			sseCustomerAlgorithm: req.Header.Get("x-amz-server-side-encryption-customer-algorithm"),
+			sseCustomerKey:       req.Header.Get("x-amz-server-side-encryption-customer-key"),
+			sseCustomerKeyMD5:    req.Header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+			log:                  log,
+		}
+		put(upload.uploadPart)(w, req)
 	}
 }
 
-// handleCompleteMultipartUpload logs the request and blocks with an error message.
-func handleCompleteMultipartUpload(log *slog.Logger) http.HandlerFunc {
+func handleCompleteMultipartUpload(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting CompleteMultipartUpload")
 
-		log.Error("Blocking CompleteMultipartUpload request")
-		http.Error(w, "s3proxy is configured to block CompleteMultipartUpload requests", http.StatusNotImplemented)
+		upload := multipartUpload{
+			keks:                 keks,
+			client:               client,
+			key:                  key,
+			bucket:               bucket,
+			uploadID:             req.URL.Query().Get("uploadId"),
+			sseCustomerAlgorithm: req.Header.Get("x-amz-server-side-encryption-customer-algorithm"),
+			sseCustomerKey:       req.Header.Get("x-amz-server-side-encryption-customer-key"),
+			sseCustomerKeyMD5:    req.Header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+			log:                  log,
+		}
+		post(upload.complete)(w, req)
 	}
 }
 
-// handleAbortMultipartUpload logs the request and blocks with an error message.
-func handleAbortMultipartUpload(log *slog.Logger) http.HandlerFunc {
+func handleAbortMultipartUpload(client *s3.Client, key string, bucket string, keks keyEncryptionKeys, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host)).Debug("intercepting AbortMultipartUpload")
 
-		log.Error("Blocking AbortMultipartUpload request")
-		http.Error(w, "s3proxy is configured to block AbortMultipartUpload requests", http.StatusNotImplemented)
+		upload := multipartUpload{
+			keks:     keks,
+			client:   client,
+			key:      key,
+			bucket:   bucket,
+			uploadID: req.URL.Query().Get("uploadId"),
+			log:      log,
+		}
+		allowMethod(upload.abort, "DELETE")(w, req)
 	}
 }
+
+// validateBody checks a body that was read completely against the digests sent by the client.
+// If the body does not match, an error is written to the response and false is returned.
+// See digestReader for why this is necessary.
+func validateBody(w http.ResponseWriter, req *http.Request, body []byte, operation string, log *slog.Logger) bool {
+	clientDigest := req.Header.Get("x-amz-content-sha256")
+	serverDigest := sha256sum(body)
+
+	// UNSIGNED-PAYLOAD can be used to disabled payload signing. In that case we don't check the content digest.
+	if clientDigest != "" && clientDigest != "UNSIGNED-PAYLOAD" && clientDigest != serverDigest {
+		log.Debug(operation, "error", "x-amz-content-sha256 mismatch")
+		// The S3 API responds with an XML formatted error message.
+		mismatchErr := NewContentSHA256MismatchError(clientDigest, serverDigest)
+		marshalled, err := xml.Marshal(mismatchErr)
+		if err != nil {
+			log.With(slog.Any("error", err)).Error(operation)
+			http.Error(w, fmt.Sprintf("marshalling error: %s", err.Error()), http.StatusInternalServerError)
+			return false
+		}
+
+		http.Error(w, string(marshalled), http.StatusBadRequest)
+		return false
+	}
+
+	if err := validateContentMD5(req.Header.Get("content-md5"), body); err != nil {
+		log.With(slog.Any("error", err)).Error("validating content md5")
+		http.Error(w, fmt.Sprintf("validating content md5: %s", err.Error()), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,163 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/edgelesssys/constellation/v2/internal/kms/kms"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+)
+
+const (
+	// kekIDTag is the name of the header that holds the keyservice ID of the KEK that wrapped an object's DEK.
+	// Objects without this header use the default KEK.
+	kekIDTag = "constellation-kek-id"
+	// kekVersionTag is the name of the header that holds the version of the KEK that wrapped an object's DEK.
+	// Objects without this header were written before KEK versioning was introduced and use version 1.
+	kekVersionTag = "constellation-kek-version"
+	// Use a 32*8 = 256 bit key for AES-256.
+	kekSizeBytes = 32
+	// defaultKEKID is the ID of the KEK used if the policy does not name one.
+	defaultKEKID = "s3proxy-kek"
+)
+
+// errKEKNotAllowed is returned if an object's DEK is wrapped with a different KEK than the one the policy assigns to the object.
+var errKEKNotAllowed = errors.New("object is encrypted with a KEK that is not allowed by the policy")
+
+// keyEncryptionKeys holds all versions of a key encryption key up to the current one.
+// New DEKs are wrapped with the current version. Older versions are kept to unwrap the DEKs of existing objects.
+type keyEncryptionKeys struct {
+	id       string
+	current  uint32
+	versions map[uint32][32]byte
+}
+
+// keyring holds the KEKs of all key IDs used by the policy.
+type keyring map[string]keyEncryptionKeys
+
+// dataKeyGetter fetches keys from Constellation's keyservice.
+type dataKeyGetter interface {
+	GetDataKey(ctx context.Context, keyID string, length int) ([]byte, error)
+}
+
+// fetchKEKs fetches all versions up to current of the KEK with the given ID from the keyservice.
+// The keyservice derives keys from its master secret, so any version can be fetched at any time.
+func fetchKEKs(ctx context.Context, kms dataKeyGetter, id string, current uint32) (keyEncryptionKeys, error) {
+	if current < 1 {
+		return keyEncryptionKeys{}, fmt.Errorf("invalid KEK version %d", current)
+	}
+
+	keks := keyEncryptionKeys{id: id, current: current, versions: make(map[uint32][32]byte, current)}
+	for version := uint32(1); version <= current; version++ {
+		kek, err := kms.GetDataKey(ctx, kekID(id, version), kekSizeBytes)
+		if err != nil {
+			return keyEncryptionKeys{}, fmt.Errorf("getting KEK %s version %d: %w", id, version, err)
+		}
+		if keks.versions[version], err = byteSliceToByteArray(kek); err != nil {
+			return keyEncryptionKeys{}, fmt.Errorf("converting KEK %s version %d to byte array: %w", id, version, err)
+		}
+	}
+	return keks, nil
+}
+
+// fetchKeyring fetches the KEKs of all given key IDs from the keyservice.
+func fetchKeyring(ctx context.Context, kms dataKeyGetter, ids []string, current uint32) (keyring, error) {
+	keys := make(keyring, len(ids))
+	for _, id := range ids {
+		keks, err := fetchKEKs(ctx, kms, id, current)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = keks
+	}
+	return keys, nil
+}
+
+// kekID returns the keyservice ID of the given version of a KEK.
+// The first version uses the plain ID, later versions use kms.VersionedKeyID, e.g., "s3proxy-kek/v2".
+func kekID(id string, version uint32) string {
+	if version == 1 {
+		return id
+	}
+	return kms.VersionedKeyID(id, version)
+}
+
+// wrap encrypts a DEK with the current KEK and records the KEK ID and version in the given metadata.
+func (k keyEncryptionKeys) wrap(dek []byte, metadata map[string]string) ([]byte, error) {
+	kek, ok := k.versions[k.current]
+	if !ok {
+		return nil, fmt.Errorf("KEK version %d is not available", k.current)
+	}
+	encryptedDEK, err := crypto.WrapDEK(dek, kek)
+	if err != nil {
+		return nil, err
+	}
+	metadata[kekIDTag] = k.id
+	metadata[kekVersionTag] = strconv.FormatUint(uint64(k.current), 10)
+	return encryptedDEK, nil
+}
+
+// forMetadata returns the KEK that wrapped the DEK of an object with the given metadata.
+// It fails with errKEKNotAllowed if the object was wrapped with a different KEK ID.
+func (k keyEncryptionKeys) forMetadata(metadata map[string]string) ([32]byte, error) {
+	if id := kekIDFromMetadata(metadata); id != k.id {
+		return [32]byte{}, fmt.Errorf("%w: object uses KEK %q, policy requires KEK %q", errKEKNotAllowed, id, k.id)
+	}
+	version, err := kekVersion(metadata)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	kek, ok := k.versions[version]
+	if !ok {
+		return [32]byte{}, fmt.Errorf("KEK version %d is not available, the current version is %d", version, k.current)
+	}
+	return kek, nil
+}
+
+// unwrap decrypts the DEK of an object with the given metadata.
+func (k keyEncryptionKeys) unwrap(encryptedDEK []byte, metadata map[string]string) ([]byte, error) {
+	kek, err := k.forMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnwrapDEK(encryptedDEK, kek)
+}
+
+// unwrap decrypts the DEK of an object with the given metadata, using whichever KEK the object records.
+func (k keyring) unwrap(encryptedDEK []byte, metadata map[string]string) ([]byte, error) {
+	id := kekIDFromMetadata(metadata)
+	keks, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("KEK %q is not available", id)
+	}
+	return keks.unwrap(encryptedDEK, metadata)
+}
+
+// kekIDFromMetadata returns the KEK ID recorded in an object's metadata.
+func kekIDFromMetadata(metadata map[string]string) string {
+	if id, ok := metadata[kekIDTag]; ok {
+		return id
+	}
+	return defaultKEKID
+}
+
+// kekVersion returns the KEK version recorded in an object's metadata.
+func kekVersion(metadata map[string]string) (uint32, error) {
+	rawVersion, ok := metadata[kekVersionTag]
+	if !ok {
+		return 1, nil
+	}
+	version, err := strconv.ParseUint(rawVersion, 10, 32)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid KEK version %q", rawVersion)
+	}
+	return uint32(version), nil
+}
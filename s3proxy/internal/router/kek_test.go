@@ -0,0 +1,106 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchKEKs(t *testing.T) {
+	testCases := map[string]struct {
+		current uint32
+		kms     *stubDataKeyGetter
+		wantIDs []string
+		wantErr bool
+	}{
+		"first version": {
+			current: 1,
+			kms:     &stubDataKeyGetter{},
+			wantIDs: []string{"s3proxy-kek"},
+		},
+		"rotated": {
+			current: 3,
+			kms:     &stubDataKeyGetter{},
+			wantIDs: []string{"s3proxy-kek", "s3proxy-kek/v2", "s3proxy-kek/v3"},
+		},
+		"invalid version": {
+			current: 0,
+			kms:     &stubDataKeyGetter{},
+			wantErr: true,
+		},
+		"keyservice error": {
+			current: 2,
+			kms:     &stubDataKeyGetter{err: errors.New("failed")},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			keks, err := fetchKEKs(context.Background(), tc.kms, defaultKEKID, tc.current)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.wantIDs, tc.kms.requested)
+			assert.Equal(tc.current, keks.current)
+			assert.Len(keks.versions, int(tc.current))
+		})
+	}
+}
+
+func TestKEKVersions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	keks := keyEncryptionKeys{id: defaultKEKID, current: 2, versions: map[uint32][32]byte{1: {0x1}, 2: {0x2}}}
+	dek := []byte("0123456789abcdef0123456789abcdef")
+
+	metadata := map[string]string{}
+	encryptedDEK, err := keks.wrap(dek, metadata)
+	require.NoError(err)
+	assert.Equal("2", metadata[kekVersionTag])
+	assert.Equal(defaultKEKID, metadata[kekIDTag])
+
+	unwrapped, err := keks.unwrap(encryptedDEK, metadata)
+	require.NoError(err)
+	assert.Equal(dek, unwrapped)
+
+	// Objects without a version use the first KEK version.
+	_, err = keks.unwrap(encryptedDEK, map[string]string{})
+	assert.Error(err)
+	kek, err := keks.forMetadata(map[string]string{})
+	require.NoError(err)
+	assert.Equal([32]byte{0x1}, kek)
+
+	_, err = keks.forMetadata(map[string]string{kekVersionTag: "3"})
+	assert.Error(err)
+	_, err = keks.forMetadata(map[string]string{kekVersionTag: "v2"})
+	assert.Error(err)
+
+	// DEKs wrapped with other KEK IDs are rejected.
+	_, err = keks.forMetadata(map[string]string{kekIDTag: "other", kekVersionTag: "1"})
+	assert.ErrorIs(err, errKEKNotAllowed)
+}
+
+type stubDataKeyGetter struct {
+	requested []string
+	err       error
+}
+
+func (s *stubDataKeyGetter) GetDataKey(_ context.Context, keyID string, length int) ([]byte, error) {
+	s.requested = append(s.requested, keyID)
+	return make([]byte, length), s.err
+}
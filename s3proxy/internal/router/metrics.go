@@ -0,0 +1,214 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// cryptoEncrypt labels failures to encrypt objects or wrap DEKs.
+	cryptoEncrypt = "encrypt"
+	// cryptoDecrypt labels failures to decrypt objects or unwrap DEKs.
+	cryptoDecrypt = "decrypt"
+)
+
+// metrics holds the Prometheus metrics of s3proxy.
+type metrics struct {
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	cryptoFailures *prometheus.CounterVec
+	kmsErrors      prometheus.Counter
+}
+
+// newMetrics creates the metrics of s3proxy and registers them with reg. If reg is nil, the metrics are not exported.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "s3proxy",
+			Name:      "requests_total",
+			Help:      "Number of requests handled, by S3 operation, policy action and response status code.",
+		}, []string{"operation", "action", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "s3proxy",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests, by S3 operation and policy action.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"operation", "action"}),
+		cryptoFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "s3proxy",
+			Name:      "crypto_failures_total",
+			Help:      "Number of failures to encrypt or decrypt objects.",
+		}, []string{"direction"}),
+		kmsErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "s3proxy",
+			Name:      "kms_errors_total",
+			Help:      "Number of failures to fetch key encryption keys from the keyservice.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.requests, m.duration, m.cryptoFailures, m.kmsErrors)
+	}
+	return m
+}
+
+// observe records a handled request.
+func (m *metrics) observe(operation string, action Action, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(operation, string(action), strconv.Itoa(code)).Inc()
+	m.duration.WithLabelValues(operation, string(action)).Observe(duration.Seconds())
+}
+
+type metricsContextKey struct{}
+
+// recordCryptoFailure counts a failure to encrypt or decrypt an object while handling the request with the given context.
+func recordCryptoFailure(ctx context.Context, direction string) {
+	if m, ok := ctx.Value(metricsContextKey{}).(*metrics); ok && m != nil {
+		m.cryptoFailures.WithLabelValues(direction).Inc()
+	}
+}
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// auditLog writes one JSON line per object access for compliance purposes.
+type auditLog struct {
+	log *slog.Logger
+}
+
+// access logs an access to an object.
+func (a *auditLog) access(req *http.Request, operation, bucket, key string, action Action, status int) {
+	if a == nil {
+		return
+	}
+
+	outcome := "success"
+	switch {
+	case status == http.StatusForbidden:
+		outcome = "denied"
+	case status >= http.StatusBadRequest:
+		outcome = "failure"
+	}
+
+	attrs := []slog.Attr{
+		slog.String("bucket", bucket),
+		slog.String("key", key),
+		slog.String("operation", operation),
+		slog.String("principal", accessKeyID(req)),
+		slog.String("action", string(action)),
+		slog.String("outcome", outcome),
+		slog.Int("status", status),
+	}
+	if copySource := req.Header.Get("x-amz-copy-source"); copySource != "" {
+		attrs = append(attrs, slog.String("copySource", copySource))
+	}
+	if versionID := req.URL.Query().Get("versionId"); versionID != "" {
+		attrs = append(attrs, slog.String("versionId", versionID))
+	}
+	a.log.LogAttrs(req.Context(), slog.LevelInfo, "object access", attrs...)
+}
+
+// accessKeyID returns the access key ID a request was signed with, using SigV4 in either the Authorization header or a presigned URL.
+// It returns an empty string for unsigned requests.
+func accessKeyID(req *http.Request) string {
+	credential := req.URL.Query().Get("X-Amz-Credential")
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		_, params, _ := strings.Cut(authorization, " ")
+		for _, param := range strings.Split(params, ",") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "Credential="); ok {
+				credential = value
+			}
+		}
+	}
+	if unescaped, err := url.QueryUnescape(credential); err == nil {
+		credential = unescaped
+	}
+	id, _, _ := strings.Cut(credential, "/")
+	return id
+}
+
+// objectOperation returns the name of the S3 operation of a request for an object, as used in metrics and the audit log.
+func objectOperation(req *http.Request) string {
+	query := req.URL.Query()
+	switch {
+	case isCopy(req.Method, req.Header) && isUploadPart(req.Method, query):
+		return "UploadPartCopy"
+	case isCopy(req.Method, req.Header):
+		return "CopyObject"
+	case isUploadPart(req.Method, query):
+		return "UploadPart"
+	case isCreateMultipartUpload(req.Method, query):
+		return "CreateMultipartUpload"
+	case isCompleteMultipartUpload(req.Method, query):
+		return "CompleteMultipartUpload"
+	case isAbortMultipartUpload(req.Method, query):
+		return "AbortMultipartUpload"
+	case req.Method == http.MethodGet && !isUnwantedGetEndpoint(query):
+		return "GetObject"
+	case req.Method == http.MethodPut && !isUnwantedPutEndpoint(req.Header, query):
+		return "PutObject"
+	case req.Method == http.MethodHead:
+		return "HeadObject"
+	case req.Method == http.MethodDelete:
+		return "DeleteObject"
+	default:
+		return "Other"
+	}
+}
+
+// countKMSErrors returns a dataKeyGetter that counts the errors returned by kms.
+func (m *metrics) countKMSErrors(kms dataKeyGetter) dataKeyGetter {
+	return kmsErrorCounter{kms: kms, errors: m.kmsErrors}
+}
+
+type kmsErrorCounter struct {
+	kms    dataKeyGetter
+	errors prometheus.Counter
+}
+
+// GetDataKey implements dataKeyGetter.
+func (k kmsErrorCounter) GetDataKey(ctx context.Context, keyID string, length int) ([]byte, error) {
+	key, err := k.kms.GetDataKey(ctx, keyID, length)
+	if err != nil {
+		k.errors.Inc()
+	}
+	return key, err
+}
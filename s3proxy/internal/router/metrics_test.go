@@ -0,0 +1,187 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeMetricsAndAuditLog(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	require := require.New(t)
+	assert := assert.New(t)
+
+	backend := newFakeS3Backend()
+	server := httptest.NewTLSServer(backend)
+	defer server.Close()
+	config := s3client.Config{Region: "us-east-1", Endpoint: server.URL, UsePathStyle: true, HTTPClient: server.Client()}
+	endpoint, err := parseEndpoint(config.Endpoint)
+	require.NoError(err)
+
+	var audit bytes.Buffer
+	m := newMetrics(prometheus.NewRegistry())
+	router := Router{
+		backend:  config,
+		endpoint: endpoint,
+		policy: Policy{Rules: []PolicyRule{
+			{Bucket: "bucket", Prefix: "public/", Action: ActionPassthrough},
+			{Bucket: "bucket", Action: ActionEncrypt},
+		}},
+		keys:    keyring{defaultKEKID: newTestKEKs([32]byte{0x1})},
+		metrics: m,
+		audit:   &auditLog{log: slog.New(slog.NewJSONHandler(&audit, nil))},
+		log:     logger.NewTest(t),
+	}
+
+	const credential = "AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20240101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc"
+	serve := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", credential)
+		resp := httptest.NewRecorder()
+		router.Serve(resp, req)
+		return resp.Code
+	}
+
+	require.Equal(http.StatusOK, serve(http.MethodPut, "/bucket/key", "hello"))
+	require.Equal(http.StatusOK, serve(http.MethodGet, "/bucket/key", ""))
+	require.Equal(http.StatusOK, serve(http.MethodPut, "/bucket/public/key", "hello"))
+	require.Equal(http.StatusOK, serve(http.MethodGet, "/bucket/public/key", ""))
+	require.Equal(http.StatusForbidden, serve(http.MethodGet, "/other/key", ""))
+	require.Equal(http.StatusOK, serve(http.MethodGet, "/bucket?list-type=2", ""))
+
+	// An object with a corrupted DEK can't be decrypted.
+	backend.objects["bucket/corrupted"] = stubObject{body: []byte("ciphertext"), metadata: map[string]string{dekTag: "invalid"}}
+	require.Equal(http.StatusInternalServerError, serve(http.MethodGet, "/bucket/corrupted", ""))
+
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("PutObject", "encrypt", "200")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("GetObject", "encrypt", "200")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("PutObject", "passthrough", "200")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("GetObject", "passthrough", "200")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("GetObject", "deny", "403")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("Other", "encrypt", "200")))
+	assert.Equal(1.0, testutil.ToFloat64(m.requests.WithLabelValues("GetObject", "encrypt", "500")))
+	assert.Equal(1.0, testutil.ToFloat64(m.cryptoFailures.WithLabelValues(cryptoDecrypt)))
+	assert.Equal(0.0, testutil.ToFloat64(m.cryptoFailures.WithLabelValues(cryptoEncrypt)))
+	assert.Equal(6, testutil.CollectAndCount(m.duration))
+
+	type auditEntry struct {
+		Bucket    string `json:"bucket"`
+		Key       string `json:"key"`
+		Operation string `json:"operation"`
+		Principal string `json:"principal"`
+		Action    string `json:"action"`
+		Outcome   string `json:"outcome"`
+		Status    int    `json:"status"`
+	}
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var entry auditEntry
+		require.NoError(json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	// Requests without an object key are not audited.
+	assert.Equal([]auditEntry{
+		{Bucket: "bucket", Key: "key", Operation: "PutObject", Principal: "AKIAEXAMPLE", Action: "encrypt", Outcome: "success", Status: 200},
+		{Bucket: "bucket", Key: "key", Operation: "GetObject", Principal: "AKIAEXAMPLE", Action: "encrypt", Outcome: "success", Status: 200},
+		{Bucket: "bucket", Key: "public/key", Operation: "PutObject", Principal: "AKIAEXAMPLE", Action: "passthrough", Outcome: "success", Status: 200},
+		{Bucket: "bucket", Key: "public/key", Operation: "GetObject", Principal: "AKIAEXAMPLE", Action: "passthrough", Outcome: "success", Status: 200},
+		{Bucket: "other", Key: "key", Operation: "GetObject", Principal: "AKIAEXAMPLE", Action: "deny", Outcome: "denied", Status: 403},
+		{Bucket: "bucket", Key: "corrupted", Operation: "GetObject", Principal: "AKIAEXAMPLE", Action: "encrypt", Outcome: "failure", Status: 500},
+	}, entries)
+}
+
+func TestAccessKeyID(t *testing.T) {
+	testCases := map[string]struct {
+		target        string
+		authorization string
+		want          string
+	}{
+		"authorization header": {
+			target:        "/bucket/key",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20240101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc",
+			want:          "AKIAEXAMPLE",
+		},
+		"presigned URL": {
+			target: "/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIAEXAMPLE%2F20240101%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Signature=abc",
+			want:   "AKIAEXAMPLE",
+		},
+		"unsigned": {
+			target: "/bucket/key",
+		},
+		"authorization without credential": {
+			target:        "/bucket/key",
+			authorization: "Bearer token",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			assert.Equal(t, tc.want, accessKeyID(req))
+		})
+	}
+}
+
+func TestObjectOperation(t *testing.T) {
+	testCases := map[string]struct {
+		method     string
+		target     string
+		copySource string
+		want       string
+	}{
+		"GetObject":               {method: http.MethodGet, target: "/bucket/key", want: "GetObject"},
+		"PutObject":               {method: http.MethodPut, target: "/bucket/key", want: "PutObject"},
+		"HeadObject":              {method: http.MethodHead, target: "/bucket/key", want: "HeadObject"},
+		"DeleteObject":            {method: http.MethodDelete, target: "/bucket/key", want: "DeleteObject"},
+		"CopyObject":              {method: http.MethodPut, target: "/bucket/key", copySource: "/bucket/source", want: "CopyObject"},
+		"UploadPartCopy":          {method: http.MethodPut, target: "/bucket/key?partNumber=1&uploadId=id", copySource: "/bucket/source", want: "UploadPartCopy"},
+		"UploadPart":              {method: http.MethodPut, target: "/bucket/key?partNumber=1&uploadId=id", want: "UploadPart"},
+		"CreateMultipartUpload":   {method: http.MethodPost, target: "/bucket/key?uploads", want: "CreateMultipartUpload"},
+		"CompleteMultipartUpload": {method: http.MethodPost, target: "/bucket/key?uploadId=id", want: "CompleteMultipartUpload"},
+		"AbortMultipartUpload":    {method: http.MethodDelete, target: "/bucket/key?uploadId=id", want: "AbortMultipartUpload"},
+		"GetObjectTagging":        {method: http.MethodGet, target: "/bucket/key?tagging", want: "Other"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			if tc.copySource != "" {
+				req.Header.Set("x-amz-copy-source", tc.copySource)
+			}
+			assert.Equal(t, tc.want, objectOperation(req))
+		})
+	}
+}
+
+func TestCountKMSErrors(t *testing.T) {
+	m := newMetrics(nil)
+	kms := m.countKMSErrors(&stubDataKeyGetter{err: errors.New("failed")})
+
+	_, err := fetchKeyring(context.Background(), kms, []string{defaultKEKID}, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.kmsErrors))
+}
@@ -0,0 +1,351 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+)
+
+const (
+	// uploadStatePrefix is the key prefix under which s3proxy stores the encrypted DEK of each in-progress multipart upload.
+	// S3 does not return the metadata of an upload before it is completed, so the DEK has to be kept next to the upload.
+	// The objects are removed once the upload is completed or aborted.
+	uploadStatePrefix = ".constellation-s3proxy/multipart/"
+)
+
+// multipartUpload bundles data to implement http.Handler methods for multipart uploads.
+type multipartUpload struct {
+	keks                      keyEncryptionKeys
+	client                    s3Client
+	key                       string
+	bucket                    string
+	uploadID                  string
+	partNumber                int32
+	body                      io.Reader
+	contentLength             int64
+	tags                      string
+	contentType               string
+	metadata                  map[string]string
+	objectLockLegalHoldStatus string
+	objectLockMode            string
+	objectLockRetainUntilDate time.Time
+	sseCustomerAlgorithm      string
+	sseCustomerKey            string
+	sseCustomerKeyMD5         string
+	log                       *slog.Logger
+}
+
+// create is a http.HandlerFunc that implements CreateMultipartUpload.
+// A new DEK is generated for the upload. The encrypted DEK is attached to the upload's metadata,
+// so that the completed object can be decrypted like any other object, and stored next to the upload for UploadPart requests.
+func (u multipartUpload) create(w http.ResponseWriter, r *http.Request) {
+	u.log.With(slog.String("key", u.key), slog.String("bucket", u.bucket)).Debug("createMultipartUpload")
+
+	encryptedDEK, err := u.keks.wrap(crypto.GenerateDEK(), u.metadata)
+	if err != nil {
+		recordCryptoFailure(r.Context(), cryptoEncrypt)
+		u.log.With(slog.Any("error", err)).Error("CreateMultipartUpload")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.metadata[dekTag] = hex.EncodeToString(encryptedDEK)
+	u.metadata[formatTag] = formatSegmented
+
+	output, err := u.client.CreateMultipartUpload(r.Context(), u.bucket, u.key, u.tags, u.contentType, u.objectLockLegalHoldStatus, u.objectLockMode, u.sseCustomerAlgorithm, u.sseCustomerKey, u.sseCustomerKeyMD5, u.objectLockRetainUntilDate, u.metadata)
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("CreateMultipartUpload sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	if output.UploadId == nil {
+		u.log.Error("CreateMultipartUpload response is missing upload ID")
+		http.Error(w, "S3 response is missing upload ID", http.StatusInternalServerError)
+		return
+	}
+
+	stateMetadata := map[string]string{kekIDTag: u.metadata[kekIDTag], kekVersionTag: u.metadata[kekVersionTag]}
+	if _, err := u.client.PutObject(r.Context(), u.bucket, uploadStateKey(*output.UploadId), "", "", "", "", "", "", "", time.Time{}, stateMetadata, bytes.NewReader(encryptedDEK), int64(len(encryptedDEK))); err != nil {
+		u.log.With(slog.Any("error", err)).Error("CreateMultipartUpload storing upload DEK")
+		// Don't leave behind an upload that can not be used.
+		if _, abortErr := u.client.AbortMultipartUpload(r.Context(), u.bucket, u.key, *output.UploadId); abortErr != nil {
+			u.log.With(slog.Any("error", abortErr)).Error("CreateMultipartUpload aborting upload")
+		}
+		writeS3Error(w, err)
+		return
+	}
+
+	if output.SSECustomerAlgorithm != nil {
+		w.Header().Set("x-amz-server-side-encryption-customer-algorithm", *output.SSECustomerAlgorithm)
+	}
+	if output.SSECustomerKeyMD5 != nil {
+		w.Header().Set("x-amz-server-side-encryption-customer-key-MD5", *output.SSECustomerKeyMD5)
+	}
+	if output.ServerSideEncryption != "" {
+		w.Header().Set("x-amz-server-side-encryption", string(output.ServerSideEncryption))
+	}
+
+	writeXML(w, initiateMultipartUploadResult{
+		Bucket:   u.bucket,
+		Key:      u.key,
+		UploadID: *output.UploadId,
+	}, u.log)
+}
+
+// uploadPart is a http.HandlerFunc that implements UploadPart.
+// The part is encrypted with the DEK of the upload it belongs to and streamed to S3.
+// Each part is a stream in the segmented format, using the part number as stream index.
+func (u multipartUpload) uploadPart(w http.ResponseWriter, r *http.Request) {
+	u.log.With(slog.String("key", u.key), slog.String("bucket", u.bucket), slog.Int("partNumber", int(u.partNumber))).Debug("uploadPart")
+
+	dek, err := u.dek(r)
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("UploadPart fetching upload DEK")
+		writeS3Error(w, err)
+		return
+	}
+
+	if u.partNumber < 1 {
+		u.log.With(slog.Int("partNumber", int(u.partNumber))).Error("UploadPart invalid part number")
+		http.Error(w, fmt.Sprintf("invalid part number: %d", u.partNumber), http.StatusBadRequest)
+		return
+	}
+
+	ciphertext, err := crypto.NewEncryptingReader(u.body, dek, uint32(u.partNumber), u.contentLength)
+	if err != nil {
+		recordCryptoFailure(r.Context(), cryptoEncrypt)
+		u.log.With(slog.Any("error", err)).Error("UploadPart")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := u.client.UploadPart(r.Context(), u.bucket, u.key, u.uploadID, u.partNumber, u.sseCustomerAlgorithm, u.sseCustomerKey, u.sseCustomerKeyMD5, ciphertext, crypto.EncryptedSize(u.contentLength))
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("UploadPart sending request to S3")
+		writeUploadError(w, err, u.body, u.log)
+		return
+	}
+
+	if output.ETag != nil {
+		w.Header().Set("ETag", *output.ETag)
+	}
+	if output.SSECustomerAlgorithm != nil {
+		w.Header().Set("x-amz-server-side-encryption-customer-algorithm", *output.SSECustomerAlgorithm)
+	}
+	if output.SSECustomerKeyMD5 != nil {
+		w.Header().Set("x-amz-server-side-encryption-customer-key-MD5", *output.SSECustomerKeyMD5)
+	}
+	if output.ServerSideEncryption != "" {
+		w.Header().Set("x-amz-server-side-encryption", string(output.ServerSideEncryption))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// complete is a http.HandlerFunc that implements CompleteMultipartUpload.
+// Once S3 assembled the object, the parts tag authenticating its parts is added to the object's metadata.
+func (u multipartUpload) complete(w http.ResponseWriter, r *http.Request) {
+	u.log.With(slog.String("key", u.key), slog.String("bucket", u.bucket)).Debug("completeMultipartUpload")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("CompleteMultipartUpload")
+		http.Error(w, fmt.Sprintf("reading body: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !validateBody(w, r, body, "CompleteMultipartUpload", u.log) {
+		return
+	}
+
+	var request completeMultipartUploadRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		u.log.With(slog.Any("error", err)).Error("CompleteMultipartUpload parsing body")
+		http.Error(w, fmt.Sprintf("parsing body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	parts := make([]types.CompletedPart, 0, len(request.Parts))
+	partNumbers := make([]uint32, 0, len(request.Parts))
+	for _, part := range request.Parts {
+		if part.PartNumber < 1 {
+			u.log.With(slog.Int("partNumber", int(part.PartNumber))).Error("CompleteMultipartUpload invalid part number")
+			http.Error(w, fmt.Sprintf("invalid part number: %d", part.PartNumber), http.StatusBadRequest)
+			return
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       &part.ETag,
+			PartNumber: &part.PartNumber,
+		})
+		partNumbers = append(partNumbers, uint32(part.PartNumber))
+	}
+
+	dek, err := u.dek(r)
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("CompleteMultipartUpload fetching upload DEK")
+		writeS3Error(w, err)
+		return
+	}
+
+	output, err := u.client.CompleteMultipartUpload(r.Context(), u.bucket, u.key, u.uploadID, u.sseCustomerAlgorithm, u.sseCustomerKey, u.sseCustomerKeyMD5, parts)
+	if err != nil {
+		u.log.With(slog.Any("error", err)).Error("CompleteMultipartUpload sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	u.deleteState(r)
+
+	sealed, err := u.seal(r.Context(), dek, partNumbers, output.VersionId)
+	if err != nil {
+		recordCryptoFailure(r.Context(), cryptoEncrypt)
+		u.log.With(slog.Any("error", err)).Error("CompleteMultipartUpload adding parts tag")
+		writeS3Error(w, err)
+		return
+	}
+	output.VersionId = sealed.VersionId
+	if sealed.CopyObjectResult != nil && sealed.CopyObjectResult.ETag != nil {
+		output.ETag = sealed.CopyObjectResult.ETag
+	}
+
+	if output.VersionId != nil {
+		w.Header().Set("x-amz-version-id", *output.VersionId)
+	}
+	if output.Expiration != nil {
+		w.Header().Set("x-amz-expiration", *output.Expiration)
+	}
+	if output.ServerSideEncryption != "" {
+		w.Header().Set("x-amz-server-side-encryption", string(output.ServerSideEncryption))
+	}
+
+	result := completeMultipartUploadResult{
+		Bucket: u.bucket,
+		Key:    u.key,
+	}
+	if output.Location != nil {
+		result.Location = *output.Location
+	}
+	if output.ETag != nil {
+		result.ETag = *output.ETag
+	}
+	writeXML(w, result, u.log)
+}
+
+// abort is a http.HandlerFunc that implements AbortMultipartUpload.
+func (u multipartUpload) abort(w http.ResponseWriter, r *http.Request) {
+	u.log.With(slog.String("key", u.key), slog.String("bucket", u.bucket)).Debug("abortMultipartUpload")
+
+	if _, err := u.client.AbortMultipartUpload(r.Context(), u.bucket, u.key, u.uploadID); err != nil {
+		u.log.With(slog.Any("error", err)).Error("AbortMultipartUpload sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	u.deleteState(r)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// seal adds the parts tag of the completed upload to the object's metadata.
+// S3 can't change the metadata of an existing object, so the object is copied onto itself.
+// In versioned buckets, the version without the parts tag is removed afterwards, since it can't be decrypted.
+func (u multipartUpload) seal(ctx context.Context, dek []byte, partNumbers []uint32, versionID *string) (*s3.CopyObjectOutput, error) {
+	tag, err := crypto.PartsTag(dek, partNumbers)
+	if err != nil {
+		return nil, err
+	}
+
+	var completedVersion string
+	if versionID != nil {
+		completedVersion = *versionID
+	}
+	head, err := u.client.HeadObject(ctx, u.bucket, u.key, completedVersion, u.sseCustomerAlgorithm, u.sseCustomerKey, u.sseCustomerKeyMD5)
+	if err != nil {
+		return nil, fmt.Errorf("fetching metadata: %w", err)
+	}
+	metadata := maps.Clone(head.Metadata)
+	metadata[partsTag] = hex.EncodeToString(tag)
+
+	output, err := u.client.ReplaceObjectMetadata(ctx, u.bucket, u.key, head, metadata, u.sseCustomerAlgorithm, u.sseCustomerKey, u.sseCustomerKeyMD5)
+	if err != nil {
+		return nil, fmt.Errorf("replacing metadata: %w", err)
+	}
+
+	// Buckets with suspended versioning overwrite the "null" version, so it must not be deleted.
+	if completedVersion != "" && completedVersion != "null" && (output.VersionId == nil || *output.VersionId != completedVersion) {
+		if _, err := u.client.DeleteObject(ctx, u.bucket, u.key, completedVersion); err != nil {
+			u.log.With(slog.Any("error", err), slog.String("versionID", completedVersion)).Warn("Deleting object version without parts tag")
+		}
+	}
+	return output, nil
+}
+
+// dek fetches and decrypts the DEK of the upload.
+func (u multipartUpload) dek(r *http.Request) ([]byte, error) {
+	output, err := u.client.GetObject(r.Context(), u.bucket, uploadStateKey(u.uploadID), "", "", "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	encryptedDEK, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading upload DEK: %w", err)
+	}
+
+	return u.keks.unwrap(encryptedDEK, output.Metadata)
+}
+
+// deleteState removes the stored DEK of a finished upload.
+// Failing to do so is not fatal for the client, since the DEK is only of use together with the KEK.
+func (u multipartUpload) deleteState(r *http.Request) {
+	if _, err := u.client.DeleteObject(r.Context(), u.bucket, uploadStateKey(u.uploadID), ""); err != nil {
+		u.log.With(slog.Any("error", err), slog.String("uploadID", u.uploadID)).Warn("Deleting upload DEK")
+	}
+}
+
+// uploadStateKey returns the key of the object holding the encrypted DEK of the given upload.
+func uploadStateKey(uploadID string) string {
+	return uploadStatePrefix + uploadID
+}
+
+// initiateMultipartUploadResult is the XML response of CreateMultipartUpload.
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// completeMultipartUploadRequest is the XML request body of CompleteMultipartUpload.
+type completeMultipartUploadRequest struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	ETag       string `xml:"ETag"`
+	PartNumber int32  `xml:"PartNumber"`
+}
+
+// completeMultipartUploadResult is the XML response of CompleteMultipartUpload.
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
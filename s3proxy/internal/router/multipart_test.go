@@ -0,0 +1,222 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	aeadsubtle "github.com/tink-crypto/tink-go/v2/aead/subtle"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	testCases := map[string]struct {
+		parts       [][]byte
+		partNumbers []int32
+		keyID       string
+	}{
+		"single part": {
+			parts:       [][]byte{[]byte("hello, world")},
+			partNumbers: []int32{1},
+		},
+		"multiple parts": {
+			parts:       [][]byte{bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 512), bytes.Repeat([]byte("c"), 16)},
+			partNumbers: []int32{1, 2, 3},
+		},
+		"parts uploaded out of order": {
+			parts:       [][]byte{[]byte("world"), []byte("hello, ")},
+			partNumbers: []int32{7, 3},
+		},
+		"non-default KEK": {
+			parts:       [][]byte{[]byte("hello, world")},
+			partNumbers: []int32{1},
+			keyID:       "team-a",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := newStubS3Client()
+			keks := newTestKEKs([32]byte{0x1})
+			if tc.keyID != "" {
+				keks.id = tc.keyID
+			}
+			log := logger.NewTest(t)
+
+			upload := multipartUpload{keks: keks, client: client, key: "key", bucket: "bucket", metadata: map[string]string{}, log: log}
+			resp := httptest.NewRecorder()
+			upload.create(resp, httptest.NewRequest(http.MethodPost, "/bucket/key?uploads", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			require.Len(client.uploads, 1)
+			var uploadID string
+			for id := range client.uploads {
+				uploadID = id
+			}
+			assert.Contains(resp.Body.String(), uploadID)
+
+			etags := map[int32]string{}
+			for i, partNumber := range tc.partNumbers {
+				upload := multipartUpload{keks: keks, client: client, key: "key", bucket: "bucket", uploadID: uploadID, partNumber: partNumber, body: bytes.NewReader(tc.parts[i]), contentLength: int64(len(tc.parts[i])), log: log}
+				resp := httptest.NewRecorder()
+				upload.uploadPart(resp, httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+				require.Equal(http.StatusOK, resp.Code)
+
+				assert.NotContains(string(client.uploads[uploadID].parts[partNumber]), string(tc.parts[i]))
+				etags[partNumber] = resp.Header().Get("ETag")
+			}
+
+			// Parts have to be listed in ascending order.
+			sorted := slices.Clone(tc.partNumbers)
+			slices.Sort(sorted)
+			var completeBody strings.Builder
+			var want []byte
+			completeBody.WriteString("<CompleteMultipartUpload>")
+			for _, partNumber := range sorted {
+				fmt.Fprintf(&completeBody, "<Part><ETag>%s</ETag><PartNumber>%d</PartNumber></Part>", etags[partNumber], partNumber)
+				want = append(want, tc.parts[slices.Index(tc.partNumbers, partNumber)]...)
+			}
+			completeBody.WriteString("</CompleteMultipartUpload>")
+
+			upload = multipartUpload{keks: keks, client: client, key: "key", bucket: "bucket", uploadID: uploadID, log: log}
+			resp = httptest.NewRecorder()
+			upload.complete(resp, httptest.NewRequest(http.MethodPost, "/bucket/key", strings.NewReader(completeBody.String())))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Empty(client.uploads)
+			assert.NotContains(client.objects, uploadStateKey(uploadID))
+
+			obj := object{keks: keks, client: client, key: "key", bucket: "bucket", log: log}
+			resp = httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/key", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Equal(string(want), resp.Body.String())
+			assert.Contains(client.objects["key"].metadata, partsTag)
+
+			// Dropping the last part is detected, even though the remaining parts decrypt fine.
+			if len(tc.parts) > 1 {
+				stored := client.objects["key"]
+				first, err := crypto.ParseStreamHeader(stored.body[:crypto.HeaderSize])
+				require.NoError(err)
+				plaintext, _, err := obj.decrypt(bytes.NewReader(stored.body[:first.CiphertextSize()]), stored.metadata, nil)
+				require.NoError(err)
+				_, err = io.ReadAll(plaintext)
+				assert.Error(err)
+			}
+		})
+	}
+}
+
+func TestGetMultipartWithoutPartsTag(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	client := newStubS3Client()
+	keks := newTestKEKs([32]byte{0x1})
+	dek := crypto.GenerateDEK()
+	body, _ := encryptParts(t, dek, []byte("hello, "), []byte("world"))
+	metadata := map[string]string{formatTag: formatSegmented}
+	encryptedDEK, err := keks.wrap(dek, metadata)
+	require.NoError(err)
+	metadata[dekTag] = hex.EncodeToString(encryptedDEK)
+	client.objects["key"] = stubObject{body: body, metadata: metadata}
+
+	obj := object{keks: keks, client: client, key: "key", bucket: "bucket", log: logger.NewTest(t)}
+	plaintext, _, err := obj.decrypt(bytes.NewReader(body), metadata, nil)
+	require.NoError(err)
+	_, err = io.ReadAll(plaintext)
+	assert.ErrorIs(err, crypto.ErrNoPartsTag)
+
+	// Ranges are checked against the parts tag before anything is sent.
+	req := httptest.NewRequest(http.MethodGet, "/bucket/key", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	resp := httptest.NewRecorder()
+	obj.get(resp, req)
+	assert.Equal(http.StatusInternalServerError, resp.Code)
+}
+
+// encryptParts encrypts the given parts like a multipart upload, using part numbers starting at 1.
+// It returns the body of the completed upload and its stream indices.
+func encryptParts(t *testing.T, dek []byte, parts ...[]byte) ([]byte, []uint32) {
+	t.Helper()
+	var body []byte
+	var indices []uint32
+	for i, part := range parts {
+		indices = append(indices, uint32(i+1))
+		encrypter, err := crypto.NewEncryptingReader(bytes.NewReader(part), dek, indices[i], int64(len(part)))
+		require.NoError(t, err)
+		ciphertext, err := io.ReadAll(encrypter)
+		require.NoError(t, err)
+		body = append(body, ciphertext...)
+	}
+	return body, indices
+}
+
+// encryptLegacyParts encrypts the given parts like multipart uploads completed by previous versions of s3proxy,
+// using part numbers starting at 1. It returns the body of the completed upload and its part numbers.
+func encryptLegacyParts(t *testing.T, dek []byte, parts ...[]byte) ([]byte, []uint32) {
+	t.Helper()
+	aesgcm, err := aeadsubtle.NewAESGCMSIV(dek)
+	require.NoError(t, err)
+
+	var body []byte
+	var partNumbers []uint32
+	for i, part := range parts {
+		partNumbers = append(partNumbers, uint32(i+1))
+		header := make([]byte, crypto.PartHeaderSize)
+		binary.BigEndian.PutUint32(header, partNumbers[i])
+		ciphertext, err := aesgcm.Encrypt(part, header[:4])
+		require.NoError(t, err)
+		binary.BigEndian.PutUint64(header[4:], uint64(len(ciphertext)))
+		body = append(append(body, header...), ciphertext...)
+	}
+	return body, partNumbers
+}
+
+func TestAbortMultipartUpload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	client := newStubS3Client()
+	log := logger.NewTest(t)
+
+	upload := multipartUpload{keks: newTestKEKs([32]byte{0x1}), client: client, key: "key", bucket: "bucket", metadata: map[string]string{}, log: log}
+	resp := httptest.NewRecorder()
+	upload.create(resp, httptest.NewRequest(http.MethodPost, "/bucket/key?uploads", nil))
+	require.Equal(http.StatusOK, resp.Code)
+	require.Len(client.uploads, 1)
+	require.Len(client.objects, 1)
+
+	for id := range client.uploads {
+		upload.uploadID = id
+	}
+	resp = httptest.NewRecorder()
+	upload.abort(resp, httptest.NewRequest(http.MethodDelete, "/bucket/key", nil))
+	assert.Equal(http.StatusNoContent, resp.Code)
+	assert.Empty(client.uploads)
+	assert.Empty(client.objects)
+
+	// Parts of unknown uploads can not be encrypted.
+	upload.partNumber = 1
+	upload.body = strings.NewReader("hello, world")
+	upload.contentLength = 12
+	resp = httptest.NewRecorder()
+	upload.uploadPart(resp, httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+	assert.NotEqual(http.StatusOK, resp.Code)
+}
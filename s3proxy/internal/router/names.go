@@ -0,0 +1,293 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+)
+
+var (
+	// nameElementPattern matches the elements of S3 XML responses that hold object keys or key prefixes.
+	nameElementPattern = regexp.MustCompile(`<(Key|Prefix|StartAfter|Marker|NextMarker|KeyMarker|NextKeyMarker)>([^<]*)</(?:Key|Prefix|StartAfter|Marker|NextMarker|KeyMarker|NextKeyMarker)>`)
+	// listEntryPattern matches the entries of listings.
+	listEntryPattern = regexp.MustCompile(`(?s)<(Contents|CommonPrefixes|Version|DeleteMarker|Upload)>.*?</(?:Contents|CommonPrefixes|Version|DeleteMarker|Upload)>`)
+	keyCountPattern  = regexp.MustCompile(`<KeyCount>\d+</KeyCount>`)
+	// listQueryParameters are the query parameters of listings that hold object keys or key prefixes.
+	listQueryParameters = []string{"start-after", "marker", "key-marker"}
+)
+
+// nameKeyID returns the keyservice ID of the key that encrypts object keys and metadata of objects using the given KEK ID.
+// Name keys are not versioned, since objects would have to be renamed when rotating them.
+func nameKeyID(id string) string {
+	return id + "-names"
+}
+
+// fetchNameCiphers fetches the name keys of all given KEK IDs from the keyservice.
+func fetchNameCiphers(ctx context.Context, kms dataKeyGetter, ids []string) (map[string]*crypto.NameCipher, error) {
+	names := make(map[string]*crypto.NameCipher, len(ids))
+	for _, id := range ids {
+		key, err := kms.GetDataKey(ctx, nameKeyID(id), crypto.NameKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("getting name key %s: %w", id, err)
+		}
+		if names[id], err = crypto.NewNameCipher(key); err != nil {
+			return nil, fmt.Errorf("creating name cipher %s: %w", id, err)
+		}
+	}
+	return names, nil
+}
+
+// ruleNames returns the name cipher of a policy rule, or nil if the rule doesn't encrypt names.
+func ruleNames(rule PolicyRule, names map[string]*crypto.NameCipher) *crypto.NameCipher {
+	if !rule.EncryptNames {
+		return nil
+	}
+	return names[rule.keyID()]
+}
+
+// encryptObjectRequest rewrites a request for an object, so S3 only sees the encrypted object key and metadata values.
+// It returns the rewritten request and the encrypted key.
+func encryptObjectRequest(req *http.Request, key string, names *crypto.NameCipher) (*http.Request, string, error) {
+	encryptedKey, err := names.EncryptKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encrypted := req.Clone(req.Context())
+	// The key is at the end of the path, both for virtual-hosted-style and path-style requests.
+	encrypted.URL.Path = strings.TrimSuffix(req.URL.Path, key) + encryptedKey
+	encrypted.URL.RawPath = ""
+	for name, values := range encrypted.Header {
+		metadataName, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-")
+		if !ok {
+			continue
+		}
+		value, err := names.EncryptMetadata(metadataName, strings.Join(values, ","))
+		if err != nil {
+			return nil, "", err
+		}
+		encrypted.Header[name] = []string{value}
+	}
+	return encrypted, encryptedKey, nil
+}
+
+// encryptListRequest rewrites the query of a listing, so S3 lists the objects by their encrypted keys.
+// Since key segments are encrypted on their own, only prefixes ending with "/" can be encrypted.
+// If the requested prefix ends within a segment, S3 lists the whole directory and the returned prefix
+// is the one the decrypted listing must be filtered by.
+func encryptListRequest(req *http.Request, names *crypto.NameCipher) (*http.Request, string, error) {
+	query := req.URL.Query()
+	var filterPrefix string
+	if prefix := query.Get("prefix"); prefix != "" {
+		dir := prefix[:strings.LastIndex(prefix, "/")+1]
+		encryptedDir, err := names.EncryptKey(dir)
+		if err != nil {
+			return nil, "", err
+		}
+		query.Set("prefix", encryptedDir)
+		if dir != prefix {
+			filterPrefix = prefix
+		}
+	}
+	for _, param := range listQueryParameters {
+		if value := query.Get(param); value != "" {
+			encrypted, err := names.EncryptKey(value)
+			if err != nil {
+				return nil, "", err
+			}
+			query.Set(param, encrypted)
+		}
+	}
+
+	encrypted := req.Clone(req.Context())
+	encrypted.URL.RawQuery = query.Encode()
+	return encrypted, filterPrefix, nil
+}
+
+// isDeleteObjects returns true for DeleteObjects requests, which name the objects to delete in their body.
+func isDeleteObjects(method string, query url.Values) bool {
+	return method == http.MethodPost && query.Has("delete")
+}
+
+// handleNamesNotImplemented rejects requests that name objects in places s3proxy doesn't encrypt.
+func handleNamesNotImplemented(operation string, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("operation", operation)).Error("operation is not supported for encrypted object names")
+		http.Error(w, fmt.Sprintf("%s is not supported for buckets with encrypted object names", operation), http.StatusNotImplemented)
+	}
+}
+
+// nameDecryptingWriter decrypts object keys and metadata values in responses for objects with encrypted names.
+type nameDecryptingWriter struct {
+	http.ResponseWriter
+	names *crypto.NameCipher
+	// rewriteBody enables decrypting object keys in successful response bodies.
+	// It must be false for responses that hold object data. Bodies of error responses are always rewritten.
+	rewriteBody bool
+	// urlEncoded is set if S3 URL-encodes the object keys in the response body.
+	urlEncoded bool
+	// filterPrefix removes list entries whose decrypted key doesn't start with it.
+	filterPrefix string
+
+	wroteHeader bool
+	status      int
+	body        *bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.
+// If the body is rewritten, writing the header is delayed until the whole body is written.
+func (w *nameDecryptingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	for name, values := range w.Header() {
+		metadataName, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-")
+		if !ok {
+			continue
+		}
+		for i, value := range values {
+			if plaintext, err := w.names.DecryptMetadata(metadataName, value); err == nil {
+				values[i] = plaintext
+			}
+		}
+	}
+
+	if w.rewriteBody || status >= http.StatusMultipleChoices {
+		w.status = status
+		w.body = &bytes.Buffer{}
+		w.Header().Del("Content-Length")
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *nameDecryptingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.ResponseWriter.
+func (w *nameDecryptingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flush writes the rewritten body. It must be called after the handler returns.
+func (w *nameDecryptingWriter) flush() error {
+	if w.body == nil {
+		return nil
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.decryptBody(w.body.Bytes()))
+	return err
+}
+
+// decryptBody decrypts the object keys in an XML response body and filters list entries by the plaintext prefix.
+func (w *nameDecryptingWriter) decryptBody(body []byte) []byte {
+	body = nameElementPattern.ReplaceAllFunc(body, func(element []byte) []byte {
+		match := nameElementPattern.FindSubmatch(element)
+		return []byte(fmt.Sprintf("<%s>%s</%s>", match[1], w.decryptName(string(match[2])), match[1]))
+	})
+	if w.filterPrefix == "" {
+		return body
+	}
+
+	removed := 0
+	body = listEntryPattern.ReplaceAllFunc(body, func(entry []byte) []byte {
+		match := nameElementPattern.FindSubmatch(entry)
+		if match == nil || strings.HasPrefix(w.unescapeName(string(match[2])), w.filterPrefix) {
+			return entry
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		body = keyCountPattern.ReplaceAllFunc(body, func(element []byte) []byte {
+			count, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(string(element), "<KeyCount>"), "</KeyCount>"))
+			return []byte(fmt.Sprintf("<KeyCount>%d</KeyCount>", max(count-removed, 0)))
+		})
+	}
+	return body
+}
+
+// decryptName decrypts the segments of an object key as it appears in an XML response body.
+// Segments that aren't encrypted with the name key, e.g., of objects written before names were encrypted, are kept.
+func (w *nameDecryptingWriter) decryptName(raw string) string {
+	segments := strings.Split(raw, "/")
+	for i, segment := range segments {
+		if w.urlEncoded {
+			if unescaped, err := url.QueryUnescape(segment); err == nil {
+				segment = unescaped
+			}
+		}
+		plaintext, err := w.names.DecryptSegment(segment)
+		if err != nil {
+			continue
+		}
+		if w.urlEncoded {
+			plaintext = sigV4Escape(plaintext)
+		}
+		var escaped strings.Builder
+		_ = xml.EscapeText(&escaped, []byte(plaintext))
+		segments[i] = escaped.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+// unescapeName returns the plaintext of an object key as it appears in an XML response body.
+func (w *nameDecryptingWriter) unescapeName(raw string) string {
+	name := html.UnescapeString(raw)
+	if w.urlEncoded {
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			return unescaped
+		}
+	}
+	return name
+}
+
+// decryptKey decrypts an object key listed by the S3 API with the first of the given name ciphers that decrypts all of its segments.
+// It returns the cipher that decrypted the key, or nil if the key isn't encrypted.
+func decryptKey(key string, names map[string]*crypto.NameCipher) (string, *crypto.NameCipher) {
+	for _, cipher := range names {
+		segments := strings.Split(key, "/")
+		decrypted := true
+		for i, segment := range segments {
+			if segment == "" {
+				continue
+			}
+			plaintext, err := cipher.DecryptSegment(segment)
+			if err != nil {
+				decrypted = false
+				break
+			}
+			segments[i] = plaintext
+		}
+		if decrypted {
+			return strings.Join(segments, "/"), cipher
+		}
+	}
+	return key, nil
+}
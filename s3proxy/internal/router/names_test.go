@@ -0,0 +1,308 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptObjectRequest(t *testing.T) {
+	names := newTestNameCipher(t, 0x1)
+
+	testCases := map[string]struct {
+		target     string
+		key        string
+		wantPrefix string
+	}{
+		"path-style": {
+			target:     "https://s3.example.com/bucket/dir/object",
+			key:        "dir/object",
+			wantPrefix: "/bucket/",
+		},
+		"virtual-hosted-style": {
+			target:     "https://bucket.s3.example.com/dir/object",
+			key:        "dir/object",
+			wantPrefix: "/",
+		},
+		"escaped key": {
+			target:     "https://s3.example.com/bucket/dir/some%20object",
+			key:        "dir/some object",
+			wantPrefix: "/bucket/",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			req := httptest.NewRequest(http.MethodPut, tc.target, nil)
+			req.Header.Set("x-amz-meta-Owner", "alice")
+			req.Header.Set("Content-Type", "text/plain")
+
+			encrypted, encryptedKey, err := encryptObjectRequest(req, tc.key, names)
+			require.NoError(err)
+
+			wantKey, err := names.EncryptKey(tc.key)
+			require.NoError(err)
+			assert.Equal(wantKey, encryptedKey)
+			assert.Equal(tc.wantPrefix+wantKey, encrypted.URL.Path)
+			assert.NotContains(encrypted.URL.Path, "object")
+
+			owner := encrypted.Header.Get("x-amz-meta-Owner")
+			assert.NotEqual("alice", owner)
+			plaintext, err := names.DecryptMetadata("owner", owner)
+			require.NoError(err)
+			assert.Equal("alice", plaintext)
+			assert.Equal("text/plain", encrypted.Header.Get("Content-Type"))
+
+			// The original request is left unchanged.
+			assert.Equal("alice", req.Header.Get("x-amz-meta-Owner"))
+		})
+	}
+}
+
+func TestEncryptListRequest(t *testing.T) {
+	names := newTestNameCipher(t, 0x1)
+	encryptKey := func(key string) string {
+		encrypted, err := names.EncryptKey(key)
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	testCases := map[string]struct {
+		query            url.Values
+		wantQuery        url.Values
+		wantFilterPrefix string
+	}{
+		"no prefix": {
+			query:     url.Values{"list-type": {"2"}},
+			wantQuery: url.Values{"list-type": {"2"}},
+		},
+		"directory prefix": {
+			query:     url.Values{"list-type": {"2"}, "prefix": {"a/b/"}, "delimiter": {"/"}},
+			wantQuery: url.Values{"list-type": {"2"}, "prefix": {encryptKey("a/b/")}, "delimiter": {"/"}},
+		},
+		"partial prefix": {
+			query:            url.Values{"list-type": {"2"}, "prefix": {"a/b/fil"}},
+			wantQuery:        url.Values{"list-type": {"2"}, "prefix": {encryptKey("a/b/")}},
+			wantFilterPrefix: "a/b/fil",
+		},
+		"partial prefix without directory": {
+			query:            url.Values{"prefix": {"fil"}},
+			wantQuery:        url.Values{"prefix": {""}},
+			wantFilterPrefix: "fil",
+		},
+		"start after": {
+			query:     url.Values{"list-type": {"2"}, "start-after": {"a/file"}},
+			wantQuery: url.Values{"list-type": {"2"}, "start-after": {encryptKey("a/file")}},
+		},
+		"marker": {
+			query:     url.Values{"marker": {"a/file"}},
+			wantQuery: url.Values{"marker": {encryptKey("a/file")}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, "https://s3.example.com/bucket?"+tc.query.Encode(), nil)
+			encrypted, filterPrefix, err := encryptListRequest(req, names)
+			require.NoError(err)
+			assert.Equal(tc.wantQuery, encrypted.URL.Query())
+			assert.Equal(tc.wantFilterPrefix, filterPrefix)
+		})
+	}
+}
+
+func TestNameDecryptingWriter(t *testing.T) {
+	names := newTestNameCipher(t, 0x1)
+	encryptKey := func(key string) string {
+		encrypted, err := names.EncryptKey(key)
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	testCases := map[string]struct {
+		writer   nameDecryptingWriter
+		status   int
+		body     string
+		wantBody string
+	}{
+		"listing": {
+			writer: nameDecryptingWriter{rewriteBody: true},
+			status: http.StatusOK,
+			body: "<ListBucketResult><Prefix>" + encryptKey("dir/") + "</Prefix><KeyCount>2</KeyCount>" +
+				"<Contents><Key>" + encryptKey("dir/a&b") + "</Key></Contents>" +
+				"<CommonPrefixes><Prefix>" + encryptKey("dir/sub/") + "</Prefix></CommonPrefixes></ListBucketResult>",
+			wantBody: "<ListBucketResult><Prefix>dir/</Prefix><KeyCount>2</KeyCount>" +
+				"<Contents><Key>dir/a&amp;b</Key></Contents>" +
+				"<CommonPrefixes><Prefix>dir/sub/</Prefix></CommonPrefixes></ListBucketResult>",
+		},
+		"filtered listing": {
+			writer: nameDecryptingWriter{rewriteBody: true, filterPrefix: "dir/fi"},
+			status: http.StatusOK,
+			body: "<ListBucketResult><KeyCount>3</KeyCount>" +
+				"<Contents><Key>" + encryptKey("dir/file") + "</Key></Contents>" +
+				"<Contents><Key>" + encryptKey("dir/other") + "</Key></Contents>" +
+				"<CommonPrefixes><Prefix>" + encryptKey("dir/files/") + "</Prefix></CommonPrefixes></ListBucketResult>",
+			wantBody: "<ListBucketResult><KeyCount>2</KeyCount>" +
+				"<Contents><Key>dir/file</Key></Contents>" +
+				"<CommonPrefixes><Prefix>dir/files/</Prefix></CommonPrefixes></ListBucketResult>",
+		},
+		"url-encoded listing": {
+			writer:   nameDecryptingWriter{rewriteBody: true, urlEncoded: true, filterPrefix: "dir/some "},
+			status:   http.StatusOK,
+			body:     "<ListBucketResult><Contents><Key>" + encryptKey("dir/some file") + "</Key></Contents></ListBucketResult>",
+			wantBody: "<ListBucketResult><Contents><Key>dir/some%20file</Key></Contents></ListBucketResult>",
+		},
+		"unencrypted keys are kept": {
+			writer:   nameDecryptingWriter{rewriteBody: true},
+			status:   http.StatusOK,
+			body:     "<ListBucketResult><Contents><Key>dir/plaintext</Key></Contents></ListBucketResult>",
+			wantBody: "<ListBucketResult><Contents><Key>dir/plaintext</Key></Contents></ListBucketResult>",
+		},
+		"error response": {
+			status:   http.StatusNotFound,
+			body:     "<Error><Code>NoSuchKey</Code><Key>" + encryptKey("dir/file") + "</Key></Error>",
+			wantBody: "<Error><Code>NoSuchKey</Code><Key>dir/file</Key></Error>",
+		},
+		"object data": {
+			status:   http.StatusOK,
+			body:     "<Key>" + encryptKey("dir/file") + "</Key>",
+			wantBody: "<Key>" + encryptKey("dir/file") + "</Key>",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			resp := httptest.NewRecorder()
+			writer := tc.writer
+			writer.ResponseWriter = resp
+			writer.names = names
+
+			owner, err := names.EncryptMetadata("owner", "alice")
+			require.NoError(err)
+			writer.Header().Set("x-amz-meta-owner", owner)
+			writer.WriteHeader(tc.status)
+			_, err = writer.Write([]byte(tc.body))
+			require.NoError(err)
+			require.NoError(writer.flush())
+
+			assert.Equal(tc.status, resp.Code)
+			assert.Equal(tc.wantBody, resp.Body.String())
+			assert.Equal("alice", resp.Header().Get("x-amz-meta-owner"))
+		})
+	}
+}
+
+func TestServeEncryptsNames(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "PROXYKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "proxy-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	require := require.New(t)
+	assert := assert.New(t)
+
+	backend := newFakeS3Backend()
+	server := httptest.NewTLSServer(backend)
+	defer server.Close()
+
+	config := s3client.Config{Region: "us-east-1", Endpoint: server.URL, UsePathStyle: true, HTTPClient: server.Client()}
+	endpoint, err := parseEndpoint(config.Endpoint)
+	require.NoError(err)
+	signer, err := s3client.NewSigner(config)
+	require.NoError(err)
+	names := newTestNameCipher(t, 0x2)
+	router := Router{
+		backend:  config,
+		endpoint: endpoint,
+		policy: Policy{Rules: []PolicyRule{
+			{Bucket: "bucket", Prefix: "secret/", Action: ActionEncrypt, KeyID: "team-a", EncryptNames: true},
+			{Bucket: "bucket", Action: ActionEncrypt},
+		}},
+		keys: keyring{
+			defaultKEKID: newTestKEKs([32]byte{0x1}),
+			"team-a":     {id: "team-a", current: 1, versions: map[uint32][32]byte{1: {0x3}}},
+		},
+		names:       map[string]*crypto.NameCipher{"team-a": names},
+		credentials: Credentials{Keys: []AccessKey{testAccessKey}},
+		signer:      signer,
+		log:         logger.NewTest(t),
+	}
+
+	serve := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp := httptest.NewRecorder()
+		router.Serve(resp, signRequest(t, req, testAccessKey, time.Now(), 0, body))
+		return resp
+	}
+
+	resp := serve(http.MethodPut, "https://s3proxy.example.com/bucket/secret/report.txt", "content", http.Header{"X-Amz-Meta-Owner": {"alice"}})
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	resp = serve(http.MethodPut, "https://s3proxy.example.com/bucket/public.txt", "public", nil)
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	// S3 neither sees the key nor the metadata value.
+	encryptedKey, err := names.EncryptKey("secret/report.txt")
+	require.NoError(err)
+	require.Contains(backend.objects, "bucket/"+encryptedKey)
+	assert.Contains(backend.objects, "bucket/public.txt")
+	assert.NotEqual("alice", backend.objects["bucket/"+encryptedKey].metadata["owner"])
+	assert.NotContains(string(backend.objects["bucket/"+encryptedKey].body), "content")
+
+	resp = serve(http.MethodGet, "https://s3proxy.example.com/bucket/secret/report.txt", "", nil)
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal("content", resp.Body.String())
+
+	resp = serve(http.MethodHead, "https://s3proxy.example.com/bucket/secret/report.txt", "", nil)
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal("alice", resp.Header().Get("x-amz-meta-owner"))
+	assert.NotEmpty(resp.Header().Get("Content-Length"))
+
+	// Listing the prefix decrypts the keys.
+	resp = serve(http.MethodGet, "https://s3proxy.example.com/bucket?list-type=2&prefix=secret%2Frep", "", nil)
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(resp.Body.String(), "<Key>secret/report.txt</Key>")
+	assert.Contains(resp.Body.String(), "<KeyCount>1</KeyCount>")
+	assert.NotContains(resp.Body.String(), "public.txt")
+
+	// Listing the bucket doesn't use the name key of the prefix.
+	resp = serve(http.MethodGet, "https://s3proxy.example.com/bucket?list-type=2", "", nil)
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(resp.Body.String(), "<Key>"+encryptedKey+"</Key>")
+	assert.Contains(resp.Body.String(), "<Key>public.txt</Key>")
+
+	resp = serve(http.MethodPost, "https://s3proxy.example.com/bucket?delete", "<Delete></Delete>", nil)
+	assert.Equal(http.StatusNotImplemented, resp.Code)
+}
+
+func newTestNameCipher(t *testing.T, b byte) *crypto.NameCipher {
+	t.Helper()
+	names, err := crypto.NewNameCipher(bytes.Repeat([]byte{b}, crypto.NameKeySize))
+	require.NoError(t, err)
+	return names
+}
@@ -7,8 +7,13 @@ SPDX-License-Identifier: BUSL-1.1
 package router
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -19,6 +24,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
 )
 
@@ -26,15 +32,28 @@ const (
 	// dekTag is the name of the header that holds the encrypted data encryption key for the attached object. Presence of the key implies the object needs to be decrypted.
 	// Use lowercase only, as AWS automatically lowercases all metadata keys.
 	dekTag = "constellation-dek"
+	// formatTag is the name of the header that holds the format of an encrypted object's body.
+	// Objects without this header were written by PutObject as a single ciphertext.
+	formatTag = "constellation-format"
+	// formatSegmented marks objects encrypted in the segmented stream format.
+	// Objects written by PutObject consist of a single stream, completed multipart uploads of one stream per part.
+	formatSegmented = "segmented"
+	// formatMultipart marks objects assembled from a multipart upload by previous versions of s3proxy.
+	// Their body is a sequence of parts, each encrypted as a single ciphertext.
+	formatMultipart = "multipart"
+	// partsTag is the name of the header that holds the parts tag of a completed multipart upload in the segmented format.
+	// It authenticates which parts the object consists of. See crypto.PartsTag.
+	partsTag = "constellation-parts"
 )
 
 // object bundles data to implement http.Handler methods that use data from incoming requests.
 type object struct {
-	kek                       [32]byte
+	keks                      keyEncryptionKeys
 	client                    s3Client
 	key                       string
 	bucket                    string
-	data                      []byte
+	body                      io.Reader
+	contentLength             int64
 	query                     url.Values
 	tags                      string
 	contentType               string
@@ -52,27 +71,56 @@ type object struct {
 func (o object) get(w http.ResponseWriter, r *http.Request) {
 	o.log.With(slog.String("key", o.key), slog.String("host", o.bucket)).Debug("getObject")
 
-	versionID, ok := o.query["versionId"]
-	if !ok {
-		versionID = []string{""}
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		o.getRange(w, r, byteRange)
+		return
 	}
 
-	output, err := o.client.GetObject(r.Context(), o.bucket, o.key, versionID[0], o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	output, err := o.client.GetObject(r.Context(), o.bucket, o.key, o.versionID(), "", o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
 	if err != nil {
 		// log with Info as it might be expected behavior (e.g. object not found).
 		o.log.With(slog.Any("error", err)).Error("GetObject sending request to S3")
 
-		// We want to forward error codes from the s3 API to clients as much as possible.
-		code := parseErrorCode(err)
-		if code != 0 {
-			http.Error(w, err.Error(), code)
-			return
-		}
+		writeS3Error(w, err)
+		return
+	}
+	defer output.Body.Close()
+
+	setGetObjectHeaders(w, output)
+
+	plaintext, contentLength, err := o.decrypt(output.Body, output.Metadata, output.ContentLength)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject decrypting response")
+		writeDecryptError(w, r, err)
+		return
+	}
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, plaintext); err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject sending response")
+		// The status code is already sent. Abort the response so clients don't mistake a partial body for the whole object.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// put is a http.HandlerFunc that implements the PUT method for objects.
+func (o object) put(w http.ResponseWriter, r *http.Request) {
+	output, err := o.upload(r.Context())
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("PutObject sending request to S3")
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUploadError(w, err, o.body, o.log)
 		return
 	}
 
+	w.Header().Set("x-amz-server-side-encryption", string(output.ServerSideEncryption))
+
+	if output.VersionId != nil {
+		w.Header().Set("x-amz-version-id", *output.VersionId)
+	}
 	if output.ETag != nil {
 		w.Header().Set("ETag", strings.Trim(*output.ETag, "\""))
 	}
@@ -100,71 +148,39 @@ func (o object) get(w http.ResponseWriter, r *http.Request) {
 	if output.SSEKMSKeyId != nil {
 		w.Header().Set("x-amz-server-side-encryption-aws-kms-key-id", *output.SSEKMSKeyId)
 	}
-	if output.ServerSideEncryption != "" {
-		w.Header().Set("x-amz-server-side-encryption-context", string(output.ServerSideEncryption))
-	}
-
-	body, err := io.ReadAll(output.Body)
-	if err != nil {
-		o.log.With(slog.Any("error", err)).Error("GetObject reading S3 response")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	plaintext := body
-	rawEncryptedDEK, ok := output.Metadata[dekTag]
-	if ok {
-		encryptedDEK, err := hex.DecodeString(rawEncryptedDEK)
-		if err != nil {
-			o.log.Error("GetObject decoding DEK", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		plaintext, err = crypto.Decrypt(body, encryptedDEK, o.kek)
-		if err != nil {
-			o.log.With(slog.Any("error", err)).Error("GetObject decrypting response")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if output.SSEKMSEncryptionContext != nil {
+		w.Header().Set("x-amz-server-side-encryption-context", *output.SSEKMSEncryptionContext)
 	}
 
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(plaintext); err != nil {
-		o.log.With(slog.Any("error", err)).Error("GetObject sending response")
+	if _, err := w.Write(nil); err != nil {
+		o.log.With(slog.Any("error", err)).Error("PutObject sending response")
 	}
 }
 
-// put is a http.HandlerFunc that implements the PUT method for objects.
-func (o object) put(w http.ResponseWriter, r *http.Request) {
-	ciphertext, encryptedDEK, err := crypto.Encrypt(o.data, o.kek)
+// upload encrypts the object's body with a new DEK and streams it to S3.
+func (o object) upload(ctx context.Context) (*s3.PutObjectOutput, error) {
+	dek := crypto.GenerateDEK()
+	encryptedDEK, err := o.keks.wrap(dek, o.metadata)
 	if err != nil {
-		o.log.With(slog.Any("error", err)).Error("PutObject")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		recordCryptoFailure(ctx, cryptoEncrypt)
+		return nil, err
 	}
 	o.metadata[dekTag] = hex.EncodeToString(encryptedDEK)
+	o.metadata[formatTag] = formatSegmented
 
-	output, err := o.client.PutObject(r.Context(), o.bucket, o.key, o.tags, o.contentType, o.objectLockLegalHoldStatus, o.objectLockMode, o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5, o.objectLockRetainUntilDate, o.metadata, ciphertext)
+	ciphertext, err := crypto.NewEncryptingReader(o.body, dek, 0, o.contentLength)
 	if err != nil {
-		o.log.With(slog.Any("error", err)).Error("PutObject sending request to S3")
-
-		// We want to forward error codes from the s3 API to clients whenever possible.
-		code := parseErrorCode(err)
-		if code != 0 {
-			http.Error(w, err.Error(), code)
-			return
-		}
-
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		recordCryptoFailure(ctx, cryptoEncrypt)
+		return nil, err
 	}
 
-	w.Header().Set("x-amz-server-side-encryption", string(output.ServerSideEncryption))
+	return o.client.PutObject(ctx, o.bucket, o.key, o.tags, o.contentType, o.objectLockLegalHoldStatus, o.objectLockMode, o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5, o.objectLockRetainUntilDate, o.metadata, ciphertext, crypto.EncryptedSize(o.contentLength))
+}
 
-	if output.VersionId != nil {
-		w.Header().Set("x-amz-version-id", *output.VersionId)
-	}
+// setGetObjectHeaders sets the response headers of a GetObject request from the S3 response.
+func setGetObjectHeaders(w http.ResponseWriter, output *s3.GetObjectOutput) {
+	w.Header().Set("Accept-Ranges", "bytes")
 	if output.ETag != nil {
 		w.Header().Set("ETag", strings.Trim(*output.ETag, "\""))
 	}
@@ -192,13 +208,154 @@ func (o object) put(w http.ResponseWriter, r *http.Request) {
 	if output.SSEKMSKeyId != nil {
 		w.Header().Set("x-amz-server-side-encryption-aws-kms-key-id", *output.SSEKMSKeyId)
 	}
-	if output.SSEKMSEncryptionContext != nil {
-		w.Header().Set("x-amz-server-side-encryption-context", *output.SSEKMSEncryptionContext)
+	if output.ServerSideEncryption != "" {
+		w.Header().Set("x-amz-server-side-encryption-context", string(output.ServerSideEncryption))
+	}
+}
+
+// versionID returns the object version requested by the client, or an empty string for the current version.
+func (o object) versionID() string {
+	return o.query.Get("versionId")
+}
+
+// decrypt returns a reader for the plaintext of an object body fetched from S3.
+// The DEK is taken from the object's metadata. Objects without a DEK are returned as is.
+// The returned size is the length of the plaintext, or -1 if it is unknown before reading the whole body.
+func (o object) decrypt(body io.Reader, metadata map[string]string, contentLength *int64) (io.Reader, int64, error) {
+	rawEncryptedDEK, ok := metadata[dekTag]
+	if !ok {
+		if contentLength == nil {
+			return body, -1, nil
+		}
+		return body, *contentLength, nil
 	}
 
+	encryptedDEK, err := hex.DecodeString(rawEncryptedDEK)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding DEK: %w", err)
+	}
+	kek, err := o.keks.forMetadata(metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch metadata[formatTag] {
+	case formatSegmented:
+		dek, err := crypto.UnwrapDEK(encryptedDEK, kek)
+		if err != nil {
+			return nil, 0, err
+		}
+		tag, err := decodePartsTag(metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ciphertext := bufio.NewReader(body)
+		header, err := ciphertext.Peek(crypto.HeaderSize)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading stream header: %w", err)
+		}
+		stream, err := crypto.ParseStreamHeader(header)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Only objects written by PutObject consist of a single stream with a known size.
+		size := int64(-1)
+		if stream.Index == 0 {
+			size = stream.PlaintextSize
+		}
+
+		// Decrypt the first segment before anything is sent to the client, so common errors (e.g. a wrong KEK) can still be reported.
+		plaintext := bufio.NewReader(crypto.NewDecryptingReader(ciphertext, dek, tag))
+		if _, err := plaintext.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, err
+		}
+		return plaintext, size, nil
+	case formatMultipart:
+		dek, err := crypto.UnwrapDEK(encryptedDEK, kek)
+		if err != nil {
+			return nil, 0, err
+		}
+		tag, err := decodePartsTag(metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+		ciphertext, err := io.ReadAll(body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading S3 response: %w", err)
+		}
+		plaintext, err := crypto.DecryptParts(ciphertext, dek, tag)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(plaintext), int64(len(plaintext)), nil
+	case "":
+		ciphertext, err := io.ReadAll(body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading S3 response: %w", err)
+		}
+		plaintext, err := crypto.Decrypt(ciphertext, encryptedDEK, kek)
+		if err != nil {
+			// Objects written by previous versions of s3proxy had their DEK wrapped with an all-zero KEK.
+			var legacyErr error
+			plaintext, legacyErr = crypto.Decrypt(ciphertext, encryptedDEK, [32]byte{})
+			if legacyErr != nil {
+				return nil, 0, err
+			}
+			o.log.With(slog.String("key", o.key), slog.String("bucket", o.bucket)).Warn("Decrypted object with legacy KEK, rewrap the object to protect it with the current KEK")
+		}
+		return bytes.NewReader(plaintext), int64(len(plaintext)), nil
+	default:
+		return nil, 0, fmt.Errorf("unknown object format %q", metadata[formatTag])
+	}
+}
+
+// decodePartsTag returns the parts tag recorded in an object's metadata, or nil if the object has none.
+func decodePartsTag(metadata map[string]string) ([]byte, error) {
+	rawTag, ok := metadata[partsTag]
+	if !ok {
+		return nil, nil
+	}
+	tag, err := hex.DecodeString(rawTag)
+	if err != nil {
+		return nil, fmt.Errorf("decoding parts tag: %w", err)
+	}
+	return tag, nil
+}
+
+// writeS3Error writes an error returned by the S3 client to the response.
+// We want to forward error codes from the s3 API to clients whenever possible.
+func writeS3Error(w http.ResponseWriter, err error) {
+	code := parseErrorCode(err)
+	if code == 0 {
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// writeDecryptError writes an error that occurred while decrypting an object to the response.
+func writeDecryptError(w http.ResponseWriter, r *http.Request, err error) {
+	recordCryptoFailure(r.Context(), cryptoDecrypt)
+	if errors.Is(err, errKEKNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeXML writes an XML encoded response body with status 200.
+func writeXML(w http.ResponseWriter, v any, log *slog.Logger) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("marshalling XML response")
+		http.Error(w, fmt.Sprintf("marshalling response: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(nil); err != nil {
-		o.log.With(slog.Any("error", err)).Error("PutObject sending response")
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		log.With(slog.Any("error", err)).Error("writing XML response")
 	}
 }
 
@@ -214,6 +371,14 @@ func parseErrorCode(err error) int {
 }
 
 type s3Client interface {
-	GetObject(ctx context.Context, bucket, key, versionID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.GetObjectOutput, error)
-	PutObject(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string, body []byte) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, bucket, key, versionID, byteRange, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string, body io.Reader, contentLength int64) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, bucket, key, versionID string) (*s3.DeleteObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int32, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, body io.Reader, contentLength int64) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, parts []types.CompletedPart) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) (*s3.AbortMultipartUploadOutput, error)
+	HeadObject(ctx context.Context, bucket, key, versionID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.HeadObjectOutput, error)
+	CopyObject(ctx context.Context, sourceBucket, sourceKey, sourceVersionID, bucket, key, tags string, head *s3.HeadObjectOutput, metadata map[string]string) (*s3.CopyObjectOutput, error)
+	ReplaceObjectMetadata(ctx context.Context, bucket, key string, head *s3.HeadObjectOutput, metadata map[string]string, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.CopyObjectOutput, error)
 }
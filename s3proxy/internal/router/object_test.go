@@ -0,0 +1,151 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutGetObject(t *testing.T) {
+	testCases := map[string]struct {
+		body []byte
+	}{
+		"empty": {
+			body: []byte{},
+		},
+		"small": {
+			body: []byte("hello, world"),
+		},
+		"multiple segments": {
+			body: bytes.Repeat([]byte("hello, world"), crypto.SegmentSize/4),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := newStubS3Client()
+			kek := [32]byte{0x1}
+			log := logger.NewTest(t)
+
+			req := httptest.NewRequest(http.MethodPut, "/bucket/key", bytes.NewReader(tc.body))
+			req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha256.Sum256(tc.body)))
+			body, err := newDigestReader(req.Body, req.Header)
+			require.NoError(err)
+
+			obj := object{keks: newTestKEKs(kek), client: client, key: "key", bucket: "bucket", body: body, contentLength: int64(len(tc.body)), metadata: map[string]string{}, log: log}
+			resp := httptest.NewRecorder()
+			obj.put(resp, req)
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Equal(formatSegmented, client.objects["key"].metadata[formatTag])
+			assert.EqualValues(crypto.EncryptedSize(int64(len(tc.body))), len(client.objects["key"].body))
+
+			obj = object{keks: newTestKEKs(kek), client: client, key: "key", bucket: "bucket", log: log}
+			resp = httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/key", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Equal(strconv.Itoa(len(tc.body)), resp.Header().Get("Content-Length"))
+			assert.True(bytes.Equal(tc.body, resp.Body.Bytes()))
+		})
+	}
+}
+
+func TestPutObjectDigestMismatch(t *testing.T) {
+	testCases := map[string]struct {
+		header   http.Header
+		wantBody string
+	}{
+		"x-amz-content-sha256 mismatch": {
+			header:   http.Header{"X-Amz-Content-Sha256": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("other")))}},
+			wantBody: "XAmzContentSHA256Mismatch",
+		},
+		"content-md5 mismatch": {
+			header:   http.Header{"Content-Md5": []string{"Q2hlY2sgSW50ZWdyaXR5IQ=="}},
+			wantBody: "content-md5 mismatch",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			client := newStubS3Client()
+			data := []byte("hello, world")
+			body, err := newDigestReader(bytes.NewReader(data), tc.header)
+			require.NoError(err)
+
+			obj := object{keks: newTestKEKs([32]byte{0x1}), client: client, key: "key", bucket: "bucket", body: body, contentLength: int64(len(data)), metadata: map[string]string{}, log: logger.NewTest(t)}
+			resp := httptest.NewRecorder()
+			obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+			assert.Equal(http.StatusBadRequest, resp.Code)
+			assert.Contains(resp.Body.String(), tc.wantBody)
+			assert.Empty(client.objects)
+		})
+	}
+}
+
+func TestGetLegacyObject(t *testing.T) {
+	testCases := map[string]struct {
+		kek [32]byte
+	}{
+		"current KEK": {
+			kek: [32]byte{0x1},
+		},
+		"all-zero KEK of previous versions": {
+			kek: [32]byte{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			plaintext := []byte("hello, world")
+			ciphertext, encryptedDEK, err := crypto.Encrypt(plaintext, tc.kek)
+			require.NoError(err)
+
+			client := newStubS3Client()
+			client.objects["key"] = stubObject{body: ciphertext, metadata: map[string]string{dekTag: hex.EncodeToString(encryptedDEK)}}
+
+			obj := object{keks: newTestKEKs([32]byte{0x1}), client: client, key: "key", bucket: "bucket", log: logger.NewTest(t)}
+			resp := httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/key", nil))
+			require.Equal(http.StatusOK, resp.Code)
+			assert.Equal(string(plaintext), resp.Body.String())
+		})
+	}
+}
+
+func TestGetObjectWrongKEK(t *testing.T) {
+	client := newStubS3Client()
+	data := "hello, world"
+	obj := object{keks: newTestKEKs([32]byte{0x1}), client: client, key: "key", bucket: "bucket", body: strings.NewReader(data), contentLength: int64(len(data)), metadata: map[string]string{}, log: logger.NewTest(t)}
+	obj.put(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+	require.Contains(t, client.objects, "key")
+
+	obj = object{keks: newTestKEKs([32]byte{0x2}), client: client, key: "key", bucket: "bucket", log: logger.NewTest(t)}
+	resp := httptest.NewRecorder()
+	obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/key", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.NotContains(t, resp.Body.String(), data)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Action is what s3proxy does with requests matching a policy rule.
+type Action string
+
+const (
+	// ActionEncrypt encrypts objects written to and decrypts objects read from matching locations.
+	ActionEncrypt Action = "encrypt"
+	// ActionPassthrough forwards requests to S3 without modification.
+	ActionPassthrough Action = "passthrough"
+	// ActionDeny rejects requests.
+	ActionDeny Action = "deny"
+)
+
+// Policy maps buckets and key prefixes to the action s3proxy takes for requests to them.
+//
+// Rules are evaluated in order and the first matching rule applies.
+// Object requests that match no rule are denied.
+// Listings, e.g., ListObjectsV2, are denied if any deny rule applies to keys below the listed prefix.
+// DeleteObjects requests are denied if any of the objects they name is denied.
+// Other requests without an object key are matched against rules without a prefix.
+// If there is none, they are forwarded as long as any rule matches the bucket.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule maps a bucket and key prefix to an action.
+type PolicyRule struct {
+	// Bucket is a pattern for bucket names, using the syntax of path.Match.
+	Bucket string `yaml:"bucket"`
+	// Prefix restricts the rule to objects whose key starts with the prefix.
+	Prefix string `yaml:"prefix"`
+	// Action is the action taken for matching requests.
+	Action Action `yaml:"action"`
+	// KeyID is the keyservice ID of the KEK used by the encrypt action.
+	// Using different key IDs cryptographically isolates the objects of different buckets or prefixes.
+	KeyID string `yaml:"keyID"`
+	// EncryptNames encrypts the keys and user metadata values of objects, so S3 doesn't learn object names.
+	// It is only allowed for the encrypt action.
+	EncryptNames bool `yaml:"encryptNames"`
+}
+
+// DefaultPolicy returns the policy used if none is configured: all objects are encrypted with the default KEK.
+func DefaultPolicy() Policy {
+	return Policy{Rules: []PolicyRule{{Bucket: "*", Action: ActionEncrypt}}}
+}
+
+// Validate checks the policy for errors.
+func (p Policy) Validate() error {
+	var errs []error
+	for i, rule := range p.Rules {
+		if rule.Bucket == "" {
+			errs = append(errs, fmt.Errorf("rule %d: bucket is required", i))
+		} else if _, err := path.Match(rule.Bucket, ""); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: invalid bucket pattern %q: %w", i, rule.Bucket, err))
+		}
+
+		switch rule.Action {
+		case ActionEncrypt:
+		case ActionPassthrough, ActionDeny:
+			if rule.KeyID != "" {
+				errs = append(errs, fmt.Errorf("rule %d: keyID is only allowed for action %q", i, ActionEncrypt))
+			}
+			if rule.EncryptNames {
+				errs = append(errs, fmt.Errorf("rule %d: encryptNames is only allowed for action %q", i, ActionEncrypt))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("rule %d: unknown action %q", i, rule.Action))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// match returns the rule that applies to an object. It returns false if no rule matches.
+func (p Policy) match(bucket, key string) (PolicyRule, bool) {
+	for _, rule := range p.Rules {
+		if matchBucket(rule.Bucket, bucket) && strings.HasPrefix(key, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// matchBucket returns the rule that applies to requests for a bucket that don't name an object.
+// It returns false if no rule matches the bucket.
+func (p Policy) matchBucket(bucket string) (PolicyRule, bool) {
+	var matched bool
+	for _, rule := range p.Rules {
+		if !matchBucket(rule.Bucket, bucket) {
+			continue
+		}
+		if rule.Prefix == "" {
+			return rule, true
+		}
+		matched = true
+	}
+	if matched {
+		return PolicyRule{Bucket: bucket, Action: ActionPassthrough}, true
+	}
+	return PolicyRule{}, false
+}
+
+// matchList returns the rule that applies to listing the keys starting with prefix in a bucket.
+// Listings reveal object keys, so they are denied if a deny rule applies to any key below prefix.
+// It returns false if no rule matches the bucket.
+func (p Policy) matchList(bucket, prefix string) (PolicyRule, bool) {
+	var matched bool
+	// shadowing holds the prefixes of earlier rules that apply to some keys of the listing.
+	// Rules below one of them never apply to those keys.
+	var shadowing []string
+	for _, rule := range p.Rules {
+		if !matchBucket(rule.Bucket, bucket) {
+			continue
+		}
+		if slices.ContainsFunc(shadowing, func(shadow string) bool { return strings.HasPrefix(rule.Prefix, shadow) }) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(prefix, rule.Prefix):
+			// The rule applies to all keys of the listing not matched by an earlier rule.
+			return rule, true
+		case strings.HasPrefix(rule.Prefix, prefix):
+			if rule.Action == ActionDeny {
+				return rule, true
+			}
+			matched = true
+			shadowing = append(shadowing, rule.Prefix)
+		}
+	}
+	if matched {
+		return PolicyRule{Bucket: bucket, Action: ActionPassthrough}, true
+	}
+	return PolicyRule{}, false
+}
+
+// matchKeys returns the rule that applies to requests naming multiple objects of a bucket, e.g., DeleteObjects.
+// If any of the objects is denied, or matches no rule, the request is denied.
+func (p Policy) matchKeys(bucket string, keys []string) (PolicyRule, bool) {
+	for _, key := range keys {
+		rule, ok := p.match(bucket, key)
+		if !ok || rule.Action == ActionDeny {
+			return rule, ok
+		}
+	}
+	return PolicyRule{Bucket: bucket, Action: ActionPassthrough}, true
+}
+
+// keyIDs returns the KEK IDs used by the policy.
+// The default KEK is always included, so objects written before a policy was configured can be re-wrapped to other KEKs.
+func (p Policy) keyIDs() []string {
+	ids := []string{defaultKEKID}
+	for _, rule := range p.Rules {
+		if rule.Action == ActionEncrypt && !slices.Contains(ids, rule.keyID()) {
+			ids = append(ids, rule.keyID())
+		}
+	}
+	return ids
+}
+
+// EncryptsNames returns true if any rule of the policy encrypts object keys and metadata.
+func (p Policy) EncryptsNames() bool {
+	return len(p.nameKeyIDs()) > 0
+}
+
+// encryptsNames returns true if any rule that matches the bucket encrypts object keys and metadata.
+func (p Policy) encryptsNames(bucket string) bool {
+	for _, rule := range p.Rules {
+		if rule.EncryptNames && matchBucket(rule.Bucket, bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameKeyIDs returns the KEK IDs of the rules that encrypt object keys and metadata.
+func (p Policy) nameKeyIDs() []string {
+	var ids []string
+	for _, rule := range p.Rules {
+		if rule.EncryptNames && !slices.Contains(ids, rule.keyID()) {
+			ids = append(ids, rule.keyID())
+		}
+	}
+	return ids
+}
+
+// keyID returns the KEK ID of the rule, falling back to the default KEK.
+func (r PolicyRule) keyID() string {
+	if r.KeyID == "" {
+		return defaultKEKID
+	}
+	return r.KeyID
+}
+
+func matchBucket(pattern, bucket string) bool {
+	matched, err := path.Match(pattern, bucket)
+	return err == nil && matched
+}
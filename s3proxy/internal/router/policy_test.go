@@ -0,0 +1,311 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	testCases := map[string]struct {
+		policy  Policy
+		wantErr bool
+	}{
+		"default policy": {
+			policy: DefaultPolicy(),
+		},
+		"all actions": {
+			policy: Policy{Rules: []PolicyRule{
+				{Bucket: "team-a-*", Action: ActionEncrypt, KeyID: "team-a"},
+				{Bucket: "public", Action: ActionPassthrough},
+				{Bucket: "*", Action: ActionDeny},
+			}},
+		},
+		"empty policy": {
+			policy: Policy{},
+		},
+		"missing bucket": {
+			policy:  Policy{Rules: []PolicyRule{{Action: ActionEncrypt}}},
+			wantErr: true,
+		},
+		"invalid bucket pattern": {
+			policy:  Policy{Rules: []PolicyRule{{Bucket: "[", Action: ActionEncrypt}}},
+			wantErr: true,
+		},
+		"unknown action": {
+			policy:  Policy{Rules: []PolicyRule{{Bucket: "*", Action: "compress"}}},
+			wantErr: true,
+		},
+		"key ID for pass-through": {
+			policy:  Policy{Rules: []PolicyRule{{Bucket: "*", Action: ActionPassthrough, KeyID: "team-a"}}},
+			wantErr: true,
+		},
+		"encrypted names": {
+			policy: Policy{Rules: []PolicyRule{{Bucket: "*", Action: ActionEncrypt, EncryptNames: true}}},
+		},
+		"encrypted names for deny": {
+			policy:  Policy{Rules: []PolicyRule{{Bucket: "*", Action: ActionDeny, EncryptNames: true}}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policy := Policy{Rules: []PolicyRule{
+		{Bucket: "shared", Prefix: "team-a/", Action: ActionEncrypt, KeyID: "team-a"},
+		{Bucket: "shared", Prefix: "team-b/", Action: ActionEncrypt, KeyID: "team-b"},
+		{Bucket: "public-*", Action: ActionPassthrough},
+		{Bucket: "secret", Action: ActionDeny},
+		{Bucket: "team-a-*", Action: ActionEncrypt, KeyID: "team-a"},
+	}}
+
+	testCases := map[string]struct {
+		bucket     string
+		key        string
+		wantAction Action
+		wantKeyID  string
+		wantMatch  bool
+	}{
+		"prefix rule": {
+			bucket: "shared", key: "team-a/data", wantAction: ActionEncrypt, wantKeyID: "team-a", wantMatch: true,
+		},
+		"second prefix rule": {
+			bucket: "shared", key: "team-b/data", wantAction: ActionEncrypt, wantKeyID: "team-b", wantMatch: true,
+		},
+		"no prefix rule matches": {
+			bucket: "shared", key: "team-c/data",
+		},
+		"bucket pattern": {
+			bucket: "public-assets", key: "logo.png", wantAction: ActionPassthrough, wantKeyID: defaultKEKID, wantMatch: true,
+		},
+		"deny": {
+			bucket: "secret", key: "data", wantAction: ActionDeny, wantKeyID: defaultKEKID, wantMatch: true,
+		},
+		"unknown bucket": {
+			bucket: "other", key: "data",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rule, ok := policy.match(tc.bucket, tc.key)
+			assert.Equal(tc.wantMatch, ok)
+			if !tc.wantMatch {
+				return
+			}
+			assert.Equal(tc.wantAction, rule.Action)
+			assert.Equal(tc.wantKeyID, rule.keyID())
+		})
+	}
+
+	t.Run("bucket requests", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// Buckets that only have prefix rules can be listed.
+		rule, ok := policy.matchBucket("shared")
+		assert.True(ok)
+		assert.Equal(ActionPassthrough, rule.Action)
+
+		rule, ok = policy.matchBucket("secret")
+		assert.True(ok)
+		assert.Equal(ActionDeny, rule.Action)
+
+		_, ok = policy.matchBucket("other")
+		assert.False(ok)
+	})
+
+	assert.Equal(t, []string{defaultKEKID, "team-a", "team-b"}, policy.keyIDs())
+}
+
+func TestPolicyMatchList(t *testing.T) {
+	policy := Policy{Rules: []PolicyRule{
+		{Bucket: "shared", Prefix: "team-a/", Action: ActionEncrypt, KeyID: "team-a"},
+		{Bucket: "shared", Prefix: "team-a/private/", Action: ActionDeny},
+		{Bucket: "shared", Prefix: "secret/", Action: ActionDeny},
+		{Bucket: "shared", Prefix: "public/", Action: ActionPassthrough},
+		{Bucket: "team-a-*", Action: ActionEncrypt, KeyID: "team-a"},
+		{Bucket: "mixed", Prefix: "secret/", Action: ActionDeny},
+		{Bucket: "mixed", Action: ActionEncrypt},
+	}}
+
+	testCases := map[string]struct {
+		bucket     string
+		prefix     string
+		wantAction Action
+		wantKeyID  string
+		wantMatch  bool
+	}{
+		"whole bucket with denied prefix": {
+			bucket: "shared", wantAction: ActionDeny, wantMatch: true,
+		},
+		"prefix of denied prefix": {
+			bucket: "shared", prefix: "sec", wantAction: ActionDeny, wantMatch: true,
+		},
+		"below denied prefix": {
+			bucket: "shared", prefix: "secret/data", wantAction: ActionDeny, wantMatch: true,
+		},
+		"prefix rule": {
+			bucket: "shared", prefix: "team-a/", wantAction: ActionEncrypt, wantKeyID: "team-a", wantMatch: true,
+		},
+		"deny rule shadowed by earlier rule": {
+			bucket: "shared", prefix: "team-a/private/", wantAction: ActionEncrypt, wantKeyID: "team-a", wantMatch: true,
+		},
+		"prefix spanning multiple rules": {
+			bucket: "shared", prefix: "p", wantAction: ActionPassthrough, wantMatch: true,
+		},
+		"prefix without rules": {
+			bucket: "shared", prefix: "other/",
+		},
+		"bucket rule": {
+			bucket: "team-a-data", prefix: "dir/", wantAction: ActionEncrypt, wantKeyID: "team-a", wantMatch: true,
+		},
+		"bucket rule with denied prefix": {
+			bucket: "mixed", wantAction: ActionDeny, wantMatch: true,
+		},
+		"bucket rule outside of denied prefix": {
+			bucket: "mixed", prefix: "public/", wantAction: ActionEncrypt, wantMatch: true,
+		},
+		"unknown bucket": {
+			bucket: "other",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rule, ok := policy.matchList(tc.bucket, tc.prefix)
+			assert.Equal(tc.wantMatch, ok)
+			if !tc.wantMatch {
+				return
+			}
+			assert.Equal(tc.wantAction, rule.Action)
+			if tc.wantKeyID != "" {
+				assert.Equal(tc.wantKeyID, rule.keyID())
+			}
+		})
+	}
+}
+
+func TestPolicyMatchKeys(t *testing.T) {
+	policy := Policy{Rules: []PolicyRule{
+		{Bucket: "shared", Prefix: "secret/", Action: ActionDeny},
+		{Bucket: "shared", Prefix: "team-a/", Action: ActionEncrypt, KeyID: "team-a"},
+		{Bucket: "shared", Prefix: "public/", Action: ActionPassthrough},
+	}}
+
+	testCases := map[string]struct {
+		keys       []string
+		wantAction Action
+		wantMatch  bool
+	}{
+		"allowed keys": {
+			keys: []string{"team-a/data", "public/logo.png"}, wantAction: ActionPassthrough, wantMatch: true,
+		},
+		"denied key": {
+			keys: []string{"team-a/data", "secret/data"}, wantAction: ActionDeny, wantMatch: true,
+		},
+		"key without rule": {
+			keys: []string{"team-a/data", "other/data"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rule, ok := policy.matchKeys("shared", tc.keys)
+			assert.Equal(tc.wantMatch, ok)
+			if tc.wantMatch {
+				assert.Equal(tc.wantAction, rule.Action)
+			}
+		})
+	}
+}
+
+func TestDeleteObjectsKeys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	body := `<Delete><Object><Key>a</Key></Object><Object><Key>dir/b</Key><VersionId>1</VersionId></Object><Quiet>true</Quiet></Delete>`
+	req := httptest.NewRequest(http.MethodPost, "/bucket?delete", strings.NewReader(body))
+	keys, err := deleteObjectsKeys(req)
+	require.NoError(err)
+	assert.Equal([]string{"a", "dir/b"}, keys)
+
+	// The body is still forwarded to S3.
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(err)
+	assert.Equal(body, string(forwarded))
+
+	req = httptest.NewRequest(http.MethodPost, "/bucket?delete", strings.NewReader(strings.Repeat(" ", maxDeleteObjectsSize+1)))
+	_, err = deleteObjectsKeys(req)
+	assert.Error(err)
+}
+
+func TestServeDeniedByPolicy(t *testing.T) {
+	router := Router{
+		backend: s3client.Config{Region: "eu-west-1"},
+		policy: Policy{Rules: []PolicyRule{
+			{Bucket: "public", Action: ActionPassthrough},
+			{Bucket: "shared", Prefix: "secret/", Action: ActionDeny},
+			{Bucket: "shared", Action: ActionPassthrough},
+		}},
+		keys: keyring{},
+		log:  logger.NewTest(t),
+	}
+
+	deleteObjects := func(keys ...string) *http.Request {
+		body := "<Delete>"
+		for _, key := range keys {
+			body += "<Object><Key>" + key + "</Key></Object>"
+		}
+		body += "</Delete>"
+		return httptest.NewRequest(http.MethodPost, "/shared?delete", strings.NewReader(body))
+	}
+
+	testCases := map[string]*http.Request{
+		"object in unknown bucket":        httptest.NewRequest(http.MethodGet, "/other/key", nil),
+		"unknown bucket":                  httptest.NewRequest(http.MethodGet, "/other", nil),
+		"upload to unknown bucket":        httptest.NewRequest(http.MethodPut, "/other/key", nil),
+		"listing bucket with denied keys": httptest.NewRequest(http.MethodGet, "/shared?list-type=2", nil),
+		"listing denied prefix":           httptest.NewRequest(http.MethodGet, "/shared?list-type=2&prefix=secret/", nil),
+		"listing versions of denied keys": httptest.NewRequest(http.MethodGet, "/shared?versions&prefix=sec", nil),
+		"deleting denied object":          deleteObjects("public.txt", "secret/data"),
+		"malformed DeleteObjects":         httptest.NewRequest(http.MethodPost, "/shared?delete", strings.NewReader("<Delete>")),
+	}
+
+	for name, req := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.Serve(resp, req)
+			assert.Equal(t, http.StatusForbidden, resp.Code)
+			assert.Contains(t, resp.Body.String(), "AccessDenied")
+		})
+	}
+}
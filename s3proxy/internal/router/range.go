@@ -0,0 +1,577 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+)
+
+var (
+	// errInvalidRange is returned for Range headers that can not be parsed. Such headers are ignored.
+	errInvalidRange = errors.New("invalid range")
+	// errRangeNotSatisfiable is returned for ranges that lie outside of the object.
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// getRange implements GET requests with a Range header.
+// For objects in the segmented format, only the segments holding the requested range are fetched from S3.
+// Objects in legacy formats are fetched and decrypted completely. Unencrypted objects are passed through.
+func (o object) getRange(w http.ResponseWriter, r *http.Request, byteRange string) {
+	// Fetch the first stream header along with the object's metadata.
+	output, err := o.client.GetObject(r.Context(), o.bucket, o.key, o.versionID(), fmt.Sprintf("bytes=0-%d", crypto.HeaderSize-1), o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	defer output.Body.Close()
+
+	rawEncryptedDEK, ok := output.Metadata[dekTag]
+	if !ok {
+		o.passthroughRange(w, r, byteRange)
+		return
+	}
+	encryptedDEK, err := hex.DecodeString(rawEncryptedDEK)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject decoding DEK")
+		recordCryptoFailure(r.Context(), cryptoDecrypt)
+		http.Error(w, fmt.Sprintf("decoding DEK: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if output.Metadata[formatTag] != formatSegmented {
+		o.getLegacyRange(w, r, byteRange)
+		return
+	}
+
+	dek, err := o.keks.unwrap(encryptedDEK, output.Metadata)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject")
+		writeDecryptError(w, r, err)
+		return
+	}
+
+	// Pin the version of the object for the following requests, so a concurrent overwrite is not mixed into the response.
+	if output.VersionId != nil && o.query.Get("versionId") == "" {
+		o.query = cloneQuery(o.query)
+		o.query.Set("versionId", *output.VersionId)
+	}
+
+	streams, err := o.streamLayout(r.Context(), output)
+	if err == nil {
+		err = verifyParts(dek, streams, output.Metadata)
+	}
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject reading stream layout")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size := plaintextSize(streams)
+
+	offset, length, err := parseRange(byteRange, size)
+	if errors.Is(err, errInvalidRange) {
+		o.log.With(slog.String("range", byteRange)).Debug("Ignoring invalid Range header")
+		r.Header.Del("Range")
+		o.get(w, r)
+		return
+	}
+	if err != nil {
+		writeRangeNotSatisfiable(w, size)
+		return
+	}
+
+	ranged := &rangeReader{
+		ctx:       r.Context(),
+		object:    o,
+		dek:       dek,
+		streams:   streams,
+		offset:    offset,
+		remaining: length,
+	}
+	defer ranged.close()
+	plaintext := bufio.NewReader(ranged)
+	// Decrypt the first segment before anything is sent to the client, so errors can still be reported.
+	if _, err := plaintext.Peek(1); err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject decrypting response")
+		writeDecryptError(w, r, err)
+		return
+	}
+
+	setGetObjectHeaders(w, output)
+	writePartialContent(w, plaintext, offset, length, size, o.log)
+}
+
+// getLegacyRange serves a range of an object in a legacy format.
+// These formats can only be decrypted as a whole, so the complete object is fetched.
+func (o object) getLegacyRange(w http.ResponseWriter, r *http.Request, byteRange string) {
+	output, err := o.client.GetObject(r.Context(), o.bucket, o.key, o.versionID(), "", o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	defer output.Body.Close()
+
+	decrypted, _, err := o.decrypt(output.Body, output.Metadata, output.ContentLength)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject decrypting response")
+		writeDecryptError(w, r, err)
+		return
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject decrypting response")
+		writeDecryptError(w, r, err)
+		return
+	}
+	size := int64(len(plaintext))
+
+	offset, length, err := parseRange(byteRange, size)
+	if errors.Is(err, errInvalidRange) {
+		o.log.With(slog.String("range", byteRange)).Debug("Ignoring invalid Range header")
+		setGetObjectHeaders(w, output)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(plaintext); err != nil {
+			o.log.With(slog.Any("error", err)).Error("GetObject sending response")
+		}
+		return
+	}
+	if err != nil {
+		writeRangeNotSatisfiable(w, size)
+		return
+	}
+
+	setGetObjectHeaders(w, output)
+	writePartialContent(w, bytes.NewReader(plaintext[offset:offset+length]), offset, length, size, o.log)
+}
+
+// passthroughRange forwards a range request for an unencrypted object to S3.
+func (o object) passthroughRange(w http.ResponseWriter, r *http.Request, byteRange string) {
+	output, err := o.client.GetObject(r.Context(), o.bucket, o.key, o.versionID(), byteRange, o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject sending request to S3")
+		writeS3Error(w, err)
+		return
+	}
+	defer output.Body.Close()
+
+	setGetObjectHeaders(w, output)
+	if output.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+	}
+	status := http.StatusOK
+	if output.ContentRange != nil {
+		w.Header().Set("Content-Range", *output.ContentRange)
+		status = http.StatusPartialContent
+	}
+
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, output.Body); err != nil {
+		o.log.With(slog.Any("error", err)).Error("GetObject sending response")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// openPlaintext opens the given range of the object's plaintext. If byteRange is empty, the whole object is opened.
+// It returns the plaintext and its length. Unlike GET requests, invalid ranges fail with errInvalidRange instead of being ignored.
+func (o object) openPlaintext(ctx context.Context, byteRange string) (io.ReadCloser, int64, error) {
+	// Fetch the first stream header along with the object's metadata.
+	output, err := o.client.GetObject(ctx, o.bucket, o.key, o.versionID(), fmt.Sprintf("bytes=0-%d", crypto.HeaderSize-1), o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		// S3 can't serve ranges of empty objects, which are never encrypted.
+		if byteRange == "" && parseErrorCode(err) == http.StatusRequestedRangeNotSatisfiable {
+			return o.openUnencrypted(ctx, "")
+		}
+		return nil, 0, err
+	}
+	defer output.Body.Close()
+
+	rawEncryptedDEK, ok := output.Metadata[dekTag]
+	if !ok {
+		return o.openUnencrypted(ctx, byteRange)
+	}
+	if output.Metadata[formatTag] != formatSegmented {
+		return o.openLegacy(ctx, byteRange)
+	}
+
+	encryptedDEK, err := hex.DecodeString(rawEncryptedDEK)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding DEK: %w", err)
+	}
+	dek, err := o.keks.unwrap(encryptedDEK, output.Metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+	if output.VersionId != nil && o.versionID() == "" {
+		o.query = cloneQuery(o.query)
+		o.query.Set("versionId", *output.VersionId)
+	}
+
+	streams, err := o.streamLayout(ctx, output)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading stream layout: %w", err)
+	}
+	if err := verifyParts(dek, streams, output.Metadata); err != nil {
+		return nil, 0, err
+	}
+	offset, length := int64(0), plaintextSize(streams)
+	if byteRange != "" {
+		if offset, length, err = parseRange(byteRange, length); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return &rangeReader{
+		ctx:       ctx,
+		object:    o,
+		dek:       dek,
+		streams:   streams,
+		offset:    offset,
+		remaining: length,
+	}, length, nil
+}
+
+// openUnencrypted opens the given range of an unencrypted object. The range is evaluated by S3.
+func (o object) openUnencrypted(ctx context.Context, byteRange string) (io.ReadCloser, int64, error) {
+	output, err := o.client.GetObject(ctx, o.bucket, o.key, o.versionID(), byteRange, o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		return nil, 0, err
+	}
+	// S3 ignores invalid ranges and returns the whole object.
+	if byteRange != "" && output.ContentRange == nil {
+		output.Body.Close()
+		return nil, 0, errInvalidRange
+	}
+	if output.ContentLength == nil {
+		output.Body.Close()
+		return nil, 0, errors.New("S3 response is missing Content-Length")
+	}
+	return output.Body, *output.ContentLength, nil
+}
+
+// openLegacy opens the given range of an object in a legacy format.
+// These formats can only be decrypted as a whole, so the complete object is fetched.
+func (o object) openLegacy(ctx context.Context, byteRange string) (io.ReadCloser, int64, error) {
+	output, err := o.client.GetObject(ctx, o.bucket, o.key, o.versionID(), "", o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer output.Body.Close()
+
+	decrypted, _, err := o.decrypt(output.Body, output.Metadata, output.ContentLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decrypting object: %w", err)
+	}
+
+	offset, length := int64(0), int64(len(plaintext))
+	if byteRange != "" {
+		if offset, length, err = parseRange(byteRange, length); err != nil {
+			return nil, 0, err
+		}
+	}
+	return io.NopCloser(bytes.NewReader(plaintext[offset : offset+length])), length, nil
+}
+
+// plaintextSize returns the size of the decrypted object consisting of the given streams.
+func plaintextSize(streams []streamLocation) int64 {
+	if len(streams) == 0 {
+		return 0
+	}
+	last := streams[len(streams)-1]
+	return last.plaintextOffset + last.info.PlaintextSize
+}
+
+// streamLocation is the position of a stream in an object in the segmented format.
+type streamLocation struct {
+	// ciphertextOffset is the offset of the stream's header in the object.
+	ciphertextOffset int64
+	// plaintextOffset is the offset of the stream's plaintext in the decrypted object.
+	plaintextOffset int64
+	info            crypto.StreamInfo
+}
+
+// streamLayout returns the position of every stream in an object in the segmented format.
+// The output has to hold the beginning of the object, as returned for a request with a range starting at 0.
+// Objects written by PutObject consist of a single stream. For completed multipart uploads,
+// the header of every part is fetched, since the parts' sizes are not stored anywhere else.
+func (o object) streamLayout(ctx context.Context, output *s3.GetObjectOutput) ([]streamLocation, error) {
+	objectSize, err := parseContentRangeSize(output.ContentRange)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, crypto.HeaderSize)
+	if _, err := io.ReadFull(output.Body, header); err != nil {
+		return nil, fmt.Errorf("reading stream header: %w", err)
+	}
+
+	var streams []streamLocation
+	var ciphertextOffset, plaintextOffset int64
+	for {
+		info, err := crypto.ParseStreamHeader(header)
+		if err != nil {
+			return nil, fmt.Errorf("parsing stream header at offset %d: %w", ciphertextOffset, err)
+		}
+		if len(streams) > 0 && info.Index <= streams[len(streams)-1].info.Index {
+			return nil, fmt.Errorf("stream %d follows stream %d", info.Index, streams[len(streams)-1].info.Index)
+		}
+		streams = append(streams, streamLocation{ciphertextOffset: ciphertextOffset, plaintextOffset: plaintextOffset, info: info})
+
+		ciphertextOffset += info.CiphertextSize()
+		plaintextOffset += info.PlaintextSize
+		if ciphertextOffset == objectSize {
+			return streams, nil
+		}
+		if info.Index == 0 || ciphertextOffset > objectSize {
+			return nil, fmt.Errorf("object size %d does not match its streams", objectSize)
+		}
+
+		if header, err = o.fetchRange(ctx, ciphertextOffset, crypto.HeaderSize); err != nil {
+			return nil, fmt.Errorf("fetching stream header: %w", err)
+		}
+	}
+}
+
+// verifyParts checks the streams of a completed multipart upload against the parts tag recorded in the object's metadata,
+// so that ranges of objects with dropped parts or truncated at the end of a part are refused.
+func verifyParts(dek []byte, streams []streamLocation, metadata map[string]string) error {
+	if len(streams) == 0 || streams[0].info.Index == 0 {
+		return nil
+	}
+	tag, err := decodePartsTag(metadata)
+	if err != nil {
+		return err
+	}
+	indices := make([]uint32, 0, len(streams))
+	for _, stream := range streams {
+		indices = append(indices, stream.info.Index)
+	}
+	return crypto.VerifyPartsTag(dek, indices, tag)
+}
+
+// fetchRange fetches length bytes of the object's ciphertext, starting at offset.
+func (o object) fetchRange(ctx context.Context, offset, length int64) ([]byte, error) {
+	body, err := o.openRange(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// openRange requests length bytes of the object's ciphertext, starting at offset.
+func (o object) openRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	output, err := o.client.GetObject(ctx, o.bucket, o.key, o.versionID(), fmt.Sprintf("bytes=%d-%d", offset, offset+length-1), o.sseCustomerAlgorithm, o.sseCustomerKey, o.sseCustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// rangeReader reads a plaintext range of an object in the segmented format.
+// Only the segments holding the range are fetched from S3, one request per stream.
+type rangeReader struct {
+	ctx       context.Context
+	object    object
+	dek       []byte
+	streams   []streamLocation
+	offset    int64
+	remaining int64
+
+	body      io.ReadCloser
+	plaintext io.Reader
+	// streamEnd is the plaintext offset at which the currently open stream is exhausted.
+	streamEnd int64
+}
+
+// Read implements io.Reader.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.remaining == 0 {
+			r.close()
+			return 0, io.EOF
+		}
+		if r.plaintext == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.plaintext.Read(p[:min(int64(len(p)), r.remaining)])
+		r.offset += int64(n)
+		r.remaining -= int64(n)
+		if errors.Is(err, io.EOF) {
+			r.close()
+			if r.offset != r.streamEnd {
+				return n, fmt.Errorf("reading stream: %w", io.ErrUnexpectedEOF)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// open requests the segments of the stream holding the current offset.
+func (r *rangeReader) open() error {
+	var stream streamLocation
+	for _, s := range r.streams {
+		if r.offset >= s.plaintextOffset && r.offset < s.plaintextOffset+s.info.PlaintextSize {
+			stream = s
+			break
+		}
+	}
+	localOffset := r.offset - stream.plaintextOffset
+	length := min(r.remaining, stream.info.PlaintextSize-localOffset)
+
+	segments, err := stream.info.SegmentRange(localOffset, length)
+	if err != nil {
+		return err
+	}
+	body, err := r.object.openRange(r.ctx, stream.ciphertextOffset+segments.Start, segments.End-segments.Start)
+	if err != nil {
+		return fmt.Errorf("fetching segments: %w", err)
+	}
+	plaintext, err := crypto.NewSegmentDecryptingReader(body, r.dek, stream.info, segments.FirstSegment)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, plaintext, segments.Skip); err != nil {
+		body.Close()
+		return fmt.Errorf("decrypting segments: %w", err)
+	}
+
+	r.body = body
+	r.plaintext = io.LimitReader(plaintext, length)
+	r.streamEnd = r.offset + length
+	return nil
+}
+
+// Close implements io.Closer.
+func (r *rangeReader) Close() error {
+	r.close()
+	return nil
+}
+
+func (r *rangeReader) close() {
+	if r.body != nil {
+		r.body.Close()
+	}
+	r.body = nil
+	r.plaintext = nil
+}
+
+// writePartialContent writes a 206 response holding the given range of an object.
+func writePartialContent(w http.ResponseWriter, body io.Reader, offset, length, size int64, log *slog.Logger) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(w, body); err != nil {
+		log.With(slog.Any("error", err)).Error("GetObject sending response")
+		// The status code is already sent. Abort the response so clients don't mistake a partial body for the requested range.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeRangeNotSatisfiable writes a 416 response for an object of the given size.
+func writeRangeNotSatisfiable(w http.ResponseWriter, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	http.Error(w, "The requested range is not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+}
+
+// parseRange parses the value of a Range header for an object of the given size.
+// It returns the offset and length of the requested range.
+// Like S3, only a single range is supported.
+func parseRange(byteRange string, size int64) (offset, length int64, err error) {
+	spec, ok := strings.CutPrefix(byteRange, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+	rawFirst, rawLast, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	// A suffix range requests the last bytes of the object.
+	if rawFirst == "" {
+		suffix, err := strconv.ParseInt(rawLast, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, nil
+	}
+
+	first, err := strconv.ParseInt(rawFirst, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, errInvalidRange
+	}
+	last := size - 1
+	if rawLast != "" {
+		if last, err = strconv.ParseInt(rawLast, 10, 64); err != nil || last < first {
+			return 0, 0, errInvalidRange
+		}
+		last = min(last, size-1)
+	}
+	if first >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return first, last - first + 1, nil
+}
+
+// parseContentRangeSize returns the complete length of an object from a Content-Range header.
+func parseContentRangeSize(contentRange *string) (int64, error) {
+	if contentRange == nil {
+		return 0, errors.New("S3 response is missing Content-Range")
+	}
+	_, rawSize, ok := strings.Cut(*contentRange, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid Content-Range %q", *contentRange)
+	}
+	size, err := strconv.ParseInt(rawSize, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range %q: %w", *contentRange, err)
+	}
+	return size, nil
+}
+
+func cloneQuery(query url.Values) url.Values {
+	clone := make(url.Values, len(query))
+	for k, v := range query {
+		clone[k] = v
+	}
+	return clone
+}
@@ -0,0 +1,232 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	testCases := map[string]struct {
+		byteRange  string
+		size       int64
+		wantOffset int64
+		wantLength int64
+		wantErr    error
+	}{
+		"closed range":                  {byteRange: "bytes=10-19", size: 100, wantOffset: 10, wantLength: 10},
+		"single byte":                   {byteRange: "bytes=0-0", size: 100, wantOffset: 0, wantLength: 1},
+		"open range":                    {byteRange: "bytes=90-", size: 100, wantOffset: 90, wantLength: 10},
+		"range past the end":            {byteRange: "bytes=90-200", size: 100, wantOffset: 90, wantLength: 10},
+		"suffix range":                  {byteRange: "bytes=-10", size: 100, wantOffset: 90, wantLength: 10},
+		"suffix longer than object":     {byteRange: "bytes=-200", size: 100, wantOffset: 0, wantLength: 100},
+		"start beyond object":           {byteRange: "bytes=100-", size: 100, wantErr: errRangeNotSatisfiable},
+		"empty suffix":                  {byteRange: "bytes=-0", size: 100, wantErr: errRangeNotSatisfiable},
+		"range of empty object":         {byteRange: "bytes=0-10", size: 0, wantErr: errRangeNotSatisfiable},
+		"suffix range of empty object":  {byteRange: "bytes=-10", size: 0, wantErr: errRangeNotSatisfiable},
+		"multiple ranges":               {byteRange: "bytes=0-1,5-6", size: 100, wantErr: errInvalidRange},
+		"unknown unit":                  {byteRange: "items=0-1", size: 100, wantErr: errInvalidRange},
+		"end before start":              {byteRange: "bytes=10-5", size: 100, wantErr: errInvalidRange},
+		"missing dash":                  {byteRange: "bytes=10", size: 100, wantErr: errInvalidRange},
+		"not a number":                  {byteRange: "bytes=a-b", size: 100, wantErr: errInvalidRange},
+		"negative start":                {byteRange: "bytes=--5", size: 100, wantErr: errInvalidRange},
+		"whitespace around range":       {byteRange: "bytes= 1-2 ", size: 100, wantOffset: 1, wantLength: 2},
+		"last byte of object":           {byteRange: "bytes=99-99", size: 100, wantOffset: 99, wantLength: 1},
+		"first byte of one byte object": {byteRange: "bytes=0-", size: 1, wantOffset: 0, wantLength: 1},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			offset, length, err := parseRange(tc.byteRange, tc.size)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantOffset, offset)
+			assert.Equal(tc.wantLength, length)
+		})
+	}
+}
+
+func TestGetObjectRange(t *testing.T) {
+	kek := [32]byte{0x1}
+	plaintext := make([]byte, 5*crypto.SegmentSize+100)
+	_, err := rand.Read(plaintext)
+	require.NoError(t, err)
+
+	// Parts of uneven size, so streams and segments are not aligned.
+	partSizes := []int{2*crypto.SegmentSize + 7, 3 * crypto.SegmentSize, 93}
+
+	testCases := map[string]struct {
+		byteRange  string
+		wantStatus int
+		wantOffset int
+		wantLength int
+	}{
+		"within a segment": {
+			byteRange:  "bytes=10-19",
+			wantStatus: http.StatusPartialContent,
+			wantOffset: 10,
+			wantLength: 10,
+		},
+		"across segments": {
+			byteRange:  fmt.Sprintf("bytes=%d-%d", crypto.SegmentSize-5, crypto.SegmentSize+4),
+			wantStatus: http.StatusPartialContent,
+			wantOffset: crypto.SegmentSize - 5,
+			wantLength: 10,
+		},
+		"across parts": {
+			byteRange:  fmt.Sprintf("bytes=%d-%d", partSizes[0]-5, partSizes[0]+crypto.SegmentSize),
+			wantStatus: http.StatusPartialContent,
+			wantOffset: partSizes[0] - 5,
+			wantLength: crypto.SegmentSize + 6,
+		},
+		"open range": {
+			byteRange:  fmt.Sprintf("bytes=%d-", len(plaintext)-50),
+			wantStatus: http.StatusPartialContent,
+			wantOffset: len(plaintext) - 50,
+			wantLength: 50,
+		},
+		"suffix range": {
+			byteRange:  "bytes=-120",
+			wantStatus: http.StatusPartialContent,
+			wantOffset: len(plaintext) - 120,
+			wantLength: 120,
+		},
+		"whole object": {
+			byteRange:  "bytes=0-",
+			wantStatus: http.StatusPartialContent,
+			wantOffset: 0,
+			wantLength: len(plaintext),
+		},
+		"unsatisfiable": {
+			byteRange:  fmt.Sprintf("bytes=%d-", len(plaintext)),
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+		"invalid range is ignored": {
+			byteRange:  "bytes=10-5",
+			wantStatus: http.StatusOK,
+			wantOffset: 0,
+			wantLength: len(plaintext),
+		},
+	}
+
+	objects := map[string]func(t *testing.T, client *stubS3Client){
+		"single stream": func(t *testing.T, client *stubS3Client) {
+			obj := object{keks: newTestKEKs(kek), client: client, key: "key", bucket: "bucket", body: bytes.NewReader(plaintext), contentLength: int64(len(plaintext)), metadata: map[string]string{}, log: logger.NewTest(t)}
+			resp := httptest.NewRecorder()
+			obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+			require.Equal(t, http.StatusOK, resp.Code)
+		},
+		"multipart": func(t *testing.T, client *stubS3Client) {
+			dek := crypto.GenerateDEK()
+			encryptedDEK, err := crypto.WrapDEK(dek, kek)
+			require.NoError(t, err)
+
+			var ciphertext []byte
+			var offset int
+			var indices []uint32
+			for i, size := range partSizes {
+				indices = append(indices, uint32(i+1))
+				encrypter, err := crypto.NewEncryptingReader(bytes.NewReader(plaintext[offset:offset+size]), dek, uint32(i+1), int64(size))
+				require.NoError(t, err)
+				part, err := io.ReadAll(encrypter)
+				require.NoError(t, err)
+				ciphertext = append(ciphertext, part...)
+				offset += size
+			}
+			require.Equal(t, len(plaintext), offset)
+			tag, err := crypto.PartsTag(dek, indices)
+			require.NoError(t, err)
+
+			client.objects["key"] = stubObject{body: ciphertext, metadata: map[string]string{dekTag: hex.EncodeToString(encryptedDEK), formatTag: formatSegmented, partsTag: hex.EncodeToString(tag)}}
+		},
+		"legacy": func(t *testing.T, client *stubS3Client) {
+			ciphertext, encryptedDEK, err := crypto.Encrypt(plaintext, kek)
+			require.NoError(t, err)
+			client.objects["key"] = stubObject{body: ciphertext, metadata: map[string]string{dekTag: hex.EncodeToString(encryptedDEK)}}
+		},
+		"unencrypted": func(_ *testing.T, client *stubS3Client) {
+			client.objects["key"] = stubObject{body: plaintext, metadata: map[string]string{}}
+		},
+	}
+
+	for objectName, createObject := range objects {
+		for name, tc := range testCases {
+			t.Run(objectName+"/"+name, func(t *testing.T) {
+				assert := assert.New(t)
+				require := require.New(t)
+
+				client := newStubS3Client()
+				createObject(t, client)
+				client.fetched = 0
+
+				req := httptest.NewRequest(http.MethodGet, "/bucket/key", nil)
+				req.Header.Set("Range", tc.byteRange)
+				obj := object{keks: newTestKEKs(kek), client: client, key: "key", bucket: "bucket", log: logger.NewTest(t)}
+				resp := httptest.NewRecorder()
+				obj.get(resp, req)
+
+				require.Equal(tc.wantStatus, resp.Code)
+				if tc.wantStatus == http.StatusRequestedRangeNotSatisfiable {
+					// Errors for unencrypted objects are forwarded from S3.
+					if objectName == "unencrypted" {
+						return
+					}
+					assert.Equal(fmt.Sprintf("bytes */%d", len(plaintext)), resp.Header().Get("Content-Range"))
+					return
+				}
+
+				want := plaintext[tc.wantOffset : tc.wantOffset+tc.wantLength]
+				assert.True(bytes.Equal(want, resp.Body.Bytes()))
+				// Completed multipart uploads are sent without Content-Length if the whole object is requested.
+				if tc.wantStatus == http.StatusPartialContent || objectName != "multipart" {
+					assert.Equal(strconv.Itoa(tc.wantLength), resp.Header().Get("Content-Length"))
+				}
+				if tc.wantStatus == http.StatusPartialContent {
+					assert.Equal(fmt.Sprintf("bytes %d-%d/%d", tc.wantOffset, tc.wantOffset+tc.wantLength-1, len(plaintext)), resp.Header().Get("Content-Range"))
+				}
+
+				// Small ranges of segmented objects are served without fetching the whole object.
+				if objectName != "legacy" && tc.wantLength < crypto.SegmentSize {
+					assert.Less(client.fetched, len(plaintext)/2)
+				}
+			})
+		}
+	}
+}
+
+func TestGetObjectRangeWrongKEK(t *testing.T) {
+	client := newStubS3Client()
+	data := "hello, world"
+	obj := object{keks: newTestKEKs([32]byte{0x1}), client: client, key: "key", bucket: "bucket", body: bytes.NewReader([]byte(data)), contentLength: int64(len(data)), metadata: map[string]string{}, log: logger.NewTest(t)}
+	obj.put(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/bucket/key", nil))
+	require.Contains(t, client.objects, "key")
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/key", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	obj = object{keks: newTestKEKs([32]byte{0x2}), client: client, key: "key", bucket: "bucket", log: logger.NewTest(t)}
+	resp := httptest.NewRecorder()
+	obj.get(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "hello")
+}
@@ -0,0 +1,268 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+)
+
+// RewrapResult counts the objects processed by Rewrap.
+type RewrapResult struct {
+	// Rewrapped is the number of objects whose DEK was re-wrapped with the current KEK version.
+	Rewrapped int
+	// Skipped is the number of objects that are unencrypted or already use the current KEK version.
+	Skipped int
+	// Failed is the number of objects that could not be re-wrapped.
+	Failed int
+}
+
+// Rewrap re-wraps the DEKs of all encrypted objects in the bucket whose key starts with prefix with the current version
+// of the KEK the policy assigns to them. Objects that the policy does not encrypt are skipped.
+// Completed multipart uploads written before s3proxy recorded parts tags get a parts tag for their current parts.
+// Only the objects' metadata is replaced, their bodies are not re-encrypted.
+// Failing objects are logged and counted, but don't stop the re-wrapping of other objects.
+func (r Router) Rewrap(ctx context.Context, bucket, prefix string) (RewrapResult, error) {
+	client, err := s3client.NewClient(r.backend)
+	if err != nil {
+		return RewrapResult{}, err
+	}
+	return rewrapObjects(ctx, client, r.policy, r.keys, r.names, bucket, prefix, r.log)
+}
+
+func rewrapObjects(
+	ctx context.Context, client rewrapClient, policy Policy, keys keyring, names map[string]*crypto.NameCipher, bucket, prefix string, log *slog.Logger,
+) (RewrapResult, error) {
+	listPrefix := prefix
+	if len(names) > 0 {
+		// Encrypted keys don't start with the plaintext prefix. List all objects and filter them by their decrypted keys.
+		listPrefix = ""
+	}
+
+	var result RewrapResult
+	var continuationToken string
+	for {
+		output, err := client.ListObjects(ctx, bucket, listPrefix, continuationToken)
+		if err != nil {
+			return result, fmt.Errorf("listing objects: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			if object.Key == nil || strings.HasPrefix(*object.Key, uploadStatePrefix) {
+				continue
+			}
+			key, cipher := decryptKey(*object.Key, names)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			log := log.With(slog.String("bucket", bucket), slog.String("key", key))
+
+			rule, ok := policy.match(bucket, key)
+			if !ok || rule.Action != ActionEncrypt {
+				result.Skipped++
+				continue
+			}
+			if ruleNames(rule, names) != cipher {
+				// The object can't be read through s3proxy, since its key isn't encrypted with the name key of its rule.
+				result.Skipped++
+				continue
+			}
+
+			rewrapped, err := rewrapObject(ctx, client, keys, keys[rule.keyID()], bucket, *object.Key)
+			switch {
+			case err != nil:
+				log.With(slog.Any("error", err)).Error("Rewrapping object")
+				result.Failed++
+			case rewrapped:
+				log.Debug("Rewrapped object")
+				result.Rewrapped++
+			default:
+				result.Skipped++
+			}
+		}
+
+		if output.NextContinuationToken == nil || *output.NextContinuationToken == "" {
+			return result, nil
+		}
+		continuationToken = *output.NextContinuationToken
+	}
+}
+
+// rewrapObject re-wraps the DEK of a single object with the current version of the target KEK,
+// and adds a parts tag to completed multipart uploads without one.
+// It returns false if the object did not need to be re-wrapped.
+func rewrapObject(ctx context.Context, client rewrapClient, keys keyring, target keyEncryptionKeys, bucket, key string) (bool, error) {
+	head, err := client.HeadObject(ctx, bucket, key, "", "", "", "")
+	if err != nil {
+		return false, fmt.Errorf("fetching metadata: %w", err)
+	}
+
+	if _, ok := head.Metadata[dekTag]; !ok {
+		return false, nil
+	}
+	version, err := kekVersion(head.Metadata)
+	if err != nil {
+		return false, err
+	}
+	var indices []uint32
+	if _, tagged := head.Metadata[partsTag]; !tagged {
+		if indices, err = untaggedParts(ctx, client, bucket, key, head); err != nil {
+			return false, err
+		}
+	}
+	if kekIDFromMetadata(head.Metadata) == target.id && version == target.current && indices == nil {
+		return false, nil
+	}
+
+	metadata, err := rewrapDEK(keys, target, head.Metadata)
+	if err != nil {
+		return false, err
+	}
+	if indices != nil {
+		if err := addPartsTag(target, metadata, indices); err != nil {
+			return false, err
+		}
+	}
+	if _, err := client.ReplaceObjectMetadata(ctx, bucket, key, head, metadata, "", "", ""); err != nil {
+		return false, fmt.Errorf("replacing metadata with KEK %s version %d: %w", target.id, target.current, err)
+	}
+	return true, nil
+}
+
+// untaggedParts returns the stream indices, or part numbers, of a completed multipart upload that has no parts tag.
+// Such uploads were completed by previous versions of s3proxy. For all other objects, nil is returned.
+// The parts tag only authenticates the parts the object consists of now.
+func untaggedParts(ctx context.Context, client s3Client, bucket, key string, head *s3.HeadObjectOutput) ([]uint32, error) {
+	o := object{client: client, bucket: bucket, key: key}
+	if head.VersionId != nil {
+		o.query = url.Values{"versionId": {*head.VersionId}}
+	}
+
+	switch head.Metadata[formatTag] {
+	case formatSegmented:
+		output, err := client.GetObject(ctx, bucket, key, o.versionID(), fmt.Sprintf("bytes=0-%d", crypto.HeaderSize-1), "", "", "")
+		if err != nil {
+			return nil, fmt.Errorf("fetching stream header: %w", err)
+		}
+		defer output.Body.Close()
+
+		streams, err := o.streamLayout(ctx, output)
+		if err != nil {
+			return nil, fmt.Errorf("reading stream layout: %w", err)
+		}
+		if streams[0].info.Index == 0 {
+			return nil, nil
+		}
+		indices := make([]uint32, 0, len(streams))
+		for _, stream := range streams {
+			indices = append(indices, stream.info.Index)
+		}
+		return indices, nil
+	case formatMultipart:
+		if head.ContentLength == nil {
+			return nil, errors.New("object size unknown")
+		}
+		return o.partNumbers(ctx, *head.ContentLength)
+	default:
+		return nil, nil
+	}
+}
+
+// partNumbers walks the part headers of a multipart upload completed by previous versions of s3proxy,
+// and returns the part numbers of its parts.
+func (o object) partNumbers(ctx context.Context, objectSize int64) ([]uint32, error) {
+	var partNumbers []uint32
+	for offset := int64(0); offset < objectSize; {
+		if objectSize-offset < crypto.PartHeaderSize {
+			return nil, fmt.Errorf("object size %d does not match its parts", objectSize)
+		}
+		header, err := o.fetchRange(ctx, offset, crypto.PartHeaderSize)
+		if err != nil {
+			return nil, fmt.Errorf("fetching part header: %w", err)
+		}
+		partNumber, length, err := crypto.ParsePartHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if len(partNumbers) > 0 && partNumber <= partNumbers[len(partNumbers)-1] {
+			return nil, fmt.Errorf("part %d follows part %d", partNumber, partNumbers[len(partNumbers)-1])
+		}
+		if length > uint64(objectSize-offset-crypto.PartHeaderSize) {
+			return nil, fmt.Errorf("part %d truncated", partNumber)
+		}
+		partNumbers = append(partNumbers, partNumber)
+		offset += crypto.PartHeaderSize + int64(length)
+	}
+	return partNumbers, nil
+}
+
+// addPartsTag adds the parts tag for the given stream indices to metadata, whose DEK is wrapped with the current version of keks.
+func addPartsTag(keks keyEncryptionKeys, metadata map[string]string, indices []uint32) error {
+	encryptedDEK, err := hex.DecodeString(metadata[dekTag])
+	if err != nil {
+		return fmt.Errorf("decoding DEK: %w", err)
+	}
+	dek, err := keks.unwrap(encryptedDEK, metadata)
+	if err != nil {
+		return err
+	}
+	tag, err := crypto.PartsTag(dek, indices)
+	if err != nil {
+		return err
+	}
+	metadata[partsTag] = hex.EncodeToString(tag)
+	return nil
+}
+
+// dekUnwrapper decrypts the DEK of an object with the given metadata.
+type dekUnwrapper interface {
+	unwrap(encryptedDEK []byte, metadata map[string]string) ([]byte, error)
+}
+
+// rewrapDEK unwraps the DEK of an object with the given metadata and wraps it with the current version of the target KEK.
+// It returns a copy of the metadata holding the re-wrapped DEK.
+func rewrapDEK(keys dekUnwrapper, target keyEncryptionKeys, metadata map[string]string) (map[string]string, error) {
+	encryptedDEK, err := hex.DecodeString(metadata[dekTag])
+	if err != nil {
+		return nil, fmt.Errorf("decoding DEK: %w", err)
+	}
+	dek, err := keys.unwrap(encryptedDEK, metadata)
+	if err != nil {
+		// Objects written by previous versions of s3proxy had their DEK wrapped with an all-zero KEK.
+		var legacyErr error
+		if _, versioned := metadata[kekVersionTag]; versioned || metadata[formatTag] != "" {
+			return nil, err
+		}
+		if dek, legacyErr = crypto.UnwrapDEK(encryptedDEK, [32]byte{}); legacyErr != nil {
+			return nil, err
+		}
+	}
+
+	rewrapped := maps.Clone(metadata)
+	newEncryptedDEK, err := target.wrap(dek, rewrapped)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped[dekTag] = hex.EncodeToString(newEncryptedDEK)
+	return rewrapped, nil
+}
+
+// rewrapClient is the subset of the S3 API used to re-wrap DEKs.
+type rewrapClient interface {
+	s3Client
+	ListObjects(ctx context.Context, bucket, prefix, continuationToken string) (*s3.ListObjectsV2Output, error)
+}
@@ -0,0 +1,239 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrap(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	kekV1 := [32]byte{0x1}
+	kekV2 := [32]byte{0x2}
+	oldKEKs := newTestKEKs(kekV1)
+	newKEKs := keyEncryptionKeys{id: defaultKEKID, current: 2, versions: map[uint32][32]byte{1: kekV1, 2: kekV2}}
+	keys := keyring{defaultKEKID: newKEKs}
+	log := logger.NewTest(t)
+	client := newStubS3Client()
+
+	put := func(keks keyEncryptionKeys, key, data string) {
+		obj := object{keks: keks, client: client, key: key, bucket: "bucket", body: bytes.NewReader([]byte(data)), contentLength: int64(len(data)), metadata: map[string]string{"user": "value"}, log: log}
+		resp := httptest.NewRecorder()
+		obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/"+key, nil))
+		require.Equal(http.StatusOK, resp.Code)
+	}
+	put(oldKEKs, "data/old-1", "old object 1")
+	put(oldKEKs, "data/old-2", "old object 2")
+	put(newKEKs, "data/new", "new object")
+	put(oldKEKs, "other/old", "outside of prefix")
+	client.objects["data/plain"] = stubObject{body: []byte("unencrypted object"), metadata: map[string]string{}}
+
+	// Objects written by previous versions of s3proxy use the all-zero KEK.
+	legacyCiphertext, legacyDEK, err := crypto.Encrypt([]byte("legacy object"), [32]byte{})
+	require.NoError(err)
+	client.objects["data/legacy"] = stubObject{body: legacyCiphertext, metadata: map[string]string{dekTag: hex.EncodeToString(legacyDEK)}}
+
+	bodies := map[string][]byte{}
+	for key, obj := range client.objects {
+		bodies[key] = obj.body
+	}
+
+	result, err := rewrapObjects(context.Background(), client, DefaultPolicy(), keys, nil, "bucket", "data/", log)
+	require.NoError(err)
+	assert.Equal(RewrapResult{Rewrapped: 3, Skipped: 2}, result)
+
+	for key, obj := range client.objects {
+		assert.Equal(bodies[key], obj.body, "body of %s changed", key)
+	}
+	assert.Equal("1", client.objects["other/old"].metadata[kekVersionTag])
+	assert.Equal("value", client.objects["data/old-1"].metadata["user"])
+
+	// The re-wrapped objects can be read without the old KEK.
+	onlyNewKEK := keyEncryptionKeys{id: defaultKEKID, current: 2, versions: map[uint32][32]byte{2: kekV2}}
+	want := map[string]string{
+		"data/old-1":  "old object 1",
+		"data/old-2":  "old object 2",
+		"data/new":    "new object",
+		"data/legacy": "legacy object",
+		"data/plain":  "unencrypted object",
+	}
+	for key, data := range want {
+		obj := object{keks: onlyNewKEK, client: client, key: key, bucket: "bucket", log: log}
+		resp := httptest.NewRecorder()
+		obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/"+key, nil))
+		assert.Equal(http.StatusOK, resp.Code, key)
+		assert.Equal(data, resp.Body.String(), key)
+	}
+
+	// Running the rewrap again has nothing to do.
+	result, err = rewrapObjects(context.Background(), client, DefaultPolicy(), keys, nil, "bucket", "data/", log)
+	require.NoError(err)
+	assert.Equal(RewrapResult{Skipped: 5}, result)
+}
+
+func TestRewrapAddsPartsTag(t *testing.T) {
+	// Multipart uploads completed by previous versions of s3proxy have no parts tag.
+	testCases := map[string]struct {
+		format       string
+		encryptParts func(t *testing.T, dek []byte, parts ...[]byte) ([]byte, []uint32)
+	}{
+		"segmented": {
+			format:       formatSegmented,
+			encryptParts: encryptParts,
+		},
+		"legacy multipart": {
+			format:       formatMultipart,
+			encryptParts: encryptLegacyParts,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			keks := newTestKEKs([32]byte{0x1})
+			log := logger.NewTest(t)
+			client := newStubS3Client()
+
+			dek := crypto.GenerateDEK()
+			body, _ := tc.encryptParts(t, dek, []byte("hello, "), []byte("world"))
+			metadata := map[string]string{formatTag: tc.format}
+			encryptedDEK, err := keks.wrap(dek, metadata)
+			require.NoError(err)
+			metadata[dekTag] = hex.EncodeToString(encryptedDEK)
+			client.objects["multipart"] = stubObject{body: body, metadata: metadata}
+
+			obj := object{keks: keks, client: client, key: "multipart", bucket: "bucket", log: log}
+			_, err = readPlaintext(obj, body, metadata)
+			assert.ErrorIs(err, crypto.ErrNoPartsTag)
+
+			obj = object{keks: keks, client: client, key: "single", bucket: "bucket", body: bytes.NewReader([]byte("single")), contentLength: 6, metadata: map[string]string{}, log: log}
+			resp := httptest.NewRecorder()
+			obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/single", nil))
+			require.Equal(http.StatusOK, resp.Code)
+
+			result, err := rewrapObjects(context.Background(), client, DefaultPolicy(), keyring{defaultKEKID: keks}, nil, "bucket", "", log)
+			require.NoError(err)
+			assert.Equal(RewrapResult{Rewrapped: 1, Skipped: 1}, result)
+			assert.Contains(client.objects["multipart"].metadata, partsTag)
+			assert.NotContains(client.objects["single"].metadata, partsTag)
+
+			obj = object{keks: keks, client: client, key: "multipart", bucket: "bucket", log: log}
+			resp = httptest.NewRecorder()
+			obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/multipart", nil))
+			assert.Equal(http.StatusOK, resp.Code)
+			assert.Equal("hello, world", resp.Body.String())
+
+			result, err = rewrapObjects(context.Background(), client, DefaultPolicy(), keyring{defaultKEKID: keks}, nil, "bucket", "", log)
+			require.NoError(err)
+			assert.Equal(RewrapResult{Skipped: 2}, result)
+		})
+	}
+}
+
+// readPlaintext decrypts an object body with the given metadata.
+func readPlaintext(obj object, body []byte, metadata map[string]string) ([]byte, error) {
+	plaintext, _, err := obj.decrypt(bytes.NewReader(body), metadata, nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
+
+func TestRewrapUnknownKEKVersion(t *testing.T) {
+	client := newStubS3Client()
+	keys := keyring{defaultKEKID: {id: defaultKEKID, current: 2, versions: map[uint32][32]byte{1: {0x1}, 2: {0x2}}}}
+	client.objects["key"] = stubObject{body: []byte("ciphertext"), metadata: map[string]string{dekTag: "00", kekVersionTag: "3"}}
+
+	result, err := rewrapObjects(context.Background(), client, DefaultPolicy(), keys, nil, "bucket", "", logger.NewTest(t))
+	require.NoError(t, err)
+	assert.Equal(t, RewrapResult{Failed: 1}, result)
+}
+
+func TestRewrapToPolicyKEK(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defaultKEKs := newTestKEKs([32]byte{0x1})
+	teamKEKs := keyEncryptionKeys{id: "team-a", current: 1, versions: map[uint32][32]byte{1: {0x2}}}
+	keys := keyring{defaultKEKID: defaultKEKs, "team-a": teamKEKs}
+	policy := Policy{Rules: []PolicyRule{
+		{Bucket: "bucket", Prefix: "team-a/", Action: ActionEncrypt, KeyID: "team-a"},
+		{Bucket: "bucket", Prefix: "public/", Action: ActionPassthrough},
+		{Bucket: "*", Action: ActionEncrypt},
+	}}
+	log := logger.NewTest(t)
+	client := newStubS3Client()
+
+	for _, key := range []string{"team-a/object", "public/object", "other/object"} {
+		obj := object{keks: defaultKEKs, client: client, key: key, bucket: "bucket", body: bytes.NewReader([]byte(key)), contentLength: int64(len(key)), metadata: map[string]string{}, log: log}
+		resp := httptest.NewRecorder()
+		obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/"+key, nil))
+		require.Equal(http.StatusOK, resp.Code)
+	}
+
+	result, err := rewrapObjects(context.Background(), client, policy, keys, nil, "bucket", "", log)
+	require.NoError(err)
+	assert.Equal(RewrapResult{Rewrapped: 1, Skipped: 2}, result)
+	assert.Equal("team-a", client.objects["team-a/object"].metadata[kekIDTag])
+	assert.Equal(defaultKEKID, client.objects["public/object"].metadata[kekIDTag])
+	assert.Equal(defaultKEKID, client.objects["other/object"].metadata[kekIDTag])
+
+	obj := object{keks: teamKEKs, client: client, key: "team-a/object", bucket: "bucket", log: log}
+	resp := httptest.NewRecorder()
+	obj.get(resp, httptest.NewRequest(http.MethodGet, "/bucket/team-a/object", nil))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("team-a/object", resp.Body.String())
+}
+
+func TestRewrapEncryptedNames(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defaultKEKs := newTestKEKs([32]byte{0x1})
+	teamKEKs := keyEncryptionKeys{id: "team-a", current: 1, versions: map[uint32][32]byte{1: {0x2}}}
+	keys := keyring{defaultKEKID: defaultKEKs, "team-a": teamKEKs}
+	teamNames, err := crypto.NewNameCipher(bytes.Repeat([]byte{0x3}, crypto.NameKeySize))
+	require.NoError(err)
+	names := map[string]*crypto.NameCipher{"team-a": teamNames}
+	policy := Policy{Rules: []PolicyRule{
+		{Bucket: "bucket", Prefix: "team-a/", Action: ActionEncrypt, KeyID: "team-a", EncryptNames: true},
+		{Bucket: "*", Action: ActionEncrypt},
+	}}
+	log := logger.NewTest(t)
+	client := newStubS3Client()
+
+	encryptedKey, err := teamNames.EncryptKey("team-a/object")
+	require.NoError(err)
+	// An object with a plaintext key in the location of the team can't be read through s3proxy.
+	for _, key := range []string{encryptedKey, "team-a/plaintext", "other/object"} {
+		obj := object{keks: defaultKEKs, client: client, key: key, bucket: "bucket", body: bytes.NewReader([]byte(key)), contentLength: int64(len(key)), metadata: map[string]string{}, log: log}
+		resp := httptest.NewRecorder()
+		obj.put(resp, httptest.NewRequest(http.MethodPut, "/bucket/"+key, nil))
+		require.Equal(http.StatusOK, resp.Code)
+	}
+
+	result, err := rewrapObjects(context.Background(), client, policy, keys, names, "bucket", "team-a/", log)
+	require.NoError(err)
+	assert.Equal(RewrapResult{Rewrapped: 1, Skipped: 1}, result)
+	assert.Equal("team-a", client.objects[encryptedKey].metadata[kekIDTag])
+	assert.Equal(defaultKEKID, client.objects["team-a/plaintext"].metadata[kekIDTag])
+	assert.Equal(defaultKEKID, client.objects["other/object"].metadata[kekIDTag])
+}
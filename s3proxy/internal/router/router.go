@@ -16,6 +16,18 @@ The stored object will have a tag that holds an encrypted data encryption key (D
 That DEK is used to encrypt the object's body.
 The DEK is generated randomly for each PutObject request.
 The DEK is encrypted with a key encryption key (KEK) fetched from Constellation's keyservice.
+KEKs are versioned. New DEKs are encrypted with the newest KEK version, which is recorded next to the encrypted DEK,
+so objects remain readable after the KEK is rotated. Rewrap moves the DEKs of existing objects to the newest KEK version.
+Bodies are encrypted in segments and streamed between client and S3, so memory usage does not depend on the object size.
+
+Multipart uploads are intercepted as well. CreateMultipartUpload generates one DEK per upload,
+which is attached to the upload's metadata and stored next to the upload, so that UploadPart requests can encrypt each part with it.
+
+If client credentials are configured, the router verifies the SigV4 signature of each request against them
+and re-signs forwarded requests with s3proxy's own credentials, so clients never hold the credentials of the S3 API.
+
+Policy rules may also encrypt object keys and user metadata values. Requests for such objects are rewritten to the encrypted
+key and metadata, and keys in responses, e.g., of listings, are decrypted again.
 */
 package router
 
@@ -24,109 +36,322 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/crypto"
 	"github.com/edgelesssys/constellation/v2/s3proxy/internal/kms"
 	"github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
-)
-
-const (
-	// Use a 32*8 = 256 bit key for AES-256.
-	kekSizeBytes = 32
-	kekID        = "s3proxy-kek"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	keyPattern          = regexp.MustCompile("/(.+)")
 	bucketAndKeyPattern = regexp.MustCompile("/([^/?]+)/(.+)")
+	bucketPattern       = regexp.MustCompile("^/([^/?]+)/?$")
 )
 
+// maxDeleteObjectsSize limits the body of DeleteObjects requests, which name up to 1000 keys of up to 1024 bytes each.
+const maxDeleteObjectsSize = 2 << 20
+
 // Router implements the interception logic for the s3proxy.
 type Router struct {
-	region string
-	kek    [32]byte
-	// forwardMultipartReqs controls whether we forward the following requests: CreateMultipartUpload, UploadPart, CompleteMultipartUpload, AbortMultipartUpload.
-	// s3proxy does not implement those yet.
-	// Setting forwardMultipartReqs to true will forward those requests to the S3 API, otherwise we block them (secure defaults).
-	forwardMultipartReqs bool
-	log                  *slog.Logger
+	backend s3.Config
+	// endpoint is the parsed backend endpoint. It is nil if requests are sent to AWS S3.
+	endpoint *url.URL
+	policy   Policy
+	keys     keyring
+	// names holds the name ciphers of the KEK IDs whose rules encrypt object keys and metadata.
+	names map[string]*crypto.NameCipher
+	// credentials are the access keys clients sign requests with. If nil, requests are forwarded with the client's signature.
+	credentials credentialStore
+	// signer signs forwarded requests with s3proxy's own credentials. It is nil if credentials is nil.
+	signer  *s3.Signer
+	metrics *metrics
+	// audit logs object accesses. It is nil if audit logging is disabled.
+	audit *auditLog
+	log   *slog.Logger
 }
 
 // New creates a new Router.
-func New(region, endpoint string, forwardMultipartReqs bool, log *slog.Logger) (Router, error) {
-	kms := kms.New(log, endpoint)
+// Requests are sent to the given S3 backend, which may be AWS S3 or an S3-compatible store.
+// The policy decides which requests are encrypted with which KEK, forwarded or denied.
+// New DEKs are wrapped with the given KEK version. All previous versions are used to unwrap the DEKs of existing objects.
+// If credentials are given, requests must be signed with one of their access keys and are re-signed with s3proxy's own credentials.
+// Otherwise, requests are forwarded with the client's signature.
+// Metrics are registered with reg, and object accesses are written to audit. Both may be nil to disable them.
+func New(
+	backend s3.Config, kmsEndpoint string, kekVersion uint32, policy Policy, credentials *CredentialFile,
+	reg prometheus.Registerer, audit *slog.Logger, log *slog.Logger,
+) (Router, error) {
+	if err := policy.Validate(); err != nil {
+		return Router{}, fmt.Errorf("invalid policy: %w", err)
+	}
 
-	// Get the key encryption key that encrypts all DEKs.
-	kek, err := kms.GetDataKey(context.Background(), kekID, kekSizeBytes)
+	endpoint, err := parseEndpoint(backend.Endpoint)
 	if err != nil {
-		return Router{}, fmt.Errorf("getting KEK: %w", err)
+		return Router{}, err
 	}
+	// Clients are created per request. Create one here to fail early on invalid configurations,
+	// e.g., a custom HTTP client combined with AWS_CA_BUNDLE.
+	if _, err := s3.NewClient(backend); err != nil {
+		return Router{}, err
+	}
+
+	metrics := newMetrics(reg)
+	kms := kms.New(log, kmsEndpoint)
 
-	kekArray, err := byteSliceToByteArray(kek)
+	// Get the key encryption keys that encrypt all DEKs.
+	keys, err := fetchKeyring(context.Background(), metrics.countKMSErrors(kms), policy.keyIDs(), kekVersion)
 	if err != nil {
-		return Router{}, fmt.Errorf("converting KEK to byte array: %w", err)
+		return Router{}, fmt.Errorf("getting KEKs: %w", err)
 	}
 
-	return Router{region: region, kek: kekArray, forwardMultipartReqs: forwardMultipartReqs, log: log}, nil
+	names, err := fetchNameCiphers(context.Background(), metrics.countKMSErrors(kms), policy.nameKeyIDs())
+	if err != nil {
+		return Router{}, fmt.Errorf("getting name keys: %w", err)
+	}
+
+	router := Router{backend: backend, endpoint: endpoint, policy: policy, keys: keys, names: names, metrics: metrics, log: log}
+	if audit != nil {
+		router.audit = &auditLog{log: audit}
+	}
+	if credentials != nil {
+		router.credentials = credentials
+		if router.signer, err = s3.NewSigner(backend); err != nil {
+			return Router{}, err
+		}
+	}
+	return router, nil
 }
 
 // Serve implements the routing logic for the s3 proxy.
-// It intercepts GetObject and PutObject requests, encrypting/decrypting their bodies if necessary.
+// Requests are first matched against the policy. Denied requests are rejected, pass-through requests are forwarded unmodified.
+// For encrypted locations, it intercepts GetObject, PutObject, CopyObject and multipart upload requests, encrypting/decrypting their bodies if necessary.
 // All other requests are forwarded to the S3 API.
 // Ideally we could separate routing logic, request handling and s3 interactions.
 // Currently routing logic and request handling are integrated.
+// Every request is recorded in the metrics, and requests for objects are written to the audit log.
 func (r Router) Serve(w http.ResponseWriter, req *http.Request) {
-	client, err := s3.NewClient(r.region)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	var key string
 	var bucket string
 	var matchingPath bool
-	if containsBucket(req.Host) {
-		// BUCKET.s3.REGION.amazonaws.com
-		parts := strings.Split(req.Host, ".")
-		bucket = parts[0]
-
+	if hostBucket, ok := r.virtualHostedBucket(req.Host); ok {
+		bucket = hostBucket
 		matchingPath = match(req.URL.Path, keyPattern, &key)
-
 	} else {
 		matchingPath = match(req.URL.Path, bucketAndKeyPattern, &bucket, &key)
+		if !matchingPath {
+			match(req.URL.Path, bucketPattern, &bucket)
+		}
+	}
+
+	var rule PolicyRule
+	var ruleFound bool
+	switch {
+	case matchingPath:
+		rule, ruleFound = r.policy.match(bucket, key)
+	case bucket != "" && isListObjects(req.Method, req.URL.Query()):
+		rule, ruleFound = r.policy.matchList(bucket, req.URL.Query().Get("prefix"))
+	case bucket != "" && isDeleteObjects(req.Method, req.URL.Query()):
+		keys, err := deleteObjectsKeys(req)
+		if err != nil {
+			r.log.With(slog.Any("error", err)).Error("reading keys of DeleteObjects request")
+			break
+		}
+		rule, ruleFound = r.policy.matchKeys(bucket, keys)
+	case bucket != "":
+		rule, ruleFound = r.policy.matchBucket(bucket)
+	default:
+		// Requests that don't target a bucket, e.g., ListBuckets.
+		rule, ruleFound = PolicyRule{Action: ActionPassthrough}, true
+	}
+	keks := r.keys[rule.keyID()]
+
+	var authErr *authError
+	if r.credentials != nil {
+		if _, err := verifySignature(req, r.credentials, time.Now()); err != nil && !errors.As(err, &authErr) {
+			authErr = newAuthError("AccessDenied", err.Error())
+		}
+	}
+
+	operation := "Other"
+	if matchingPath {
+		operation = objectOperation(req)
+	}
+	action := rule.Action
+	if !ruleFound || authErr != nil {
+		action = ActionDeny
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	req = req.WithContext(context.WithValue(req.Context(), metricsContextKey{}, r.metrics))
+	defer func(start time.Time) {
+		// Handlers abort responses by panicking with http.ErrAbortHandler. Record those as failures before re-panicking.
+		aborted := recover()
+		status := recorder.status
+		switch {
+		case aborted != nil:
+			status = http.StatusInternalServerError
+		case status == 0:
+			status = http.StatusOK
+		}
+		r.metrics.observe(operation, action, status, time.Since(start))
+		if matchingPath {
+			r.audit.access(req, operation, bucket, key, action, status)
+		}
+		if aborted != nil {
+			panic(aborted)
+		}
+	}(time.Now())
+
+	client, err := s3.NewClient(r.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If the rule encrypts names, S3 only sees encrypted object keys and metadata values.
+	// backendKey is the key of the object in S3, while key stays the plaintext key for logging and auditing.
+	backendKey := key
+	var namesWriter *nameDecryptingWriter
+	if names := r.requestNames(req, rule, matchingPath, bucket); authErr == nil && ruleFound && names != nil {
+		namesWriter = &nameDecryptingWriter{ResponseWriter: w, names: names}
+		var encryptedReq *http.Request
+		if matchingPath {
+			encryptedReq, backendKey, err = encryptObjectRequest(req, key, names)
+			namesWriter.rewriteBody = operation != "GetObject" && req.Method != http.MethodHead
+		} else {
+			encryptedReq, namesWriter.filterPrefix, err = encryptListRequest(req, names)
+			namesWriter.rewriteBody = true
+			namesWriter.urlEncoded = req.URL.Query().Get("encoding-type") == "url"
+		}
+		if err != nil {
+			r.log.With(slog.Any("error", err)).Error("encrypting object names")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req, w = encryptedReq, namesWriter
 	}
 
 	var h http.Handler
 
 	switch {
+	case authErr != nil:
+		h = handleUnauthenticated(authErr, r.log)
+	case !ruleFound || rule.Action == ActionDeny:
+		h = handleDeny(bucket, key, r.log)
+	// DeleteObjects names the objects in the request body, which isn't rewritten.
+	case !matchingPath && isDeleteObjects(req.Method, req.URL.Query()) && r.policy.encryptsNames(bucket):
+		h = handleNamesNotImplemented("DeleteObjects", r.log)
+	// intercept CopyObject and UploadPartCopy, which may cross policy rules.
+	case matchingPath && isCopy(req.Method, req.Header):
+		h = handleCopy(client, backendKey, bucket, rule, r.policy, r.keys, r.names, handleForwards(r.backend.HTTPClient, r.endpoint, r.signer, r.log), r.log)
+	case rule.Action == ActionPassthrough:
+		h = handleForwards(r.backend.HTTPClient, r.endpoint, r.signer, r.log)
 	// intercept GetObject.
 	case matchingPath && req.Method == "GET" && !isUnwantedGetEndpoint(req.URL.Query()):
-		h = handleGetObject(client, key, bucket, r.log)
+		h = handleGetObject(client, backendKey, bucket, keks, r.log)
 	// intercept PutObject.
 	case matchingPath && req.Method == "PUT" && !isUnwantedPutEndpoint(req.Header, req.URL.Query()):
-		h = handlePutObject(client, key, bucket, r.log)
-	case !r.forwardMultipartReqs && matchingPath && isUploadPart(req.Method, req.URL.Query()):
-		h = handleUploadPart(r.log)
-	case !r.forwardMultipartReqs && matchingPath && isCreateMultipartUpload(req.Method, req.URL.Query()):
-		h = handleCreateMultipartUpload(r.log)
-	case !r.forwardMultipartReqs && matchingPath && isCompleteMultipartUpload(req.Method, req.URL.Query()):
-		h = handleCompleteMultipartUpload(r.log)
-	case !r.forwardMultipartReqs && matchingPath && isAbortMultipartUpload(req.Method, req.URL.Query()):
-		h = handleAbortMultipartUpload(r.log)
+		h = handlePutObject(client, backendKey, bucket, keks, r.log)
+	case matchingPath && isUploadPart(req.Method, req.URL.Query()):
+		h = handleUploadPart(client, backendKey, bucket, keks, r.log)
+	case matchingPath && isCreateMultipartUpload(req.Method, req.URL.Query()):
+		h = handleCreateMultipartUpload(client, backendKey, bucket, keks, r.log)
+	case matchingPath && isCompleteMultipartUpload(req.Method, req.URL.Query()):
+		h = handleCompleteMultipartUpload(client, backendKey, bucket, keks, r.log)
+	case matchingPath && isAbortMultipartUpload(req.Method, req.URL.Query()):
+		h = handleAbortMultipartUpload(client, backendKey, bucket, keks, r.log)
 	// Forward all other requests.
 	default:
-		h = handleForwards(r.log)
+		h = handleForwards(r.backend.HTTPClient, r.endpoint, r.signer, r.log)
 	}
 
 	h.ServeHTTP(w, req)
+	if namesWriter != nil {
+		if err := namesWriter.flush(); err != nil {
+			r.log.With(slog.Any("error", err)).Error("writing response with decrypted names")
+		}
+	}
+}
+
+// requestNames returns the name cipher for the object keys of a request, or nil if they aren't encrypted.
+// Object requests use the name key of their rule. Listings are matched by their prefix,
+// so listing a prefix only decrypts keys encrypted with the name key of that prefix.
+func (r Router) requestNames(req *http.Request, rule PolicyRule, matchingPath bool, bucket string) *crypto.NameCipher {
+	switch {
+	case matchingPath:
+		return ruleNames(rule, r.names)
+	case bucket == "" || req.Method != http.MethodGet:
+		return nil
+	}
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		if prefixRule, ok := r.policy.match(bucket, prefix); ok {
+			return ruleNames(prefixRule, r.names)
+		}
+	}
+	return ruleNames(rule, r.names)
+}
+
+// listParameters are the query parameters of ListObjects, ListObjectsV2, ListObjectVersions, and ListMultipartUploads.
+var listParameters = []string{
+	"continuation-token", "delimiter", "encoding-type", "fetch-owner", "key-marker", "list-type", "marker", "max-keys",
+	"max-uploads", "prefix", "start-after", "upload-id-marker", "uploads", "version-id-marker", "versions", "x-id",
+}
+
+// isListObjects returns true for requests that list the keys of a bucket.
+func isListObjects(method string, query url.Values) bool {
+	if method != http.MethodGet {
+		return false
+	}
+	for parameter := range query {
+		if !slices.Contains(listParameters, parameter) {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteObjectsKeys returns the keys of the objects named in the body of a DeleteObjects request.
+// The body is restored, so the request can still be forwarded.
+func deleteObjectsKeys(req *http.Request) ([]string, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxDeleteObjectsSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if len(body) > maxDeleteObjectsSize {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxDeleteObjectsSize)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var request struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("parsing body: %w", err)
+	}
+	keys := make([]string, 0, len(request.Objects))
+	for _, object := range request.Objects {
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+func isCopy(method string, header http.Header) bool {
+	return method == "PUT" && header.Get("x-amz-copy-source") != ""
 }
 
 func isAbortMultipartUpload(method string, query url.Values) bool {
@@ -154,6 +379,23 @@ func isUploadPart(method string, query url.Values) bool {
 	return method == "PUT" && partNumber && uploadID
 }
 
+// AccessDeniedError is a helper struct to create an XML formatted error message for denied requests.
+type AccessDeniedError struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// NewAccessDeniedError creates a new AccessDeniedError.
+func NewAccessDeniedError(resource string) AccessDeniedError {
+	return AccessDeniedError{
+		Code:     "AccessDenied",
+		Message:  "Access denied by s3proxy policy.",
+		Resource: resource,
+	}
+}
+
 // ContentSHA256MismatchError is a helper struct to create an XML formatted error message.
 // s3 clients might try to parse error messages, so we need to serve correctly formatted messages.
 type ContentSHA256MismatchError struct {
@@ -184,6 +426,48 @@ func byteSliceToByteArray(input []byte) ([32]byte, error) {
 	return ([32]byte)(input), nil
 }
 
+// virtualHostedBucket returns the bucket name if the request addresses the bucket as part of the host name.
+// For AWS S3 the host has the form BUCKET.s3.REGION.amazonaws.com. For S3-compatible backends it has the form BUCKET.ENDPOINT.
+// Backends that use path-style addressing always carry the bucket name in the path.
+func (r Router) virtualHostedBucket(host string) (string, bool) {
+	if r.backend.UsePathStyle {
+		return "", false
+	}
+	if r.endpoint == nil {
+		if !containsBucket(host) {
+			return "", false
+		}
+		return strings.Split(host, ".")[0], true
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	bucket, ok := strings.CutSuffix(host, "."+r.endpoint.Hostname())
+	if !ok || bucket == "" {
+		return "", false
+	}
+	return bucket, true
+}
+
+// parseEndpoint parses the URL of an S3-compatible backend. It returns nil if no endpoint is given.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing S3 endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("S3 endpoint %q must use scheme http or https", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q is missing a host", endpoint)
+	}
+	return u, nil
+}
+
 // containsBucket is a helper to recognizes cases where the bucket name is sent as part of the host.
 // In other cases the bucket name is sent as part of the path.
 func containsBucket(host string) bool {
@@ -257,13 +541,21 @@ func parseRetentionTime(raw string) (time.Time, error) {
 }
 
 // repackage implements all modifications we need to do to an incoming request that we want to forward to the s3 API.
-func repackage(r *http.Request) http.Request {
+// If an endpoint is given, the request is sent to it. Otherwise it is sent to the host the client addressed.
+func repackage(r *http.Request, endpoint *url.URL) http.Request {
 	req := r.Clone(r.Context())
 
 	// HTTP clients are not supposed to set this field, however when we receive a request it is set.
 	// So, we unset it.
 	req.RequestURI = ""
 
+	if endpoint != nil {
+		// The Host header is kept, since it is part of the client's request signature.
+		req.URL.Host = endpoint.Host
+		req.URL.Scheme = endpoint.Scheme
+		return *req
+	}
+
 	req.URL.Host = r.Host
 	// We always want to use HTTPS when talking to S3.
 	req.URL.Scheme = "https"
@@ -273,17 +565,9 @@ func repackage(r *http.Request) http.Request {
 
 // validateContentMD5 checks if the content-md5 header matches the body.
 func validateContentMD5(contentMD5 string, body []byte) error {
-	if contentMD5 == "" {
-		return nil
-	}
-
-	expected, err := base64.StdEncoding.DecodeString(contentMD5)
-	if err != nil {
-		return fmt.Errorf("decoding base64: %w", err)
-	}
-
-	if len(expected) != 16 {
-		return fmt.Errorf("content-md5 must be 16 bytes long, got %d bytes", len(expected))
+	expected, err := parseContentMD5(contentMD5)
+	if err != nil || expected == nil {
+		return err
 	}
 
 	actual := md5.Sum(body)
@@ -329,7 +613,12 @@ func get(h http.HandlerFunc) http.HandlerFunc {
 	return allowMethod(h, "GET")
 }
 
-// put takes a HandlerFunc and wraps it to only allow the POST method.
+// put takes a HandlerFunc and wraps it to only allow the PUT method.
 func put(h http.HandlerFunc) http.HandlerFunc {
 	return allowMethod(h, "PUT")
 }
+
+// post takes a HandlerFunc and wraps it to only allow the POST method.
+func post(h http.HandlerFunc) http.HandlerFunc {
+	return allowMethod(h, "POST")
+}
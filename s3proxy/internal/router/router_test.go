@@ -6,9 +6,29 @@ SPDX-License-Identifier: BUSL-1.1
 package router
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidateContentMD5(t *testing.T) {
@@ -85,3 +105,446 @@ func TestByteSliceToByteArray(t *testing.T) {
 		})
 	}
 }
+
+// stubS3Client is an in-memory implementation of s3Client.
+type stubS3Client struct {
+	objects map[string]stubObject
+	uploads map[string]stubUpload
+	nextID  int
+	// fetched counts the bytes returned by GetObject.
+	fetched int
+}
+
+type stubObject struct {
+	body     []byte
+	metadata map[string]string
+}
+
+type stubUpload struct {
+	metadata map[string]string
+	parts    map[int32][]byte
+}
+
+func newStubS3Client() *stubS3Client {
+	return &stubS3Client{objects: map[string]stubObject{}, uploads: map[string]stubUpload{}}
+}
+
+func (c *stubS3Client) GetObject(_ context.Context, _, key, _, byteRange, _, _, _ string) (*s3.GetObjectOutput, error) {
+	obj, ok := c.objects[key]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+	output := &s3.GetObjectOutput{Metadata: obj.metadata}
+
+	body := obj.body
+	if byteRange != "" {
+		offset, length, err := parseRange(byteRange, int64(len(obj.body)))
+		if errors.Is(err, errRangeNotSatisfiable) {
+			return nil, errors.New("https response error StatusCode: 416")
+		}
+		if err == nil {
+			body = obj.body[offset : offset+length]
+			contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, len(obj.body))
+			output.ContentRange = &contentRange
+		}
+	}
+	c.fetched += len(body)
+
+	contentLength := int64(len(body))
+	output.ContentLength = &contentLength
+	output.Body = io.NopCloser(bytes.NewReader(body))
+	return output, nil
+}
+
+func (c *stubS3Client) PutObject(_ context.Context, _, key, _, _, _, _, _, _, _ string, _ time.Time, metadata map[string]string, body io.Reader, contentLength int64) (*s3.PutObjectOutput, error) {
+	data, err := readBody(body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	c.objects[key] = stubObject{body: data, metadata: metadata}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *stubS3Client) DeleteObject(_ context.Context, _, key, _ string) (*s3.DeleteObjectOutput, error) {
+	delete(c.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *stubS3Client) CreateMultipartUpload(_ context.Context, _, _, _, _, _, _, _, _, _ string, _ time.Time, metadata map[string]string) (*s3.CreateMultipartUploadOutput, error) {
+	c.nextID++
+	uploadID := fmt.Sprintf("upload-%d", c.nextID)
+	c.uploads[uploadID] = stubUpload{metadata: metadata, parts: map[int32][]byte{}}
+	return &s3.CreateMultipartUploadOutput{UploadId: &uploadID}, nil
+}
+
+func (c *stubS3Client) UploadPart(_ context.Context, _, _, uploadID string, partNumber int32, _, _, _ string, body io.Reader, contentLength int64) (*s3.UploadPartOutput, error) {
+	upload, ok := c.uploads[uploadID]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+	data, err := readBody(body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[partNumber] = data
+	etag := fmt.Sprintf("%q", fmt.Sprintf("etag-%d", partNumber))
+	return &s3.UploadPartOutput{ETag: &etag}, nil
+}
+
+func (c *stubS3Client) CompleteMultipartUpload(_ context.Context, _, key, uploadID, _, _, _ string, parts []types.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	upload, ok := c.uploads[uploadID]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+
+	var body []byte
+	var last int32
+	for _, part := range parts {
+		if *part.PartNumber <= last {
+			return nil, errors.New("https response error StatusCode: 400")
+		}
+		body = append(body, upload.parts[*part.PartNumber]...)
+		last = *part.PartNumber
+	}
+	c.objects[key] = stubObject{body: body, metadata: upload.metadata}
+	delete(c.uploads, uploadID)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *stubS3Client) AbortMultipartUpload(_ context.Context, _, _, uploadID string) (*s3.AbortMultipartUploadOutput, error) {
+	delete(c.uploads, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// readBody reads a request body like the AWS SDK would send it.
+func readBody(body io.Reader, contentLength int64) ([]byte, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("sending request body: %w", err)
+	}
+	if int64(len(data)) != contentLength {
+		return nil, fmt.Errorf("body length %d does not match content length %d", len(data), contentLength)
+	}
+	return data, nil
+}
+
+// newTestKEKs returns the default KEK, only holding the given KEK as version 1.
+func newTestKEKs(kek [32]byte) keyEncryptionKeys {
+	return keyEncryptionKeys{id: defaultKEKID, current: 1, versions: map[uint32][32]byte{1: kek}}
+}
+
+func (c *stubS3Client) ListObjects(_ context.Context, _, prefix, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	// Return one object per page to exercise pagination.
+	output := &s3.ListObjectsV2Output{}
+	for i, key := range keys {
+		if key <= continuationToken {
+			continue
+		}
+		output.Contents = []types.Object{{Key: &keys[i]}}
+		if i < len(keys)-1 {
+			output.NextContinuationToken = &keys[i]
+		}
+		break
+	}
+	return output, nil
+}
+
+func (c *stubS3Client) HeadObject(_ context.Context, _, key, _, _, _, _ string) (*s3.HeadObjectOutput, error) {
+	obj, ok := c.objects[key]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+	contentLength := int64(len(obj.body))
+	return &s3.HeadObjectOutput{Metadata: obj.metadata, ContentLength: &contentLength}, nil
+}
+
+func (c *stubS3Client) CopyObject(_ context.Context, _, sourceKey, _, _, key, _ string, _ *s3.HeadObjectOutput, metadata map[string]string) (*s3.CopyObjectOutput, error) {
+	obj, ok := c.objects[sourceKey]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+	c.objects[key] = stubObject{body: bytes.Clone(obj.body), metadata: metadata}
+	etag := `"etag"`
+	return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{ETag: &etag}}, nil
+}
+
+func (c *stubS3Client) ReplaceObjectMetadata(_ context.Context, _, key string, _ *s3.HeadObjectOutput, metadata map[string]string, _, _, _ string) (*s3.CopyObjectOutput, error) {
+	obj, ok := c.objects[key]
+	if !ok {
+		return nil, errors.New("https response error StatusCode: 404")
+	}
+	c.objects[key] = stubObject{body: obj.body, metadata: metadata}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func TestVirtualHostedBucket(t *testing.T) {
+	testCases := map[string]struct {
+		backend    s3client.Config
+		host       string
+		wantBucket string
+		wantOK     bool
+	}{
+		"AWS virtual-hosted-style": {
+			host:       "bucket.s3.eu-west-1.amazonaws.com",
+			wantBucket: "bucket",
+			wantOK:     true,
+		},
+		"AWS path-style": {
+			host: "s3.eu-west-1.amazonaws.com",
+		},
+		"path-style is enforced": {
+			backend: s3client.Config{UsePathStyle: true},
+			host:    "bucket.s3.eu-west-1.amazonaws.com",
+		},
+		"endpoint virtual-hosted-style": {
+			backend:    s3client.Config{Endpoint: "https://minio.example.com:9000"},
+			host:       "bucket.minio.example.com:9000",
+			wantBucket: "bucket",
+			wantOK:     true,
+		},
+		"endpoint path-style": {
+			backend: s3client.Config{Endpoint: "https://minio.example.com:9000"},
+			host:    "minio.example.com:9000",
+		},
+		"cluster-local endpoint": {
+			backend: s3client.Config{Endpoint: "http://minio.storage.svc.cluster.local:9000"},
+			host:    "minio.storage.svc.cluster.local:9000",
+		},
+		"host of another endpoint": {
+			backend: s3client.Config{Endpoint: "https://minio.example.com"},
+			host:    "bucket.objects.example.com",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			endpoint, err := parseEndpoint(tc.backend.Endpoint)
+			require.NoError(t, err)
+			r := Router{backend: tc.backend, endpoint: endpoint}
+
+			bucket, ok := r.virtualHostedBucket(tc.host)
+			assert.Equal(tc.wantOK, ok)
+			assert.Equal(tc.wantBucket, bucket)
+		})
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	testCases := map[string]struct {
+		endpoint string
+		wantNil  bool
+		wantErr  bool
+	}{
+		"empty":          {endpoint: "", wantNil: true},
+		"https":          {endpoint: "https://minio.example.com:9000"},
+		"http":           {endpoint: "http://10.0.0.1:9000"},
+		"missing scheme": {endpoint: "minio.example.com:9000", wantErr: true},
+		"other scheme":   {endpoint: "ftp://minio.example.com", wantErr: true},
+		"missing host":   {endpoint: "https://", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			endpoint, err := parseEndpoint(tc.endpoint)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantNil, endpoint == nil)
+		})
+	}
+}
+
+func TestS3CompatibleBackend(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	// The SDK can't combine a CA bundle from the environment with a custom HTTP client.
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	testCases := map[string]struct {
+		noTLS       bool
+		trustCA     bool
+		wantSuccess bool
+	}{
+		"custom CA is trusted": {
+			trustCA:     true,
+			wantSuccess: true,
+		},
+		"custom CA is not trusted": {
+			trustCA: false,
+		},
+		"plain HTTP": {
+			noTLS:       true,
+			wantSuccess: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backend := newFakeS3Backend()
+			server := httptest.NewUnstartedServer(backend)
+			// Don't log the failing TLS handshakes of untrusted clients.
+			server.Config.ErrorLog = log.New(io.Discard, "", 0)
+			if tc.noTLS {
+				server.Start()
+			} else {
+				server.StartTLS()
+			}
+			defer server.Close()
+
+			config := s3client.Config{Region: "us-east-1", Endpoint: server.URL, UsePathStyle: true}
+			if tc.trustCA {
+				var err error
+				config.HTTPClient, err = s3client.NewHTTPClient(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+				require.NoError(err)
+			}
+			endpoint, err := parseEndpoint(config.Endpoint)
+			require.NoError(err)
+			router := Router{
+				backend:  config,
+				endpoint: endpoint,
+				policy:   DefaultPolicy(),
+				keys:     keyring{defaultKEKID: newTestKEKs([32]byte{0x1})},
+				log:      logger.NewTest(t),
+			}
+
+			// The host has more than four labels, which must not be mistaken for a virtual-hosted-style AWS host.
+			const host = "https://minio.storage.svc.cluster.local"
+			data := "hello, world"
+
+			resp := httptest.NewRecorder()
+			router.Serve(resp, httptest.NewRequest(http.MethodPut, host+"/bucket/key", strings.NewReader(data)))
+			if !tc.wantSuccess {
+				assert.NotEqual(http.StatusOK, resp.Code)
+				assert.Empty(backend.objects)
+
+				resp := httptest.NewRecorder()
+				router.Serve(resp, httptest.NewRequest(http.MethodGet, host+"/bucket?list-type=2", nil))
+				assert.NotEqual(http.StatusOK, resp.Code)
+				return
+			}
+			require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+			require.Contains(backend.objects, "bucket/key")
+			assert.NotContains(string(backend.objects["bucket/key"].body), data)
+			assert.Contains(backend.objects["bucket/key"].metadata, dekTag)
+
+			resp = httptest.NewRecorder()
+			router.Serve(resp, httptest.NewRequest(http.MethodGet, host+"/bucket/key", nil))
+			require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+			assert.Equal(data, resp.Body.String())
+
+			// ListObjectsV2 is forwarded to the endpoint.
+			resp = httptest.NewRecorder()
+			router.Serve(resp, httptest.NewRequest(http.MethodGet, host+"/bucket?list-type=2", nil))
+			require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+			assert.Contains(resp.Body.String(), "<Key>key</Key>")
+		})
+	}
+}
+
+// fakeS3Backend is a minimal S3-compatible store that only supports path-style addressing, like a MinIO deployment.
+type fakeS3Backend struct {
+	mux     sync.Mutex
+	objects map[string]stubObject
+}
+
+func newFakeS3Backend() *fakeS3Backend {
+	return &fakeS3Backend{objects: map[string]stubObject{}}
+}
+
+func (b *fakeS3Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		body, err := readAWSChunked(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.objects[bucket+"/"+key] = stubObject{body: body, metadata: getMetadataHeaders(r.Header)}
+		w.Header().Set("ETag", `"etag"`)
+
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && key != "":
+		obj, ok := b.objects[bucket+"/"+key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		for name, value := range obj.metadata {
+			w.Header().Set("x-amz-meta-"+name, value)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		w.Header().Set("ETag", `"etag"`)
+		_, _ = w.Write(obj.body)
+
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		var keys []string
+		for name := range b.objects {
+			if objBucket, objKey, _ := strings.Cut(name, "/"); objBucket == bucket {
+				keys = append(keys, objKey)
+			}
+		}
+		slices.Sort(keys)
+		var list strings.Builder
+		fmt.Fprintf(&list, "<ListBucketResult><Name>%s</Name><KeyCount>%d</KeyCount>", bucket, len(keys))
+		for _, key := range keys {
+			fmt.Fprintf(&list, "<Contents><Key>%s</Key></Contents>", key)
+		}
+		list.WriteString("</ListBucketResult>")
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(list.String()))
+
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+// readAWSChunked reads a request body, decoding the aws-chunked encoding the AWS SDK uses to send trailing checksums.
+func readAWSChunked(r *http.Request) ([]byte, error) {
+	if r.Header.Get("x-amz-decoded-content-length") == "" {
+		return io.ReadAll(r.Body)
+	}
+
+	reader := bufio.NewReader(r.Body)
+	var body []byte
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading chunk size: %w", err)
+		}
+		rawSize, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(rawSize, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing chunk size: %w", err)
+		}
+		// The last chunk is empty and followed by the trailing checksum.
+		if size == 0 {
+			return body, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, fmt.Errorf("reading chunk: %w", err)
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
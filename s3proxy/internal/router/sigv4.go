@@ -0,0 +1,345 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4Terminator = "aws4_request"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	streamingSigned = "STREAMING-AWS4-"
+	// maxClockSkew is the maximum difference between the signing time of a request and the time it is received, as enforced by S3.
+	maxClockSkew = 15 * time.Minute
+	// maxPresignExpires is the maximum validity of presigned URLs, as enforced by S3.
+	maxPresignExpires = 7 * 24 * time.Hour
+)
+
+// presignQueryParameters are the query parameters of presigned URLs that hold the signature.
+var presignQueryParameters = []string{
+	"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires",
+	"X-Amz-SignedHeaders", "X-Amz-Signature", "X-Amz-Security-Token", "X-Amz-Content-Sha256",
+}
+
+// authError is returned if a request isn't signed with a valid access key.
+// Its code and status match the errors of the S3 API, since clients may parse them.
+type authError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func newAuthError(code, message string) *authError {
+	return &authError{code: code, message: message, status: http.StatusForbidden}
+}
+
+func malformedAuthError(format string, args ...any) *authError {
+	return &authError{code: "AuthorizationHeaderMalformed", message: fmt.Sprintf(format, args...), status: http.StatusBadRequest}
+}
+
+// sigV4 is the signature of a request, either from the Authorization header or from the query of a presigned URL.
+type sigV4 struct {
+	accessKeyID   string
+	scope         string
+	scopeDate     string
+	region        string
+	signedHeaders []string
+	signature     string
+	signingTime   time.Time
+	rawTime       string
+	payloadHash   string
+	// expires is the validity of a presigned URL. It is zero for signatures in the Authorization header.
+	expires time.Duration
+}
+
+// verifySignature checks the SigV4 signature of a request against the access keys in credentials.
+// It returns the access key the request is signed with.
+func verifySignature(req *http.Request, credentials credentialStore, now time.Time) (AccessKey, error) {
+	sig, err := parseSigV4(req)
+	if err != nil {
+		return AccessKey{}, err
+	}
+
+	key, ok := credentials.lookup(sig.accessKeyID)
+	if !ok {
+		return AccessKey{}, newAuthError("InvalidAccessKeyId", "The access key ID you provided does not exist in our records.")
+	}
+
+	if sig.expires == 0 {
+		if skew := now.Sub(sig.signingTime); skew > maxClockSkew || skew < -maxClockSkew {
+			return AccessKey{}, newAuthError("RequestTimeTooSkewed", "The difference between the request time and the current time is too large.")
+		}
+	} else {
+		if sig.signingTime.Sub(now) > maxClockSkew {
+			return AccessKey{}, newAuthError("AccessDenied", "Request is not valid yet.")
+		}
+		if now.After(sig.signingTime.Add(sig.expires)) {
+			return AccessKey{}, newAuthError("AccessDenied", "Request has expired.")
+		}
+	}
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		sig.rawTime,
+		sig.scope,
+		hexSHA256(canonicalRequest(req, sig)),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(signingKey(key.SecretAccessKey, sig.scopeDate, sig.region), stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(sig.signature)) {
+		return AccessKey{}, newAuthError("SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	}
+	return key, nil
+}
+
+// parseSigV4 parses the signature of a request.
+func parseSigV4(req *http.Request) (sigV4, error) {
+	query := req.URL.Query()
+	var sig sigV4
+	var credential, signedHeaders string
+
+	switch authorization := req.Header.Get("Authorization"); {
+	case authorization != "":
+		algorithm, params, _ := strings.Cut(authorization, " ")
+		if algorithm != sigV4Algorithm {
+			return sigV4{}, malformedAuthError("unsupported signature algorithm %q, only %s is supported", algorithm, sigV4Algorithm)
+		}
+		for _, param := range strings.Split(params, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				sig.signature = value
+			}
+		}
+		sig.rawTime = req.Header.Get("X-Amz-Date")
+		sig.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			return sigV4{}, &authError{code: "InvalidRequest", message: "Missing required header for this request: x-amz-content-sha256", status: http.StatusBadRequest}
+		}
+
+	case query.Has("X-Amz-Signature"):
+		if algorithm := query.Get("X-Amz-Algorithm"); algorithm != sigV4Algorithm {
+			return sigV4{}, malformedAuthError("unsupported signature algorithm %q, only %s is supported", algorithm, sigV4Algorithm)
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig.signature = query.Get("X-Amz-Signature")
+		sig.rawTime = query.Get("X-Amz-Date")
+		sig.payloadHash = query.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			sig.payloadHash = unsignedPayload
+		}
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPresignExpires {
+			return sigV4{}, malformedAuthError("X-Amz-Expires must be between 1 and %d seconds", int(maxPresignExpires.Seconds()))
+		}
+		sig.expires = time.Duration(seconds) * time.Second
+
+	default:
+		return sigV4{}, newAuthError("AccessDenied", "Requests to s3proxy must be signed.")
+	}
+
+	scopeParts := strings.Split(credential, "/")
+	if len(scopeParts) != 5 || scopeParts[0] == "" || scopeParts[3] != "s3" || scopeParts[4] != sigV4Terminator {
+		return sigV4{}, malformedAuthError("invalid credential scope %q", credential)
+	}
+	sig.accessKeyID = scopeParts[0]
+	sig.scopeDate = scopeParts[1]
+	sig.region = scopeParts[2]
+	sig.scope = strings.Join(scopeParts[1:], "/")
+
+	signingTime, err := time.Parse(sigV4TimeFormat, sig.rawTime)
+	if err != nil {
+		return sigV4{}, malformedAuthError("invalid X-Amz-Date %q", sig.rawTime)
+	}
+	if signingTime.Format("20060102") != sig.scopeDate {
+		return sigV4{}, malformedAuthError("credential scope date %q doesn't match X-Amz-Date %q", sig.scopeDate, sig.rawTime)
+	}
+	sig.signingTime = signingTime
+
+	if sig.signature == "" || signedHeaders == "" {
+		return sigV4{}, malformedAuthError("signature and signed headers are required")
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return sigV4{}, malformedAuthError("the host header must be signed")
+	}
+	// s3proxy signs all headers of forwarded requests, so all headers that modify the request must be signed by the client.
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && !slices.Contains(sig.signedHeaders, name) {
+			return sigV4{}, newAuthError("AccessDenied", fmt.Sprintf("There were headers present in the request which were not signed: %s", name))
+		}
+	}
+
+	return sig, nil
+}
+
+// canonicalRequest returns the canonical form of a request as defined by SigV4.
+func canonicalRequest(req *http.Request, sig sigV4) string {
+	// S3 doesn't normalize the path. Use it as sent by the client.
+	path := req.URL.EscapedPath()
+	if req.RequestURI != "" {
+		path, _, _ = strings.Cut(req.RequestURI, "?")
+		if u, err := url.ParseRequestURI(req.RequestURI); err == nil && u.IsAbs() {
+			path = u.EscapedPath()
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	query := req.URL.Query()
+	query.Del("X-Amz-Signature")
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, sigV4Escape(name)+"="+sigV4Escape(value))
+		}
+	}
+	slices.Sort(params)
+
+	var headers strings.Builder
+	for _, name := range sig.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = req.Host
+		case "content-length":
+			value = strconv.FormatInt(req.ContentLength, 10)
+		default:
+			values := req.Header.Values(name)
+			for i := range values {
+				values[i] = strings.Join(strings.Fields(values[i]), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// sigV4Escape percent-encodes all characters except the unreserved characters of RFC 3986.
+func sigV4Escape(s string) string {
+	var escaped strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// signingKey derives the SigV4 signing key of a secret access key for the given date and region.
+func signingKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, sigV4Terminator)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// resign replaces the client's signature of a forwarded request with a signature by s3proxy's own credentials.
+// The payload hash sent by the client is kept, so S3 still verifies the body against the hash the client signed.
+func resign(req *http.Request, signer *s3.Signer) error {
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(payloadHash, streamingSigned) {
+		// The chunks of the body are signed with a key derived from the client's secret.
+		return &authError{
+			code:    "NotImplemented",
+			message: "s3proxy can't re-sign requests with signed payload chunks, use HTTPS or unsigned payloads instead",
+			status:  http.StatusNotImplemented,
+		}
+	}
+
+	query := req.URL.Query()
+	if query.Has("X-Amz-Signature") {
+		if payloadHash == "" {
+			payloadHash = query.Get("X-Amz-Content-Sha256")
+		}
+		for _, name := range presignQueryParameters {
+			query.Del(name)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Del("X-Amz-Date")
+	req.Header.Del("X-Amz-Security-Token")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	return signer.Sign(req.Context(), req, payloadHash)
+}
+
+// handleUnauthenticated rejects requests that aren't signed with a valid access key.
+func handleUnauthenticated(authErr *authError, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.With(slog.String("path", req.URL.Path), slog.String("method", req.Method), slog.String("host", req.Host), slog.Any("error", authErr)).Info("rejecting unauthenticated request")
+		writeAuthError(w, req, authErr, log)
+	}
+}
+
+// writeAuthError writes an XML formatted S3 error for a failed authentication.
+func writeAuthError(w http.ResponseWriter, req *http.Request, authErr *authError, log *slog.Logger) {
+	marshalled, err := xml.Marshal(AccessDeniedError{Code: authErr.code, Message: authErr.message, Resource: req.URL.Path})
+	if err != nil {
+		log.With(slog.Any("error", err)).Error("marshalling error")
+		http.Error(w, fmt.Sprintf("marshalling error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(authErr.status)
+	if _, err := w.Write(marshalled); err != nil {
+		log.With(slog.Any("error", err)).Error("Write")
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/edgelesssys/constellation/v2/internal/file"
+	"github.com/edgelesssys/constellation/v2/internal/logger"
+	s3client "github.com/edgelesssys/constellation/v2/s3proxy/internal/s3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAccessKey = AccessKey{Name: "workload", AccessKeyID: "CLIENTKEY", SecretAccessKey: "client-secret"}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	body := "hello, world"
+
+	testCases := map[string]struct {
+		target   string
+		signWith AccessKey
+		signedAt time.Time
+		presign  time.Duration
+		tamper   func(req *http.Request)
+		wantCode string
+	}{
+		"signed header": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now,
+		},
+		"special characters in path and query": {
+			target:   "/bucket/dir/a%20b%2Bc~%21.txt?versionId=a%2Fb&tagging",
+			signWith: testAccessKey,
+			signedAt: now,
+		},
+		"presigned": {
+			target:   "/bucket/key?versionId=1",
+			signWith: testAccessKey,
+			signedAt: now.Add(-time.Hour),
+			presign:  2 * time.Hour,
+		},
+		"unsigned": {
+			target:   "/bucket/key",
+			wantCode: "AccessDenied",
+		},
+		"unknown access key": {
+			target:   "/bucket/key",
+			signWith: AccessKey{AccessKeyID: "OTHER", SecretAccessKey: "client-secret"},
+			signedAt: now,
+			wantCode: "InvalidAccessKeyId",
+		},
+		"wrong secret": {
+			target:   "/bucket/key",
+			signWith: AccessKey{AccessKeyID: testAccessKey.AccessKeyID, SecretAccessKey: "wrong"},
+			signedAt: now,
+			wantCode: "SignatureDoesNotMatch",
+		},
+		"modified path": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now,
+			tamper: func(req *http.Request) {
+				req.RequestURI = "/bucket/other"
+				req.URL.Path = "/bucket/other"
+			},
+			wantCode: "SignatureDoesNotMatch",
+		},
+		"modified signed header": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now,
+			tamper: func(req *http.Request) {
+				req.Header.Set("X-Amz-Meta-Owner", "attacker")
+			},
+			wantCode: "SignatureDoesNotMatch",
+		},
+		"unsigned x-amz header": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now,
+			tamper: func(req *http.Request) {
+				req.Header.Set("X-Amz-Acl", "public-read")
+			},
+			wantCode: "AccessDenied",
+		},
+		"clock skew": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now.Add(-time.Hour),
+			wantCode: "RequestTimeTooSkewed",
+		},
+		"expired presigned URL": {
+			target:   "/bucket/key",
+			signWith: testAccessKey,
+			signedAt: now.Add(-2 * time.Hour),
+			presign:  time.Hour,
+			wantCode: "AccessDenied",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			req := httptest.NewRequest(http.MethodPut, "https://s3proxy.example.com"+tc.target, strings.NewReader(body))
+			req.Header.Set("X-Amz-Meta-Owner", "workload")
+			if tc.signWith.AccessKeyID != "" {
+				req = signRequest(t, req, tc.signWith, tc.signedAt, tc.presign, body)
+			}
+			if tc.tamper != nil {
+				tc.tamper(req)
+			}
+
+			key, err := verifySignature(req, Credentials{Keys: []AccessKey{testAccessKey}}, now)
+			if tc.wantCode != "" {
+				var authErr *authError
+				require.ErrorAs(err, &authErr)
+				assert.Equal(tc.wantCode, authErr.code)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(testAccessKey, key)
+		})
+	}
+}
+
+func TestResign(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "PROXYKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "proxy-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	proxyKey := AccessKey{AccessKeyID: "PROXYKEY", SecretAccessKey: "proxy-secret"}
+
+	signer, err := s3client.NewSigner(s3client.Config{Region: "eu-west-1"})
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		presign     time.Duration
+		payloadHash string
+		wantErr     bool
+	}{
+		"signed header": {},
+		"presigned":     {presign: time.Hour},
+		"streaming signed payload": {
+			payloadHash: "STREAMING-AWS4-HMAC-SHA256-PAYLOAD",
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, "https://bucket.s3.eu-west-1.amazonaws.com/key?list-type=2&prefix=a%2Fb", nil)
+			req = signRequest(t, req, testAccessKey, time.Now(), tc.presign, "")
+			if tc.payloadHash != "" {
+				req.Header.Set("X-Amz-Content-Sha256", tc.payloadHash)
+			}
+
+			forwarded := repackage(req, nil)
+			err := resign(&forwarded, signer)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			assert.False(forwarded.URL.Query().Has("X-Amz-Signature"))
+			assert.Equal("a/b", forwarded.URL.Query().Get("prefix"))
+
+			// S3 receives a request signed by s3proxy.
+			received := httptest.NewRequest(forwarded.Method, forwarded.URL.String(), nil)
+			received.Header = forwarded.Header
+			received.Host = forwarded.Host
+			key, err := verifySignature(received, Credentials{Keys: []AccessKey{proxyKey}}, time.Now())
+			require.NoError(err)
+			assert.Equal(proxyKey.AccessKeyID, key.AccessKeyID)
+		})
+	}
+}
+
+func TestServeVerifiesAndResigns(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "PROXYKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "proxy-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// The backend only accepts requests signed by s3proxy.
+	backend := newFakeS3Backend()
+	proxyCredentials := Credentials{Keys: []AccessKey{{AccessKeyID: "PROXYKEY", SecretAccessKey: "proxy-secret"}}}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := verifySignature(r, proxyCredentials, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	config := s3client.Config{Region: "us-east-1", Endpoint: server.URL, UsePathStyle: true, HTTPClient: server.Client()}
+	endpoint, err := parseEndpoint(config.Endpoint)
+	require.NoError(err)
+	signer, err := s3client.NewSigner(config)
+	require.NoError(err)
+	router := Router{
+		backend:     config,
+		endpoint:    endpoint,
+		policy:      DefaultPolicy(),
+		keys:        keyring{defaultKEKID: newTestKEKs([32]byte{0x1})},
+		credentials: Credentials{Keys: []AccessKey{testAccessKey}},
+		signer:      signer,
+		log:         logger.NewTest(t),
+	}
+	backend.objects["bucket/key"] = stubObject{}
+
+	const target = "https://s3proxy.example.com/bucket?list-type=2"
+
+	resp := httptest.NewRecorder()
+	router.Serve(resp, httptest.NewRequest(http.MethodGet, target, nil))
+	assert.Equal(http.StatusForbidden, resp.Code)
+	assert.Contains(resp.Body.String(), "<Code>AccessDenied</Code>")
+
+	resp = httptest.NewRecorder()
+	router.Serve(resp, signRequest(t, httptest.NewRequest(http.MethodGet, target, nil), AccessKey{AccessKeyID: "PROXYKEY", SecretAccessKey: "proxy-secret"}, time.Now(), 0, ""))
+	assert.Equal(http.StatusForbidden, resp.Code)
+	assert.Contains(resp.Body.String(), "<Code>InvalidAccessKeyId</Code>")
+
+	resp = httptest.NewRecorder()
+	router.Serve(resp, signRequest(t, httptest.NewRequest(http.MethodGet, target, nil), testAccessKey, time.Now(), 0, ""))
+	require.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(resp.Body.String(), "<Key>key</Key>")
+}
+
+func TestCredentialFile(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	fs := afero.NewMemMapFs()
+	fileHandler := file.NewHandler(fs)
+	const path = "/etc/s3proxy/credentials.yaml"
+	modified := time.Now()
+
+	writeCredentials := func(content string) {
+		require.NoError(afero.WriteFile(fs, path, []byte(content), 0o600))
+		modified = modified.Add(time.Second)
+		require.NoError(fs.Chtimes(path, modified, modified))
+	}
+
+	writeCredentials("keys:\n  - name: a\n    accessKeyID: A\n    secretAccessKey: secret-a\n  - name: b\n    accessKeyID: B\n    secretAccessKey: secret-b\n")
+	credentials, err := NewCredentialFile(fileHandler, path, logger.NewTest(t))
+	require.NoError(err)
+
+	key, ok := credentials.lookup("A")
+	assert.True(ok)
+	assert.Equal(AccessKey{Name: "a", AccessKeyID: "A", SecretAccessKey: "secret-a"}, key)
+	_, ok = credentials.lookup("B")
+	assert.True(ok)
+
+	// Revoking a key takes effect without restarting s3proxy.
+	writeCredentials("keys:\n  - name: a\n    accessKeyID: A\n    secretAccessKey: secret-a\n")
+	_, ok = credentials.lookup("B")
+	assert.False(ok)
+
+	// An invalid file doesn't leave revoked keys usable.
+	writeCredentials("keys:\n  - accessKeyID: A\n")
+	_, ok = credentials.lookup("A")
+	assert.False(ok)
+
+	writeCredentials("keys:\n  - name: a\n    accessKeyID: A\n    secretAccessKey: secret-a\n")
+	_, ok = credentials.lookup("A")
+	assert.True(ok)
+
+	_, err = NewCredentialFile(fileHandler, "/missing.yaml", logger.NewTest(t))
+	assert.Error(err)
+}
+
+func TestValidateCredentials(t *testing.T) {
+	testCases := map[string]struct {
+		credentials Credentials
+		wantErr     bool
+	}{
+		"valid": {
+			credentials: Credentials{Keys: []AccessKey{{AccessKeyID: "A", SecretAccessKey: "a"}, {AccessKeyID: "B", SecretAccessKey: "b"}}},
+		},
+		"empty": {},
+		"missing access key ID": {
+			credentials: Credentials{Keys: []AccessKey{{SecretAccessKey: "a"}}},
+			wantErr:     true,
+		},
+		"missing secret": {
+			credentials: Credentials{Keys: []AccessKey{{AccessKeyID: "A"}}},
+			wantErr:     true,
+		},
+		"invalid access key ID": {
+			credentials: Credentials{Keys: []AccessKey{{AccessKeyID: "A/B", SecretAccessKey: "a"}}},
+			wantErr:     true,
+		},
+		"duplicate access key ID": {
+			credentials: Credentials{Keys: []AccessKey{{AccessKeyID: "A", SecretAccessKey: "a"}, {AccessKeyID: "A", SecretAccessKey: "b"}}},
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.credentials.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// signRequest signs a request like an AWS SDK would.
+// If presign is not zero, the signature is added to the query of the URL instead of the Authorization header.
+func signRequest(t *testing.T, req *http.Request, key AccessKey, signedAt time.Time, presign time.Duration, body string) *http.Request {
+	t.Helper()
+	signer := v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	})
+	credentials := aws.Credentials{AccessKeyID: key.AccessKeyID, SecretAccessKey: key.SecretAccessKey}
+
+	// The signer reads the URL of the request. Sign a copy and apply the signature to the request the server receives.
+	signed := req.Clone(context.Background())
+	signed.URL = &url.URL{Scheme: "https", Host: req.Host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	signed.Body = io.NopCloser(strings.NewReader(body))
+
+	if presign != 0 {
+		query := signed.URL.Query()
+		query.Set("X-Amz-Expires", strconv.Itoa(int(presign.Seconds())))
+		signed.URL.RawQuery = query.Encode()
+		presigned, _, err := signer.PresignHTTP(context.Background(), credentials, signed, unsignedPayload, "s3", "eu-west-1", signedAt)
+		require.NoError(t, err)
+		presignedURL, err := url.Parse(presigned)
+		require.NoError(t, err)
+		req.URL.RawQuery = presignedURL.RawQuery
+		req.RequestURI = presignedURL.RequestURI()
+		return req
+	}
+
+	hash := sha256.Sum256([]byte(body))
+	payloadHash := hex.EncodeToString(hash[:])
+	signed.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	require.NoError(t, signer.SignHTTP(context.Background(), credentials, signed, payloadHash, "s3", "eu-west-1", signedAt))
+	req.Header = signed.Header
+	return req
+}
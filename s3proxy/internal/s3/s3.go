@@ -11,44 +11,143 @@ It only exists to enable stubbing of the AWS S3 client in tests.
 package s3
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/base64"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+const (
+	// maxCopySize is the size of the largest object S3 copies with a single CopyObject request.
+	maxCopySize = 5 * 1024 * 1024 * 1024
+	// copyPartSize is the size of the parts larger objects are copied in.
+	copyPartSize = 512 * 1024 * 1024
+	// maxParts is the maximum number of parts of a multipart upload.
+	maxParts = 10000
+)
+
 // Client is a wrapper around the AWS S3 client.
 type Client struct {
 	s3client *s3.Client
+	// maxCopySize is the size up to which objects are copied with a single CopyObject request.
+	maxCopySize int64
+	// streamOptions are applied to requests that stream a body, i.e., PutObject and UploadPart.
+	streamOptions []func(*s3.Options)
+}
+
+// Config describes the S3 API a Client sends requests to.
+type Config struct {
+	// Region is the region in which the buckets are located.
+	Region string
+	// Endpoint is the URL of an S3-compatible API, e.g., a MinIO or Ceph RGW deployment.
+	// If empty, AWS S3 is used.
+	Endpoint string
+	// UsePathStyle addresses buckets as part of the URL path instead of the host name.
+	// Most S3-compatible stores require path-style addressing.
+	UsePathStyle bool
+	// HTTPClient is used to send requests. If nil, the SDK's default client is used.
+	HTTPClient *http.Client
 }
 
 // NewClient creates a new AWS S3 client.
-func NewClient(region string) (*Client, error) {
+func NewClient(cfg Config) (*Client, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	if cfg.HTTPClient != nil {
+		opts = append(opts, config.WithHTTPClient(cfg.HTTPClient))
+	}
+
 	// Use context.Background here because this context will not influence the later operations of the client.
 	// The context given here is used for http requests that are made during client construction.
 	// Client construction happens once during proxy setup.
-	clientCfg, err := config.LoadDefaultConfig(
-		context.Background(),
-		config.WithRegion(region),
-	)
+	clientCfg, err := config.LoadDefaultConfig(context.Background(), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("loading AWS S3 client config: %w", err)
 	}
 
-	client := s3.NewFromConfig(clientCfg)
+	client := s3.NewFromConfig(clientCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = &cfg.Endpoint
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	})
+
+	c := &Client{s3client: client, maxCopySize: maxCopySize}
+	if strings.HasPrefix(strings.ToLower(cfg.Endpoint), "http://") {
+		c.streamOptions = append(c.streamOptions, unsignedPayload)
+	}
+	return c, nil
+}
+
+// unsignedPayload configures a request to send its body without a payload hash or checksum.
+// Bodies are streamed and can't be rewound to compute either of them up front,
+// and the SDK only sends trailing checksums over TLS. Encrypted bodies are authenticated by s3proxy itself.
+func unsignedPayload(o *s3.Options) {
+	o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+	o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+}
 
-	return &Client{client}, nil
+// Signer signs requests to the S3 API with SigV4.
+type Signer struct {
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	region      string
+}
+
+// NewSigner creates a Signer that uses the credentials of the SDK's default credential chain, e.g., from environment variables.
+func NewSigner(cfg Config) (*Signer, error) {
+	clientCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS S3 client config: %w", err)
+	}
+
+	// The path of forwarded requests is already escaped. Escaping it again would result in an invalid signature.
+	signer := v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	})
+	return &Signer{credentials: clientCfg.Credentials, signer: signer, region: cfg.Region}, nil
+}
+
+// Sign signs the request. payloadHash is the hex encoded SHA-256 hash of the body, or a value like UNSIGNED-PAYLOAD.
+func (s *Signer) Sign(ctx context.Context, req *http.Request, payloadHash string) error {
+	credentials, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving credentials: %w", err)
+	}
+	return s.signer.SignHTTP(ctx, credentials, req, payloadHash, "s3", s.region, time.Now())
+}
+
+// NewHTTPClient creates an HTTP client that trusts the system's root certificates
+// and the given PEM encoded CA certificates, e.g., of an S3-compatible store with a private CA.
+func NewHTTPClient(caCerts []byte) (*http.Client, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("loading system certificate pool: %w", err)
+	}
+	if len(caCerts) > 0 && !rootCAs.AppendCertsFromPEM(caCerts) {
+		return nil, errors.New("no valid PEM encoded certificate found in CA certificates")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	return &http.Client{Transport: transport}, nil
 }
 
 // GetObject returns the object with the given key from the given bucket.
 // If a versionID is given, the specific version of the object is returned.
-func (c Client) GetObject(ctx context.Context, bucket, key, versionID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.GetObjectOutput, error) {
+// If a byteRange is given, only the given range of the object is returned. It uses the syntax of the HTTP Range header.
+func (c Client) GetObject(ctx context.Context, bucket, key, versionID, byteRange, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.GetObjectOutput, error) {
 	getObjectInput := &s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
@@ -56,6 +155,9 @@ func (c Client) GetObject(ctx context.Context, bucket, key, versionID, sseCustom
 	if versionID != "" {
 		getObjectInput.VersionId = &versionID
 	}
+	if byteRange != "" {
+		getObjectInput.Range = &byteRange
+	}
 	if sseCustomerAlgorithm != "" {
 		getObjectInput.SSECustomerAlgorithm = &sseCustomerAlgorithm
 	}
@@ -70,8 +172,9 @@ func (c Client) GetObject(ctx context.Context, bucket, key, versionID, sseCustom
 }
 
 // PutObject creates a new object in the given bucket with the given key and body.
+// The body is streamed to S3 and has to be exactly contentLength bytes long.
 // Various optional parameters can be set.
-func (c Client) PutObject(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string, body []byte) (*s3.PutObjectOutput, error) {
+func (c Client) PutObject(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string, body io.Reader, contentLength int64) (*s3.PutObjectOutput, error) {
 	// The AWS Go SDK has two versions. V1 does not set the Content-Type header.
 	// V2 always sets the Content-Type header. We use V2.
 	// The s3 API sets an object's content-type to binary/octet-stream if
@@ -83,16 +186,16 @@ func (c Client) PutObject(ctx context.Context, bucket, key, tags, contentType, o
 		contentType = "binary/octet-stream"
 	}
 
-	contentMD5 := md5.Sum(body)
-	encodedContentMD5 := base64.StdEncoding.EncodeToString(contentMD5[:])
-
+	// The body can not be rewound to compute a Content-MD5 header.
+	// Instead, the SDK sends a trailing checksum, which S3 also accepts for buckets with object lock enabled.
+	// Over plain HTTP, no checksum is sent, see unsignedPayload.
 	putObjectInput := &s3.PutObjectInput{
 		Bucket:                    &bucket,
 		Key:                       &key,
-		Body:                      bytes.NewReader(body),
+		Body:                      body,
+		ContentLength:             &contentLength,
 		Tagging:                   &tags,
 		Metadata:                  metadata,
-		ContentMD5:                &encodedContentMD5,
 		ContentType:               &contentType,
 		ObjectLockLegalHoldStatus: types.ObjectLockLegalHoldStatus(objectLockLegalHoldStatus),
 	}
@@ -112,5 +215,334 @@ func (c Client) PutObject(ctx context.Context, bucket, key, tags, contentType, o
 		putObjectInput.ObjectLockRetainUntilDate = &objectLockRetainUntilDate
 	}
 
-	return c.s3client.PutObject(ctx, putObjectInput)
+	return c.s3client.PutObject(ctx, putObjectInput, c.streamOptions...)
+}
+
+// DeleteObject deletes the object with the given key from the given bucket.
+// If a versionID is given, the specific version of the object is deleted.
+func (c Client) DeleteObject(ctx context.Context, bucket, key, versionID string) (*s3.DeleteObjectOutput, error) {
+	return c.s3client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    &bucket,
+		Key:       &key,
+		VersionId: optional(versionID),
+	})
+}
+
+// CreateMultipartUpload starts a multipart upload for the given key in the given bucket.
+// Metadata and other object properties have to be set here, as parts can not carry them.
+func (c Client) CreateMultipartUpload(ctx context.Context, bucket, key, tags, contentType, objectLockLegalHoldStatus, objectLockMode, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, objectLockRetainUntilDate time.Time, metadata map[string]string) (*s3.CreateMultipartUploadOutput, error) {
+	// See PutObject for why this is necessary.
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:                    &bucket,
+		Key:                       &key,
+		Tagging:                   &tags,
+		Metadata:                  metadata,
+		ContentType:               &contentType,
+		ObjectLockLegalHoldStatus: types.ObjectLockLegalHoldStatus(objectLockLegalHoldStatus),
+	}
+	if sseCustomerAlgorithm != "" {
+		createInput.SSECustomerAlgorithm = &sseCustomerAlgorithm
+	}
+	if sseCustomerKey != "" {
+		createInput.SSECustomerKey = &sseCustomerKey
+	}
+	if sseCustomerKeyMD5 != "" {
+		createInput.SSECustomerKeyMD5 = &sseCustomerKeyMD5
+	}
+
+	// It is not allowed to only set one of these two properties.
+	if objectLockMode != "" && !objectLockRetainUntilDate.IsZero() {
+		createInput.ObjectLockMode = types.ObjectLockMode(objectLockMode)
+		createInput.ObjectLockRetainUntilDate = &objectLockRetainUntilDate
+	}
+
+	return c.s3client.CreateMultipartUpload(ctx, createInput)
+}
+
+// UploadPart uploads a single part of the multipart upload with the given upload ID.
+// The body is streamed to S3 and has to be exactly contentLength bytes long.
+func (c Client) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int32, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, body io.Reader, contentLength int64) (*s3.UploadPartOutput, error) {
+	uploadPartInput := &s3.UploadPartInput{
+		Bucket:        &bucket,
+		Key:           &key,
+		UploadId:      &uploadID,
+		PartNumber:    &partNumber,
+		Body:          body,
+		ContentLength: &contentLength,
+	}
+	if sseCustomerAlgorithm != "" {
+		uploadPartInput.SSECustomerAlgorithm = &sseCustomerAlgorithm
+	}
+	if sseCustomerKey != "" {
+		uploadPartInput.SSECustomerKey = &sseCustomerKey
+	}
+	if sseCustomerKeyMD5 != "" {
+		uploadPartInput.SSECustomerKeyMD5 = &sseCustomerKeyMD5
+	}
+
+	return c.s3client.UploadPart(ctx, uploadPartInput, c.streamOptions...)
+}
+
+// CompleteMultipartUpload assembles the given parts into the final object.
+func (c Client) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string, parts []types.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	if sseCustomerAlgorithm != "" {
+		completeInput.SSECustomerAlgorithm = &sseCustomerAlgorithm
+	}
+	if sseCustomerKey != "" {
+		completeInput.SSECustomerKey = &sseCustomerKey
+	}
+	if sseCustomerKeyMD5 != "" {
+		completeInput.SSECustomerKeyMD5 = &sseCustomerKeyMD5
+	}
+
+	return c.s3client.CompleteMultipartUpload(ctx, completeInput)
+}
+
+// AbortMultipartUpload aborts the multipart upload with the given upload ID and removes all uploaded parts.
+func (c Client) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) (*s3.AbortMultipartUploadOutput, error) {
+	return c.s3client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+}
+
+// ListObjects returns up to 1000 objects of the given bucket whose keys start with prefix.
+// Pass the NextContinuationToken of the previous output to list further objects.
+func (c Client) ListObjects(ctx context.Context, bucket, prefix, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+	if continuationToken != "" {
+		listInput.ContinuationToken = &continuationToken
+	}
+
+	return c.s3client.ListObjectsV2(ctx, listInput)
+}
+
+// HeadObject returns the metadata of the object with the given key from the given bucket.
+// If a versionID is given, the metadata of the specific version of the object is returned.
+func (c Client) HeadObject(ctx context.Context, bucket, key, versionID, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.HeadObjectOutput, error) {
+	headInput := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if versionID != "" {
+		headInput.VersionId = &versionID
+	}
+	if sseCustomerAlgorithm != "" {
+		headInput.SSECustomerAlgorithm = &sseCustomerAlgorithm
+	}
+	if sseCustomerKey != "" {
+		headInput.SSECustomerKey = &sseCustomerKey
+	}
+	if sseCustomerKeyMD5 != "" {
+		headInput.SSECustomerKeyMD5 = &sseCustomerKeyMD5
+	}
+
+	return c.s3client.HeadObject(ctx, headInput)
+}
+
+// CopyObject copies an object within S3 and replaces the user metadata of the copy.
+// The object's body is copied by S3 and not transferred. Content headers, the storage class and
+// server-side encryption settings are taken from head, which has to describe the source object.
+// If tags are given, they replace the tags of the source object.
+// The copy fails if the source object was changed since head was fetched.
+func (c Client) CopyObject(ctx context.Context, sourceBucket, sourceKey, sourceVersionID, bucket, key, tags string, head *s3.HeadObjectOutput, metadata map[string]string) (*s3.CopyObjectOutput, error) {
+	return c.s3client.CopyObject(ctx, copyObjectInput(sourceBucket, sourceKey, sourceVersionID, bucket, key, tags, head, metadata))
+}
+
+// copyObjectInput returns the input of a CopyObject request, see CopyObject.
+func copyObjectInput(sourceBucket, sourceKey, sourceVersionID, bucket, key, tags string, head *s3.HeadObjectOutput, metadata map[string]string) *s3.CopyObjectInput {
+	copySource := copySourcePath(sourceBucket, sourceKey, sourceVersionID)
+	copyInput := &s3.CopyObjectInput{
+		Bucket:             &bucket,
+		Key:                &key,
+		CopySource:         &copySource,
+		CopySourceIfMatch:  head.ETag,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		Metadata:           metadata,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		StorageClass:       types.StorageClass(head.StorageClass),
+	}
+	if tags != "" {
+		copyInput.TaggingDirective = types.TaggingDirectiveReplace
+		copyInput.Tagging = &tags
+	}
+	if head.ServerSideEncryption != "" {
+		copyInput.ServerSideEncryption = head.ServerSideEncryption
+		copyInput.SSEKMSKeyId = head.SSEKMSKeyId
+	}
+	return copyInput
+}
+
+// ReplaceObjectMetadata replaces the user metadata of an object by copying the object onto itself.
+// The object's body is copied by S3 and not transferred. System metadata, tags and the storage class are kept.
+// Objects larger than S3's limit for CopyObject are copied in parts with a multipart upload.
+// Objects encrypted with a customer-provided key (SSE-C) require the key, which is used for the copy as well.
+// The copy fails if the object was changed since head was fetched.
+func (c Client) ReplaceObjectMetadata(ctx context.Context, bucket, key string, head *s3.HeadObjectOutput, metadata map[string]string, sseCustomerAlgorithm, sseCustomerKey, sseCustomerKeyMD5 string) (*s3.CopyObjectOutput, error) {
+	sse := sseCustomerKeyParams{algorithm: optional(sseCustomerAlgorithm), key: optional(sseCustomerKey), keyMD5: optional(sseCustomerKeyMD5)}
+	if head.ContentLength != nil && *head.ContentLength > c.maxCopySize {
+		return c.replaceObjectMetadataMultipart(ctx, bucket, key, head, metadata, sse)
+	}
+
+	copyInput := copyObjectInput(bucket, key, "", bucket, key, "", head, metadata)
+	copyInput.CopySourceSSECustomerAlgorithm, copyInput.CopySourceSSECustomerKey, copyInput.CopySourceSSECustomerKeyMD5 = sse.algorithm, sse.key, sse.keyMD5
+	copyInput.SSECustomerAlgorithm, copyInput.SSECustomerKey, copyInput.SSECustomerKeyMD5 = sse.algorithm, sse.key, sse.keyMD5
+	return c.s3client.CopyObject(ctx, copyInput)
+}
+
+// sseCustomerKeyParams holds the optional parameters of a customer-provided server-side encryption key.
+type sseCustomerKeyParams struct {
+	algorithm, key, keyMD5 *string
+}
+
+// replaceObjectMetadataMultipart copies an object onto itself with a multipart upload, using UploadPartCopy for its parts.
+// Unlike CopyObject, multipart uploads don't copy the object's tags, so they are fetched and set explicitly.
+func (c Client) replaceObjectMetadataMultipart(ctx context.Context, bucket, key string, head *s3.HeadObjectOutput, metadata map[string]string, sse sseCustomerKeyParams) (*s3.CopyObjectOutput, error) {
+	tagging, err := c.s3client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: &bucket, Key: &key, VersionId: head.VersionId})
+	if err != nil {
+		return nil, fmt.Errorf("fetching tags: %w", err)
+	}
+	tags := url.Values{}
+	for _, tag := range tagging.TagSet {
+		if tag.Key != nil && tag.Value != nil {
+			tags.Add(*tag.Key, *tag.Value)
+		}
+	}
+	encodedTags := tags.Encode()
+
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:               &bucket,
+		Key:                  &key,
+		Tagging:              &encodedTags,
+		Metadata:             metadata,
+		CacheControl:         head.CacheControl,
+		ContentDisposition:   head.ContentDisposition,
+		ContentEncoding:      head.ContentEncoding,
+		ContentLanguage:      head.ContentLanguage,
+		ContentType:          head.ContentType,
+		StorageClass:         types.StorageClass(head.StorageClass),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	}
+	if head.ServerSideEncryption != "" {
+		createInput.ServerSideEncryption = head.ServerSideEncryption
+		createInput.SSEKMSKeyId = head.SSEKMSKeyId
+	}
+	upload, err := c.s3client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return nil, fmt.Errorf("creating multipart upload: %w", err)
+	}
+	if upload.UploadId == nil {
+		return nil, errors.New("S3 response is missing upload ID")
+	}
+
+	var versionID string
+	if head.VersionId != nil {
+		versionID = *head.VersionId
+	}
+	copySource := copySourcePath(bucket, key, versionID)
+
+	var parts []types.CompletedPart
+	for i, byteRange := range copyPartRanges(*head.ContentLength) {
+		partNumber := int32(i + 1)
+		output, err := c.s3client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         &bucket,
+			Key:                            &key,
+			UploadId:                       upload.UploadId,
+			PartNumber:                     &partNumber,
+			CopySource:                     &copySource,
+			CopySourceIfMatch:              head.ETag,
+			CopySourceRange:                &byteRange,
+			CopySourceSSECustomerAlgorithm: sse.algorithm,
+			CopySourceSSECustomerKey:       sse.key,
+			CopySourceSSECustomerKeyMD5:    sse.keyMD5,
+			SSECustomerAlgorithm:           sse.algorithm,
+			SSECustomerKey:                 sse.key,
+			SSECustomerKeyMD5:              sse.keyMD5,
+		})
+		if err == nil && (output.CopyPartResult == nil || output.CopyPartResult.ETag == nil) {
+			err = errors.New("S3 response is missing ETag")
+		}
+		if err != nil {
+			// Don't leave behind the parts copied so far.
+			if _, abortErr := c.AbortMultipartUpload(ctx, bucket, key, *upload.UploadId); abortErr != nil {
+				err = errors.Join(err, fmt.Errorf("aborting multipart upload: %w", abortErr))
+			}
+			return nil, fmt.Errorf("copying part %d: %w", partNumber, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: &partNumber})
+	}
+
+	// Only replace the object if it wasn't overwritten while its parts were copied.
+	output, err := c.s3client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               &bucket,
+		Key:                  &key,
+		UploadId:             upload.UploadId,
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+		IfMatch:              head.ETag,
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	if err != nil {
+		if _, abortErr := c.AbortMultipartUpload(ctx, bucket, key, *upload.UploadId); abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("aborting multipart upload: %w", abortErr))
+		}
+		return nil, fmt.Errorf("completing multipart upload: %w", err)
+	}
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &types.CopyObjectResult{ETag: output.ETag},
+		VersionId:        output.VersionId,
+	}, nil
+}
+
+// copyPartRanges splits an object of the given size into the byte ranges of the parts it is copied in.
+// Parts are copyPartSize bytes large, unless more than maxParts parts would be needed.
+func copyPartRanges(size int64) []string {
+	partSize := max(int64(copyPartSize), (size+maxParts-1)/maxParts)
+	var ranges []string
+	for offset := int64(0); offset < size; offset += partSize {
+		ranges = append(ranges, fmt.Sprintf("bytes=%d-%d", offset, min(offset+partSize, size)-1))
+	}
+	return ranges
+}
+
+// optional returns a pointer to s, or nil if s is empty.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// copySourcePath returns the value of the x-amz-copy-source header for the given object.
+func copySourcePath(bucket, key, versionID string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	copySource := bucket + "/" + strings.Join(segments, "/")
+	if versionID != "" {
+		copySource += "?versionId=" + url.QueryEscape(versionID)
+	}
+	return copySource
 }
@@ -0,0 +1,265 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: BUSL-1.1
+*/
+
+package s3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m,
+		goleak.IgnoreAnyFunction("github.com/bazelbuild/rules_go/go/tools/bzltestutil.RegisterTimeoutHandler.func1"),
+		// The HTTP client of the AWS SDK keeps idle connections open.
+		goleak.IgnoreTopFunction("internal/poll.runtime_pollWait"),
+	)
+}
+
+func TestReplaceObjectMetadata(t *testing.T) {
+	testCases := map[string]struct {
+		size          int64
+		failPart      int
+		failComplete  bool
+		wantRequests  []string
+		wantCopyRange []string
+		wantErr       bool
+	}{
+		"small object is copied with a single request": {
+			size:         maxCopySize,
+			wantRequests: []string{"CopyObject"},
+		},
+		"large object is copied in parts": {
+			size:          maxCopySize + 1,
+			wantRequests:  append(append([]string{"GetObjectTagging", "CreateMultipartUpload"}, slices.Repeat([]string{"UploadPartCopy"}, 11)...), "CompleteMultipartUpload"),
+			wantCopyRange: []string{"bytes=0-536870911", "bytes=536870912-1073741823"},
+		},
+		"failing part copy aborts the upload": {
+			size:         2 * maxCopySize,
+			failPart:     2,
+			wantRequests: []string{"GetObjectTagging", "CreateMultipartUpload", "UploadPartCopy", "UploadPartCopy", "AbortMultipartUpload"},
+			wantErr:      true,
+		},
+		"object overwritten while copying aborts the upload": {
+			size:         maxCopySize + 1,
+			failComplete: true,
+			wantRequests: append(append([]string{"GetObjectTagging", "CreateMultipartUpload"}, slices.Repeat([]string{"UploadPartCopy"}, 11)...), "CompleteMultipartUpload", "AbortMultipartUpload"),
+			wantErr:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backend := &fakeS3{failPart: tc.failPart, failComplete: tc.failComplete}
+			server := httptest.NewServer(backend)
+			defer server.Close()
+			client := newTestClient(t, server.URL)
+
+			etag := `"etag"`
+			contentType := "text/plain"
+			head := &s3.HeadObjectOutput{ContentLength: &tc.size, ETag: &etag, ContentType: &contentType}
+			output, err := client.ReplaceObjectMetadata(t.Context(), "bucket", "dir/key", head, map[string]string{"new": "value"}, "", "", "")
+			assert.Equal(tc.wantRequests, backend.requests)
+			if slices.Contains(backend.requests, "CompleteMultipartUpload") {
+				assert.Equal(etag, backend.completeIfMatch)
+			}
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.NotNil(output.CopyObjectResult)
+			assert.Equal(etag, *output.CopyObjectResult.ETag)
+
+			for _, header := range backend.headers {
+				assert.Equal("value", header.Get("x-amz-meta-new"))
+				assert.Equal(contentType, header.Get("Content-Type"))
+				assert.Equal("tag=value", header.Get("x-amz-tagging"))
+			}
+			for _, source := range backend.copySources {
+				assert.Equal("bucket/dir/key", source)
+			}
+			if tc.wantCopyRange != nil {
+				assert.Equal(tc.wantCopyRange, backend.copyRanges[:len(tc.wantCopyRange)])
+			}
+		})
+	}
+}
+
+func TestStreamOverHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Bodies can't be rewound, so the SDK can't compute a payload hash or checksum up front,
+	// and only sends trailing checksums over TLS.
+	backend := &fakeS3{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	client := newTestClient(t, server.URL)
+
+	body := io.MultiReader(strings.NewReader("hello, "), strings.NewReader("world"))
+	_, err := client.PutObject(t.Context(), "bucket", "key", "", "", "", "", "", "", "", time.Time{}, nil, body, 12)
+	require.NoError(err)
+
+	body = io.MultiReader(strings.NewReader("hello, "), strings.NewReader("part"))
+	_, err = client.UploadPart(t.Context(), "bucket", "key", "upload", 1, "", "", "", body, 11)
+	require.NoError(err)
+
+	assert.Equal([]string{"PutObject", "UploadPart"}, backend.requests)
+	assert.Equal([]string{"hello, world", "hello, part"}, backend.bodies)
+	for _, header := range backend.headers {
+		assert.Equal("UNSIGNED-PAYLOAD", header.Get("x-amz-content-sha256"))
+	}
+}
+
+func TestCopyPartRanges(t *testing.T) {
+	testCases := map[string]struct {
+		size      int64
+		wantParts int
+		wantLast  string
+	}{
+		"smaller than a part": {
+			size:      1,
+			wantParts: 1,
+			wantLast:  "bytes=0-0",
+		},
+		"multiple of the part size": {
+			size:      2 * copyPartSize,
+			wantParts: 2,
+			wantLast:  "bytes=536870912-1073741823",
+		},
+		"remainder": {
+			size:      2*copyPartSize + 1,
+			wantParts: 3,
+			wantLast:  "bytes=1073741824-1073741824",
+		},
+		"parts grow beyond maxParts": {
+			size:      (maxParts + 1) * copyPartSize,
+			wantParts: maxParts,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			ranges := copyPartRanges(tc.size)
+			assert.Len(ranges, tc.wantParts)
+			if tc.wantLast != "" {
+				assert.Equal(tc.wantLast, ranges[len(ranges)-1])
+			}
+		})
+	}
+}
+
+func newTestClient(t *testing.T, endpoint string) *Client {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	client, err := NewClient(Config{Region: "us-east-1", Endpoint: endpoint, UsePathStyle: true})
+	require.NoError(t, err)
+	return client
+}
+
+// fakeS3 records the operations sent to it and answers them with minimal responses.
+type fakeS3 struct {
+	mux          sync.Mutex
+	failPart     int
+	failComplete bool
+
+	requests    []string
+	headers     []http.Header
+	copySources []string
+	copyRanges  []string
+	bodies      []string
+	parts       int
+	// completeIfMatch is the If-Match header of CompleteMultipartUpload.
+	completeIfMatch string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		f.requests = append(f.requests, "GetObjectTagging")
+		fmt.Fprint(w, "<Tagging><TagSet><Tag><Key>tag</Key><Value>value</Value></Tag></TagSet></Tagging>")
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.requests = append(f.requests, "CreateMultipartUpload")
+		f.headers = append(f.headers, r.Header)
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") == "":
+		operation := "PutObject"
+		if query.Has("partNumber") {
+			operation = "UploadPart"
+		}
+		f.requests = append(f.requests, operation)
+		f.headers = append(f.headers, r.Header)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.bodies = append(f.bodies, string(body))
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		f.requests = append(f.requests, "UploadPartCopy")
+		f.copySources = append(f.copySources, r.Header.Get("x-amz-copy-source"))
+		f.copyRanges = append(f.copyRanges, r.Header.Get("x-amz-copy-source-range"))
+		f.parts++
+		if f.parts == f.failPart {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code></Error>")
+			return
+		}
+		fmt.Fprintf(w, "<CopyPartResult><ETag>\"etag-%d\"</ETag></CopyPartResult>", f.parts)
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.requests = append(f.requests, "CompleteMultipartUpload")
+		f.completeIfMatch = r.Header.Get("If-Match")
+		if f.failComplete {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code></Error>")
+			return
+		}
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.requests = append(f.requests, "AbortMultipartUpload")
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		f.requests = append(f.requests, "CopyObject")
+		f.copySources = append(f.copySources, r.Header.Get("x-amz-copy-source"))
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "<Error><Code>NotImplemented</Code></Error>")
+	}
+}